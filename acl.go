@@ -0,0 +1,147 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+)
+
+//Endpoints can be given ACL rules filtering the traffic they send, e.g.
+//
+//  docker network connect --driver-opt com.ipdk.acl=deny:tcp:10.0.0.0/8:22,allow:any:0.0.0.0/0 ...
+//
+//Each rule is <allow|deny>:<tcp|udp|icmp|any>:<destination CIDR>[:<port>].
+//Docker doesn't hand container labels to network drivers, so rules are
+//passed as endpoint driver options.
+//
+//Rules are installed in the ternary endpoint ACL table, keyed on the
+//port of the endpoint, and the first matching rule wins. Traffic no rule
+//matches is allowed.
+const (
+	optACL = "com.ipdk.acl"
+
+	aclTable       = "ingress.endpoint_acl"
+	aclAllowAction = "ingress.allow"
+	aclDenyAction  = "ingress.drop"
+
+	//Rules are prioritized in order, starting from aclTopPriority
+	aclTopPriority = 1000
+)
+
+type aclRule struct {
+	Action   string //allow or deny
+	Protocol string //tcp, udp, icmp or any
+	CIDR     string
+	Port     int //0 for any port
+}
+
+func (r aclRule) String() string {
+	s := fmt.Sprintf("%s:%s:%s", r.Action, r.Protocol, r.CIDR)
+	if r.Port != 0 {
+		s += fmt.Sprintf(":%d", r.Port)
+	}
+	return s
+}
+
+var aclProtocols = map[string]int{"any": 0, "icmp": 1, "tcp": 6, "udp": 17}
+
+//parseACLRule parses a rule such as deny:tcp:10.0.0.0/8:22
+func parseACLRule(v string) (aclRule, error) {
+	parts := strings.Split(strings.ToLower(v), ":")
+	if len(parts) != 3 && len(parts) != 4 {
+		return aclRule{}, fmt.Errorf("invalid ACL rule %q, expected <allow|deny>:<protocol>:<cidr>[:<port>]", v)
+	}
+
+	r := aclRule{Action: parts[0], Protocol: parts[1]}
+	if r.Action != "allow" && r.Action != "deny" {
+		return aclRule{}, fmt.Errorf("invalid action in ACL rule %q", v)
+	}
+	if _, ok := aclProtocols[r.Protocol]; !ok {
+		return aclRule{}, fmt.Errorf("invalid protocol in ACL rule %q", v)
+	}
+	_, cidr, err := net.ParseCIDR(parts[2])
+	if err != nil || cidr.IP.To4() == nil {
+		return aclRule{}, fmt.Errorf("invalid CIDR in ACL rule %q", v)
+	}
+	r.CIDR = cidr.String()
+
+	if len(parts) == 4 {
+		if r.Protocol != "tcp" && r.Protocol != "udp" {
+			return aclRule{}, fmt.Errorf("ACL rule %q has a port but is not tcp or udp", v)
+		}
+		if r.Port, err = strconv.Atoi(parts[3]); err != nil || r.Port < 1 || r.Port > 65535 {
+			return aclRule{}, fmt.Errorf("invalid port in ACL rule %q", v)
+		}
+	}
+	return r, nil
+}
+
+//parseACLRules parses a comma separated list of ACL rules
+func parseACLRules(v string) ([]aclRule, error) {
+	var rules []aclRule
+	for _, item := range splitOption(v) {
+		r, err := parseACLRule(item)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func aclMatch(intf int, r aclRule, priority int) string {
+	m := fmt.Sprintf("istd.ingress_port=%d,hdr.ipv4.dst_addr=%s", intf, r.CIDR)
+	if proto := aclProtocols[r.Protocol]; proto != 0 {
+		m += fmt.Sprintf(",hdr.ipv4.protocol=%d", proto)
+	}
+	if r.Port != 0 {
+		m += fmt.Sprintf(",meta.l4_dst_port=%d", r.Port)
+	}
+	return m + fmt.Sprintf(",priority=%d", priority)
+}
+
+func aclAction(r aclRule) string {
+	if r.Action == "deny" {
+		return aclDenyAction
+	}
+	return aclAllowAction
+}
+
+//programACL installs the ACL rules of the port intf, the first rule with
+//the highest priority
+func programACL(owner string, bridge string, intf int, rules []aclRule, top int) error {
+	for i, r := range rules {
+		if err := addEntry(owner, bridge, aclTable, aclMatch(intf, r, top-i), aclAction(r)); err != nil {
+			unprogramACL(bridge, intf, rules[:i], top)
+			return err
+		}
+	}
+	return nil
+}
+
+//unprogramACL removes the rules installed by programACL
+func unprogramACL(bridge string, intf int, rules []aclRule, top int) {
+	for i, r := range rules {
+		if err := deleteEntry(bridge, aclTable, aclMatch(intf, r, top-i)); err != nil {
+			slog.Error("Unable to remove ACL rule", "rule", r, "port", intf, "err", err)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+//The admin API is served next to the libnetwork driver API under /v1.
+//Successful responses are JSON documents, failures carry an HTTP error
+//status and a JSON body of the form {"Err": "..."}.
+
+type adminErrorResponse struct {
+	Err  string
+	Code string `json:",omitempty"` //Error catalog code, if known
+	Hint string `json:",omitempty"` //Remediation hint of the code
+}
+
+func adminError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	resp := adminErrorResponse{Err: fmt.Sprintf(format, args...)}
+	if e := lookupErrorCatalog(resp.Err); e != nil {
+		resp.Code = e.Code
+		resp.Hint = e.Hint
+	}
+	slog.Info("Admin API error", "status", status, "err", resp.Err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.Error("unable to marshal response", "err", err)
+	}
+}
+
+//adminService decodes the proto/port pair of a service request
+func adminService(r *http.Request) (serviceRule, error) {
+	vars := mux.Vars(r)
+	if vars["proto"] != "" {
+		return parseServiceRule(vars["proto"] + "/" + vars["port"])
+	}
+
+	body, err := getBody(r)
+	if err != nil {
+		return serviceRule{}, err
+	}
+	req := serviceRule{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return serviceRule{}, err
+	}
+	return parseServiceRule(fmt.Sprintf("%s/%d", req.Protocol, req.Port))
+}
+
+func adminListNetworkServices(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	nwMap.Lock()
+	defer nwMap.Unlock()
+
+	nw, ok := nwMap.m[id]
+	if !ok {
+		adminError(w, http.StatusNotFound, "network %s not found", id)
+		return
+	}
+	sendResponse(nw.Services, w)
+}
+
+func adminExposeNetworkService(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	s, err := adminService(r)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	nwMap.Lock()
+	defer nwMap.Unlock()
+
+	nw, ok := nwMap.m[id]
+	if !ok {
+		adminError(w, http.StatusNotFound, "network %s not found", id)
+		return
+	}
+	if !nw.DefaultDeny {
+		adminError(w, http.StatusConflict, "network %s is not a default-deny network", id)
+		return
+	}
+	if hasService(nw.Services, s) {
+		sendResponse(nw.Services, w)
+		return
+	}
+
+	if err := allowService(networkOwner(id), nw.Bridge, nw.Subnet.String(), s); err != nil {
+		adminError(w, http.StatusInternalServerError, "unable to expose %v: %v", s, err)
+		return
+	}
+	nw.Services = append(nw.Services, s)
+	if err := dbUpdate(putNetwork(id, nw)); err != nil {
+		slog.Error("Unable to update db", "err", err)
+	}
+	sendResponse(nw.Services, w)
+}
+
+func adminRevokeNetworkService(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	s, err := adminService(r)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	nwMap.Lock()
+	defer nwMap.Unlock()
+
+	nw, ok := nwMap.m[id]
+	if !ok {
+		adminError(w, http.StatusNotFound, "network %s not found", id)
+		return
+	}
+	if !hasService(nw.Services, s) {
+		adminError(w, http.StatusNotFound, "service %v not exposed on network %s", s, id)
+		return
+	}
+
+	revokeService(nw.Bridge, nw.Subnet.String(), s)
+	nw.Services = removeService(nw.Services, s)
+	if err := dbUpdate(putNetwork(id, nw)); err != nil {
+		slog.Error("Unable to update db", "err", err)
+	}
+	sendResponse(nw.Services, w)
+}
+
+func adminListEndpointServices(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	epMap.Lock()
+	defer epMap.Unlock()
+
+	ep, ok := epMap.m[id]
+	if !ok {
+		adminError(w, http.StatusNotFound, "endpoint %s not found", id)
+		return
+	}
+	sendResponse(ep.Services, w)
+}
+
+func adminExposeEndpointService(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	s, err := adminService(r)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	nwMap.Lock()
+	defer nwMap.Unlock()
+
+	epMap.Lock()
+	defer epMap.Unlock()
+
+	ep, ok := epMap.m[id]
+	if !ok {
+		adminError(w, http.StatusNotFound, "endpoint %s not found", id)
+		return
+	}
+	nw, ok := nwMap.m[ep.NetworkID]
+	if !ok || !nw.DefaultDeny {
+		adminError(w, http.StatusConflict, "endpoint %s is not on a default-deny network", id)
+		return
+	}
+	if hasService(ep.Services, s) {
+		sendResponse(ep.Services, w)
+		return
+	}
+
+	if err := programEndpointServices(id, nw, ep.VhostuserPort, []serviceRule{s}); err != nil {
+		adminError(w, http.StatusInternalServerError, "unable to expose %v: %v", s, err)
+		return
+	}
+	ep.Services = append(ep.Services, s)
+	if err := dbUpdate(putEndpoint(id, ep)); err != nil {
+		slog.Error("Unable to update db", "err", err)
+	}
+	sendResponse(ep.Services, w)
+}
+
+func adminRevokeEndpointService(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	s, err := adminService(r)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	nwMap.Lock()
+	defer nwMap.Unlock()
+
+	epMap.Lock()
+	defer epMap.Unlock()
+
+	ep, ok := epMap.m[id]
+	if !ok {
+		adminError(w, http.StatusNotFound, "endpoint %s not found", id)
+		return
+	}
+	if !hasService(ep.Services, s) {
+		adminError(w, http.StatusNotFound, "service %v not exposed on endpoint %s", s, id)
+		return
+	}
+
+	unprogramEndpointServices(nwMap.m[ep.NetworkID], ep.VhostuserPort, []serviceRule{s})
+	ep.Services = removeService(ep.Services, s)
+	if err := dbUpdate(putEndpoint(id, ep)); err != nil {
+		slog.Error("Unable to update db", "err", err)
+	}
+	sendResponse(ep.Services, w)
+}
+
+func registerAdminRoutes(r *mux.Router) {
+	if *debugState {
+		r.HandleFunc("/debug/state", authorized(tenantHost, adminDebugState)).Methods("GET")
+	}
+	r.HandleFunc("/v1/networks", authorized(tenantList, adminListNetworks)).Methods("GET")
+	r.HandleFunc("/v1/networks/{id}", authorized(tenantNetwork, adminGetNetwork)).Methods("GET")
+	r.HandleFunc("/v1/endpoints", authorized(tenantList, adminListEndpoints)).Methods("GET")
+	r.HandleFunc("/v1/endpoints/{id}", authorized(tenantEndpoint, adminGetEndpoint)).Methods("GET")
+	r.HandleFunc("/v1/endpoints/{id}", authorized(tenantEndpoint, adminDeleteEndpoint)).Methods("DELETE")
+	r.HandleFunc("/v1/events", authorized(tenantHost, adminEvents)).Methods("GET")
+	r.HandleFunc("/v1/networks/{id}/services", authorized(tenantNetwork, adminListNetworkServices)).Methods("GET")
+	r.HandleFunc("/v1/networks/{id}/services", authorized(tenantNetwork, adminExposeNetworkService)).Methods("POST")
+	r.HandleFunc("/v1/networks/{id}/services/{proto}/{port}", authorized(tenantNetwork, adminRevokeNetworkService)).Methods("DELETE")
+	r.HandleFunc("/v1/networks/{id}/connections", authorized(tenantNetwork, adminListConnections)).Methods("GET")
+	r.HandleFunc("/v1/networks/{id}/connections", authorized(tenantNetwork, adminConnectNetworks)).Methods("POST")
+	r.HandleFunc("/v1/networks/{id}/connections/{peer}", authorized(tenantNetwork, adminDisconnectNetworks)).Methods("DELETE")
+	r.HandleFunc("/v1/networks/{id}/routes", authorized(tenantNetwork, adminListRoutes)).Methods("GET")
+	r.HandleFunc("/v1/networks/{id}/routes", authorized(tenantNetwork, adminAddRoute)).Methods("POST")
+	r.HandleFunc("/v1/networks/{id}/routes/{peer}", authorized(tenantNetwork, adminRemoveRoute)).Methods("DELETE")
+	r.HandleFunc("/v1/networks/{id}/peers", authorized(tenantNetwork, adminListPeers)).Methods("GET")
+	r.HandleFunc("/v1/networks/{id}/peers", authorized(tenantNetwork, adminAddPeer)).Methods("POST")
+	r.HandleFunc("/v1/networks/{id}/peers/{ip}", authorized(tenantNetwork, adminRemovePeer)).Methods("DELETE")
+	r.HandleFunc("/v1/networks/{id}/nexthop-groups", authorized(tenantNetwork, adminListNextHopGroups)).Methods("GET")
+	r.HandleFunc("/v1/networks/{id}/nexthop-groups/{name}", authorized(tenantNetwork, adminPutNextHopGroup)).Methods("PUT")
+	r.HandleFunc("/v1/networks/{id}/nexthop-groups/{name}", authorized(tenantNetwork, adminDeleteNextHopGroup)).Methods("DELETE")
+	r.HandleFunc("/v1/endpoints/{id}/services", authorized(tenantEndpoint, adminListEndpointServices)).Methods("GET")
+	r.HandleFunc("/v1/endpoints/{id}/services", authorized(tenantEndpoint, adminExposeEndpointService)).Methods("POST")
+	r.HandleFunc("/v1/endpoints/{id}/services/{proto}/{port}", authorized(tenantEndpoint, adminRevokeEndpointService)).Methods("DELETE")
+	r.HandleFunc("/v1/endpoints/{id}/mirror", authorized(tenantEndpoint, adminGetMirror)).Methods("GET")
+	r.HandleFunc("/v1/endpoints/{id}/mirror", authorized(tenantEndpoint, adminStartMirror)).Methods("POST")
+	r.HandleFunc("/v1/endpoints/{id}/mirror", authorized(tenantEndpoint, adminStopMirror)).Methods("DELETE")
+	r.HandleFunc("/v1/endpoints/{id}/capture", authorized(tenantEndpoint, adminGetCapture)).Methods("GET")
+	r.HandleFunc("/v1/endpoints/{id}/capture", authorized(tenantEndpoint, adminStartCapture)).Methods("POST")
+	r.HandleFunc("/v1/endpoints/{id}/capture", authorized(tenantEndpoint, adminStopCapture)).Methods("DELETE")
+	r.HandleFunc("/v1/security-groups", authorized(tenantHost, adminListSecurityGroups)).Methods("GET")
+	r.HandleFunc("/v1/security-groups/{name}", authorized(tenantHost, adminGetSecurityGroup)).Methods("GET")
+	r.HandleFunc("/v1/security-groups/{name}", authorized(tenantHost, adminPutSecurityGroup)).Methods("PUT")
+	r.HandleFunc("/v1/security-groups/{name}", authorized(tenantHost, adminDeleteSecurityGroup)).Methods("DELETE")
+	r.HandleFunc("/v1/snapshots", authorized(tenantHost, adminListSnapshots)).Methods("GET")
+	r.HandleFunc("/v1/entries", authorized(tenantHost, adminListEntries)).Methods("GET")
+	r.HandleFunc("/v1/db/backup", authorized(tenantHost, adminBackup)).Methods("GET")
+	r.HandleFunc("/v1/db/restore", authorized(tenantHost, adminRestore)).Methods("POST")
+	r.HandleFunc("/v1/db/stats", authorized(tenantHost, adminDbStats)).Methods("GET")
+	r.HandleFunc("/v1/db/compact", authorized(tenantHost, adminDbCompact)).Methods("POST")
+	r.HandleFunc("/v1/mtu", authorized(tenantHost, adminMTUReport)).Methods("GET")
+	r.HandleFunc("/v1/gc", authorized(tenantHost, adminGC)).Methods("POST")
+	r.HandleFunc("/v1/reconcile", authorized(tenantHost, adminReconcile)).Methods("POST")
+	r.HandleFunc("/v1/errors", authorized(tenantHost, adminListErrorCatalog)).Methods("GET")
+	r.HandleFunc("/v1/dry-run", authorized(tenantHost, adminListDryRun)).Methods("GET")
+	r.HandleFunc("/v1/dry-run", authorized(tenantHost, adminClearDryRun)).Methods("DELETE")
+	r.HandleFunc("/v1/log-level", authorized(tenantHost, adminGetLogLevel)).Methods("GET")
+	r.HandleFunc("/v1/log-level", authorized(tenantHost, adminSetLogLevel)).Methods("PUT")
+	r.HandleFunc("/v1/vhost-devices/{id}", authorized(tenantHost, adminGetVhostDevice)).Methods("GET")
+	r.HandleFunc("/v1/vhost-devices/{id}", authorized(tenantHost, adminAllocateVhostDevice)).Methods("POST")
+	r.HandleFunc("/v1/cni/add", authorized(tenantHost, adminCNIAdd)).Methods("POST")
+	r.HandleFunc("/v1/cni/del", authorized(tenantHost, adminCNIDel)).Methods("POST")
+	r.HandleFunc("/v1/cni/check", authorized(tenantHost, adminCNICheck)).Methods("POST")
+
+	r.HandleFunc("/healthz", handlerHealthz).Methods("GET")
+	r.HandleFunc("/readyz", handlerReadyz).Methods("GET")
+}
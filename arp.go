@@ -0,0 +1,105 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+)
+
+//The pipeline does not flood broadcasts, so ARP requests are answered by
+//the pipeline itself from the ingress.arp_responder table. The gateway
+//of every network is answered with a MAC address derived from its
+//address, unless it is external, see gateway.go. With -o com.ipdk.proxy_arp=true the addresses of the endpoints
+//are answered as well, with their MAC address, and endpoints docker has
+//no MAC address for are given one derived from their address.
+const (
+	optProxyARP = "com.ipdk.proxy_arp"
+
+	arpTable  = "ingress.arp_responder"
+	arpAction = "ingress.arp_reply"
+)
+
+//parseProxyARP parses the proxy ARP option of a network
+func parseProxyARP(v string) (bool, error) {
+	if v == "" {
+		return false, nil
+	}
+	proxy, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q", optProxyARP, v)
+	}
+	return proxy, nil
+}
+
+func arpMatch(ip string) string {
+	return fmt.Sprintf("hdr.arp.opcode=1,hdr.arp.target_proto_addr=%s", ip)
+}
+
+func addARPEntry(owner string, bridge string, ip string, mac string) error {
+	return addEntry(owner, bridge, arpTable, arpMatch(ip), fmt.Sprintf("%s(%s)", arpAction, mac))
+}
+
+func removeARPEntry(bridge string, ip string) {
+	if err := deleteEntry(bridge, arpTable, arpMatch(ip)); err != nil {
+		slog.Error("Unable to remove ARP entry", "ip", ip, "err", err)
+	}
+}
+
+//gatewayMAC returns the MAC address the gateway of a network answers
+//with
+func gatewayMAC(nw *nwVal) (string, error) {
+	return endpointMAC("", nw.Gateway.IP)
+}
+
+//programARP installs the ARP entry of the gateway of a network
+func programARP(networkID string, nw *nwVal) error {
+	if nw.Gateway.IP == nil || nw.GatewayMode == gatewayExternal {
+		return nil
+	}
+
+	mac, err := gatewayMAC(nw)
+	if err != nil {
+		return err
+	}
+	return addARPEntry(networkOwner(networkID), nw.Bridge, nw.Gateway.IP.String(), mac)
+}
+
+//unprogramARP removes the entry installed by programARP
+func unprogramARP(nw *nwVal) {
+	if nw == nil || nw.Gateway.IP == nil || nw.GatewayMode == gatewayExternal {
+		return
+	}
+	removeARPEntry(nw.Bridge, nw.Gateway.IP.String())
+}
+
+//programEndpointARP answers ARP requests for an endpoint on proxy ARP
+//networks
+func programEndpointARP(endpointID string, nw *nwVal, ip string, mac string) error {
+	if !nw.ProxyARP {
+		return nil
+	}
+	return addARPEntry(endpointOwner(endpointID), nw.Bridge, ip, mac)
+}
+
+func unprogramEndpointARP(nw *nwVal, ip string) {
+	if nw == nil || !nw.ProxyARP {
+		return
+	}
+	removeARPEntry(nw.Bridge, ip)
+}
@@ -0,0 +1,218 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+//The admin API, /debug/state and the diagnostics of -pprof-addr show the
+//state of the host and can force deletions, restore the db or reset the
+//dataplane. They are protected by tokens, sent as Authorization: Bearer
+//<token>, or by client certificates when the plugin serves TLS. Each token
+//and certificate is given a role: readers may only GET, operators may do
+//anything. Tenants, see tenants.go, may only read their own networks.
+//Once -admin-tokens, -admin-tokens-file or -tls-client-ca is set,
+//requests without credentials are refused; otherwise they are served as
+//operators, as before. /healthz and /readyz are always open to probes.
+//
+//With -tls-client-ca every connection must present a certificate the CA
+//signed, docker included, which is given one in the TLSConfig of
+//ipdk.json. The common name of the certificate selects its role through
+//-tls-client-roles, certificates without a role only reach the driver API.
+var (
+	adminTokens    = flag.String("admin-tokens", "", "comma separated <role>=<token> pairs of the admin API, the role being reader or operator")
+	tlsCert        = flag.String("tls-cert", "", "certificate of the plugin, serving -listen over TLS when set")
+	tlsKey         = flag.String("tls-key", "", "key of the certificate of -tls-cert")
+	tlsClientCA    = flag.String("tls-client-ca", "", "CA bundle verifying the certificates clients must present")
+	tlsClientRoles = flag.String("tls-client-roles", "", "comma separated <role>=<common name> pairs giving client certificates a role on the admin API")
+)
+
+const (
+	roleReader   = "reader"
+	roleOperator = "operator"
+	roleTenant   = "tenant"
+)
+
+//principal is who an admin request comes from
+type principal struct {
+	Role   string
+	Tenant string //For roleTenant
+}
+
+//parseRoles parses <role>=<value> pairs into roles by value
+func parseRoles(name string, v string) (map[string]string, error) {
+	roles := make(map[string]string)
+	for _, item := range splitOption(v) {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || kv[1] == "" || (kv[0] != roleReader && kv[0] != roleOperator) {
+			return nil, fmt.Errorf("invalid -%s %q, expected <reader|operator>=<value>", name, kv[0])
+		}
+		roles[kv[1]] = kv[0]
+	}
+	return roles, nil
+}
+
+//checkAdminAuth checks the authentication settings of the admin API
+func checkAdminAuth() error {
+	if err := checkSecretSettings(); err != nil {
+		return err
+	}
+	if _, err := parseRoles("tls-client-roles", *tlsClientRoles); err != nil {
+		return err
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return fmt.Errorf("-tls-cert and -tls-key must be set together")
+	}
+	if *tlsClientCA != "" && *tlsCert == "" {
+		return fmt.Errorf("-tls-client-ca needs -tls-cert")
+	}
+	if *tlsClientRoles != "" && *tlsClientCA == "" {
+		return fmt.Errorf("-tls-client-roles needs -tls-client-ca")
+	}
+	return nil
+}
+
+//authRequired reports whether admin requests must carry credentials.
+//Tenant tokens need it too, or a tenant would get past its scope by
+//leaving its token out.
+func authRequired() bool {
+	return *adminTokens != "" || *adminTokensFile != "" || *tlsClientCA != "" ||
+		*tenantTokens != "" || *tenantTokensFile != ""
+}
+
+//authenticate returns who an admin request comes from, or the status
+//and error it is refused with
+func authenticate(r *http.Request) (principal, int, error) {
+	if token := bearerToken(r); token != "" {
+		roles, err := adminTokenRoles()
+		if err != nil {
+			return principal{}, http.StatusInternalServerError, fmt.Errorf("unable to read the admin tokens: %v", err)
+		}
+		if role, ok := roles[token]; ok {
+			return principal{Role: role}, 0, nil
+		}
+		tenants, err := tenantTokenTenants()
+		if err != nil {
+			return principal{}, http.StatusInternalServerError, fmt.Errorf("unable to read the tenant tokens: %v", err)
+		}
+		if tenant, ok := tenants[token]; ok {
+			return principal{Role: roleTenant, Tenant: tenant}, 0, nil
+		}
+		return principal{}, http.StatusUnauthorized, fmt.Errorf("unknown token")
+	}
+
+	if r.TLS != nil && len(r.TLS.VerifiedChains) != 0 {
+		cn := r.TLS.PeerCertificates[0].Subject.CommonName
+		roles, _ := parseRoles("tls-client-roles", *tlsClientRoles)
+		if role, ok := roles[cn]; ok {
+			return principal{Role: role}, 0, nil
+		}
+		return principal{}, http.StatusForbidden, fmt.Errorf("certificate %s has no role on the admin API", cn)
+	}
+
+	if !authRequired() {
+		return principal{Role: roleOperator}, 0, nil
+	}
+	return principal{}, http.StatusUnauthorized, fmt.Errorf("authentication required")
+}
+
+//authorized lets the requests of an admin route through if their
+//principal may make them, kind telling what the route shows to tenants
+func authorized(kind string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, status, err := authenticate(r)
+		if err != nil {
+			adminError(w, status, "%v", err)
+			return
+		}
+
+		switch p.Role {
+		case roleReader:
+			if r.Method != "GET" {
+				adminError(w, http.StatusForbidden, "%s %s is not allowed for readers", r.Method, r.URL.Path)
+				return
+			}
+		case roleTenant:
+			if kind == tenantHost || r.Method != "GET" {
+				adminError(w, http.StatusForbidden, "%s %s is not allowed for tenant %s", r.Method, r.URL.Path, p.Tenant)
+				return
+			}
+			var ok bool
+			if r, ok = scopeToTenant(w, r, kind, p.Tenant); !ok {
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+//operatorOnly lets the requests of a route through if they come from an
+//operator
+func operatorOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, status, err := authenticate(r)
+		if err != nil {
+			adminError(w, status, "%v", err)
+			return
+		}
+		if p.Role != roleOperator {
+			adminError(w, http.StatusForbidden, "%s %s is only allowed for operators", r.Method, r.URL.Path)
+			return
+		}
+		h(w, r)
+	}
+}
+
+//serveTLS wraps the listener of -listen into TLS when -tls-cert is set.
+//The certificate and the client CA are read on every handshake, so that
+//they can be rotated, see secrets.go.
+func serveTLS(l net.Listener) (net.Listener, error) {
+	if *tlsCert == "" {
+		return l, nil
+	}
+
+	if _, err := serverCertificate(nil); err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		GetCertificate: serverCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if *tlsClientCA != "" {
+		if _, err := clientCAs(); err != nil {
+			return nil, err
+		}
+		config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			pool, err := clientCAs()
+			if err != nil {
+				return nil, err
+			}
+			c := config.Clone()
+			c.GetConfigForClient = nil
+			c.ClientCAs = pool
+			c.ClientAuth = tls.RequireAndVerifyClientCert
+			return c, nil
+		}
+	}
+	return tls.NewListener(l, config), nil
+}
@@ -0,0 +1,177 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+//adminBackup streams a consistent snapshot of the db. The snapshot is
+//taken in a read transaction so the plugin keeps serving requests.
+//Backups of etcd and Consul stores are left to the tools of the cluster.
+func adminBackup(w http.ResponseWriter, r *http.Request) {
+	if db == nil {
+		adminError(w, http.StatusNotImplemented, "backup is only supported with the bolt store")
+		return
+	}
+
+	err := db.View(func(tx *bolt.Tx) error {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition",
+			fmt.Sprintf(`attachment; filename="ipdk-state-%s.db"`, time.Now().UTC().Format("20060102T150405Z")))
+		w.Header().Set("Content-Length", strconv.FormatInt(tx.Size(), 10))
+		_, err := tx.WriteTo(w)
+		return err
+	})
+	if err != nil {
+		slog.Error("Backup failed", "err", err)
+	}
+}
+
+//validateBackup checks that path holds a plugin db this version of the
+//plugin is able to load
+func validateBackup(path string) error {
+	options := bolt.Options{
+		Timeout:  time.Second,
+		ReadOnly: true,
+	}
+
+	bdb, err := bolt.Open(path, 0600, &options)
+	if err != nil {
+		return fmt.Errorf("not a valid db: %v", err)
+	}
+	defer bdb.Close()
+
+	return bdb.View(func(tx *bolt.Tx) error {
+		for _, table := range []string{"global", "nwMap", "epMap", "brMap"} {
+			if tx.Bucket([]byte(table)) == nil {
+				return fmt.Errorf("Bucket %v not found", table)
+			}
+		}
+
+		//Backups taken before versioning was introduced are migrated on load
+		v := tx.Bucket([]byte("global")).Get([]byte(dbSchemaKey))
+		if v == nil {
+			return nil
+		}
+		version := 0
+		if err := json.Unmarshal(v, &version); err != nil {
+			return fmt.Errorf("Decode Error: %v %v", dbSchemaKey, err)
+		}
+		if version > dbSchemaVersion() {
+			return fmt.Errorf("db schema version %d is newer than the supported version %d",
+				version, dbSchemaVersion())
+		}
+		return nil
+	})
+}
+
+//adminRestore replaces the db with the one in the request body and
+//reloads the plugin state from it. The replaced db is kept next to the
+//new one with a .pre-restore suffix. Restoring does not touch the
+//dataplane, the restored state is applied by the reconciliation at the
+//next plugin start.
+func adminRestore(w http.ResponseWriter, r *http.Request) {
+	if db == nil {
+		adminError(w, http.StatusNotImplemented, "restore is only supported with the bolt store")
+		return
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dbFile), ".restore")
+	if os.IsPermission(err) {
+		adminError(w, http.StatusInternalServerError, "unable to stage restore, the db directory %v is not writable by the plugin user, see -run-as", filepath.Dir(dbFile))
+		return
+	}
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, "unable to stage restore: %v", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r.Body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		adminError(w, http.StatusBadRequest, "unable to read backup: %v", err)
+		return
+	}
+
+	if err := validateBackup(tmp.Name()); err != nil {
+		adminError(w, http.StatusBadRequest, "invalid backup: %v", err)
+		return
+	}
+
+	//The garbage collector must not remove what the restored state uses
+	gcRuns.Lock()
+	defer gcRuns.Unlock()
+
+	networkChanges.Lock()
+	defer networkChanges.Unlock()
+
+	nwMap.Lock()
+	defer nwMap.Unlock()
+
+	epMap.Lock()
+	defer epMap.Unlock()
+
+	brMap.Lock()
+	defer brMap.Unlock()
+
+	if err := store.Close(); err != nil {
+		slog.Error("unable to close database", "err", err)
+	}
+
+	if err := os.Rename(dbFile, dbFile+".pre-restore"); err != nil {
+		slog.Error("unable to keep the previous database", "err", err)
+	}
+	if err := os.Rename(tmp.Name(), dbFile); err != nil {
+		//Fall back to the previous db so the plugin keeps working
+		os.Rename(dbFile+".pre-restore", dbFile)
+		adminError(w, http.StatusInternalServerError, "unable to install backup: %v", err)
+		err = initDb()
+		if err != nil {
+			slog.Error("db init failed", "err", err)
+		}
+		return
+	}
+
+	epMap.m = make(map[string]*epVal)
+	nwMap.m = make(map[string]*nwVal)
+	brMap.m = make(map[string]int)
+	poolMap.Lock()
+	poolMap.m = make(map[string]*ipamPool)
+	poolMap.Unlock()
+	if err := initDb(); err != nil {
+		adminError(w, http.StatusInternalServerError, "unable to load backup: %v", err)
+		return
+	}
+
+	slog.Info("Restored db", "networks", len(nwMap.m), "endpoints", len(epMap.m))
+	sendResponse(map[string]int{"Networks": len(nwMap.m), "Endpoints": len(epMap.m)}, w)
+}
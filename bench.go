@@ -0,0 +1,285 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//The bench subcommand measures the provisioning path at scale:
+//
+//  ipdk-docker-network-plugin bench -networks 4 -endpoints 250
+//
+//It sends synthetic CreateNetwork/CreateEndpoint requests, then the
+//matching deletes, straight to the driver handlers, bypassing docker,
+//-parallel endpoint requests at a time as docker does when containers
+//are started together, and reports the throughput of each phase along with the latency of the
+//requests and of every command run against the IPDK container. State is
+//kept in a scratch db, but the ports and entries are programmed into the
+//real dataplane, so the benchmark refuses to run on a host that already
+//has endpoints.
+
+//latencies collects durations under a name
+type latencies struct {
+	sync.Mutex
+	m map[string][]time.Duration
+}
+
+func (l *latencies) add(name string, d time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	l.m[name] = append(l.m[name], d)
+}
+
+//commandLatencies records the duration of every command run by
+//hostOutput while it is set
+var commandLatencies *latencies
+
+//commandName names a command after the command and its first argument,
+//or the command run in the ipdk container and its first argument
+func commandName(cmd string, args []string) string {
+	name := append([]string{cmd}, args...)
+	if cmd == "docker" && len(args) > 2 && args[0] == "exec" {
+		name = args[2:]
+	}
+	if len(name) > 2 {
+		name = name[:2]
+	}
+	return strings.Join(name, " ")
+}
+
+//observeCommand records the duration of a command
+func observeCommand(cmd string, args []string, start time.Time) {
+	if commandLatencies == nil {
+		return
+	}
+	commandLatencies.add(commandName(cmd, args), time.Since(start))
+}
+
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[(len(sorted)-1)*p/100]
+}
+
+func (l *latencies) report() {
+	var names []string
+	for name := range l.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Printf("%-28s %8s %12s %12s %12s %12s\n", "operation", "count", "p50", "p95", "p99", "max")
+	for _, name := range names {
+		d := l.m[name]
+		sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+		fmt.Printf("%-28s %8d %12v %12v %12v %12v\n", name, len(d),
+			percentile(d, 50), percentile(d, 95), percentile(d, 99), d[len(d)-1])
+	}
+}
+
+//driverRequest sends a synthetic driver request to handler
+func driverRequest(handler http.HandlerFunc, req interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/", bytes.NewReader(body)))
+
+	resp := struct{ Err string }{}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		return err
+	}
+	if resp.Err != "" {
+		return fmt.Errorf("%s", resp.Err)
+	}
+	return nil
+}
+
+//benchPhase runs op for each of n items, parallel at a time, and prints
+//its throughput
+func benchPhase(name string, n int, parallel int, requests *latencies, op func(i int) error) error {
+	start := time.Now()
+	items := make(chan int)
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range items {
+				t := time.Now()
+				if err := op(i); err != nil {
+					errs <- fmt.Errorf("%s %d failed: %v", name, i, err)
+					continue
+				}
+				requests.add(name, time.Since(t))
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		items <- i
+	}
+	close(items)
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	elapsed := time.Since(start)
+	fmt.Printf("%-28s %8d in %v (%.1f/s)\n", name, n, elapsed, float64(n)/elapsed.Seconds())
+	return nil
+}
+
+func runBenchmark(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	networks := fs.Int("networks", 1, "number of synthetic networks")
+	endpoints := fs.Int("endpoints", 10, "number of synthetic endpoints per network")
+	keep := fs.Bool("keep", false, "leave the synthetic networks and endpoints in place")
+	parallel := fs.Int("parallel", 1, "number of endpoint requests sent concurrently")
+	fs.Parse(args)
+
+	if *networks < 1 || *networks > 256 || *endpoints < 1 || *endpoints > 253 {
+		return fmt.Errorf("between 1 and 256 networks of 1 to 253 endpoints are supported")
+	}
+	if *parallel < 1 {
+		return fmt.Errorf("-parallel must be at least 1")
+	}
+
+	if err := requireDocker(); err != nil {
+		return err
+	}
+	if err := requireNetAdmin(); err != nil {
+		return err
+	}
+	links, err := dummyLinks()
+	if err != nil {
+		return err
+	}
+	for link := range links {
+		if isEndpointLink(link) {
+			return fmt.Errorf("endpoint %v exists, run the benchmark on a host without endpoints", link)
+		}
+	}
+	if vhostPortExists(1) {
+		return fmt.Errorf("vhost port 1 exists, run the benchmark on a host without endpoints")
+	}
+
+	dir, err := ioutil.TempDir("", "ipdk-bench")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	dbFile = dir + "/state.db"
+	*storeURL = "bolt"
+	if err := initDb(); err != nil {
+		return err
+	}
+	defer store.Close()
+
+	//Synthetic networks are 10.251.<network>.0/24
+	subnet := func(n int) string { return fmt.Sprintf("10.251.%d.0/24", n) }
+	address := func(n int, e int) string { return fmt.Sprintf("10.251.%d.%d/24", n, e+2) }
+	networkID := func(n int) string { return fmt.Sprintf("bench-network-%d", n) }
+	endpointID := func(i int) string {
+		return fmt.Sprintf("bench-endpoint-%d-%d", i / *endpoints, i%*endpoints)
+	}
+
+	requests := &latencies{m: make(map[string][]time.Duration)}
+	commandLatencies = &latencies{m: make(map[string][]time.Duration)}
+	defer func() { commandLatencies = nil }()
+
+	err = benchPhase("CreateNetwork", *networks, 1, requests, func(n int) error {
+		gw, _, _ := net.ParseCIDR(subnet(n))
+		gw[len(gw)-1] = 1
+		return driverRequest(handlerCreateNetwork, map[string]interface{}{
+			"NetworkID": networkID(n),
+			"Options":   map[string]interface{}{},
+			"IPv4Data": []map[string]string{{
+				"Pool":    subnet(n),
+				"Gateway": gw.String() + "/24",
+			}},
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	total := *networks * *endpoints
+	err = benchPhase("CreateEndpoint", total, *parallel, requests, func(i int) error {
+		n := i / *endpoints
+		return driverRequest(handlerCreateEndpoint, map[string]interface{}{
+			"NetworkID":  networkID(n),
+			"EndpointID": endpointID(i),
+			"Interface":  map[string]string{"Address": address(n, i%*endpoints)},
+			"Options":    map[string]interface{}{},
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if !*keep {
+		err = benchPhase("DeleteEndpoint", total, *parallel, requests, func(i int) error {
+			return driverRequest(handlerDeleteEndpoint, map[string]string{
+				"NetworkID":  networkID(i / *endpoints),
+				"EndpointID": endpointID(i),
+			})
+		})
+		if err != nil {
+			return err
+		}
+
+		err = benchPhase("DeleteNetwork", *networks, 1, requests, func(n int) error {
+			return driverRequest(handlerDeleteNetwork, map[string]string{"NetworkID": networkID(n)})
+		})
+		if err != nil {
+			return err
+		}
+
+		//Nothing should be left by the deletions, the collection times
+		//the probes of every interface ID handed out
+		start := time.Now()
+		r := gc()
+		requests.add("GarbageCollect", time.Since(start))
+		fmt.Printf("%-28s %8d in %v\n", "GarbageCollect",
+			len(r.Entries)+len(r.Links)+len(r.SocketDirs)+len(r.VhostPorts)+len(r.Bridges), time.Since(start))
+	}
+
+	fmt.Println()
+	requests.report()
+	fmt.Println()
+	commandLatencies.report()
+	return nil
+}
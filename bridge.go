@@ -0,0 +1,220 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+//By default every network is programmed into the pipeline of the shared
+//br0 bridge, which is set up along with the IPDK container. With
+//-bridge-per-network each network gets a bridge of its own, br<bridge
+//ID>, loaded with its own instance of the pipeline: networks can't reach
+//each other, and deleting a network tears down all of its entries at
+//once by deleting its bridge.
+var bridgePerNetwork = flag.Bool("bridge-per-network", false, "program every network into a bridge and pipeline of its own instead of br0")
+
+const defaultBridge = "br0"
+
+//A network can also be programmed into a bridge of its choosing with
+//-o com.ipdk.bridge=<name>, shared by the networks naming it. The bridge
+//is created and loaded with the program of the network unless it exists
+//already, and is deleted with the last network using it if the plugin
+//created it. Networks sharing a bridge run the same program.
+const optBridge = "com.ipdk.bridge"
+
+var (
+	bridgeNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]{0,14}$`)
+
+	//Names of the bridges the plugin hands out
+	reservedBridgePattern = regexp.MustCompile(`^(br[0-9]+|ipdkfb[0-9]+)$`)
+)
+
+//parseBridge parses the bridge option of a network, "" meaning the bridge
+//selected by the plugin
+func parseBridge(v string) (string, error) {
+	if v == "" || v == defaultBridge {
+		return v, nil
+	}
+	if !bridgeNamePattern.MatchString(v) {
+		return "", fmt.Errorf("invalid %s %q, expected up to 15 letters, digits, - and _", optBridge, v)
+	}
+	if reservedBridgePattern.MatchString(v) {
+		return "", fmt.Errorf("invalid %s %q, the name is reserved for the bridges of the plugin", optBridge, v)
+	}
+	return v, nil
+}
+
+//bridgeNetwork returns a network other than except using a bridge, or
+//nil. nwMap must be locked by the caller.
+func bridgeNetwork(bridge string, except string) (string, *nwVal) {
+	for id, nw := range nwMap.m {
+		if id != except && nw.Bridge == bridge && !nw.Fallback {
+			return id, nw
+		}
+	}
+	return "", nil
+}
+
+//attachNamedBridge sets up a bridge named by a new network, creating it
+//unless it exists, and reports whether it was created. sharedID and
+//shared are the network already using the bridge, if any, see
+//bridgeNetwork.
+func attachNamedBridge(bridge string, prog *p4Program, sharedID string, shared *nwVal) (bool, error) {
+	source := ""
+	if prog != nil {
+		source = prog.Source
+	}
+	if shared != nil {
+		if shared.P4Program != source {
+			return false, fmt.Errorf("bridge %v of network %v runs %q, not %q", bridge, sharedID, shared.P4Program, source)
+		}
+		return false, nil
+	}
+
+	bridges, err := listBridges()
+	if err != nil {
+		return false, err
+	}
+	if bridges[bridge] {
+		if prog != nil {
+			return false, fmt.Errorf("bridge %v exists already, its pipeline can't be replaced", bridge)
+		}
+		return false, nil
+	}
+	if err := createBridge(bridge, prog); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+//releaseNamedBridge hands the deletion of the named bridge of a deleted
+//network over to a network still using it, and reports whether the
+//bridge must be deleted instead: it was created by the plugin and no
+//other network uses it. nwMap must be locked by the caller.
+func releaseNamedBridge(networkID string, nw *nwVal) ([]dbOp, bool) {
+	if !nw.BridgeCreated {
+		return nil, false
+	}
+	if id, other := bridgeNetwork(nw.Bridge, networkID); other != nil {
+		other.BridgeCreated = true
+		return []dbOp{putNetwork(id, other)}, false
+	}
+	return nil, true
+}
+
+//networkBridge returns the name of the bridge of a network with the given
+//bridge ID
+func networkBridge(id int) string {
+	if !*bridgePerNetwork {
+		return defaultBridge
+	}
+	return fmt.Sprintf("br%d", id)
+}
+
+//ownsBridge reports whether the bridge of a network was created for it
+//alone
+func ownsBridge(nw *nwVal) bool {
+	return nw.Bridge != defaultBridge && !nw.Fallback && !nw.NamedBridge
+}
+
+//createBridge creates a bridge and loads a program into its pipeline,
+//the default program if prog is nil
+func createBridge(bridge string, prog *p4Program) error {
+	binary, p4Info := defaultArtifacts()
+	if prog != nil {
+		binary, p4Info = prog.Binary, prog.P4Info
+	}
+
+	if _, err := ipdkExec("ovs-vsctl", "add-br", bridge); err != nil {
+		return err
+	}
+
+	if _, err := ipdkExec("ovs-p4ctl", "set-pipe", bridge, binary, p4Info); err != nil {
+		if err := deleteBridge(bridge); err != nil {
+			slog.Error("Unable to delete bridge", "bridge", bridge, "err", err)
+		}
+		return err
+	}
+	if prog != nil {
+		setPipelineMapping(bridge, prog.Mapping)
+	}
+
+	slog.Info("Created bridge", "bridge", bridge)
+	return nil
+}
+
+//deleteBridge deletes a bridge along with the entries of its pipeline,
+//and drops the ownership records of those entries
+func deleteBridge(bridge string) error {
+	if _, err := ipdkExec("ovs-vsctl", "del-br", bridge); err != nil {
+		return err
+	}
+	setPipelineMapping(bridge, nil)
+
+	entries, err := ownedEntries()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Bridge == bridge {
+			forgetEntry(e.Bridge, e.Table, e.Match)
+		}
+	}
+
+	slog.Info("Deleted bridge", "bridge", bridge)
+	return nil
+}
+
+//listBridges returns the bridges of the IPDK container
+func listBridges() (map[string]bool, error) {
+	output, err := ipdkOutput("ovs-vsctl", "list-br")
+	if err != nil {
+		return nil, err
+	}
+
+	bridges := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		if name := strings.TrimSpace(scanner.Text()); name != "" {
+			bridges[name] = true
+		}
+	}
+	return bridges, nil
+}
+
+//networkBridges returns the bridges used by the known networks, always
+//including br0. nwMap must be locked by the caller.
+func networkBridges() []string {
+	bridges := []string{defaultBridge}
+	named := make(map[string]bool)
+	for _, nw := range nwMap.m {
+		if nw.NamedBridge && !named[nw.Bridge] {
+			named[nw.Bridge] = true
+			bridges = append(bridges, nw.Bridge)
+		} else if ownsBridge(nw) {
+			bridges = append(bridges, nw.Bridge)
+		}
+	}
+	return bridges
+}
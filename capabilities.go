@@ -0,0 +1,139 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//The plugin needs CAP_NET_ADMIN to manage dummy links (unless they are
+//delegated to the privileged helper) and access to the docker socket to
+//drive the IPDK container. Both are detected at startup so that requests
+//needing a missing privilege fail upfront with an explicit message,
+//instead of half way through with an exec error.
+
+const capNetAdmin = 12
+
+type capabilities struct {
+	NetAdmin bool
+	Docker   bool
+	IPDK     bool //The ipdk container is running
+}
+
+var caps = capabilities{NetAdmin: true, Docker: true, IPDK: true}
+
+//hasCapability reports whether cap is in the effective capability set
+//of the plugin process
+func hasCapability(cap uint) bool {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		slog.Error("Unable to read capabilities", "err", err)
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[0] != "CapEff:" {
+			continue
+		}
+		eff, err := strconv.ParseUint(fields[1], 16, 64)
+		if err != nil {
+			return false
+		}
+		return eff&(1<<cap) != 0
+	}
+	return false
+}
+
+//dockerAccessible reports whether the docker daemon socket, as given by
+//DOCKER_HOST, can be connected to
+func dockerAccessible() bool {
+	proto, addr := "unix", "/var/run/docker.sock"
+	if h := os.Getenv("DOCKER_HOST"); h != "" {
+		if i := strings.Index(h, "://"); i > 0 {
+			proto, addr = h[:i], h[i+3:]
+		}
+	}
+	if proto != "unix" {
+		proto = "tcp"
+	}
+
+	conn, err := net.DialTimeout(proto, addr, time.Second)
+	if err != nil {
+		slog.Info("Docker daemon not accessible", "addr", addr, "err", err)
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func detectCapabilities() capabilities {
+	c := capabilities{
+		//Links are managed by the helper in the frontend role
+		NetAdmin: *role == "frontend" || hasCapability(capNetAdmin),
+		Docker:   dockerAccessible(),
+	}
+	if c.Docker {
+		_, err := ipdkExec("true")
+		c.IPDK = err == nil
+	}
+
+	if h, ok := host.(helperHostOps); ok {
+		//The helper may start after the frontend, links are still
+		//delegated to it
+		if err := h.ping(); err != nil {
+			slog.Warn("The privileged helper is not answering yet, endpoints can't be created or deleted until it does", "err", err)
+		}
+		if os.Geteuid() == 0 && *runAs == "" {
+			slog.Warn("The frontend runs as root, run it as an unprivileged user to benefit from the privileged helper")
+		}
+	}
+	if !c.NetAdmin {
+		slog.Warn("CAP_NET_ADMIN is missing: endpoints can't be created or deleted, run as root or with -role=frontend and a privileged helper")
+	}
+	if !c.Docker {
+		slog.Warn("Docker socket is not accessible: the IPDK dataplane can't be programmed, endpoints, isolation, services, reconciliation and garbage collection are disabled")
+	}
+	if c.Docker && !c.IPDK {
+		slog.Warn("The ipdk container is not running: only the IPAM driver is available")
+	}
+	slog.Info("Detected capabilities", "net_admin", c.NetAdmin, "docker", c.Docker, "ipdk", c.IPDK)
+	return c
+}
+
+func requireNetAdmin() error {
+	if !caps.NetAdmin {
+		return fmt.Errorf("the plugin lacks CAP_NET_ADMIN, dummy links can't be managed")
+	}
+	return nil
+}
+
+func requireDocker() error {
+	if !caps.Docker {
+		return fmt.Errorf("the plugin can't access the docker socket, the IPDK dataplane can't be programmed")
+	}
+	return nil
+}
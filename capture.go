@@ -0,0 +1,220 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+//The traffic of an endpoint can be captured to a pcap file on the host
+//without changing the P4 program:
+//
+//  curl -X POST http://127.0.0.1:9075/v1/endpoints/<id>/capture
+//
+//A TAP port of the pipeline is created as the capture port, the traffic
+//of the endpoint is mirrored to it, and tcpdump writes what it receives
+//to <-capture-dir>/<endpoint-id>.pcap, rotating through -capture-files
+//files of -capture-file-size MB. A capture is a mirror session, it is
+//stopped like any other with DELETE /v1/endpoints/<id>/mirror, or with
+//DELETE /v1/endpoints/<id>/capture.
+var captureDir = flag.String("capture-dir", "/var/lib/ipdk-docker-plugin/captures", "directory of the pcap files of endpoint captures")
+var captureFileSize = flag.Int("capture-file-size", 10, "size in MB at which capture files are rotated")
+var captureFiles = flag.Int("capture-files", 5, "number of rotated files kept per capture")
+
+//captures holds the tcpdump processes of the running captures, by
+//endpoint ID
+var captures = struct {
+	sync.Mutex
+	m map[string]*exec.Cmd
+}{m: make(map[string]*exec.Cmd)}
+
+//captureResponse is a capture session and its files
+type captureResponse struct {
+	*mirrorSession
+	Files []string
+}
+
+//startTcpdump writes the traffic received on the capture port of an
+//endpoint to its pcap files
+func startTcpdump(endpointID string, m *mirrorSession) error {
+	link := tapName(m.Port)
+	if _, err := hostOutput("ip", "link", "set", "dev", link, "up"); err != nil {
+		return err
+	}
+
+	cmd := exec.Command("tcpdump", "-i", link, "-U", "-Z", "root",
+		"-C", strconv.Itoa(*captureFileSize), "-W", strconv.Itoa(*captureFiles), "-w", m.Capture)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("unable to start tcpdump: %v", err)
+	}
+	go func() {
+		err := cmd.Wait()
+		slog.Info("Capture ended", "endpoint", endpointID, "err", err)
+	}()
+
+	captures.Lock()
+	defer captures.Unlock()
+	captures.m[endpointID] = cmd
+	return nil
+}
+
+func stopTcpdump(endpointID string) {
+	captures.Lock()
+	defer captures.Unlock()
+	if cmd, ok := captures.m[endpointID]; ok {
+		if err := cmd.Process.Kill(); err != nil {
+			slog.Error("Unable to stop the capture", "endpoint", endpointID, "err", err)
+		}
+		delete(captures.m, endpointID)
+	}
+}
+
+//stopCapture stops tcpdump and deletes the capture port of a capture
+//session, once its mirror entries are removed
+func stopCapture(endpointID string, m *mirrorSession) {
+	if m == nil || m.Capture == "" {
+		return
+	}
+	stopTcpdump(endpointID)
+	if err := deleteTapPort(m.Port); err != nil {
+		slog.Error("Unable to delete capture port", "port", tapName(m.Port), "err", err)
+	}
+}
+
+//resumeCapture restarts tcpdump for a capture session restored from the
+//db
+func resumeCapture(endpointID string, ep *epVal) {
+	if ep.Mirror == nil || ep.Mirror.Capture == "" {
+		return
+	}
+	slog.Info("Reconcile: resuming the capture", "endpoint", endpointID)
+	if err := startTcpdump(endpointID, ep.Mirror); err != nil {
+		slog.Error("Reconcile: unable to resume the capture", "endpoint", endpointID, "err", err)
+	}
+}
+
+func captureFilesOf(m *mirrorSession) []string {
+	files, _ := filepath.Glob(m.Capture + "*")
+	sort.Strings(files)
+	return files
+}
+
+func adminGetCapture(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	epMap.Lock()
+	defer epMap.Unlock()
+
+	ep, ok := epMap.m[id]
+	if !ok {
+		adminError(w, http.StatusNotFound, "endpoint %s not found", id)
+		return
+	}
+	if ep.Mirror == nil || ep.Mirror.Capture == "" {
+		adminError(w, http.StatusNotFound, "endpoint %s is not captured", id)
+		return
+	}
+	sendResponse(captureResponse{ep.Mirror, captureFilesOf(ep.Mirror)}, w)
+}
+
+//adminStartCapture creates the capture port of an endpoint, mirrors its
+//traffic to it and starts tcpdump
+func adminStartCapture(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	if err := requireNetAdmin(); err != nil {
+		adminError(w, http.StatusServiceUnavailable, "%v", err)
+		return
+	}
+	if err := os.MkdirAll(*captureDir, 0750); err != nil {
+		adminError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	nwMap.Lock()
+	defer nwMap.Unlock()
+	epMap.Lock()
+	defer epMap.Unlock()
+	brMap.Lock()
+	defer brMap.Unlock()
+
+	ep, ok := epMap.m[id]
+	if !ok {
+		adminError(w, http.StatusNotFound, "endpoint %s not found", id)
+		return
+	}
+	nw := nwMap.m[ep.NetworkID]
+	if nw == nil {
+		adminError(w, http.StatusConflict, "network %s of endpoint %s not found", ep.NetworkID, id)
+		return
+	}
+	if ep.Mirror != nil {
+		adminError(w, http.StatusConflict, "endpoint %s is already mirrored to port %d", id, ep.Mirror.Port)
+		return
+	}
+
+	m := &mirrorSession{Port: allocIntf(), Capture: filepath.Join(*captureDir, filepath.Base(id)+".pcap")}
+	if err := createTapPort(m.Port, ep.MTU); err != nil {
+		adminError(w, http.StatusInternalServerError, "unable to create the capture port of %s: %v", id, err)
+		return
+	}
+	err := startTcpdump(id, m)
+	if err == nil {
+		if err = startMirror(id, nw, ep, m); err != nil {
+			stopTcpdump(id)
+		}
+	}
+	if err != nil {
+		if err := deleteTapPort(m.Port); err != nil {
+			slog.Error("Unable to delete capture port", "port", tapName(m.Port), "err", err)
+		}
+		adminError(w, http.StatusInternalServerError, "unable to capture endpoint %s: %v", id, err)
+		return
+	}
+
+	ep.Mirror = m
+	if err := dbUpdate(putEndpoint(id, ep), putCounter("intfCount", brMap.intfCount), putFreeIntfs(brMap.freeIntfs)); err != nil {
+		slog.Error("Unable to update db", "err", err)
+	}
+	sendResponse(captureResponse{m, captureFilesOf(m)}, w)
+}
+
+func adminStopCapture(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	epMap.Lock()
+	ep, ok := epMap.m[id]
+	captured := ok && ep.Mirror != nil && ep.Mirror.Capture != ""
+	epMap.Unlock()
+
+	if !captured {
+		adminError(w, http.StatusNotFound, "endpoint %s is not captured", id)
+		return
+	}
+	adminStopMirror(w, r)
+}
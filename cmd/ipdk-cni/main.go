@@ -0,0 +1,437 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+//ipdk-cni is a CNI plugin provisioning the interfaces of pods through
+//the ipdk docker network plugin, which must be running on the node. It is
+//also a netavark plugin for Podman, see netavark.go.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const defaultPluginURL = "http://127.0.0.1:9075"
+
+var supportedVersions = []string{"0.3.0", "0.3.1", "0.4.0", "1.0.0", "1.1.0"}
+
+//Device information files are read by Multus to publish the vhost-user
+//socket or VF of an attachment in the network-status annotation of the pod
+const devInfoDir = "/var/run/k8s.cni.cncf.io/devinfo/cni"
+
+//netConf is the network configuration handed to the plugin on stdin:
+//
+//  {
+//      "cniVersion": "1.0.0",
+//      "name": "pods",
+//      "type": "ipdk-cni",
+//      "subnet": "10.30.0.0/24",
+//      "options": {"com.ipdk.vlan": "100"}
+//  }
+//
+//The subnet is only used by the first pod, which creates the network.
+//"url" is the address of the plugin, http://127.0.0.1:9075 by default,
+//and "token" the operator token of its admin API, if it has any.
+//"deviceID", set by Multus for pods requesting an intel.com/ipdk-vhost
+//device, gives the endpoint its vhost-user socket in the directory of the
+//device.
+//
+//Network attachments of Multus can also set "queues" and "pipeline", the
+//com.ipdk.queues and com.ipdk.p4program options, and list the prefixes
+//routed through the gateway in "routes", secondary attachments not
+//getting the default route: [] for none.
+type netConf struct {
+	CNIVersion string            `json:"cniVersion"`
+	Name       string            `json:"name"`
+	URL        string            `json:"url"`
+	Token      string            `json:"token"`
+	Subnet     string            `json:"subnet"`
+	Options    map[string]string `json:"options"`
+	DeviceID   string            `json:"deviceID"`
+	Queues     int               `json:"queues"`
+	Pipeline   string            `json:"pipeline"`
+	Routes     []string          `json:"routes"`
+}
+
+//options returns the driver options of the network and its endpoints
+func (c *netConf) options() map[string]string {
+	options := make(map[string]string)
+	for k, v := range c.Options {
+		options[k] = v
+	}
+	if c.DeviceID != "" {
+		options["com.ipdk.vhost_device"] = c.DeviceID
+	}
+	if c.Queues != 0 {
+		options["com.ipdk.queues"] = fmt.Sprint(c.Queues)
+	}
+	if c.Pipeline != "" {
+		options["com.ipdk.p4program"] = c.Pipeline
+	}
+	return options
+}
+
+//routes returns the prefixes routed through the gateway
+func (c *netConf) routes() []string {
+	if c.Routes == nil {
+		return []string{"0.0.0.0/0"}
+	}
+	return c.Routes
+}
+
+//cniRequest and cniResult mirror the /v1/cni API of the plugin
+type cniRequest struct {
+	ContainerID string
+	IfName      string
+	Network     string
+	Subnet      string
+	Gateway     string
+	Address     string
+	MAC         string
+	Options     map[string]string
+}
+
+type cniResult struct {
+	Link    string
+	Address string
+	Gateway string
+	MAC     string
+	MTU     int
+
+	SocketPath string
+	PCI        string
+}
+
+//cniError is a CNI error result. Codes below 100 are defined by the
+//CNI specification, the others are ours.
+type cniError struct {
+	CNIVersion string `json:"cniVersion"`
+	Code       int    `json:"code"`
+	Msg        string `json:"msg"`
+}
+
+const (
+	errIncompatibleVersion = 1
+	errInvalidEnvironment  = 4
+	errDecodingFailure     = 6
+	errInvalidConfig       = 7
+	errTryAgainLater       = 11
+	errInternal            = 100
+)
+
+func fail(version string, code int, format string, args ...interface{}) {
+	json.NewEncoder(os.Stdout).Encode(cniError{CNIVersion: version, Code: code, Msg: fmt.Sprintf(format, args...)})
+	os.Exit(1)
+}
+
+//call sends a CNI operation to the plugin
+func call(conf *netConf, op string, req *cniRequest) (*cniResult, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	r, err := http.NewRequest("POST", conf.URL+"/v1/cni/"+op, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if conf.Token != "" {
+		r.Header.Set("Authorization", "Bearer "+conf.Token)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		e := struct{ Err string }{}
+		json.Unmarshal(body, &e)
+		return nil, fmt.Errorf("%s: %s", resp.Status, e.Err)
+	}
+	res := &cniResult{}
+	if err := json.Unmarshal(body, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+//commandTimeout bounds the commands run for a container, which are
+//killed past it
+const commandTimeout = 30 * time.Second
+
+func run(name string, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+//netnsTarget returns how ip link set netns refers to a network namespace
+//path: the name of a named namespace, or the PID of a process
+func netnsTarget(netns string) (string, error) {
+	dir, name := filepath.Split(netns)
+	switch filepath.Clean(dir) {
+	case "/var/run/netns", "/run/netns":
+		return name, nil
+	}
+	var pid int
+	if _, err := fmt.Sscanf(netns, "/proc/%d/ns/net", &pid); err == nil {
+		return fmt.Sprint(pid), nil
+	}
+	return "", fmt.Errorf("unsupported network namespace %v", netns)
+}
+
+//inNetns runs ip in a network namespace
+func inNetns(netns string, args ...string) error {
+	return run("nsenter", append([]string{"--net=" + netns, "ip"}, args...)...)
+}
+
+//configure moves the link of an endpoint into the pod, names it ifName
+//and gives it the address and routes of the endpoint
+func configure(res *cniResult, netns string, ifName string, routes []string) error {
+	target, err := netnsTarget(netns)
+	if err != nil {
+		return err
+	}
+	if err := run("ip", "link", "set", "dev", res.Link, "netns", target); err != nil {
+		return err
+	}
+	if err := inNetns(netns, "link", "set", "dev", res.Link, "name", ifName); err != nil {
+		return err
+	}
+	if res.MAC != "" {
+		if err := inNetns(netns, "link", "set", "dev", ifName, "address", res.MAC); err != nil {
+			return err
+		}
+	}
+	if res.MTU != 0 {
+		if err := inNetns(netns, "link", "set", "dev", ifName, "mtu", fmt.Sprint(res.MTU)); err != nil {
+			return err
+		}
+	}
+	if err := inNetns(netns, "addr", "add", res.Address, "dev", ifName); err != nil {
+		return err
+	}
+	if err := inNetns(netns, "link", "set", "dev", ifName, "up"); err != nil {
+		return err
+	}
+	for _, dst := range routes {
+		if err := inNetns(netns, "route", "add", dst, "via", res.Gateway, "dev", ifName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//printResult prints the CNI result of an endpoint
+func printResult(conf *netConf, res *cniResult, netns string, ifName string) error {
+	version := conf.CNIVersion
+	mac := res.MAC
+	if mac == "" {
+		mac = linkMAC(netns, ifName)
+	}
+
+	intf := map[string]interface{}{"name": ifName, "mac": mac, "sandbox": netns}
+	if version == "1.1.0" {
+		if res.MTU != 0 {
+			intf["mtu"] = res.MTU
+		}
+		if res.SocketPath != "" {
+			intf["socketPath"] = res.SocketPath
+		}
+		if res.PCI != "" {
+			intf["pciID"] = res.PCI
+		}
+	}
+	var routes []map[string]string
+	for _, dst := range conf.routes() {
+		routes = append(routes, map[string]string{"dst": dst, "gw": res.Gateway})
+	}
+
+	ip := map[string]interface{}{
+		"address":   res.Address,
+		"gateway":   res.Gateway,
+		"interface": 0,
+	}
+	if strings.HasPrefix(version, "0.") {
+		ip["version"] = "4"
+	}
+	return json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+		"cniVersion": version,
+		"interfaces": []interface{}{intf},
+		"ips":        []interface{}{ip},
+		"routes":     routes,
+	})
+}
+
+func devInfoPath(conf *netConf, containerID string, ifName string) string {
+	return filepath.Join(devInfoDir, fmt.Sprintf("%s-%s-%s-device.json", conf.Name, containerID, ifName))
+}
+
+//saveDeviceInfo writes the device information file of a vhost-user or
+//VF endpoint, in the format of the device information specification of
+//the Network Plumbing Working Group
+func saveDeviceInfo(conf *netConf, containerID string, ifName string, res *cniResult) error {
+	var info map[string]interface{}
+	switch {
+	case res.SocketPath != "":
+		//The pod connects to the socket created by the pipeline
+		info = map[string]interface{}{
+			"type":       "vhost-user",
+			"version":    "1.1.0",
+			"vhost-user": map[string]string{"mode": "client", "path": res.SocketPath},
+		}
+	case res.PCI != "":
+		info = map[string]interface{}{
+			"type":    "pci",
+			"version": "1.1.0",
+			"pci":     map[string]string{"pci-address": res.PCI},
+		}
+	default:
+		return nil
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(devInfoDir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(devInfoPath(conf, containerID, ifName), data, 0600)
+}
+
+//linkMAC returns the MAC address of a link of the pod, "" if unknown
+func linkMAC(netns string, ifName string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, "nsenter", "--net="+netns, "cat", "/sys/class/net/"+ifName+"/address").Output()
+	if err != nil {
+		return ""
+	}
+	if mac, err := net.ParseMAC(strings.TrimSpace(string(output))); err == nil {
+		return mac.String()
+	}
+	return ""
+}
+
+func main() {
+	//Netavark passes its commands as arguments, CNI in the environment
+	if len(os.Args) > 1 {
+		netavarkMain(os.Args[1:])
+		return
+	}
+
+	command := os.Getenv("CNI_COMMAND")
+	if command == "VERSION" {
+		json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+			"cniVersion":        supportedVersions[len(supportedVersions)-1],
+			"supportedVersions": supportedVersions,
+		})
+		return
+	}
+
+	stdin, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		fail("", errDecodingFailure, "unable to read the network configuration: %v", err)
+	}
+	conf := &netConf{URL: defaultPluginURL}
+	if err := json.Unmarshal(stdin, conf); err != nil {
+		fail("", errDecodingFailure, "invalid network configuration: %v", err)
+	}
+	supported := false
+	for _, v := range supportedVersions {
+		supported = supported || v == conf.CNIVersion
+	}
+	if !supported {
+		fail(conf.CNIVersion, errIncompatibleVersion, "unsupported CNI version %q", conf.CNIVersion)
+	}
+	if conf.Name == "" {
+		fail(conf.CNIVersion, errInvalidConfig, "the network configuration has no name")
+	}
+
+	req := &cniRequest{
+		ContainerID: os.Getenv("CNI_CONTAINERID"),
+		IfName:      os.Getenv("CNI_IFNAME"),
+		Network:     conf.Name,
+		Subnet:      conf.Subnet,
+		Options:     conf.options(),
+	}
+	netns := os.Getenv("CNI_NETNS")
+	if req.ContainerID == "" || req.IfName == "" {
+		fail(conf.CNIVersion, errInvalidEnvironment, "CNI_CONTAINERID and CNI_IFNAME must be set")
+	}
+
+	switch command {
+	case "ADD":
+		if netns == "" {
+			fail(conf.CNIVersion, errInvalidEnvironment, "CNI_NETNS must be set")
+		}
+		res, err := call(conf, "add", req)
+		if err != nil {
+			fail(conf.CNIVersion, errTryAgainLater, "unable to create the endpoint: %v", err)
+		}
+		err = configure(res, netns, req.IfName, conf.routes())
+		if err == nil {
+			err = saveDeviceInfo(conf, req.ContainerID, req.IfName, res)
+		}
+		if err != nil {
+			if _, err := call(conf, "del", req); err != nil {
+				fmt.Fprintf(os.Stderr, "ipdk-cni: unable to delete the endpoint: %v\n", err)
+			}
+			fail(conf.CNIVersion, errInternal, "unable to configure %v: %v", req.IfName, err)
+		}
+		if err := printResult(conf, res, netns, req.IfName); err != nil {
+			fail(conf.CNIVersion, errInternal, "%v", err)
+		}
+	case "DEL":
+		if _, err := call(conf, "del", req); err != nil {
+			fail(conf.CNIVersion, errTryAgainLater, "unable to delete the endpoint: %v", err)
+		}
+		if err := os.Remove(devInfoPath(conf, req.ContainerID, req.IfName)); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "ipdk-cni: unable to remove the device information: %v\n", err)
+		}
+	case "CHECK":
+		if _, err := call(conf, "check", req); err != nil {
+			fail(conf.CNIVersion, errInternal, "%v", err)
+		}
+		if netns != "" {
+			if err := inNetns(netns, "link", "show", "dev", req.IfName); err != nil {
+				fail(conf.CNIVersion, errInternal, "%v", err)
+			}
+		}
+	default:
+		fail(conf.CNIVersion, errInvalidEnvironment, "unknown CNI_COMMAND %q", command)
+	}
+}
@@ -0,0 +1,208 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+)
+
+//Podman uses the plugin as a netavark plugin, installed in one of the
+//netavark plugin directories, e.g. /usr/libexec/netavark/ipdk-cni, and
+//selected as the driver of a network:
+//
+//  podman network create -d ipdk-cni --subnet 10.50.0.0/24 fast
+//
+//Podman networks are backed by the networks of the CNI plugin of the same
+//name, created by their first container with the options of the podman
+//network. The addresses allocated by podman are kept.
+
+//netavarkNetwork is the part of a podman network used by the plugin
+type netavarkNetwork struct {
+	Name     string            `json:"name"`
+	ID       string            `json:"id"`
+	Driver   string            `json:"driver"`
+	Internal bool              `json:"internal"`
+	Options  map[string]string `json:"options"`
+	Subnets  []struct {
+		Subnet  string `json:"subnet"`
+		Gateway string `json:"gateway"`
+	} `json:"subnets"`
+}
+
+//netavarkExec is the input of the setup and teardown commands
+type netavarkExec struct {
+	ContainerID    string          `json:"container_id"`
+	Network        netavarkNetwork `json:"network"`
+	NetworkOptions struct {
+		StaticIPs     []string `json:"static_ips"`
+		StaticMAC     string   `json:"static_mac"`
+		InterfaceName string   `json:"interface_name"`
+	} `json:"network_options"`
+}
+
+type netavarkSubnet struct {
+	IPNet   string `json:"ipnet"`
+	Gateway string `json:"gateway,omitempty"`
+}
+
+type netavarkInterface struct {
+	MACAddress string           `json:"mac_address"`
+	Subnets    []netavarkSubnet `json:"subnets"`
+}
+
+//netavarkStatus is the result of the setup command
+type netavarkStatus struct {
+	DNSSearchDomains []string                     `json:"dns_search_domains"`
+	DNSServerIPs     []string                     `json:"dns_server_ips"`
+	Interfaces       map[string]netavarkInterface `json:"interfaces"`
+}
+
+func netavarkFail(format string, args ...interface{}) {
+	json.NewEncoder(os.Stdout).Encode(map[string]string{"error": fmt.Sprintf(format, args...)})
+	os.Exit(1)
+}
+
+//netConf returns the configuration of the CNI network backing a podman
+//network
+func (n *netavarkNetwork) netConf() *netConf {
+	conf := &netConf{Name: n.Name, URL: defaultPluginURL, Options: make(map[string]string)}
+	for k, v := range n.Options {
+		if k == "url" {
+			conf.URL = v
+			continue
+		}
+		conf.Options[k] = v
+	}
+	if len(n.Subnets) > 0 {
+		conf.Subnet = n.Subnets[0].Subnet
+	}
+	//Internal networks have no route out
+	if n.Internal {
+		conf.Routes = []string{}
+	}
+	return conf
+}
+
+func (e *netavarkExec) request() *cniRequest {
+	conf := e.Network.netConf()
+	req := &cniRequest{
+		ContainerID: e.ContainerID,
+		IfName:      e.NetworkOptions.InterfaceName,
+		Network:     conf.Name,
+		Subnet:      conf.Subnet,
+		MAC:         e.NetworkOptions.StaticMAC,
+		Options:     conf.options(),
+	}
+	if len(e.Network.Subnets) > 0 {
+		req.Gateway = e.Network.Subnets[0].Gateway
+	}
+	for _, ip := range e.NetworkOptions.StaticIPs {
+		if v := net.ParseIP(ip); v != nil && v.To4() != nil {
+			req.Address = ip
+			break
+		}
+	}
+	return req
+}
+
+func readNetavarkInput(v interface{}) {
+	stdin, err := ioutil.ReadAll(os.Stdin)
+	if err == nil {
+		err = json.Unmarshal(stdin, v)
+	}
+	if err != nil {
+		netavarkFail("invalid input: %v", err)
+	}
+}
+
+func netavarkMain(args []string) {
+	switch args[0] {
+	case "info":
+		json.NewEncoder(os.Stdout).Encode(map[string]string{
+			"version":     "1.0.0",
+			"api_version": "1.0.0",
+		})
+
+	case "create":
+		//The network is created by its first container
+		network := netavarkNetwork{}
+		stdin, err := ioutil.ReadAll(os.Stdin)
+		if err == nil {
+			err = json.Unmarshal(stdin, &network)
+		}
+		if err != nil {
+			netavarkFail("invalid network: %v", err)
+		}
+		if len(network.Subnets) > 1 {
+			netavarkFail("a single IPv4 subnet is supported")
+		}
+		os.Stdout.Write(stdin)
+
+	case "setup", "teardown":
+		if len(args) != 2 {
+			netavarkFail("usage: %s <netns>", args[0])
+		}
+		netns := args[1]
+		e := netavarkExec{}
+		readNetavarkInput(&e)
+		conf := e.Network.netConf()
+		req := e.request()
+		if req.IfName == "" {
+			req.IfName = "eth0"
+		}
+
+		if args[0] == "teardown" {
+			if _, err := call(conf, "del", req); err != nil {
+				netavarkFail("unable to delete the endpoint: %v", err)
+			}
+			return
+		}
+
+		res, err := call(conf, "add", req)
+		if err != nil {
+			netavarkFail("unable to create the endpoint: %v", err)
+		}
+		if err := configure(res, netns, req.IfName, conf.routes()); err != nil {
+			if _, err := call(conf, "del", req); err != nil {
+				fmt.Fprintf(os.Stderr, "ipdk-cni: unable to delete the endpoint: %v\n", err)
+			}
+			netavarkFail("unable to configure %v: %v", req.IfName, err)
+		}
+
+		mac := res.MAC
+		if mac == "" {
+			mac = linkMAC(netns, req.IfName)
+		}
+		json.NewEncoder(os.Stdout).Encode(netavarkStatus{
+			DNSSearchDomains: []string{},
+			DNSServerIPs:     []string{},
+			Interfaces: map[string]netavarkInterface{
+				req.IfName: {
+					MACAddress: mac,
+					Subnets:    []netavarkSubnet{{IPNet: res.Address, Gateway: res.Gateway}},
+				},
+			},
+		})
+
+	default:
+		netavarkFail("unknown command %q", args[0])
+	}
+}
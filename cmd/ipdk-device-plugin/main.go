@@ -0,0 +1,304 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+//ipdk-device-plugin is a Kubernetes device plugin advertising the
+//vhost-user interfaces of the ipdk docker network plugin as
+//intel.com/ipdk-vhost devices, for Kata based pods
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+var (
+	pluginURL    = flag.String("url", "http://127.0.0.1:9075", "address of the ipdk network plugin")
+	token        = flag.String("token", "", "operator token of the admin API of the ipdk network plugin (default $IPDK_TOKEN)")
+	resourceName = flag.String("resource", "intel.com/ipdk-vhost", "name of the resource advertised to the kubelet")
+	deviceCount  = flag.Int("devices", 32, "number of vhost-user devices advertised")
+	socketName   = flag.String("socket", "ipdk-vhost.sock", "name of the device plugin socket in "+pluginapi.DevicePluginPath)
+)
+
+//The command logs through log/slog like the network plugin, -log-level
+//and -log-format selecting the level and format and SIGUSR1 toggling
+//between the debug level and the level it was started with
+var (
+	logLevelName = flag.String("log-level", "info", "log level: debug, info, warn or error")
+	logFormat    = flag.String("log-format", "text", "log format: text or json")
+)
+
+//initLogging installs the default logger selected by the flags
+func initLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(*logLevelName))); err != nil {
+		return fmt.Errorf("invalid log level %q, expected debug, info, warn or error", *logLevelName)
+	}
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(level)
+
+	options := &slog.HandlerOptions{Level: logLevel}
+	switch *logFormat {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, options)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, options)))
+	default:
+		return fmt.Errorf("invalid log format %q, expected text or json", *logFormat)
+	}
+
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGUSR1)
+		for range c {
+			next := slog.LevelDebug
+			if logLevel.Level() == slog.LevelDebug {
+				next = level
+			}
+			logLevel.Set(next)
+			slog.Warn("Log level changed", "level", next.String())
+		}
+	}()
+	return nil
+}
+
+//fatal logs an error and exits
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+//Health of the devices is checked this often, they are unhealthy while
+//the network plugin is unreachable
+const healthInterval = 10 * time.Second
+
+//vhostDevice mirrors the /v1/vhost-devices API of the network plugin
+type vhostDevice struct {
+	ID        string
+	SocketDir string
+	Endpoint  string
+}
+
+type devicePlugin struct {
+	devices []string
+	stop    chan struct{}
+}
+
+func deviceID(i int) string {
+	return fmt.Sprintf("vhost-%d", i)
+}
+
+//pluginToken returns the token of -token or $IPDK_TOKEN
+func pluginToken() string {
+	if *token != "" {
+		return *token
+	}
+	return os.Getenv("IPDK_TOKEN")
+}
+
+//call sends a request to the network plugin
+func call(method string, path string) (*vhostDevice, error) {
+	req, err := http.NewRequest(method, *pluginURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if t := pluginToken(); t != "" {
+		req.Header.Set("Authorization", "Bearer "+t)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s: %s", resp.Status, string(body))
+	}
+	d := &vhostDevice{}
+	if err := json.Unmarshal(body, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+//health returns the health of the devices, those of a network plugin
+//that can't be reached being unhealthy
+func (p *devicePlugin) health() []*pluginapi.Device {
+	health := pluginapi.Healthy
+	if _, err := call("GET", "/v1/vhost-devices/"+p.devices[0]); err != nil {
+		slog.Warn("Network plugin unreachable, devices are unhealthy", "err", err)
+		health = pluginapi.Unhealthy
+	}
+
+	devices := make([]*pluginapi.Device, len(p.devices))
+	for i, id := range p.devices {
+		devices[i] = &pluginapi.Device{ID: id, Health: health}
+	}
+	return devices
+}
+
+func (p *devicePlugin) GetDevicePluginOptions(context.Context, *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
+	return &pluginapi.DevicePluginOptions{}, nil
+}
+
+//ListAndWatch sends the devices again whenever their health changes
+func (p *devicePlugin) ListAndWatch(_ *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
+	devices := p.health()
+	if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: devices}); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return nil
+		case <-s.Context().Done():
+			return nil
+		case <-ticker.C:
+			current := p.health()
+			if current[0].Health == devices[0].Health {
+				continue
+			}
+			devices = current
+			if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: devices}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (p *devicePlugin) GetPreferredAllocation(context.Context, *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	return &pluginapi.PreferredAllocationResponse{}, nil
+}
+
+//Allocate reserves the socket directories of the devices with the
+//network plugin and mounts them into the containers
+func (p *devicePlugin) Allocate(_ context.Context, req *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	resp := &pluginapi.AllocateResponse{}
+	for _, r := range req.ContainerRequests {
+		cresp := &pluginapi.ContainerAllocateResponse{Envs: make(map[string]string)}
+		for i, id := range r.DevicesIDs {
+			d, err := call("POST", "/v1/vhost-devices/"+id)
+			if err != nil {
+				return nil, fmt.Errorf("unable to allocate device %v: %v", id, err)
+			}
+			cresp.Mounts = append(cresp.Mounts, &pluginapi.Mount{ContainerPath: d.SocketDir, HostPath: d.SocketDir})
+			cresp.Envs[fmt.Sprintf("IPDK_VHOST_SOCKET_DIR_%d", i)] = d.SocketDir
+			slog.Info("Allocated device", "device", id, "dir", d.SocketDir)
+		}
+		resp.ContainerResponses = append(resp.ContainerResponses, cresp)
+	}
+	return resp, nil
+}
+
+func (p *devicePlugin) PreStartContainer(context.Context, *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	return &pluginapi.PreStartContainerResponse{}, nil
+}
+
+//register announces the device plugin to the kubelet
+func register(socket string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, "unix://"+pluginapi.KubeletSocket, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = pluginapi.NewRegistrationClient(conn).Register(ctx, &pluginapi.RegisterRequest{
+		Version:      pluginapi.Version,
+		Endpoint:     filepath.Base(socket),
+		ResourceName: *resourceName,
+		Options:      &pluginapi.DevicePluginOptions{},
+	})
+	return err
+}
+
+//serve runs the device plugin until the kubelet restarts, which removes
+//the sockets of the device plugins
+func serve(devices []string) error {
+	socket := filepath.Join(pluginapi.DevicePluginPath, *socketName)
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+
+	p := &devicePlugin{devices: devices, stop: make(chan struct{})}
+	server := grpc.NewServer()
+	pluginapi.RegisterDevicePluginServer(server, p)
+	go server.Serve(l)
+	defer server.Stop()
+	defer close(p.stop)
+
+	if err := register(socket); err != nil {
+		return fmt.Errorf("unable to register with the kubelet: %v", err)
+	}
+	slog.Info("Registered devices", "devices", len(devices), "resource", *resourceName)
+
+	for {
+		time.Sleep(time.Second)
+		if _, err := os.Stat(socket); err != nil {
+			slog.Info("Kubelet restarted, registering again")
+			return nil
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+	if err := initLogging(); err != nil {
+		fatal("invalid logging configuration", "err", err)
+	}
+
+	if *deviceCount < 1 || *deviceCount > 9999 {
+		fatal("Between 1 and 9999 devices are supported", "devices", *deviceCount)
+	}
+	var devices []string
+	for i := 0; i < *deviceCount; i++ {
+		devices = append(devices, deviceID(i))
+	}
+
+	for {
+		if err := serve(devices); err != nil {
+			slog.Error("Device plugin failed", "err", err)
+			time.Sleep(5 * time.Second)
+		}
+	}
+}
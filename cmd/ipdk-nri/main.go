@@ -0,0 +1,377 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+//ipdk-nri is a containerd NRI plugin attaching the pods of a node to ipdk
+//networks, for hosts running containerd without docker. Pods select their
+//networks through annotations:
+//
+//  annotations:
+//    ipdk.io/networks: "fast,storage@st0"
+//    com.ipdk.queues: "4"
+//
+//Every network, name[@interface], gets an endpoint created through the
+//CNI API of the ipdk docker network plugin when the sandbox of the pod is
+//created, the interfaces being named ipdk0, ipdk1... unless given a
+//name. Annotations of the com.ipdk. domain are the driver options of the
+//networks and endpoints. The endpoints are vhost-user ports unless
+//com.ipdk.port_type says otherwise, and are deleted when the sandbox is
+//stopped. The attachments are secondary, ipdk.io/routes lists the
+//prefixes routed through their gateway.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/containerd/nri/pkg/stub"
+)
+
+var (
+	pluginURL  = flag.String("url", "http://127.0.0.1:9075", "address of the ipdk network plugin")
+	token      = flag.String("token", "", "operator token of the admin API of the ipdk network plugin (default $IPDK_TOKEN)")
+	pluginName = flag.String("name", "ipdk", "name of the NRI plugin")
+	pluginIdx  = flag.String("idx", "50", "index of the NRI plugin, ordering it among the plugins of containerd")
+)
+
+//The command logs through log/slog like the network plugin, -log-level
+//and -log-format selecting the level and format and SIGUSR1 toggling
+//between the debug level and the level it was started with
+var (
+	logLevelName = flag.String("log-level", "info", "log level: debug, info, warn or error")
+	logFormat    = flag.String("log-format", "text", "log format: text or json")
+)
+
+//initLogging installs the default logger selected by the flags
+func initLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(*logLevelName))); err != nil {
+		return fmt.Errorf("invalid log level %q, expected debug, info, warn or error", *logLevelName)
+	}
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(level)
+
+	options := &slog.HandlerOptions{Level: logLevel}
+	switch *logFormat {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, options)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, options)))
+	default:
+		return fmt.Errorf("invalid log format %q, expected text or json", *logFormat)
+	}
+
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGUSR1)
+		for range c {
+			next := slog.LevelDebug
+			if logLevel.Level() == slog.LevelDebug {
+				next = level
+			}
+			logLevel.Set(next)
+			slog.Warn("Log level changed", "level", next.String())
+		}
+	}()
+	return nil
+}
+
+//fatal logs an error and exits
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+const (
+	annotationNetworks = "ipdk.io/networks"
+	annotationRoutes   = "ipdk.io/routes"
+	optionPrefix       = "com.ipdk."
+)
+
+//cniRequest and cniResult mirror the /v1/cni API of the plugin
+type cniRequest struct {
+	ContainerID string
+	IfName      string
+	Network     string
+	Options     map[string]string
+}
+
+type cniResult struct {
+	Link       string
+	Address    string
+	Gateway    string
+	MAC        string
+	MTU        int
+	SocketPath string
+	PCI        string
+}
+
+//attachment is a network a pod is attached to
+type attachment struct {
+	Network string
+	IfName  string
+}
+
+//podAttachments parses the networks of a pod
+func podAttachments(pod *api.PodSandbox) ([]attachment, error) {
+	var attachments []attachment
+	for i, item := range strings.Split(pod.Annotations[annotationNetworks], ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		a := attachment{Network: item, IfName: fmt.Sprintf("ipdk%d", i)}
+		if n := strings.Index(item, "@"); n >= 0 {
+			a.Network, a.IfName = item[:n], item[n+1:]
+		}
+		if a.Network == "" || a.IfName == "" || len(a.IfName) > 15 {
+			return nil, fmt.Errorf("invalid network %q in %s", item, annotationNetworks)
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, nil
+}
+
+//podOptions returns the driver options of the endpoints of a pod
+func podOptions(pod *api.PodSandbox) map[string]string {
+	options := map[string]string{"com.ipdk.port_type": "vhost"}
+	for k, v := range pod.Annotations {
+		if strings.HasPrefix(k, optionPrefix) {
+			options[k] = v
+		}
+	}
+	return options
+}
+
+//podRoutes returns the prefixes routed through the gateway of the
+//networks of a pod
+func podRoutes(pod *api.PodSandbox) []string {
+	var routes []string
+	for _, dst := range strings.Split(pod.Annotations[annotationRoutes], ",") {
+		if dst = strings.TrimSpace(dst); dst != "" {
+			routes = append(routes, dst)
+		}
+	}
+	return routes
+}
+
+//podNetns returns the network namespace of a pod, "" for pods of the
+//host network
+func podNetns(pod *api.PodSandbox) string {
+	if pod.Linux == nil {
+		return ""
+	}
+	for _, ns := range pod.Linux.Namespaces {
+		if ns.Type == "network" {
+			return ns.Path
+		}
+	}
+	return ""
+}
+
+//pluginToken returns the token of -token or $IPDK_TOKEN
+func pluginToken() string {
+	if *token != "" {
+		return *token
+	}
+	return os.Getenv("IPDK_TOKEN")
+}
+
+//call sends a CNI operation to the plugin
+func call(op string, req *cniRequest) (*cniResult, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	r, err := http.NewRequest("POST", *pluginURL+"/v1/cni/"+op, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if t := pluginToken(); t != "" {
+		r.Header.Set("Authorization", "Bearer "+t)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		e := struct{ Err string }{}
+		json.Unmarshal(body, &e)
+		return nil, fmt.Errorf("%s: %s", resp.Status, e.Err)
+	}
+	res := &cniResult{}
+	if err := json.Unmarshal(body, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+//commandTimeout bounds the commands run for a container, which are
+//killed past it
+const commandTimeout = 30 * time.Second
+
+func run(name string, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+//netnsTarget returns how ip link set netns refers to a network namespace
+//path: the name of a named namespace, or the PID of a process
+func netnsTarget(netns string) (string, error) {
+	dir, name := filepath.Split(netns)
+	switch filepath.Clean(dir) {
+	case "/var/run/netns", "/run/netns":
+		return name, nil
+	}
+	var pid int
+	if _, err := fmt.Sscanf(netns, "/proc/%d/ns/net", &pid); err == nil {
+		return fmt.Sprint(pid), nil
+	}
+	return "", fmt.Errorf("unsupported network namespace %v", netns)
+}
+
+func inNetns(netns string, args ...string) error {
+	return run("nsenter", append([]string{"--net=" + netns, "ip"}, args...)...)
+}
+
+//configure moves the link of an endpoint into the pod, as ipdk-cni does
+func configure(res *cniResult, netns string, ifName string, routes []string) error {
+	target, err := netnsTarget(netns)
+	if err != nil {
+		return err
+	}
+	if err := run("ip", "link", "set", "dev", res.Link, "netns", target); err != nil {
+		return err
+	}
+	cmds := [][]string{{"link", "set", "dev", res.Link, "name", ifName}}
+	if res.MAC != "" {
+		cmds = append(cmds, []string{"link", "set", "dev", ifName, "address", res.MAC})
+	}
+	if res.MTU != 0 {
+		cmds = append(cmds, []string{"link", "set", "dev", ifName, "mtu", fmt.Sprint(res.MTU)})
+	}
+	cmds = append(cmds,
+		[]string{"addr", "add", res.Address, "dev", ifName},
+		[]string{"link", "set", "dev", ifName, "up"})
+	for _, dst := range routes {
+		cmds = append(cmds, []string{"route", "add", dst, "via", res.Gateway, "dev", ifName})
+	}
+	for _, args := range cmds {
+		if err := inNetns(netns, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type plugin struct{}
+
+//RunPodSandbox attaches a new pod to its networks, detaching it from
+//those it was attached to if one of them fails
+func (p *plugin) RunPodSandbox(ctx context.Context, pod *api.PodSandbox) error {
+	attachments, err := podAttachments(pod)
+	if err != nil || len(attachments) == 0 {
+		return err
+	}
+	netns := podNetns(pod)
+	if netns == "" {
+		return fmt.Errorf("pod %s/%s has no network namespace of its own", pod.Namespace, pod.Name)
+	}
+	options := podOptions(pod)
+	routes := podRoutes(pod)
+
+	for i, a := range attachments {
+		req := &cniRequest{ContainerID: pod.Id, IfName: a.IfName, Network: a.Network, Options: options}
+		res, err := call("add", req)
+		if err == nil {
+			if err = configure(res, netns, a.IfName, routes); err != nil {
+				detach(pod, a)
+			}
+		}
+		if err != nil {
+			for _, a := range attachments[:i] {
+				detach(pod, a)
+			}
+			return fmt.Errorf("unable to attach pod %s/%s to %v: %v", pod.Namespace, pod.Name, a.Network, err)
+		}
+		slog.Info("Attached pod", "namespace", pod.Namespace, "pod", pod.Name, "network", a.Network, "interface", a.IfName, "address", res.Address, "socket", res.SocketPath)
+	}
+	return nil
+}
+
+func detach(pod *api.PodSandbox, a attachment) {
+	if _, err := call("del", &cniRequest{ContainerID: pod.Id, IfName: a.IfName, Network: a.Network}); err != nil {
+		slog.Error("Unable to detach pod", "namespace", pod.Namespace, "pod", pod.Name, "network", a.Network, "err", err)
+	}
+}
+
+//StopPodSandbox deletes the endpoints of a pod. Deletes are idempotent,
+//the pod is detached again when removed in case the plugin was not
+//running when it stopped.
+func (p *plugin) StopPodSandbox(ctx context.Context, pod *api.PodSandbox) error {
+	attachments, err := podAttachments(pod)
+	if err != nil {
+		return err
+	}
+	for _, a := range attachments {
+		detach(pod, a)
+	}
+	return nil
+}
+
+func (p *plugin) RemovePodSandbox(ctx context.Context, pod *api.PodSandbox) error {
+	return p.StopPodSandbox(ctx, pod)
+}
+
+func main() {
+	flag.Parse()
+	if err := initLogging(); err != nil {
+		fatal("invalid logging configuration", "err", err)
+	}
+
+	s, err := stub.New(&plugin{}, stub.WithPluginName(*pluginName), stub.WithPluginIdx(*pluginIdx))
+	if err != nil {
+		fatal("Unable to create the NRI plugin", "err", err)
+	}
+	if err := s.Run(context.Background()); err != nil {
+		fatal("NRI plugin failed", "err", err)
+	}
+}
@@ -0,0 +1,494 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+//ipdknetctl talks to the admin API of the ipdk docker network plugin
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var pluginURL = flag.String("url", "http://127.0.0.1:9075", "address of the plugin, or unix://<path> for its unix socket")
+
+//useUnixSocket sends the requests to the unix socket of a unix:// URL
+func useUnixSocket() {
+	if !strings.HasPrefix(*pluginURL, "unix://") {
+		return
+	}
+	path := strings.TrimPrefix(*pluginURL, "unix://")
+	http.DefaultTransport = &http.Transport{
+		DialContext: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}
+	*pluginURL = "http://ipdk"
+}
+
+var token = flag.String("token", "", "token sent to the admin API, scoping it to a tenant (default $IPDK_TOKEN)")
+
+//tokenTransport sends the token with every request
+type tokenTransport struct {
+	base http.RoundTripper
+}
+
+func (t tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+*token)
+	return t.base.RoundTrip(req)
+}
+
+var (
+	tlsCA   = flag.String("tls-ca", "", "CA bundle verifying the certificate of the plugin, for https URLs")
+	tlsCert = flag.String("tls-cert", "", "client certificate presented to the plugin")
+	tlsKey  = flag.String("tls-key", "", "key of the client certificate")
+)
+
+//useTLS configures the CA and the client certificate of https URLs
+func useTLS() {
+	if *tlsCA == "" && *tlsCert == "" {
+		return
+	}
+	config := &tls.Config{}
+	if *tlsCA != "" {
+		pem, err := ioutil.ReadFile(*tlsCA)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			fatalf("no certificate found in %v", *tlsCA)
+		}
+	}
+	if *tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	http.DefaultTransport.(*http.Transport).TLSClientConfig = config
+}
+
+//useToken sends -token or $IPDK_TOKEN with the requests, if set
+func useToken() {
+	if *token == "" {
+		*token = os.Getenv("IPDK_TOKEN")
+	}
+	if *token != "" {
+		http.DefaultTransport = tokenTransport{base: http.DefaultTransport}
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: ipdknetctl [options] <command> [args]
+
+Commands:
+  networks [id]          list the networks, or show one
+  endpoints [id]         list the endpoints, or show one
+  drift                  list what is missing from the dataplane
+  delete-endpoint <id>   force the deletion of a stuck endpoint
+  gc                     remove orphaned dataplane artifacts
+  reconcile              repair drift between the plugin and the dataplane
+  events                 show the driver requests as they are handled
+  backup <file>          save a consistent snapshot of the plugin db
+  restore <file>         replace the plugin db with a backup
+  db-stats               show the size and usage of the plugin db
+  compact                rewrite the plugin db without its free pages
+  dry-run [clear]        show, or forget, the operations skipped by -dry-run
+
+Options:
+`)
+	flag.PrintDefaults()
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "ipdknetctl: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+//checkResponse turns an admin API error response into an error
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	return fmt.Errorf("%s: %s", resp.Status, string(body))
+}
+
+func backup(path string) error {
+	resp, err := http.Get(*pluginURL + "/v1/db/backup")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func restore(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	resp, err := http.Post(*pluginURL+"/v1/db/restore", "application/octet-stream", f)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(os.Stdout, resp.Body)
+	fmt.Println()
+	return err
+}
+
+//call sends a request without a body and prints the response
+func call(method string, path string) error {
+	req, err := http.NewRequest(method, *pluginURL+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
+
+//getJSON decodes the response to a GET request
+func getJSON(path string, v interface{}) error {
+	resp, err := http.Get(*pluginURL + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+//networkState and endpointState are the parts of the network and
+//endpoint states of the admin API that are shown
+type networkState struct {
+	ID      string
+	Network struct {
+		Bridge string
+		Subnet struct {
+			IP   net.IP
+			Mask net.IPMask
+		}
+		Fallback bool
+	}
+	Endpoints []string
+	Status    *struct {
+		BridgePresent bool
+		Error         string
+	}
+}
+
+type endpointState struct {
+	ID       string
+	Endpoint struct {
+		IP            string
+		NetworkID     string
+		PortType      string
+		IpdkInterface int
+	}
+	Status *struct {
+		PortPresent  bool
+		EntryPresent bool
+		Error        string
+	}
+}
+
+//shortID shortens IDs the way docker does
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+func present(ok bool) string {
+	if ok {
+		return "yes"
+	}
+	return "MISSING"
+}
+
+func (n networkState) bridgeStatus() string {
+	if n.Status == nil {
+		return "-"
+	}
+	if n.Status.Error != "" {
+		return n.Status.Error
+	}
+	return present(n.Status.BridgePresent)
+}
+
+func (e endpointState) portStatus() (string, string) {
+	if e.Status == nil {
+		return "-", "-"
+	}
+	if e.Status.Error != "" {
+		return present(e.Status.PortPresent), e.Status.Error
+	}
+	return present(e.Status.PortPresent), present(e.Status.EntryPresent)
+}
+
+func (e endpointState) portType() string {
+	if e.Endpoint.PortType == "" {
+		return "vhost"
+	}
+	return e.Endpoint.PortType
+}
+
+func printNetworks(networks []networkState) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NETWORK\tBRIDGE\tSUBNET\tENDPOINTS\tBRIDGE PRESENT")
+	for _, n := range networks {
+		subnet := net.IPNet{IP: n.Network.Subnet.IP, Mask: n.Network.Subnet.Mask}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", shortID(n.ID), n.Network.Bridge, subnet.String(), len(n.Endpoints), n.bridgeStatus())
+	}
+	tw.Flush()
+}
+
+func printEndpoints(endpoints []endpointState) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ENDPOINT\tNETWORK\tADDRESS\tPORT\tINTERFACE\tPORT PRESENT\tENTRY PRESENT")
+	for _, e := range endpoints {
+		port, entry := e.portStatus()
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", shortID(e.ID), shortID(e.Endpoint.NetworkID),
+			e.Endpoint.IP, e.portType(), e.Endpoint.IpdkInterface, port, entry)
+	}
+	tw.Flush()
+}
+
+func listNetworks() error {
+	var networks []networkState
+	if err := getJSON("/v1/networks", &networks); err != nil {
+		return err
+	}
+	printNetworks(networks)
+	return nil
+}
+
+func listEndpoints() error {
+	var endpoints []endpointState
+	if err := getJSON("/v1/endpoints", &endpoints); err != nil {
+		return err
+	}
+	printEndpoints(endpoints)
+	return nil
+}
+
+//drift lists the networks and endpoints the dataplane is missing parts of
+func drift() error {
+	var networks []networkState
+	if err := getJSON("/v1/networks", &networks); err != nil {
+		return err
+	}
+	var endpoints []endpointState
+	if err := getJSON("/v1/endpoints", &endpoints); err != nil {
+		return err
+	}
+
+	var brokenNetworks []networkState
+	for _, n := range networks {
+		if n.Status != nil && (!n.Status.BridgePresent || n.Status.Error != "") {
+			brokenNetworks = append(brokenNetworks, n)
+		}
+	}
+	var brokenEndpoints []endpointState
+	for _, e := range endpoints {
+		if e.Status != nil && (!e.Status.PortPresent || !e.Status.EntryPresent || e.Status.Error != "") {
+			brokenEndpoints = append(brokenEndpoints, e)
+		}
+	}
+
+	if len(brokenNetworks) == 0 && len(brokenEndpoints) == 0 {
+		fmt.Println("No drift")
+		return nil
+	}
+	if len(brokenNetworks) > 0 {
+		printNetworks(brokenNetworks)
+	}
+	if len(brokenEndpoints) > 0 {
+		if len(brokenNetworks) > 0 {
+			fmt.Println()
+		}
+		printEndpoints(brokenEndpoints)
+	}
+	fmt.Println("\nRun ipdknetctl reconcile to repair the dataplane")
+	return nil
+}
+
+//operation is a driver request of the event stream
+type operation struct {
+	Name       string
+	NetworkID  string
+	EndpointID string
+	Start      time.Time
+	Duration   string
+	Err        string
+}
+
+//events prints the driver requests handled by the plugin, the recent
+//ones first, then the new ones as they come
+func events() error {
+	resp, err := http.Get(*pluginURL + "/v1/events")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		op := operation{}
+		if err := dec.Decode(&op); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		line := fmt.Sprintf("%s %-44s %8s", op.Start.Format("15:04:05.000"), op.Name, op.Duration)
+		if op.NetworkID != "" {
+			line += " network=" + shortID(op.NetworkID)
+		}
+		if op.EndpointID != "" {
+			line += " endpoint=" + shortID(op.EndpointID)
+		}
+		if op.Err != "" {
+			line += " err=" + strconv.Quote(op.Err)
+		}
+		fmt.Println(line)
+	}
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	useUnixSocket()
+	useTLS()
+	useToken()
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch cmd := flag.Arg(0); cmd {
+	case "backup", "restore":
+		if flag.NArg() != 2 {
+			usage()
+			os.Exit(2)
+		}
+		if cmd == "backup" {
+			err = backup(flag.Arg(1))
+		} else {
+			err = restore(flag.Arg(1))
+		}
+	case "networks", "endpoints":
+		switch {
+		case flag.NArg() == 2:
+			err = call("GET", "/v1/"+cmd+"/"+flag.Arg(1))
+		case flag.NArg() > 2:
+			usage()
+			os.Exit(2)
+		case cmd == "networks":
+			err = listNetworks()
+		default:
+			err = listEndpoints()
+		}
+	case "drift":
+		err = drift()
+	case "delete-endpoint":
+		if flag.NArg() != 2 {
+			usage()
+			os.Exit(2)
+		}
+		err = call("DELETE", "/v1/endpoints/"+flag.Arg(1))
+	case "gc":
+		err = call("POST", "/v1/gc")
+	case "reconcile":
+		err = call("POST", "/v1/reconcile")
+	case "events":
+		err = events()
+	case "db-stats":
+		err = call("GET", "/v1/db/stats")
+	case "compact":
+		err = call("POST", "/v1/db/compact")
+	case "dry-run":
+		switch {
+		case flag.NArg() == 1:
+			err = call("GET", "/v1/dry-run")
+		case flag.NArg() == 2 && flag.Arg(1) == "clear":
+			err = call("DELETE", "/v1/dry-run")
+		default:
+			usage()
+			os.Exit(2)
+		}
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fatalf("%v", err)
+	}
+}
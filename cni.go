@@ -0,0 +1,270 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+)
+
+//Kubernetes clusters using containerd reach the plugin through the
+//ipdk-cni plugin, cmd/ipdk-cni, which forwards the CNI operations of its
+//pods to /v1/cni. Endpoints are provisioned by the driver handlers, as if
+//docker had asked for them, and share the state store of the docker
+//networks. The first pod of a CNI network creates it, as cni-<name>, with
+//a pool of the "cni" address space of the IPAM driver; the network is
+//left in place when its last pod goes away. CNI endpoints are given a TAP
+//port unless their options say otherwise, pods being runc containers.
+const cniAddressSpace = "cni"
+
+//cniRequest is an operation of the ipdk-cni plugin
+type cniRequest struct {
+	ContainerID string
+	IfName      string
+	Network     string            //Name of the CNI network
+	Subnet      string            //Subnet of the network, carved out of the default pools if ""
+	Gateway     string            //Gateway of the network, the first address of the subnet if ""
+	Address     string            //Address of the endpoint, allocated from the subnet if ""
+	MAC         string            //MAC address of the endpoint, generated if ""
+	Options     map[string]string //Driver options of the network and of its endpoints
+}
+
+//cniResult describes the link of a pod endpoint, to be moved into the
+//pod and configured there
+type cniResult struct {
+	Link    string
+	Address string //In CIDR notation
+	Gateway string
+	MAC     string `json:",omitempty"`
+	MTU     int    `json:",omitempty"`
+
+	//Vhost-user socket, or PCI address of the VF, of the endpoint
+	SocketPath string `json:",omitempty"`
+	PCI        string `json:",omitempty"`
+}
+
+//CNI operations are serialized so the first pods of a network don't race
+//to create it
+var cniLock sync.Mutex
+
+func cniNetworkID(name string) string {
+	return "cni-" + name
+}
+
+func cniEndpointID(req *cniRequest) string {
+	return "cni-" + req.ContainerID + "-" + req.IfName
+}
+
+func cniPoolID(subnet string) string {
+	return poolID(&ipamPool{AddressSpace: cniAddressSpace, Pool: subnet})
+}
+
+//decodeCNIRequest decodes the body of a CNI operation
+func decodeCNIRequest(r *http.Request) (*cniRequest, error) {
+	body, err := getBody(r)
+	if err != nil {
+		return nil, err
+	}
+	req := &cniRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, err
+	}
+	if req.ContainerID == "" || req.IfName == "" || req.Network == "" {
+		return nil, fmt.Errorf("container ID, interface name and network are required")
+	}
+	return req, nil
+}
+
+//cniEndpoint returns the result of the endpoint of a CNI operation, nil
+//if it does not exist
+func cniEndpoint(req *cniRequest) *cniResult {
+	nwMap.Lock()
+	defer nwMap.Unlock()
+
+	epMap.Lock()
+	defer epMap.Unlock()
+
+	ep, ok := epMap.m[cniEndpointID(req)]
+	if !ok {
+		return nil
+	}
+	res := &cniResult{Link: endpointLink(ep), Address: ep.IP, MAC: ep.MAC, MTU: ep.MTU, PCI: ep.VF}
+	if ep.PortType == "" {
+		res.SocketPath = endpointSocketDir(ep) + "/vhu.sock"
+	}
+	if nw, ok := nwMap.m[ep.NetworkID]; ok {
+		res.Gateway = nw.Gateway.IP.String()
+	}
+	return res
+}
+
+//cniNetwork returns the subnet of the network of a CNI operation,
+//creating the network if it does not exist yet
+func cniNetwork(req *cniRequest) (string, error) {
+	id := cniNetworkID(req.Network)
+
+	nwMap.Lock()
+	nw, ok := nwMap.m[id]
+	subnet := ""
+	if ok {
+		subnet = nw.Subnet.String()
+	}
+	nwMap.Unlock()
+	if ok {
+		return subnet, nil
+	}
+
+	pool, subnet, err := requestPool(cniAddressSpace, req.Subnet, "", false)
+	if err != nil {
+		return "", err
+	}
+	gateway, err := requestAddress(pool, req.Gateway)
+	if err != nil {
+		releasePool(pool)
+		return "", err
+	}
+
+	options := make(map[string]interface{})
+	for k, v := range req.Options {
+		options[k] = v
+	}
+	err = driverRequest(handlerCreateNetwork, map[string]interface{}{
+		"NetworkID": id,
+		"Options":   map[string]interface{}{"com.docker.network.generic": options},
+		"IPv4Data": []map[string]string{{
+			"AddressSpace": cniAddressSpace,
+			"Pool":         subnet,
+			"Gateway":      gateway,
+		}},
+	})
+	if err != nil {
+		if err := releasePool(pool); err != nil {
+			slog.Error("Unable to release pool", "pool", pool, "err", err)
+		}
+		return "", err
+	}
+	slog.Info("Created CNI network", "network", id, "subnet", subnet)
+	return subnet, nil
+}
+
+func adminCNIAdd(w http.ResponseWriter, r *http.Request) {
+	req, err := decodeCNIRequest(r)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	cniLock.Lock()
+	defer cniLock.Unlock()
+
+	if res := cniEndpoint(req); res != nil {
+		adminError(w, http.StatusConflict, "%v already has an endpoint %v on %v", req.ContainerID, req.IfName, req.Network)
+		return
+	}
+
+	subnet, err := cniNetwork(req)
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, "unable to create network %v: %v", req.Network, err)
+		return
+	}
+	pool := cniPoolID(subnet)
+	address, err := requestAddress(pool, req.Address)
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, "unable to allocate an address on %v: %v", req.Network, err)
+		return
+	}
+
+	//Pods of a vhost device get a vhost-user port
+	options := map[string]interface{}{optPortType: portTypeTAP}
+	if req.Options[optVhostDevice] != "" {
+		options[optPortType] = portTypeVhost
+	}
+	for k, v := range req.Options {
+		options[k] = v
+	}
+	err = driverRequest(handlerCreateEndpoint, map[string]interface{}{
+		"NetworkID":  cniNetworkID(req.Network),
+		"EndpointID": cniEndpointID(req),
+		"Interface":  map[string]string{"Address": address, "MacAddress": req.MAC},
+		"Options":    options,
+	})
+	if err != nil {
+		ip, _, _ := net.ParseCIDR(address)
+		if err := releaseAddress(pool, ip.String()); err != nil {
+			slog.Error("Unable to release address", "address", address, "err", err)
+		}
+		adminError(w, http.StatusInternalServerError, "unable to create endpoint of %v: %v", req.ContainerID, err)
+		return
+	}
+
+	sendResponse(cniEndpoint(req), w)
+}
+
+func adminCNIDel(w http.ResponseWriter, r *http.Request) {
+	req, err := decodeCNIRequest(r)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	cniLock.Lock()
+	defer cniLock.Unlock()
+
+	//DEL must succeed for endpoints that are already gone
+	res := cniEndpoint(req)
+	if res == nil {
+		sendResponse(struct{}{}, w)
+		return
+	}
+
+	err = driverRequest(handlerDeleteEndpoint, map[string]string{
+		"NetworkID":  cniNetworkID(req.Network),
+		"EndpointID": cniEndpointID(req),
+	})
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, "unable to delete endpoint of %v: %v", req.ContainerID, err)
+		return
+	}
+
+	ip, subnet, err := net.ParseCIDR(res.Address)
+	if err == nil {
+		err = releaseAddress(cniPoolID(subnet.String()), ip.String())
+	}
+	if err != nil {
+		slog.Error("Unable to release address", "address", res.Address, "err", err)
+	}
+	sendResponse(struct{}{}, w)
+}
+
+func adminCNICheck(w http.ResponseWriter, r *http.Request) {
+	req, err := decodeCNIRequest(r)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	res := cniEndpoint(req)
+	if res == nil {
+		adminError(w, http.StatusNotFound, "endpoint of %v on %v not found", req.ContainerID, req.Network)
+		return
+	}
+	sendResponse(res, w)
+}
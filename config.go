@@ -0,0 +1,219 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+//Every setting of the plugin is a command line flag, and can also be set
+//with an environment variable, IPDK_ followed by the name of the flag in
+//upper case with - replaced by _, e.g. IPDK_EXEC_TIMEOUT, or in a YAML
+//configuration file under the name of the flag:
+//
+//  listen: 127.0.0.1:9075
+//  db-path: /var/lib/ipdk-docker-plugin/state.db
+//  ipdk-container: ipdk
+//  vhost-dir: /run/ipdk/vhost
+//  exec-timeout: 30s
+//  mtu-probe-targets: [192.168.1.1, 192.168.1.2]
+//  env:
+//    DOCKER_HOST: unix:///run/docker.sock
+//
+//A flag given on the command line wins over the environment, which wins
+//over the file. The env section sets the environment of the plugin and of
+//the commands it runs, unless the variables are set already. A missing
+//file is fine at the default path, not at one given with -config. The
+//resolved settings are logged at startup along with where they come from.
+var configFile = flag.String("config", defaultConfigFile, "YAML configuration file of the plugin settings")
+
+const defaultConfigFile = "/etc/ipdk-docker-plugin/config.yaml"
+
+//Where the plugin serves docker and the admin API, and the container
+//running infrap4d commands are run in
+var (
+	listenAddr    = flag.String("listen", "127.0.0.1:9075", "address serving docker and the admin API, or unix://<path> for a unix socket")
+	ipdkContainer = flag.String("ipdk-container", "ipdk", "name of the container running infrap4d and the IPDK tools")
+)
+
+//configEnv is the key of the environment variables in the file
+const configEnv = "env"
+
+//loadConfig reads a configuration file, returning the settings by flag
+//name and the environment variables, or nothing if the file is missing
+//and optional
+func loadConfig(path string, optional bool) (map[string]string, map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && optional {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, nil, fmt.Errorf("invalid configuration file %v: %v", path, err)
+	}
+
+	settings := make(map[string]string)
+	env := make(map[string]string)
+	for k, v := range raw {
+		if k == configEnv {
+			vars, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, nil, fmt.Errorf("invalid configuration file %v: %s must map variable names to values", path, configEnv)
+			}
+			for name, value := range vars {
+				env[name] = fmt.Sprint(value)
+			}
+			continue
+		}
+
+		if flag.Lookup(k) == nil || k == "config" {
+			return nil, nil, fmt.Errorf("invalid configuration file %v: unknown setting %q", path, k)
+		}
+		switch v := v.(type) {
+		case map[string]interface{}:
+			return nil, nil, fmt.Errorf("invalid configuration file %v: %s must be a value or a list", path, k)
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			settings[k] = strings.Join(items, ",")
+		case nil:
+			settings[k] = ""
+		default:
+			settings[k] = fmt.Sprint(v)
+		}
+	}
+	return settings, env, nil
+}
+
+//Sources of the settings, from the highest precedence
+const (
+	sourceFlag    = "flag"
+	sourceEnv     = "env"
+	sourceFile    = "file"
+	sourceDefault = "default"
+)
+
+//envAliases are the standard environment variables some settings also
+//follow, after their own
+var envAliases = map[string]string{
+	"otlp-endpoint": "OTEL_EXPORTER_OTLP_ENDPOINT",
+}
+
+//settingSources records where every setting comes from
+var settingSources = make(map[string]string)
+
+//settingEnv returns the environment variable of a setting
+func settingEnv(name string) string {
+	return "IPDK_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+//lookupSettingEnv returns the value of a setting in the environment
+func lookupSettingEnv(name string) (string, bool) {
+	if v, ok := os.LookupEnv(settingEnv(name)); ok {
+		return v, true
+	}
+	if alias, ok := envAliases[name]; ok {
+		return os.LookupEnv(alias)
+	}
+	return "", false
+}
+
+//applyConfig resolves the flags not given on the command line from the
+//environment, then from the configuration file, and sets the variables of
+//the env section that are not set
+func applyConfig() error {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		settingSources[f.Name] = sourceDefault
+		if given[f.Name] {
+			settingSources[f.Name] = sourceFlag
+		} else if v, ok := lookupSettingEnv(f.Name); ok && err == nil {
+			if err = flag.Set(f.Name, v); err != nil {
+				err = fmt.Errorf("invalid %s: %v", settingEnv(f.Name), err)
+			}
+			settingSources[f.Name] = sourceEnv
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	path := *configFile
+	settings, env, err := loadConfig(path, settingSources["config"] == sourceDefault)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if settingSources[name] != sourceDefault {
+			continue
+		}
+		if err := flag.Set(name, settings[name]); err != nil {
+			return fmt.Errorf("invalid configuration file %v: %s: %v", path, name, err)
+		}
+		settingSources[name] = sourceFile
+	}
+
+	for name, value := range env {
+		if _, ok := os.LookupEnv(name); !ok {
+			os.Setenv(name, value)
+		}
+	}
+	return nil
+}
+
+//secretSettings are the settings holding credentials, whose values are
+//not logged
+var secretSettings = map[string]bool{
+	"admin-tokens":  true,
+	"tenant-tokens": true,
+}
+
+//logConfig logs the resolved settings along with where they come from
+func logConfig() {
+	var attrs []interface{}
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if secretSettings[f.Name] && value != "" {
+			value = "<redacted>"
+		}
+		attrs = append(attrs, f.Name, fmt.Sprintf("%s (%s)", value, settingSources[f.Name]))
+	})
+	slog.Info("Configuration", attrs...)
+}
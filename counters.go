@@ -0,0 +1,117 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//EndpointOperInfo reports the port of an endpoint along with its packet
+//and byte counters, read from infrap4d:
+//
+//  docker exec ipdk gnmi-cli get "device:virtual-device,name:net_vhost1,counters"
+//
+//Counters are only available for the vhost-user and TAP ports of the
+//pipeline, the traffic of VFs and veth pairs doesn't go through it.
+const (
+	optSocketPath  = "com.ipdk.socket_path"
+	optInterfaceID = "com.ipdk.interface_id"
+	optMAC         = "com.ipdk.mac"
+	optCounters    = "com.ipdk.counters"
+	optVFAddress   = "com.ipdk.vf"
+)
+
+//portCounterNames are the counters reported, as named by infrap4d
+var portCounterNames = []string{
+	"in-octets", "in-unicast-pkts", "in-discards", "in-errors",
+	"out-octets", "out-unicast-pkts", "out-discards", "out-errors",
+}
+
+var counterValue = regexp.MustCompile(`[0-9]+`)
+
+//portDevice returns the infrap4d device of the port of an endpoint, ""
+//if it has none
+func portDevice(ep *epVal) string {
+	switch ep.PortType {
+	case "":
+		netname, _ := vhostNames(ep.IpdkInterface)
+		return netname
+	case portTypeTAP:
+		return tapName(ep.IpdkInterface)
+	}
+	return ""
+}
+
+//readPortCounters reads the counters of a device
+func readPortCounters(device string) (map[string]uint64, error) {
+	output, err := ipdkOutput("gnmi-cli", "get", fmt.Sprintf("device:virtual-device,name:%s,counters", device))
+	if err != nil {
+		return nil, err
+	}
+	return parsePortCounters(output), nil
+}
+
+//parsePortCounters parses the output of gnmi-cli get, which names every
+//counter on the line holding its value, the last number of the line
+func parsePortCounters(output []byte) map[string]uint64 {
+	counters := make(map[string]uint64)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		for _, name := range portCounterNames {
+			if !strings.Contains(line, name) {
+				continue
+			}
+			values := counterValue.FindAllString(line[strings.Index(line, name)+len(name):], -1)
+			if len(values) == 0 {
+				continue
+			}
+			if v, err := strconv.ParseUint(values[len(values)-1], 10, 64); err == nil {
+				counters[name] = v
+			}
+		}
+	}
+	return counters
+}
+
+//endpointOperInfo returns the operational data of an endpoint.
+//epMap must be locked by the caller.
+func endpointOperInfo(ep *epVal) map[string]interface{} {
+	info := map[string]interface{}{
+		optPortType:    ep.PortType,
+		optInterfaceID: ep.IpdkInterface,
+	}
+	if ep.PortType == "" {
+		info[optPortType] = portTypeVhost
+		info[optSocketPath] = endpointSocketDir(ep) + "/vhu.sock"
+	}
+	if ep.MTU != 0 {
+		info[optMTU] = ep.MTU
+	}
+	if ep.MAC != "" {
+		info[optMAC] = ep.MAC
+	}
+	if ep.VF != "" {
+		info[optVFAddress] = ep.VF
+	}
+	return info
+}
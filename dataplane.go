@@ -0,0 +1,317 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//The vhost-user socket of every endpoint lives in a directory named after
+//its address, under -vhost-dir or the directory selected for its network
+//with -o com.ipdk.vhost_dir. The IPDK container must see these
+//directories at the same path.
+var vhostDir = flag.String("vhost-dir", "/run/ipdk/vhost", "base directory of the vhost-user socket directories")
+
+const (
+	optVhostDir = "com.ipdk.vhost_dir"
+
+	//Socket directories of the endpoints created before -vhost-dir
+	legacySocketDirPrefix = "/tmp/vhostuser_"
+)
+
+//hostOutput runs a command on the host and returns its full output
+func hostOutput(cmd string, args ...string) ([]byte, error) {
+	if skipCommand(cmd, args) {
+		return nil, nil
+	}
+	slog.Debug("Running command", "cmd", cmd, "args", args)
+	defer observeCommand(cmd, args, time.Now())
+	s := startCommandSpan(commandName(cmd, args), map[string]string{"ipdk.command": cmd + " " + strings.Join(args, " ")})
+	output, err := runCommand(cmd, args)
+	s.end(err)
+	if err != nil {
+		stderr := ""
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			stderr = strings.TrimSpace(string(exitErr.Stderr))
+		} else if _, ok := err.(*timeoutError); ok {
+			stderr = err.Error()
+		}
+		slog.Warn("Command failed", "cmd", cmd, "args", args, "err", err, "stderr", stderr)
+		return nil, commandError(cmd, args, stderr+"\n"+string(output))
+	}
+	return output, nil
+}
+
+//ipdkOutput runs a command inside the ipdk container and returns its
+//full output
+func ipdkOutput(args ...string) ([]byte, error) {
+	if len(args) != 0 && args[0] == "gnmi-cli" {
+		if len(args) > 2 {
+			if err := checkGNMIConfig(args[2]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(args) != 0 {
+		args = append(append([]string{}, args...), grpcArgs(args[0])...)
+	}
+	return hostOutput("docker", append([]string{"exec", *ipdkContainer}, args...)...)
+}
+
+//ipdkExec runs a command inside the ipdk container and returns the
+//first line of its output
+func ipdkExec(args ...string) (string, error) {
+	output, err := ipdkOutput(args...)
+	if err != nil {
+		return "", err
+	}
+
+	ifcb, _, _ := bufio.NewReader(bytes.NewReader(output)).ReadLine()
+	return string(ifcb), nil
+}
+
+//vhostNames returns the gNMI device and host names of an interface ID
+func vhostNames(intf int) (string, string) {
+	return fmt.Sprintf("net_vhost%d", intf), fmt.Sprintf("host_%d", intf)
+}
+
+//vhostPortConfig is the configuration of a vhost-user port, the zero
+//value leaving everything to the defaults of the target
+type vhostPortConfig struct {
+	MTU    int
+	Queues int //0 for a single queue
+	RSS    *rssConfig
+	MAC    string //MAC address of the virtio-net device
+}
+
+//createVhostPort creates the IPDK vhost-user interface for an interface ID:
+//docker exec -it ipdk gnmi-cli set "device:virtual-device,name:net_vhost0,host:host1,device-type:VIRTIO_NET,queues:1,socket-path:/tmp/vhost-user-0,port-type:LINK"
+func createVhostPort(intf int, socketpath string, cfg vhostPortConfig) error {
+	netname, nethost := vhostNames(intf)
+	config := fmt.Sprintf("device:virtual-device,name:%s,host:%s,device-type:VIRTIO_NET,queues:%d,socket-path:%s/vhu.sock,port-type:LINK",
+		netname, nethost, vhostQueues(cfg.Queues), socketpath)
+	if cfg.MTU != 0 {
+		config += fmt.Sprintf(",mtu:%d", cfg.MTU) + jumboConfig(cfg.MTU)
+	}
+	if cfg.MAC != "" {
+		config += fmt.Sprintf(",mac-address:%s", cfg.MAC)
+	}
+	config += cfg.RSS.config()
+	ifc, err := ipdkExec("gnmi-cli", "set", config)
+	if err != nil {
+		return err
+	}
+
+	slog.Debug("Result of gnmi-cli", "output", ifc)
+	return nil
+}
+
+//vhostPortExists reports whether infrap4d knows about the vhost-user
+//interface of an interface ID
+func vhostPortExists(intf int) bool {
+	netname, _ := vhostNames(intf)
+	return deviceExists(netname)
+}
+
+//deviceExists reports whether infrap4d knows about a device
+func deviceExists(name string) bool {
+	_, err := ipdkExec("gnmi-cli", "get", fmt.Sprintf("device:virtual-device,name:%s,device-type", name))
+	return err == nil
+}
+
+func hostEntryMatch(ip string) string {
+	return fmt.Sprintf("hdr.ipv4.dst_addr=%s", ip)
+}
+
+//deleteVhostPort deletes the vhost-user interface of an interface ID
+func deleteVhostPort(intf int) error {
+	netname, _ := vhostNames(intf)
+	_, err := ipdkExec("gnmi-cli", "delete", fmt.Sprintf("device:virtual-device,name:%s", netname))
+	return err
+}
+
+//addHostEntry forwards traffic for ip to the pipeline port intf
+func addHostEntry(owner string, bridge string, ip string, intf int) error {
+	return addEntry(owner, bridge, "ingress.ipv4_host", hostEntryMatch(ip), fmt.Sprintf("ingress.send(%d)", intf))
+}
+
+//deleteHostEntry removes the forwarding entry for ip
+func deleteHostEntry(bridge string, ip string) error {
+	return deleteEntry(bridge, "ingress.ipv4_host", hostEntryMatch(ip))
+}
+
+//dumpHostEntries returns the ingress.ipv4_host entries installed in the
+//pipeline of a bridge as a map of destination IP to pipeline port
+func dumpHostEntries(bridge string) (map[string]int, error) {
+	m := pipelineMapping(bridge)
+	output, err := ipdkOutput("ovs-p4ctl", "dump-entries", bridge, m.table("ingress.ipv4_host"))
+	if err != nil {
+		return nil, err
+	}
+	return parseHostEntries(output, m.field("hdr.ipv4.dst_addr")), nil
+}
+
+//parseHostEntries parses ovs-p4ctl dump-entries output. Each entry lists
+//its match key (field, hdr.ipv4.dst_addr for simple_l3, as a hex or
+//dotted quad value) before its action parameters (port, as a hex or
+//decimal value).
+func parseHostEntries(output []byte, field string) map[string]int {
+	entries := make(map[string]int)
+
+	var ip string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		value := fields[len(fields)-1]
+
+		switch {
+		case strings.HasPrefix(fields[0], field):
+			ip = parseP4Addr(value)
+		case fields[0] == "port" && ip != "":
+			var port int
+			if _, err := fmt.Sscanf(value, "%x", &port); err == nil {
+				entries[ip] = port
+			}
+			ip = ""
+		}
+	}
+	return entries
+}
+
+func parseP4Addr(value string) string {
+	value = strings.TrimPrefix(value, "0x")
+	if strings.Contains(value, ".") {
+		return value
+	}
+
+	var a uint32
+	if _, err := fmt.Sscanf(value, "%x", &a); err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d.%d.%d.%d", byte(a>>24), byte(a>>16), byte(a>>8), byte(a))
+}
+
+//addDummyLink creates the dummy interface docker programs the endpoint
+//address on, with the default MTU if mtu is 0 and a random MAC address if
+//mac is ""
+func addDummyLink(name string, mtu int, mac string) error {
+	//A link left over by a creation that didn't complete is reused
+	if err := host.AddDummyLink(name); err != nil && !isExist(err) {
+		return err
+	}
+	if mtu != 0 {
+		if err := host.SetLinkMTU(name, mtu); err != nil {
+			return err
+		}
+	}
+	if mac != "" {
+		if err := host.SetLinkMAC(name, mac); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("Setup dummy port", "link", name)
+	return nil
+}
+
+//deleteDummyLink deletes the dummy interface of an endpoint
+func deleteDummyLink(name string) error {
+	if err := host.DeleteDummyLink(name); err != nil {
+		return err
+	}
+
+	slog.Info("Deleted dummy port", "link", name)
+	return nil
+}
+
+//dummyLinks returns the names of all dummy interfaces on the host
+func dummyLinks() (map[string]bool, error) {
+	return host.DummyLinks()
+}
+
+//parseVhostDir parses the socket directory option of a network, ""
+//means -vhost-dir
+func parseVhostDir(v string) (string, error) {
+	if v == "" {
+		return "", nil
+	}
+	if !filepath.IsAbs(v) || filepath.Clean(v) != v || v == "/" || checkCommandArg(v) != nil {
+		return "", fmt.Errorf("invalid %s %q, expected an absolute path", optVhostDir, v)
+	}
+	return v, nil
+}
+
+//vhostSocketDir returns the directory holding the vhost-user socket of
+//the endpoint with the given IP address, under base or -vhost-dir if base
+//is ""
+func vhostSocketDir(base string, ip string) string {
+	if base == "" {
+		base = *vhostDir
+	}
+	return filepath.Join(base, ip)
+}
+
+//endpointSocketDir returns the socket directory of an endpoint, in the
+//legacy location for endpoints created before it was recorded
+func endpointSocketDir(ep *epVal) string {
+	if ep.SocketDir != "" {
+		return ep.SocketDir
+	}
+	return legacySocketDirPrefix + ep.VhostuserPort
+}
+
+//makeSocketDir creates the directory holding a vhost-user socket
+func makeSocketDir(path string) error {
+	slog.Debug("Creating directory", "path", path)
+	return host.MakeSocketDir(path)
+}
+
+//removeSocketDir removes a vhost-user socket directory and its content
+func removeSocketDir(path string) error {
+	slog.Debug("Removing directory", "path", path)
+	return host.RemoveSocketDir(path)
+}
+
+//parseDummyLinks parses the output of ip -o link show type dummy
+func parseDummyLinks(output []byte) map[string]bool {
+	links := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		//1: name: <FLAGS> ... or 1: name@parent: <FLAGS> ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		name := strings.TrimSuffix(fields[1], ":")
+		if i := strings.Index(name, "@"); i >= 0 {
+			name = name[:i]
+		}
+		links[name] = true
+	}
+	return links
+}
@@ -0,0 +1,182 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+//bolt never shrinks its file: pages freed by deleted records are only
+//reused for new ones. Hosts that churn through many endpoints can check
+//how much of the file is in use with GET /v1/db/stats, and rewrite it
+//without the free pages with POST /v1/db/compact.
+
+//compactTxMaxSize bounds the size of the transactions used to copy the
+//db while compacting it
+const compactTxMaxSize = 64 * 1024
+
+type dbBucketStats struct {
+	Keys        int
+	Depth       int
+	BranchPages int
+	LeafPages   int
+	Inuse       int //Bytes used by the pages of the bucket
+	Alloc       int //Bytes allocated to the pages of the bucket
+}
+
+type dbStats struct {
+	Path          string
+	Size          int64 //Size of the db file
+	FreePages     int
+	PendingPages  int //Pages freed but still used by a read transaction
+	FreeAlloc     int //Bytes allocated to free pages
+	FreelistInuse int //Bytes used by the freelist
+	Buckets       map[string]dbBucketStats
+}
+
+func (s *boltStore) stats() (dbStats, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	bs := s.db.Stats()
+	st := dbStats{
+		Path:          s.db.Path(),
+		FreePages:     bs.FreePageN,
+		PendingPages:  bs.PendingPageN,
+		FreeAlloc:     bs.FreeAlloc,
+		FreelistInuse: bs.FreelistInuse,
+		Buckets:       make(map[string]dbBucketStats),
+	}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		st.Size = tx.Size()
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			bst := b.Stats()
+			st.Buckets[string(name)] = dbBucketStats{
+				Keys:        bst.KeyN,
+				Depth:       bst.Depth,
+				BranchPages: bst.BranchPageN,
+				LeafPages:   bst.LeafPageN,
+				Inuse:       bst.BranchInuse + bst.LeafInuse,
+				Alloc:       bst.BranchAlloc + bst.LeafAlloc,
+			}
+			return nil
+		})
+	})
+	return st, err
+}
+
+//compact rewrites the db file without its free pages and returns the
+//size of the file before and after. Writes are blocked meanwhile.
+func (s *boltStore) compact() (int64, int64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	path := s.db.Path()
+	before, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".compact")
+	if err != nil {
+		return 0, 0, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	options := bolt.Options{
+		Timeout: 3 * time.Second,
+	}
+	dst, err := bolt.Open(tmp.Name(), 0600, &options)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := bolt.Compact(dst, s.db, compactTxMaxSize); err != nil {
+		dst.Close()
+		return 0, 0, fmt.Errorf("compaction failed: %v", err)
+	}
+	if err := dst.Close(); err != nil {
+		return 0, 0, err
+	}
+
+	if err := s.db.Close(); err != nil {
+		return 0, 0, err
+	}
+	renameErr := os.Rename(tmp.Name(), path)
+
+	//Reopen the db whether or not the compacted copy replaced it
+	s.db, err = bolt.Open(path, 0600, &options)
+	if err != nil {
+		slog.Error("Unable to reopen the db after compaction", "err", err)
+		return 0, 0, err
+	}
+	db = s.db
+	if renameErr != nil {
+		return 0, 0, renameErr
+	}
+
+	after, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	return before.Size(), after.Size(), nil
+}
+
+func adminDbStats(w http.ResponseWriter, r *http.Request) {
+	s, ok := store.(*boltStore)
+	if !ok {
+		adminError(w, http.StatusNotImplemented, "db statistics are only available with the bolt store")
+		return
+	}
+
+	st, err := s.stats()
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, "unable to read db statistics: %v", err)
+		return
+	}
+	sendResponse(st, w)
+}
+
+func adminDbCompact(w http.ResponseWriter, r *http.Request) {
+	s, ok := store.(*boltStore)
+	if !ok {
+		adminError(w, http.StatusNotImplemented, "compaction is only available with the bolt store")
+		return
+	}
+
+	before, after, err := s.compact()
+	if os.IsPermission(err) {
+		adminError(w, http.StatusInternalServerError, "unable to compact db, the db directory %v is not writable by the plugin user, see -run-as", filepath.Dir(dbFile))
+		return
+	}
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, "unable to compact db: %v", err)
+		return
+	}
+
+	slog.Info("Compacted db", "before", before, "after", after)
+	sendResponse(map[string]int64{"SizeBefore": before, "SizeAfter": after}, w)
+}
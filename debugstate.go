@@ -0,0 +1,193 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//GET /debug/state dumps the in-memory state of the plugin: the networks,
+//endpoints and bridge IDs, the ID counters and the last driver requests
+//along with their outcome. Unlike the db, it shows what the plugin is
+//actually working with, and what it has been asked to do recently.
+var debugState = flag.Bool("debug-state", true, "serve a dump of the plugin state on /debug/state")
+
+//operationHistorySize is the number of driver requests kept
+const operationHistorySize = 256
+
+//operation is a driver request handled by the plugin
+type operation struct {
+	Name       string
+	NetworkID  string `json:",omitempty"`
+	EndpointID string `json:",omitempty"`
+	Start      time.Time
+	Duration   string
+	Err        string `json:",omitempty"`
+}
+
+//operations is a ring of the last driver requests, and the channels of
+//the clients following them through /v1/events
+var operations struct {
+	sync.Mutex
+	ring      []operation
+	next      int
+	followers map[chan operation]bool
+}
+
+//recordOperation adds a driver request to the operation history
+func recordOperation(name string, networkID string, endpointID string, start time.Time, err error) {
+	op := operation{Name: name, NetworkID: networkID, EndpointID: endpointID, Start: start, Duration: time.Since(start).String()}
+	if err != nil {
+		op.Err = err.Error()
+	}
+
+	operations.Lock()
+	defer operations.Unlock()
+	for c := range operations.followers {
+		//Slow followers miss operations rather than delay requests
+		select {
+		case c <- op:
+		default:
+		}
+	}
+	if len(operations.ring) < operationHistorySize {
+		operations.ring = append(operations.ring, op)
+		return
+	}
+	operations.ring[operations.next] = op
+	operations.next = (operations.next + 1) % operationHistorySize
+}
+
+//recentOperations returns the operation history, oldest first
+func recentOperations() []operation {
+	operations.Lock()
+	defer operations.Unlock()
+	return operationHistory()
+}
+
+//operationHistory returns the operation history, oldest first.
+//operations must be locked by the caller.
+func operationHistory() []operation {
+	ops := make([]operation, 0, len(operations.ring))
+	ops = append(ops, operations.ring[operations.next:]...)
+	return append(ops, operations.ring[:operations.next]...)
+}
+
+type debugStateDump struct {
+	Networks   map[string]*nwVal
+	Endpoints  map[string]*epVal
+	Bridges    map[string]int
+	Counters   map[string]int
+	FreeIntfs  []int
+	Operations []operation
+	Queued     map[string]int //Requests running or waiting, by endpoint
+	Workers    workerState
+	Activated  activationState
+}
+
+func adminDebugState(w http.ResponseWriter, r *http.Request) {
+	state, err := marshalDebugState()
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, "unable to dump the state: %v", err)
+		return
+	}
+	//The client may be slow, the maps are no longer locked
+	w.Write(state)
+}
+
+//marshalDebugState encodes the state under the locks of the maps
+func marshalDebugState() ([]byte, error) {
+	ops := recentOperations()
+	queued := queuedEndpointOps()
+	workers := endpointWorkerState()
+	activated := pluginActivations()
+
+	nwMap.Lock()
+	defer nwMap.Unlock()
+	epMap.Lock()
+	defer epMap.Unlock()
+	brMap.Lock()
+	defer brMap.Unlock()
+
+	return json.Marshal(debugStateDump{
+		Networks:   nwMap.m,
+		Endpoints:  epMap.m,
+		Bridges:    brMap.m,
+		Counters:   map[string]int{"brCount": brMap.brCount, "intfCount": brMap.intfCount},
+		FreeIntfs:  brMap.freeIntfs,
+		Operations: ops,
+		Queued:     queued,
+		Workers:    workers,
+		Activated:  activated,
+	})
+}
+
+//followOperations returns a channel receiving the operations recorded
+//from now on, along with the operation history
+func followOperations() (chan operation, []operation) {
+	c := make(chan operation, 64)
+
+	operations.Lock()
+	defer operations.Unlock()
+	if operations.followers == nil {
+		operations.followers = make(map[chan operation]bool)
+	}
+	operations.followers[c] = true
+	return c, operationHistory()
+}
+
+func unfollowOperations(c chan operation) {
+	operations.Lock()
+	defer operations.Unlock()
+	delete(operations.followers, c)
+}
+
+//adminEvents streams the driver requests handled by the plugin as JSON
+//lines, starting with the operation history, until the client goes away.
+//?follow=false only returns the history.
+func adminEvents(w http.ResponseWriter, r *http.Request) {
+	c, ops := followOperations()
+	defer unfollowOperations(c)
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	for _, op := range ops {
+		enc.Encode(op)
+	}
+	if r.URL.Query().Get("follow") == "false" {
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case op := <-c:
+			if err := enc.Encode(op); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,132 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"runtime"
+	rpprof "runtime/pprof"
+	"sync"
+	"syscall"
+)
+
+//With -pprof-addr, the runtime profiles of net/http/pprof are served on a
+//listener of their own, under /debug/pprof/, along with /debug/locks,
+//which tells which of the locks of the plugin are held. Mutex and block
+//profiling are enabled as well, so that contention on nwMap, epMap and
+//brMap shows up in /debug/pprof/mutex and /debug/pprof/block. SIGUSR2
+//writes the stacks of all goroutines to stderr, which works even when
+//no listener is set or the plugin is stuck. The listener takes the
+//credentials of the admin API, see auth.go.
+var pprofAddr = flag.String("pprof-addr", "", "address serving the pprof and lock diagnostics, e.g. 127.0.0.1:6060, empty to disable")
+
+const (
+	//One in mutexProfileFraction contention events is sampled, and one
+	//blocking event per blockProfileRate nanoseconds spent blocked
+	mutexProfileFraction = 5
+	blockProfileRate     = 1000000
+)
+
+type namedLock struct {
+	name string
+	lock *sync.Mutex
+}
+
+//pluginLocks are the locks reported by /debug/locks, in locking order
+//where there is one
+func pluginLocks() []namedLock {
+	return []namedLock{
+		{"networkChanges", &networkChanges},
+		{"nwMap", &nwMap.Mutex},
+		{"epMap", &epMap.Mutex},
+		{"brMap", &brMap.Mutex},
+		{"sgMap", &sgMap.Mutex},
+		{"poolMap", &poolMap.Mutex},
+		{"pipelines", &pipelines.Mutex},
+		{"nodeMap", &nodeMap.Mutex},
+		{"cniLock", &cniLock},
+		{"tracer", &tracer.Mutex},
+		{"operations", &operations.Mutex},
+	}
+}
+
+type lockReport struct {
+	Locks      map[string]string //held or free
+	Goroutines int
+}
+
+//adminDebugLocks reports the locks that are held. A lock that stays held
+//across several requests, with goroutines piling up, points at a
+//deadlock, whose goroutines /debug/pprof/goroutine?debug=2 shows.
+func adminDebugLocks(w http.ResponseWriter, r *http.Request) {
+	report := lockReport{Locks: make(map[string]string), Goroutines: runtime.NumGoroutine()}
+	for _, l := range pluginLocks() {
+		if l.lock.TryLock() {
+			l.lock.Unlock()
+			report.Locks[l.name] = "free"
+		} else {
+			report.Locks[l.name] = "held"
+		}
+	}
+	sendResponse(report, w)
+}
+
+//initDiagnostics starts the pprof listener if one is set, and the
+//goroutine dumps on SIGUSR2
+func initDiagnostics() {
+	go dumpGoroutinesOnSignal()
+
+	if *pprofAddr == "" {
+		return
+	}
+
+	runtime.SetMutexProfileFraction(mutexProfileFraction)
+	runtime.SetBlockProfileRate(blockProfileRate)
+
+	//The profiles expose the command line, tokens included, and slow
+	//the plugin down while they run: only operators get them
+	m := http.NewServeMux()
+	m.HandleFunc("/debug/pprof/", operatorOnly(pprof.Index))
+	m.HandleFunc("/debug/pprof/cmdline", operatorOnly(pprof.Cmdline))
+	m.HandleFunc("/debug/pprof/profile", operatorOnly(pprof.Profile))
+	m.HandleFunc("/debug/pprof/symbol", operatorOnly(pprof.Symbol))
+	m.HandleFunc("/debug/pprof/trace", operatorOnly(pprof.Trace))
+	m.HandleFunc("/debug/locks", operatorOnly(adminDebugLocks))
+
+	go func() {
+		slog.Info("Serving diagnostics", "addr", *pprofAddr)
+		if err := http.ListenAndServe(*pprofAddr, m); err != nil {
+			slog.Error("diagnostics http server failed", "err", err)
+		}
+	}()
+}
+
+//dumpGoroutinesOnSignal writes the stacks of all goroutines to stderr on
+//every SIGUSR2
+func dumpGoroutinesOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR2)
+	for range c {
+		slog.Warn("Dumping goroutines")
+		rpprof.Lookup("goroutine").WriteTo(os.Stderr, 2)
+	}
+}
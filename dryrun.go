@@ -0,0 +1,105 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//With -dry-run the plugin serves docker as usual but only logs the
+//commands that would change the dataplane or the host, gnmi-cli set,
+//ovs-p4ctl add-entry, ip link add and the like, instead of running them.
+//Commands that only read, such as dumping the entries of a table, still
+//run. The operations are also kept for GET /v1/dry-run, so that the
+//effect of a compose file on the pipeline can be reviewed before it is
+//applied for real. The state of a dry run is kept apart from the real
+//one, see main.
+var dryRun = flag.Bool("dry-run", false, "log the dataplane and host operations instead of running them")
+
+//dryRunMaxOps bounds the operations kept for the admin API
+const dryRunMaxOps = 10000
+
+//readOnlyCommands are the commands run even in a dry run, see
+//commandName
+var readOnlyCommands = map[string]bool{
+	"cat":                    true,
+	"true":                   true,
+	"gnmi-cli get":           true,
+	"ovs-p4ctl dump-entries": true,
+	"ovs-vsctl list-br":      true,
+	"ip -o":                  true,
+	"ping -c":                true,
+}
+
+//dryRunOp is an operation skipped by a dry run
+type dryRunOp struct {
+	Time      time.Time
+	Operation string
+}
+
+var dryRunOps = struct {
+	sync.Mutex
+	ops []dryRunOp
+}{}
+
+//skipOperation records an operation and reports whether it must be
+//skipped, that is whether this is a dry run
+func skipOperation(op string) bool {
+	if !*dryRun {
+		return false
+	}
+	slog.Info("Dry run, skipping", "operation", op)
+
+	dryRunOps.Lock()
+	defer dryRunOps.Unlock()
+	if len(dryRunOps.ops) == dryRunMaxOps {
+		dryRunOps.ops = dryRunOps.ops[1:]
+	}
+	dryRunOps.ops = append(dryRunOps.ops, dryRunOp{Time: time.Now(), Operation: op})
+	return true
+}
+
+//skipCommand is skipOperation for a command run by hostOutput
+func skipCommand(cmd string, args []string) bool {
+	if readOnlyCommands[commandName(cmd, args)] {
+		return false
+	}
+	return skipOperation(strings.Join(append([]string{cmd}, args...), " "))
+}
+
+func adminListDryRun(w http.ResponseWriter, r *http.Request) {
+	dryRunOps.Lock()
+	defer dryRunOps.Unlock()
+
+	sendResponse(struct {
+		Enabled    bool
+		Operations []dryRunOp
+	}{*dryRun, dryRunOps.ops}, w)
+}
+
+func adminClearDryRun(w http.ResponseWriter, r *http.Request) {
+	dryRunOps.Lock()
+	defer dryRunOps.Unlock()
+
+	dryRunOps.ops = nil
+	sendResponse(struct{}{}, w)
+}
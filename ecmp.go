@@ -0,0 +1,315 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+
+	"github.com/gorilla/mux"
+)
+
+//Next-hop groups spread the traffic for a destination prefix, typically
+//a service address, across several endpoints of a network:
+//
+//  curl -X PUT -d '{"Prefix": "10.20.0.100/32", "Endpoints": ["<id>", "<id>"]}' \
+//      http://127.0.0.1:9075/v1/networks/<network-id>/nexthop-groups/web
+//
+//Traffic from the segment of the network for the prefix matches
+//ingress.ecmp_route, which hands the group and its size to the program.
+//The program hashes the 5-tuple of the packet into a member index and
+//ingress.ecmp_nexthop sends it to the port of that member, so every flow
+//sticks to one endpoint. Packets are not rewritten: the endpoints are
+//expected to accept traffic for the prefix, as with any next hop.
+const (
+	ecmpRouteTable    = "ingress.ecmp_route"
+	ecmpRouteAction   = "ingress.set_nexthop_group"
+	ecmpNextHopTable  = "ingress.ecmp_nexthop"
+	ecmpNextHopAction = "ingress.send"
+)
+
+var nextHopGroupNameRe = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+//nextHopGroup spreads the traffic for Prefix across Endpoints. Ports
+//holds the port of each member, by member index, as programmed.
+type nextHopGroup struct {
+	Name      string
+	Group     int
+	Prefix    string
+	Endpoints []string
+	Ports     []int
+}
+
+//allocNextHopGroup returns a group number no network uses.
+//nwMap must be locked by the caller.
+func allocNextHopGroup() int {
+	used := make(map[int]bool)
+	for _, nw := range nwMap.m {
+		for _, g := range nw.NextHopGroups {
+			used[g.Group] = true
+		}
+	}
+	group := 1
+	for used[group] {
+		group++
+	}
+	return group
+}
+
+func ecmpRouteMatch(segment int, prefix string) string {
+	return fmt.Sprintf("meta.segment_id=%d,hdr.ipv4.dst_addr=%s", segment, prefix)
+}
+
+func ecmpNextHopMatch(group int, index int) string {
+	return fmt.Sprintf("meta.nexthop_group=%d,meta.nexthop_index=%d", group, index)
+}
+
+func removeECMPEntry(bridge string, table string, m string) {
+	if err := deleteEntry(bridge, table, m); err != nil {
+		slog.Error("Unable to remove ECMP entry", "match", m, "err", err)
+	}
+}
+
+//programNextHopGroup installs the members of a group, then the route
+//sending the prefix to them
+func programNextHopGroup(networkID string, nw *nwVal, g *nextHopGroup) error {
+	owner := networkOwner(networkID)
+	for i, port := range g.Ports {
+		if err := addEntry(owner, nw.Bridge, ecmpNextHopTable, ecmpNextHopMatch(g.Group, i),
+			fmt.Sprintf("%s(%d)", ecmpNextHopAction, port)); err != nil {
+			unprogramNextHopGroup(nw, &nextHopGroup{Group: g.Group, Ports: g.Ports[:i]})
+			return err
+		}
+	}
+
+	if len(g.Ports) == 0 {
+		return nil
+	}
+	if err := addEntry(owner, nw.Bridge, ecmpRouteTable, ecmpRouteMatch(nw.Segment, g.Prefix),
+		fmt.Sprintf("%s(%d,%d)", ecmpRouteAction, g.Group, len(g.Ports))); err != nil {
+		unprogramNextHopGroup(nw, &nextHopGroup{Group: g.Group, Ports: g.Ports})
+		return err
+	}
+	return nil
+}
+
+//unprogramNextHopGroup removes the entries installed by
+//programNextHopGroup. A group without members has no route.
+func unprogramNextHopGroup(nw *nwVal, g *nextHopGroup) {
+	if nw == nil {
+		return
+	}
+
+	if g.Prefix != "" && len(g.Ports) != 0 {
+		removeECMPEntry(nw.Bridge, ecmpRouteTable, ecmpRouteMatch(nw.Segment, g.Prefix))
+	}
+	for i := range g.Ports {
+		removeECMPEntry(nw.Bridge, ecmpNextHopTable, ecmpNextHopMatch(g.Group, i))
+	}
+}
+
+//unprogramNextHopGroups removes the entries of all the groups of a
+//network
+func unprogramNextHopGroups(nw *nwVal) {
+	if nw == nil {
+		return
+	}
+	for _, g := range nw.NextHopGroups {
+		unprogramNextHopGroup(nw, g)
+	}
+}
+
+//leaveNextHopGroups removes an endpoint from the groups of its network,
+//re-programming the groups it was a member of. nwMap must be locked by
+//the caller.
+func leaveNextHopGroups(networkID string, nw *nwVal, endpointID string) {
+	if nw == nil {
+		return
+	}
+
+	for _, g := range nw.NextHopGroups {
+		if !hasAny(g.Endpoints, []string{endpointID}) {
+			continue
+		}
+
+		unprogramNextHopGroup(nw, g)
+		var endpoints []string
+		var ports []int
+		for i, id := range g.Endpoints {
+			if id != endpointID {
+				endpoints = append(endpoints, id)
+				ports = append(ports, g.Ports[i])
+			}
+		}
+		g.Endpoints, g.Ports = endpoints, ports
+		if err := programNextHopGroup(networkID, nw, g); err != nil {
+			slog.Error("Unable to program next-hop group", "group", g.Name, "network", networkID, "err", err)
+		}
+	}
+}
+
+func findNextHopGroup(nw *nwVal, name string) (int, *nextHopGroup) {
+	for i, g := range nw.NextHopGroups {
+		if g.Name == name {
+			return i, g
+		}
+	}
+	return -1, nil
+}
+
+func sortedNextHopGroups(nw *nwVal) []*nextHopGroup {
+	groups := append([]*nextHopGroup{}, nw.NextHopGroups...)
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups
+}
+
+func adminListNextHopGroups(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	nwMap.Lock()
+	defer nwMap.Unlock()
+
+	nw, ok := nwMap.m[id]
+	if !ok {
+		adminError(w, http.StatusNotFound, "network %s not found", id)
+		return
+	}
+	sendResponse(sortedNextHopGroups(nw), w)
+}
+
+//adminPutNextHopGroup creates a group or replaces its prefix and members
+func adminPutNextHopGroup(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, name := vars["id"], vars["name"]
+	if !nextHopGroupNameRe.MatchString(name) {
+		adminError(w, http.StatusBadRequest, "invalid next-hop group name %q", name)
+		return
+	}
+
+	body, err := getBody(r)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	req := struct {
+		Prefix    string
+		Endpoints []string
+	}{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		adminError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	_, prefix, err := net.ParseCIDR(req.Prefix)
+	if err != nil || prefix.IP.To4() == nil {
+		adminError(w, http.StatusBadRequest, "invalid prefix %q", req.Prefix)
+		return
+	}
+
+	nwMap.Lock()
+	defer nwMap.Unlock()
+	epMap.Lock()
+	defer epMap.Unlock()
+
+	nw, ok := nwMap.m[id]
+	if !ok {
+		adminError(w, http.StatusNotFound, "network %s not found", id)
+		return
+	}
+	if nw.Forwarding == forwardingL2 {
+		adminError(w, http.StatusConflict, "network %s does not route traffic", id)
+		return
+	}
+
+	g := &nextHopGroup{Name: name, Prefix: prefix.String(), Endpoints: []string{}, Ports: []int{}}
+	for _, epID := range req.Endpoints {
+		ep, ok := epMap.m[epID]
+		if !ok || ep.NetworkID != id {
+			adminError(w, http.StatusBadRequest, "endpoint %s is not on network %s", epID, id)
+			return
+		}
+		if hasAny(g.Endpoints, []string{epID}) {
+			continue
+		}
+		g.Endpoints = append(g.Endpoints, epID)
+		g.Ports = append(g.Ports, ep.IpdkInterface)
+	}
+
+	i, prev := findNextHopGroup(nw, name)
+	for _, v := range nw.NextHopGroups {
+		if v.Name != name && v.Prefix == g.Prefix {
+			adminError(w, http.StatusConflict, "prefix %v is routed by next-hop group %s", g.Prefix, v.Name)
+			return
+		}
+	}
+
+	if prev != nil {
+		g.Group = prev.Group
+		unprogramNextHopGroup(nw, prev)
+	} else {
+		g.Group = allocNextHopGroup()
+	}
+	if err := programNextHopGroup(id, nw, g); err != nil {
+		if prev != nil {
+			if err := programNextHopGroup(id, nw, prev); err != nil {
+				slog.Error("Unable to restore next-hop group", "group", name, "network", id, "err", err)
+			}
+		}
+		adminError(w, http.StatusInternalServerError, "unable to program next-hop group %s: %v", name, err)
+		return
+	}
+
+	if prev != nil {
+		nw.NextHopGroups[i] = g
+	} else {
+		nw.NextHopGroups = append(nw.NextHopGroups, g)
+	}
+	if err := dbUpdate(putNetwork(id, nw)); err != nil {
+		slog.Error("Unable to update db", "err", err)
+	}
+	sendResponse(g, w)
+}
+
+func adminDeleteNextHopGroup(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, name := vars["id"], vars["name"]
+
+	nwMap.Lock()
+	defer nwMap.Unlock()
+
+	nw, ok := nwMap.m[id]
+	if !ok {
+		adminError(w, http.StatusNotFound, "network %s not found", id)
+		return
+	}
+	i, g := findNextHopGroup(nw, name)
+	if g == nil {
+		adminError(w, http.StatusNotFound, "next-hop group %s not found on network %s", name, id)
+		return
+	}
+
+	unprogramNextHopGroup(nw, g)
+	nw.NextHopGroups = append(nw.NextHopGroups[:i], nw.NextHopGroups[i+1:]...)
+	if err := dbUpdate(putNetwork(id, nw)); err != nil {
+		slog.Error("Unable to update db", "err", err)
+	}
+	sendResponse(sortedNextHopGroups(nw), w)
+}
@@ -0,0 +1,243 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//ovs-p4ctl has no way to attach a cookie to a table entry, so every
+//entry the plugin installs is recorded in the entries table of the db,
+//keyed by bridge, table and match. Entries missing from the registry
+//belong to some other controller sharing the pipeline and must be left
+//alone.
+
+//pipelineEntry is a table entry installed by the plugin
+type pipelineEntry struct {
+	Bridge  string
+	Table   string
+	Match   string
+	Action  string
+	Owner   string //network/<id> or endpoint/<id>
+	Created time.Time
+}
+
+func networkOwner(id string) string {
+	return "network/" + id
+}
+
+func endpointOwner(id string) string {
+	return "endpoint/" + id
+}
+
+func entryKey(bridge string, table string, match string) string {
+	return bridge + " " + table + " " + match
+}
+
+//addEntry installs a table entry into the pipeline of a bridge and
+//records it as owned by owner
+func addEntry(owner string, bridge string, table string, match string, action string) error {
+	m := pipelineMapping(bridge)
+	if err := checkEntry(bridge, m.table(table), m.match(match), m.action(action)); err != nil {
+		return err
+	}
+	if _, err := ipdkExec("ovs-p4ctl", "add-entry", bridge, m.table(table),
+		fmt.Sprintf("%s,action=%s", m.match(match), m.action(action))); err != nil {
+		return err
+	}
+
+	e := pipelineEntry{
+		Bridge:  bridge,
+		Table:   table,
+		Match:   match,
+		Action:  action,
+		Owner:   owner,
+		Created: time.Now().UTC(),
+	}
+	if err := dbAdd("entries", entryKey(bridge, table, match), e); err != nil {
+		slog.Error("Unable to update db", "err", err)
+	}
+	return nil
+}
+
+//deleteEntry removes a table entry. The ownership record is only dropped
+//once the entry is gone, so a failed delete is not forgotten.
+func deleteEntry(bridge string, table string, match string) error {
+	m := pipelineMapping(bridge)
+	if err := checkEntry(bridge, m.table(table), m.match(match), ""); err != nil {
+		return err
+	}
+	if _, err := ipdkExec("ovs-p4ctl", "del-entry", bridge, m.table(table), m.match(match)); err != nil {
+		return err
+	}
+
+	if err := dbDelete("entries", entryKey(bridge, table, match)); err != nil {
+		slog.Error("Unable to update db", "err", err)
+	}
+	return nil
+}
+
+//forgetEntry drops the ownership record of an entry that is known to be
+//gone from the pipeline
+func forgetEntry(bridge string, table string, match string) {
+	if err := dbDelete("entries", entryKey(bridge, table, match)); err != nil {
+		slog.Error("Unable to update db", "err", err)
+	}
+}
+
+//ownedEntries returns the entries recorded as installed by the plugin
+func ownedEntries() (map[string]pipelineEntry, error) {
+	entries := make(map[string]pipelineEntry)
+
+	records, err := store.List("entries")
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range records {
+		e := pipelineEntry{}
+		if err := json.Unmarshal(v, &e); err != nil {
+			return nil, fmt.Errorf("Decode Error: %v %v", k, err)
+		}
+		entries[k] = e
+	}
+	return entries, nil
+}
+
+//removeOwnedEntries removes the entries recorded as installed for owner.
+//Entries that can't be removed stay recorded for the garbage collector.
+func removeOwnedEntries(owner string) {
+	entries, err := ownedEntries()
+	if err != nil {
+		slog.Error("Unable to list owned entries", "owner", owner, "err", err)
+		return
+	}
+	for _, e := range entries {
+		if e.Owner != owner {
+			continue
+		}
+		if err := deleteEntry(e.Bridge, e.Table, e.Match); err != nil {
+			slog.Error("Unable to remove entry", "owner", owner, "table", e.Table, "match", e.Match, "err", err)
+		}
+	}
+}
+
+//sameEntry reports whether the ownership record of an entry is still the
+//one listed: once the entry is gone, another owner may install it again
+func sameEntry(key string, e pipelineEntry) bool {
+	v, err := store.Get("entries", key)
+	if err != nil {
+		slog.Error("Unable to read db", "err", err)
+		return false
+	}
+	cur := pipelineEntry{}
+	if v == nil || json.Unmarshal(v, &cur) != nil {
+		return false
+	}
+	return cur.Owner == e.Owner && cur.Created.Equal(e.Created)
+}
+
+//isOwnedEntry reports whether the plugin installed an entry
+func isOwnedEntry(bridge string, table string, match string) bool {
+	v, err := store.Get("entries", entryKey(bridge, table, match))
+	if err != nil {
+		slog.Error("Unable to read db", "err", err)
+	}
+	return v != nil
+}
+
+//liveEndpoint reports whether an endpoint exists, or is being created or
+//deleted
+func liveEndpoint(id string) bool {
+	epMap.Lock()
+	_, ok := epMap.m[id]
+	_, pending := epMap.pending[id]
+	epMap.Unlock()
+	if ok || pending {
+		return true
+	}
+
+	v, err := store.Get("intents", id)
+	if err != nil {
+		slog.Error("Unable to read db", "err", err)
+		return true
+	}
+	return v != nil
+}
+
+//checkHostEntry returns an error if the pipeline of a bridge already
+//forwards ip, unless endpoint id installed the entry in an earlier
+//attempt to create it. The entries of an endpoint that is gone are stale
+//and removed.
+func checkHostEntry(id string, bridge string, ip string) error {
+	entries, err := dumpHostEntries(bridge)
+	if err != nil {
+		return err
+	}
+	if _, ok := entries[ip]; !ok {
+		return nil
+	}
+
+	v, err := store.Get("entries", entryKey(bridge, "ingress.ipv4_host", hostEntryMatch(ip)))
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return fmt.Errorf("address %v is already forwarded by %v for another controller", ip, bridge)
+	}
+	e := pipelineEntry{}
+	if err := json.Unmarshal(v, &e); err != nil {
+		return fmt.Errorf("Decode Error: %v", err)
+	}
+	if e.Owner == endpointOwner(id) {
+		return nil
+	}
+
+	owner := strings.TrimPrefix(e.Owner, endpointOwner(""))
+	if owner == e.Owner || liveEndpoint(owner) {
+		return fmt.Errorf("address %v is already forwarded by %v for %v, remove it with POST /v1/gc if it is left over", ip, bridge, e.Owner)
+	}
+	slog.Info("Removing the stale entries of a deleted endpoint", "endpoint", owner, "address", ip)
+	removeOwnedEntries(e.Owner)
+	if isOwnedEntry(bridge, "ingress.ipv4_host", hostEntryMatch(ip)) {
+		return fmt.Errorf("address %v is still forwarded by %v for %v, its stale entry could not be removed", ip, bridge, e.Owner)
+	}
+	return nil
+}
+
+//adminListEntries lists the entries owned by the plugin, optionally only
+//those of the owner given by the owner query parameter
+func adminListEntries(w http.ResponseWriter, r *http.Request) {
+	entries, err := ownedEntries()
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	owner := r.URL.Query().Get("owner")
+	list := []pipelineEntry{}
+	for _, e := range entries {
+		if owner == "" || e.Owner == owner || strings.HasSuffix(e.Owner, "/"+owner) {
+			list = append(list, e)
+		}
+	}
+	sendResponse(list, w)
+}
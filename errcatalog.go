@@ -0,0 +1,173 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+//The error catalog maps failures to an error code and a one line
+//remediation hint. Failed commands are reported to docker by their name,
+//code and hint only: their arguments and output hold host paths and are
+//unreadable in the output of docker run, so they are only logged. The
+//admin API returns the code and hint as separate fields.
+type catalogEntry struct {
+	Code       string
+	Hint       string
+	signatures []string //Lower case substrings of the command output
+	commands   []string //Names of the commands, see commandName
+}
+
+//Entries are first matched on the output of the command, the first
+//matching entry winning, so more specific entries come first, then on
+//the command
+var errorCatalog = []catalogEntry{
+	{"COMMAND_TIMEOUT", "the command was killed after -exec-timeout, check that docker, the IPDK container and infrap4d respond",
+		[]string{"command timed out after"}, nil},
+	{"DOCKER_UNAVAILABLE", "start the docker daemon, or point DOCKER_HOST at it",
+		[]string{"cannot connect to the docker daemon"}, nil},
+	{"IPDK_CONTAINER_DOWN", "start the IPDK container with docker start ipdk",
+		[]string{"no such container", "is not running"}, nil},
+	{"IPDK_GNMI_UNAVAILABLE", "infrap4d is not reachable, check that it is running in the IPDK container",
+		[]string{"connection refused", "failed to connect to all addresses", "connect failed", "unavailable"}, nil},
+	{"IPDK_HUGEPAGES", "reserve more hugepages on the host, e.g. sysctl -w vm.nr_hugepages=1024",
+		[]string{"hugepage", "cannot allocate memory"}, nil},
+	{"IPDK_PIPELINE_NOT_SET", "load the P4 pipeline with ovs-p4ctl set-pipe before creating networks",
+		[]string{"pipeline not set", "pipeline is not set", "no forwarding pipeline", "failed_precondition"}, nil},
+	{"IPDK_NOT_READY", "the plugin is still waiting for the IPDK container, infrap4d or the P4 pipeline after startup, retry shortly",
+		nil, nil},
+	{"IPDK_PORT_EXISTS", "a port of a previous run is left over, remove it with POST /v1/gc or restart the plugin",
+		[]string{"already exists", "already_exists", "file exists"}, nil},
+	{"NOT_FOUND", "the port, link or entry is already gone",
+		[]string{"cannot find device", "no such device", "not_found"}, nil},
+	{"PERMISSION_DENIED", "run the plugin as root, or with CAP_NET_ADMIN and access to the docker socket",
+		[]string{"operation not permitted", "permission denied"}, nil},
+	{"IPDK_PORT_CREATE_FAILED", "the IPDK target refused the port, check the infrap4d logs in the IPDK container",
+		nil, []string{"gnmi-cli set"}},
+	{"IPDK_PORT_DELETE_FAILED", "the port is left to the garbage collector, see the plugin logs",
+		nil, []string{"gnmi-cli delete"}},
+	{"IPDK_PORT_QUERY_FAILED", "infrap4d could not report on the port, see the plugin logs",
+		nil, []string{"gnmi-cli get"}},
+	{"IPDK_ENTRY_FAILED", "the pipeline refused a table entry, check that the P4 program of the plugin is loaded",
+		nil, []string{"ovs-p4ctl add-entry", "ovs-p4ctl del-entry", "ovs-p4ctl dump-entries"}},
+	{"IPDK_PIPELINE_LOAD_FAILED", "the P4 program could not be compiled or loaded, see the plugin logs",
+		nil, []string{"ovs-p4ctl set-pipe", "p4c --arch"}},
+	{"IPDK_BRIDGE_FAILED", "the bridge could not be created or removed, see the plugin logs",
+		nil, []string{"ovs-vsctl add-br", "ovs-vsctl del-br", "ovs-vsctl list-br"}},
+	{"HOST_LINK_FAILED", "a host network interface could not be set up, see the plugin logs",
+		nil, []string{"ip -o", "ip addr", "ip link"}},
+	{"HOST_SOCKET_DIR_FAILED", "the vhost-user socket directory could not be created or removed, see the plugin logs",
+		nil, nil},
+	{"COMMAND_FAILED", "see the plugin logs", nil, nil},
+	{"INTERNAL", "the plugin hit an internal error, see the plugin logs", nil, nil},
+}
+
+//catalogCode returns the catalog entry of a code. Codes missing from the
+//catalog are a plugin bug: they are logged and reported as INTERNAL.
+func catalogCode(code string) *catalogEntry {
+	for i, e := range errorCatalog {
+		if e.Code == code {
+			return &errorCatalog[i]
+		}
+	}
+	slog.Error("Unknown error code", "code", code)
+	return catalogCode("INTERNAL")
+}
+
+//lookupErrorCatalog returns the catalog entry matching text, or nil.
+//Errors already annotated by the catalog match their own entry.
+func lookupErrorCatalog(text string) *catalogEntry {
+	for i, e := range errorCatalog {
+		if strings.Contains(text, "("+e.Code+": ") {
+			return &errorCatalog[i]
+		}
+	}
+
+	text = strings.ToLower(text)
+	for i, e := range errorCatalog {
+		for _, s := range e.signatures {
+			if strings.Contains(text, s) {
+				return &errorCatalog[i]
+			}
+		}
+	}
+	return nil
+}
+
+//isExist reports whether err is due to an object that exists already
+func isExist(err error) bool {
+	e := lookupErrorCatalog(fmt.Sprint(err))
+	return os.IsExist(err) || e != nil && e.Code == "IPDK_PORT_EXISTS"
+}
+
+//isNotFound reports whether err is due to an object that is gone already
+func isNotFound(err error) bool {
+	e := lookupErrorCatalog(fmt.Sprint(err))
+	return os.IsNotExist(err) || e != nil && e.Code == "NOT_FOUND"
+}
+
+//catalogError is a failure reported by a short description and its
+//catalog entry
+type catalogError struct {
+	msg   string
+	entry *catalogEntry
+}
+
+func (e *catalogError) Error() string {
+	return fmt.Sprintf("%s (%s: %s)", e.msg, e.entry.Code, e.entry.Hint)
+}
+
+//commandError returns the error reported for a failed command, given its
+//output
+func commandError(cmd string, args []string, output string) error {
+	name := commandName(cmd, args)
+	e := lookupErrorCatalog(output)
+	for i := 0; e == nil && i < len(errorCatalog); i++ {
+		for _, c := range errorCatalog[i].commands {
+			if c == name {
+				e = &errorCatalog[i]
+			}
+		}
+	}
+	if e == nil {
+		e = catalogCode("COMMAND_FAILED")
+	}
+	return &catalogError{msg: name + " failed", entry: e}
+}
+
+//hostError returns the error reported for a failed host operation, err
+//being logged. Errors of the catalog are kept as they are.
+func hostError(code string, msg string, err error) error {
+	if e, ok := err.(*catalogError); ok {
+		return e
+	}
+	slog.Warn("Host operation failed", "op", msg, "err", err)
+	e := lookupErrorCatalog(err.Error())
+	if e == nil {
+		e = catalogCode(code)
+	}
+	return &catalogError{msg: msg, entry: e}
+}
+
+//adminListErrorCatalog lists the error codes the plugin may report
+func adminListErrorCatalog(w http.ResponseWriter, r *http.Request) {
+	sendResponse(errorCatalog, w)
+}
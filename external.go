@@ -0,0 +1,121 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+)
+
+//Endpoints reach external destinations through the uplink, a physical
+//port of the pipeline, with their source address translated to the
+//address of the uplink. The pipeline has no connection tracking, so
+//every endpoint is given a block of 256 source ports on the uplink
+//address: ingress.snat rewrites the source address and puts the port
+//into the block of the endpoint, and ingress.unsnat maps replies for the
+//block, which the program exposes as meta.snat_block, back to the
+//endpoint and its port.
+var uplinkPort = flag.Int("uplink-port", 0, "pipeline port of the uplink used for external connectivity, 0 to disable")
+var uplinkIP = flag.String("uplink-ip", "", "address external traffic is translated to (default $IPDK_UPLINK_IP)")
+
+const (
+	snatTable    = "ingress.snat"
+	snatAction   = "ingress.snat_send"
+	unsnatTable  = "ingress.unsnat"
+	unsnatAction = "ingress.unsnat_send"
+
+	//Ports below 1024 are left alone
+	snatMinBlock = 4
+	snatMaxBlock = 255
+)
+
+//externalUplink returns the uplink address, or "" if external
+//connectivity is disabled
+func externalUplink() (string, error) {
+	if *uplinkPort == 0 {
+		return "", nil
+	}
+
+	v := *uplinkIP
+	if ip := net.ParseIP(v); ip == nil || ip.To4() == nil {
+		return "", fmt.Errorf("invalid uplink address %q, set -uplink-ip or IPDK_UPLINK_IP", v)
+	}
+	return v, nil
+}
+
+//allocSNATBlock returns a port block no endpoint uses.
+//epMap must be locked by the caller.
+func allocSNATBlock() (int, error) {
+	used := make(map[int]bool)
+	for _, ep := range epMap.m {
+		used[ep.SNATBlock] = true
+	}
+	for block := snatMinBlock; block <= snatMaxBlock; block++ {
+		if !used[block] {
+			return block, nil
+		}
+	}
+	return 0, fmt.Errorf("all %d SNAT port blocks are in use", snatMaxBlock-snatMinBlock+1)
+}
+
+func snatMatch(ip string) string {
+	return fmt.Sprintf("hdr.ipv4.src_addr=%s", ip)
+}
+
+func unsnatMatch(uplink string, block int) string {
+	return fmt.Sprintf("hdr.ipv4.dst_addr=%s,meta.snat_block=%d", uplink, block)
+}
+
+//programSNAT translates the external traffic of an endpoint to the
+//uplink address
+func programSNAT(endpointID string, nw *nwVal, ep *epVal, uplink string, block int) error {
+	owner := endpointOwner(endpointID)
+	if err := addEntry(owner, nw.Bridge, snatTable, snatMatch(ep.VhostuserPort),
+		fmt.Sprintf("%s(%s,%d,%d)", snatAction, uplink, block, *uplinkPort)); err != nil {
+		return err
+	}
+
+	if err := addEntry(owner, nw.Bridge, unsnatTable, unsnatMatch(uplink, block),
+		fmt.Sprintf("%s(%s,%d)", unsnatAction, ep.VhostuserPort, ep.IpdkInterface)); err != nil {
+		if err := deleteEntry(nw.Bridge, snatTable, snatMatch(ep.VhostuserPort)); err != nil {
+			slog.Error("Unable to remove SNAT entry", "ip", ep.VhostuserPort, "err", err)
+		}
+		return err
+	}
+	return nil
+}
+
+//unprogramSNAT removes the entries installed by programSNAT
+func unprogramSNAT(nw *nwVal, ep *epVal) {
+	if nw == nil || ep.SNATBlock == 0 {
+		return
+	}
+
+	uplink, err := externalUplink()
+	if err != nil || uplink == "" {
+		slog.Error("Unable to remove SNAT entries", "ip", ep.VhostuserPort, "err", err)
+		return
+	}
+	if err := deleteEntry(nw.Bridge, unsnatTable, unsnatMatch(uplink, ep.SNATBlock)); err != nil {
+		slog.Error("Unable to remove SNAT entry", "ip", ep.VhostuserPort, "err", err)
+	}
+	if err := deleteEntry(nw.Bridge, snatTable, snatMatch(ep.VhostuserPort)); err != nil {
+		slog.Error("Unable to remove SNAT entry", "ip", ep.VhostuserPort, "err", err)
+	}
+}
@@ -0,0 +1,164 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+
+	api "github.com/docker/libnetwork/drivers/remote/api"
+)
+
+//Development machines without the IPDK container can still run the same
+//compose files: networks in veth mode are plain Linux bridges, with the
+//gateway address on the bridge, and their endpoints are veth pairs, one
+//end on the bridge and the other moved into the container by docker.
+//None of the features of the pipeline apply to them. A network is created
+//in veth mode with -o com.ipdk.fallback=veth, or whenever the ipdk
+//container is not running if the plugin is started with -veth-fallback.
+var vethFallback = flag.Bool("veth-fallback", false, "create networks in veth mode when the ipdk container is not running")
+
+const (
+	optFallback = "com.ipdk.fallback"
+
+	fallbackVeth = "veth"
+	fallbackNone = "none"
+
+	portTypeVeth = "veth"
+)
+
+//parseFallback returns whether a network is created in veth mode
+func parseFallback(v string) (bool, error) {
+	switch v {
+	case "":
+		return *vethFallback && !caps.IPDK, nil
+	case fallbackVeth:
+		return true, nil
+	case fallbackNone:
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid %s %q, expected %s or %s", optFallback, v, fallbackVeth, fallbackNone)
+}
+
+//fallbackBridge returns the name of the Linux bridge of a veth mode
+//network
+func fallbackBridge(segment int) string {
+	return fmt.Sprintf("ipdkfb%d", segment)
+}
+
+//vethNames returns the names of the bridge and container ends of the
+//veth pair of an interface ID
+func vethNames(intf int) (string, string) {
+	return fmt.Sprintf("ipdkv%d", intf), fmt.Sprintf("ipdkc%d", intf)
+}
+
+//createFallbackBridge creates the Linux bridge of a veth mode network,
+//holding the address of its gateway
+func createFallbackBridge(nw *nwVal) error {
+	if err := requireNetAdmin(); err != nil {
+		return err
+	}
+	gateway := ""
+	if nw.Gateway.IP != nil && nw.GatewayMode != gatewayExternal {
+		gateway = nw.Gateway.String()
+	}
+	if err := host.AddBridgeLink(nw.Bridge, gateway); err != nil {
+		return fmt.Errorf("unable to create bridge %v: %v", nw.Bridge, err)
+	}
+	slog.Info("Created fallback bridge", "bridge", nw.Bridge)
+	return nil
+}
+
+func deleteFallbackBridge(nw *nwVal) {
+	if err := host.DeleteLink(nw.Bridge); err != nil {
+		slog.Error("Unable to delete bridge", "bridge", nw.Bridge, "err", err)
+	}
+}
+
+//createFallbackEndpoint wires an endpoint of a veth mode network and
+//answers its CreateEndpoint request
+func createFallbackEndpoint(w http.ResponseWriter, req *api.CreateEndpointRequest, nw *nwVal, ip net.IP) {
+	resp := api.CreateEndpointResponse{}
+
+	mtu, err := endpointMTU(nw, req.Options)
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+
+	epMap.Lock()
+	defer epMap.Unlock()
+
+	brMap.Lock()
+	defer brMap.Unlock()
+
+	if createdEndpoint(w, req, resp) {
+		return
+	}
+	if other := endpointWithIP(req.NetworkID, ip.String(), true); other != "" {
+		resp.Err = fmt.Sprintf("Error: address %v is already used by endpoint %v", ip, other)
+		sendResponse(resp, w)
+		return
+	}
+
+	intf := allocIntf()
+	link, peer := vethNames(intf)
+	ep := &epVal{
+		IP:            req.Interface.Address,
+		NetworkID:     req.NetworkID,
+		VhostuserPort: ip.String(),
+		IpdkInterface: intf,
+		MTU:           mtu,
+		PortType:      portTypeVeth,
+		Netdev:        peer,
+	}
+	err = dbUpdate(
+		putIntent(req.EndpointID, intentCreate, ep),
+		putCounter("intfCount", brMap.intfCount),
+		putFreeIntfs(brMap.freeIntfs),
+	)
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+
+	if err := host.AddVethLink(VethLink{Name: link, Peer: peer, Master: nw.Bridge, MTU: mtu}); err != nil {
+		finishIntent(req.EndpointID)
+		resp.Err = fmt.Sprintf("Error EndPointCreate: %v", err)
+		sendResponse(resp, w)
+		return
+	}
+
+	epMap.m[req.EndpointID] = ep
+	if err := dbUpdate(putEndpoint(req.EndpointID, ep), delIntent(req.EndpointID)); err != nil {
+		slog.Error("Unable to update db", "err", err, "ip", ip)
+	}
+	slog.Info("Created veth endpoint", "network", req.NetworkID, "endpoint", req.EndpointID, "ip", ip, "config", endpointConfig(ep))
+
+	sendResponse(resp, w)
+}
+
+//deleteFallbackEndpoint deletes the veth pair of an endpoint
+func deleteFallbackEndpoint(ep *epVal) error {
+	link, _ := vethNames(ep.IpdkInterface)
+	return host.DeleteLink(link)
+}
@@ -0,0 +1,202 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+//Every network has a replication group, numbered after its segment,
+//holding the ports of all of its endpoints. Broadcast (ARP, DHCP) and
+//IPv4 multicast frames received from the segment of the network are
+//sent to the group by the ingress.flood table. ovs-p4ctl can't manage
+//the replication engine, so the members of a group are entries of the
+//ingress.flood_group table, keyed on group and on a dense member index
+//the program walks through, and are rewritten as endpoints come and go.
+const (
+	floodTable        = "ingress.flood"
+	floodAction       = "ingress.flood"
+	floodGroupTable   = "ingress.flood_group"
+	floodGroupAction  = "ingress.replicate"
+	floodBroadcastMAC = "ff:ff:ff:ff:ff:ff"
+	floodMulticastMAC = "01:00:5e:00:00:00/25"
+)
+
+func floodMatch(segment int, mac string) string {
+	return fmt.Sprintf("meta.segment_id=%d,hdr.ethernet.dst_addr=%s", segment, mac)
+}
+
+func floodMemberMatch(group int, index int) string {
+	return fmt.Sprintf("meta.flood_group=%d,meta.flood_index=%d", group, index)
+}
+
+//programFlood sends the broadcast and multicast traffic of a network to
+//its replication group
+func programFlood(networkID string, nw *nwVal) error {
+	if nw.Segment == 0 {
+		return nil
+	}
+
+	for i, mac := range []string{floodBroadcastMAC, floodMulticastMAC} {
+		if err := addEntry(networkOwner(networkID), nw.Bridge, floodTable, floodMatch(nw.Segment, mac),
+			fmt.Sprintf("%s(%d)", floodAction, nw.Segment)); err != nil {
+			if i > 0 {
+				removeFloodEntry(nw.Bridge, floodTable, floodMatch(nw.Segment, floodBroadcastMAC))
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+//unprogramFlood removes the entries installed by programFlood and the
+//members of the group
+func unprogramFlood(nw *nwVal) {
+	if nw == nil || nw.Segment == 0 {
+		return
+	}
+
+	for i := range nw.FloodPorts {
+		removeFloodEntry(nw.Bridge, floodGroupTable, floodMemberMatch(nw.Segment, i))
+	}
+	for _, mac := range []string{floodBroadcastMAC, floodMulticastMAC} {
+		removeFloodEntry(nw.Bridge, floodTable, floodMatch(nw.Segment, mac))
+	}
+}
+
+func removeFloodEntry(bridge string, table string, m string) {
+	if err := deleteEntry(bridge, table, m); err != nil {
+		slog.Error("Unable to remove flood entry", "match", m, "err", err)
+	}
+}
+
+func addFloodMember(networkID string, nw *nwVal, index int, intf int) error {
+	return addEntry(networkOwner(networkID), nw.Bridge, floodGroupTable, floodMemberMatch(nw.Segment, index),
+		fmt.Sprintf("%s(%d)", floodGroupAction, intf))
+}
+
+//joinFloodGroup adds the port of an endpoint to the replication group of
+//its network. nwMap must be locked by the caller.
+func joinFloodGroup(networkID string, nw *nwVal, intf int) error {
+	if nw.Segment == 0 {
+		return nil
+	}
+
+	if err := addFloodMember(networkID, nw, len(nw.FloodPorts), intf); err != nil {
+		return err
+	}
+	nw.FloodPorts = append(nw.FloodPorts, intf)
+	return nil
+}
+
+//leaveFloodGroup removes the port of an endpoint from the replication
+//group of its network, moving the last member into its place to keep
+//the member indexes dense. nwMap must be locked by the caller.
+func leaveFloodGroup(networkID string, nw *nwVal, intf int) {
+	if nw == nil || nw.Segment == 0 {
+		return
+	}
+
+	last := len(nw.FloodPorts) - 1
+	for i, port := range nw.FloodPorts {
+		if port != intf {
+			continue
+		}
+
+		if i != last {
+			removeFloodEntry(nw.Bridge, floodGroupTable, floodMemberMatch(nw.Segment, i))
+			if err := addFloodMember(networkID, nw, i, nw.FloodPorts[last]); err != nil {
+				slog.Error("Unable to move port in the flood group", "port", nw.FloodPorts[last], "network", networkID, "err", err)
+			}
+			nw.FloodPorts[i] = nw.FloodPorts[last]
+		}
+		removeFloodEntry(nw.Bridge, floodGroupTable, floodMemberMatch(nw.Segment, last))
+		nw.FloodPorts = nw.FloodPorts[:last]
+		return
+	}
+}
+
+//joinNetworkFloodGroup adds the port of an endpoint being created to the
+//flood group of its network, nwc being the copy of the network the
+//endpoint was reserved with. Other endpoints of the network may be
+//created meanwhile, the port is added after the members the network has
+//by then and the network is updated right away.
+func joinNetworkFloodGroup(networkID string, nwc *nwVal, intf int) error {
+	if nwc.Segment == 0 {
+		return nil
+	}
+	defer lockNetworkMembers(networkID)()
+
+	refreshFloodPorts(networkID, nwc)
+	if err := joinFloodGroup(networkID, nwc, intf); err != nil {
+		return err
+	}
+	storeFloodPorts(networkID, nwc)
+	return nil
+}
+
+//leaveNetworkFloodGroup undoes joinNetworkFloodGroup
+func leaveNetworkFloodGroup(networkID string, nwc *nwVal, intf int) {
+	if nwc.Segment == 0 {
+		return
+	}
+	defer lockNetworkMembers(networkID)()
+
+	refreshFloodPorts(networkID, nwc)
+	leaveFloodGroup(networkID, nwc, intf)
+	storeFloodPorts(networkID, nwc)
+}
+
+//refreshFloodPorts copies the members of the flood group of a network to
+//nwc
+func refreshFloodPorts(networkID string, nwc *nwVal) {
+	nwMap.Lock()
+	defer nwMap.Unlock()
+
+	if nw := nwMap.m[networkID]; nw != nil {
+		nwc.FloodPorts = append([]int(nil), nw.FloodPorts...)
+	}
+}
+
+//storeFloodPorts sets the members of the flood group of a network to
+//those of nwc
+func storeFloodPorts(networkID string, nwc *nwVal) {
+	nwMap.Lock()
+	defer nwMap.Unlock()
+
+	if nw := nwMap.m[networkID]; nw != nil {
+		nw.FloodPorts = nwc.FloodPorts
+		if err := dbUpdate(putNetwork(networkID, nw)); err != nil {
+			slog.Error("Unable to update db", "network", networkID, "err", err)
+		}
+	}
+}
+
+//resyncFloodGroup re-creates the missing members of the replication
+//group of a network
+func resyncFloodGroup(networkID string, nw *nwVal) {
+	for i, intf := range nw.FloodPorts {
+		if isOwnedEntry(nw.Bridge, floodGroupTable, floodMemberMatch(nw.Segment, i)) {
+			continue
+		}
+		slog.Info("Reconcile: re-creating flood group member", "port", intf, "network", networkID)
+		if err := addFloodMember(networkID, nw, i, intf); err != nil {
+			slog.Error("Reconcile: unable to add flood group member", "network", networkID, "err", err)
+		}
+	}
+}
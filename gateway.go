@@ -0,0 +1,151 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+//The gateway of a network is answered for according to
+//-o com.ipdk.gateway_mode:
+//
+//  pipeline  the default, the pipeline answers ARP requests for the
+//            gateway from ingress.arp_responder and ICMP echo requests
+//            from ingress.icmp_responder
+//  host      the gateway address is assigned to a TAP port of the
+//            network on the host, ipdktap<interface ID>, so the host
+//            answers for it and routes the traffic of the network
+//  external  nothing answers for the gateway, a router reachable
+//            through the uplink of the network owns it
+//
+//Networks in veth mode hold the gateway on their Linux bridge unless it
+//is external.
+const (
+	optGatewayMode = "com.ipdk.gateway_mode"
+
+	gatewayPipeline = "pipeline"
+	gatewayHost     = "host"
+	gatewayExternal = "external"
+
+	icmpTable  = "ingress.icmp_responder"
+	icmpAction = "ingress.icmp_echo_reply"
+)
+
+//parseGatewayMode parses the gateway mode option of a network, "" for
+//the default
+func parseGatewayMode(v string) (string, error) {
+	switch v {
+	case "", gatewayPipeline, gatewayHost, gatewayExternal:
+		return v, nil
+	}
+	return "", fmt.Errorf("invalid %s %q, expected %s, %s or %s", optGatewayMode, v, gatewayPipeline, gatewayHost, gatewayExternal)
+}
+
+func icmpMatch(ip string) string {
+	return fmt.Sprintf("hdr.ipv4.dst_addr=%s,hdr.icmp.type=8", ip)
+}
+
+func removeGatewayEntry(bridge string, table string, m string) {
+	if err := deleteEntry(bridge, table, m); err != nil {
+		slog.Error("Unable to remove gateway entry", "match", m, "err", err)
+	}
+}
+
+//programGateway makes the pipeline or the host answer for the gateway of
+//a network, the ARP entry of the gateway being installed by programARP.
+//The network must not be in nwMap, its flood group changes.
+func programGateway(networkID string, nw *nwVal) error {
+	if nw.Gateway.IP == nil {
+		return nil
+	}
+
+	switch nw.GatewayMode {
+	case "", gatewayPipeline:
+		return addEntry(networkOwner(networkID), nw.Bridge, icmpTable, icmpMatch(nw.Gateway.IP.String()), icmpAction)
+	case gatewayHost:
+		return programHostGateway(networkID, nw)
+	}
+	return nil
+}
+
+//programHostGateway creates the TAP port holding the gateway address on
+//the host and connects it to the network like an endpoint
+func programHostGateway(networkID string, nw *nwVal) error {
+	if err := requireNetAdmin(); err != nil {
+		return err
+	}
+	if err := createTapPort(nw.GatewayPort, nw.MTU); err != nil {
+		return err
+	}
+
+	link := tapName(nw.GatewayPort)
+	mac, err := gatewayMAC(nw)
+	if err == nil {
+		err = host.SetLinkMAC(link, mac)
+	}
+	if err == nil {
+		err = host.AddLinkAddr(link, nw.Gateway.String())
+	}
+	if err != nil {
+		err = hostError("HOST_LINK_FAILED", "setting up the gateway link failed", err)
+	}
+
+	owner := networkOwner(networkID)
+	if err == nil {
+		err = addEntry(owner, nw.Bridge, segmentTable, segmentMatch(nw.GatewayPort),
+			fmt.Sprintf("%s(%d)", segmentAction, nw.Segment))
+	}
+	if err == nil {
+		if err = addHostEntry(owner, nw.Bridge, nw.Gateway.IP.String(), nw.GatewayPort); err != nil {
+			removeGatewayEntry(nw.Bridge, segmentTable, segmentMatch(nw.GatewayPort))
+		}
+	}
+	if err == nil {
+		if err = joinFloodGroup(networkID, nw, nw.GatewayPort); err != nil {
+			removeGatewayEntry(nw.Bridge, "ingress.ipv4_host", hostEntryMatch(nw.Gateway.IP.String()))
+			removeGatewayEntry(nw.Bridge, segmentTable, segmentMatch(nw.GatewayPort))
+		}
+	}
+	if err != nil {
+		if err := deleteTapPort(nw.GatewayPort); err != nil {
+			slog.Error("Unable to delete gateway port", "network", networkID, "err", err)
+		}
+		return err
+	}
+	return nil
+}
+
+//unprogramGateway removes what programGateway installed. The network must
+//not be in nwMap.
+func unprogramGateway(networkID string, nw *nwVal) {
+	if nw == nil || nw.Gateway.IP == nil {
+		return
+	}
+
+	switch nw.GatewayMode {
+	case "", gatewayPipeline:
+		removeGatewayEntry(nw.Bridge, icmpTable, icmpMatch(nw.Gateway.IP.String()))
+	case gatewayHost:
+		leaveFloodGroup(networkID, nw, nw.GatewayPort)
+		removeGatewayEntry(nw.Bridge, "ingress.ipv4_host", hostEntryMatch(nw.Gateway.IP.String()))
+		removeGatewayEntry(nw.Bridge, segmentTable, segmentMatch(nw.GatewayPort))
+		if err := deleteTapPort(nw.GatewayPort); err != nil {
+			slog.Error("Unable to delete gateway port", "network", networkID, "err", err)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var gcInterval = flag.Duration("gc-interval", time.Hour, "interval between garbage collections of orphaned dataplane artifacts, 0 to disable")
+
+//gcReport lists the orphaned artifacts removed by a garbage collection
+type gcReport struct {
+	Entries    []string
+	Links      []string
+	SocketDirs []string
+	VhostPorts []int
+	Bridges    []string
+	Interfaces []int //Interface IDs put back on the free list
+}
+
+//gcRuns serializes the garbage collections, which run without holding the
+//map locks, with each other and with db restores
+var gcRuns sync.Mutex
+
+//gcState is what the networks and endpoints use, as the garbage collector
+//found it
+type gcState struct {
+	networks  map[string]bool
+	endpoints map[string]bool
+	links     map[string]bool
+	dirs      map[string]bool
+	intfs     map[int]bool //Used or free
+	intfCount int
+	bridges   map[string]bool
+	brCount   int
+}
+
+//snapshotGarbageState returns what the networks and endpoints use. It
+//waits for the network being created or deleted, if any: the artifacts of
+//a network are only known once it is in nwMap.
+func snapshotGarbageState() gcState {
+	networkChanges.Lock()
+	defer networkChanges.Unlock()
+
+	nwMap.Lock()
+	defer nwMap.Unlock()
+
+	epMap.Lock()
+	defer epMap.Unlock()
+
+	brMap.Lock()
+	defer brMap.Unlock()
+
+	s := gcState{
+		networks:  make(map[string]bool),
+		endpoints: make(map[string]bool),
+		links:     make(map[string]bool),
+		dirs:      make(map[string]bool),
+		intfs:     usedIntfs(),
+		intfCount: brMap.intfCount,
+		bridges:   make(map[string]bool),
+		brCount:   brMap.brCount,
+	}
+	for id := range nwMap.m {
+		s.networks[id] = true
+	}
+	for id, ep := range allEndpoints() {
+		s.endpoints[id] = true
+		s.links[dummyLink(ep)] = true
+		s.dirs[endpointSocketDir(ep)] = true
+	}
+	for _, intf := range brMap.freeIntfs {
+		s.intfs[intf] = true
+	}
+	for _, bridge := range networkBridges() {
+		s.bridges[bridge] = true
+	}
+	return s
+}
+
+//endpointUses reports whether an endpoint, created or being created, uses
+//a dummy link or socket directory. An endpoint created since the state
+//was taken may have been given the name of an orphan.
+func endpointUses(link string, dir string) bool {
+	epMap.Lock()
+	defer epMap.Unlock()
+
+	for _, ep := range allEndpoints() {
+		if (link != "" && dummyLink(ep) == link) || (dir != "" && endpointSocketDir(ep) == dir) {
+			return true
+		}
+	}
+	return false
+}
+
+//collectGarbage removes the artifacts that no known network or endpoint
+//uses: plugin owned pipeline entries, dummy links and vhost-user socket
+//directories named after an endpoint IP, and vhost-user ports with an
+//interface ID that was handed out but is not in use. Endpoints being
+//created are in use.
+//
+//The map locks are not held while the artifacts are removed. The
+//artifacts are listed before the networks and endpoints are looked at, so
+//that those created meanwhile are not taken for orphans, and the names an
+//endpoint may get again are checked once more right before their removal.
+//Interface and bridge IDs that are not in use are not handed out again
+//until reclaimed. gcRuns must be held by the caller.
+func collectGarbage() gcReport {
+	report := gcReport{
+		Entries:    []string{},
+		Links:      []string{},
+		SocketDirs: []string{},
+		VhostPorts: []int{},
+		Bridges:    []string{},
+		Interfaces: []int{},
+	}
+
+	//Socket directories live under -vhost-dir, the directories selected
+	//for networks and the legacy location
+	nwMap.Lock()
+	bases := map[string]bool{*vhostDir: true}
+	for _, nw := range nwMap.m {
+		if nw.VhostDir != "" {
+			bases[nw.VhostDir] = true
+		}
+	}
+	nwMap.Unlock()
+
+	var entries map[string]pipelineEntry
+	var err error
+	if !caps.Docker {
+		slog.Info("GC: skipping pipeline entries and vhost ports", "reason", requireDocker())
+	} else if entries, err = ownedEntries(); err != nil {
+		slog.Error("GC: unable to list owned entries", "err", err)
+	}
+
+	//Dummy links created by the plugin are named after -link-name, or
+	//after the endpoint IP
+	var dummies map[string]bool
+	if !caps.NetAdmin {
+		slog.Info("GC: skipping dummy links", "reason", requireNetAdmin())
+	} else if dummies, err = dummyLinks(); err != nil {
+		slog.Error("GC: unable to list dummy links", "err", err)
+	}
+
+	dirs, _ := filepath.Glob(legacySocketDirPrefix + "*")
+	for base := range bases {
+		if d, err := filepath.Glob(filepath.Join(base, "*")); err != nil {
+			slog.Error("GC: unable to list socket directories", "dir", base, "err", err)
+		} else {
+			dirs = append(dirs, d...)
+		}
+	}
+
+	state := snapshotGarbageState()
+
+	for key, e := range entries {
+		var inUse bool
+		switch {
+		case strings.HasPrefix(e.Owner, "network/"):
+			inUse = state.networks[strings.TrimPrefix(e.Owner, "network/")]
+		case strings.HasPrefix(e.Owner, "endpoint/"):
+			inUse = state.endpoints[strings.TrimPrefix(e.Owner, "endpoint/")]
+		}
+		if inUse || !sameEntry(key, e) {
+			continue
+		}
+		slog.Info("GC: deleting orphaned entry", "key", key, "owner", e.Owner)
+		if err := deleteEntry(e.Bridge, e.Table, e.Match); err != nil {
+			slog.Error("GC: unable to delete entry", "key", key, "err", err)
+			continue
+		}
+		report.Entries = append(report.Entries, key)
+	}
+
+	for link := range dummies {
+		if state.links[link] || !isEndpointLink(link) || endpointUses(link, "") {
+			continue
+		}
+		slog.Info("GC: deleting orphaned dummy link", "link", link)
+		if err := deleteDummyLink(link); err != nil {
+			slog.Error("GC: unable to delete dummy link", "link", link, "err", err)
+			continue
+		}
+		report.Links = append(report.Links, link)
+	}
+
+	for _, dir := range dirs {
+		ip := strings.TrimPrefix(filepath.Base(dir), filepath.Base(legacySocketDirPrefix))
+		if state.dirs[dir] || net.ParseIP(ip) == nil || endpointUses("", dir) {
+			continue
+		}
+		slog.Info("GC: removing orphaned socket directory", "dir", dir)
+		if err := removeSocketDir(dir); err != nil {
+			slog.Error("GC: unable to remove socket directory", "dir", dir, "err", err)
+			continue
+		}
+		report.SocketDirs = append(report.SocketDirs, dir)
+	}
+
+	//gNMI can't list virtual devices, probe every ID handed out so far
+	for intf := 1; caps.Docker && intf < state.intfCount; intf++ {
+		if state.intfs[intf] || !vhostPortExists(intf) {
+			continue
+		}
+		slog.Info("GC: deleting orphaned vhost port", "port", intf)
+		if err := deleteVhostPort(intf); err != nil {
+			slog.Error("GC: unable to delete vhost port", "port", intf, "err", err)
+			continue
+		}
+		report.VhostPorts = append(report.VhostPorts, intf)
+	}
+
+	//Bridges created for networks are named after a bridge ID handed out
+	//by the plugin
+	if caps.Docker && *bridgePerNetwork {
+		if bridges, err := listBridges(); err != nil {
+			slog.Error("GC: unable to list bridges", "err", err)
+		} else {
+			for id := 1; id < state.brCount; id++ {
+				bridge := networkBridge(id)
+				if state.bridges[bridge] || !bridges[bridge] {
+					continue
+				}
+				slog.Info("GC: deleting orphaned bridge", "bridge", bridge)
+				if err := deleteBridge(bridge); err != nil {
+					slog.Error("GC: unable to delete bridge", "bridge", bridge, "err", err)
+					continue
+				}
+				report.Bridges = append(report.Bridges, bridge)
+			}
+		}
+	}
+
+	return report
+}
+
+//gc collects the garbage, then reclaims the unused interface IDs. Driver
+//requests go on meanwhile, only network creations and deletions wait for
+//the state of the networks to be taken.
+func gc() gcReport {
+	gcRuns.Lock()
+	defer gcRuns.Unlock()
+
+	report := collectGarbage()
+	if caps.Docker {
+		report.Interfaces = reclaimIntfs()
+	}
+	return report
+}
+
+func gcLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		gc()
+	}
+}
+
+func adminGC(w http.ResponseWriter, r *http.Request) {
+	sendResponse(gc(), w)
+}
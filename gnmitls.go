@@ -0,0 +1,114 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+//Two tools the plugin runs in the ipdk container talk to infrap4d: gnmi-cli
+//over its gNMI service to manage the ports, and ovs-p4ctl over P4Runtime
+//to manage the pipeline entries when it is a build talking gRPC to
+//infrap4d rather than going through ovs-vswitchd. Each of them is a
+//target with its own address and TLS credentials: a CA bundle turns TLS
+//on, a client certificate and key are presented when infrap4d requires
+//clients to authenticate, and the server name overrides the name the
+//certificate of infrap4d is checked against. The files are paths in the
+//ipdk container, so they are checked by the tools rather than by the
+//plugin.
+type grpcTarget struct {
+	name       string //Prefix of the flags of the target
+	tool       string //Command talking to the target
+	addr       *string
+	caCert     *string
+	clientCert *string
+	clientKey  *string
+	serverName *string
+}
+
+func newGRPCTarget(name string, tool string, service string) *grpcTarget {
+	return &grpcTarget{
+		name:       name,
+		tool:       tool,
+		addr:       flag.String(name+"-addr", "", "gRPC address of the "+service+" service of infrap4d used by "+tool+", empty for the default of "+tool),
+		caCert:     flag.String(name+"-ca-cert", "", "CA bundle in the ipdk container verifying the certificate of infrap4d for "+tool+", empty for an insecure channel"),
+		clientCert: flag.String(name+"-client-cert", "", "client certificate in the ipdk container presented to infrap4d by "+tool),
+		clientKey:  flag.String(name+"-client-key", "", "key in the ipdk container of the client certificate of "+tool),
+		serverName: flag.String(name+"-server-name", "", "name the certificate of infrap4d is checked against by "+tool+", empty for the host of the address"),
+	}
+}
+
+var grpcTargets = []*grpcTarget{
+	newGRPCTarget("gnmi", "gnmi-cli", "gNMI"),
+	newGRPCTarget("p4rt", "ovs-p4ctl", "P4Runtime"),
+}
+
+//check checks that the TLS settings of a target go together
+func (t *grpcTarget) check() error {
+	if (*t.clientCert == "") != (*t.clientKey == "") {
+		return fmt.Errorf("-%s-client-cert and -%s-client-key must be set together", t.name, t.name)
+	}
+	if *t.clientCert != "" && *t.caCert == "" {
+		return fmt.Errorf("-%s-client-cert needs -%s-ca-cert, %s ignores client certificates on insecure channels", t.name, t.name, t.tool)
+	}
+	if *t.serverName != "" && *t.caCert == "" {
+		return fmt.Errorf("-%s-server-name needs -%s-ca-cert, there is no certificate to check on insecure channels", t.name, t.name)
+	}
+	return nil
+}
+
+//args returns the flags of the tool of a target selecting the address of
+//infrap4d and the credentials of the channel. They go after the other
+//arguments so that commands keep their names, see commandName.
+func (t *grpcTarget) args() []string {
+	var args []string
+	if *t.addr != "" {
+		args = append(args, "--grpc_addr="+*t.addr)
+	}
+	if *t.caCert != "" {
+		args = append(args, "--ca_cert="+*t.caCert)
+	}
+	if *t.clientCert != "" {
+		args = append(args, "--client_cert="+*t.clientCert, "--client_key="+*t.clientKey)
+	}
+	if *t.serverName != "" {
+		args = append(args, "--server_name="+*t.serverName)
+	}
+	return args
+}
+
+//checkGRPCTargets checks the settings of every target
+func checkGRPCTargets() error {
+	for _, t := range grpcTargets {
+		if err := t.check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//grpcArgs returns the flags of a command run in the ipdk container for
+//the target it talks to, if any
+func grpcArgs(tool string) []string {
+	for _, t := range grpcTargets {
+		if t.tool == tool {
+			return t.args()
+		}
+	}
+	return nil
+}
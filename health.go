@@ -0,0 +1,119 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+//Orchestrators and monitoring probe the plugin on /healthz and /readyz.
+//The plugin is healthy when its state store accepts writes and infrap4d
+//answers gNMI requests, and ready once the P4 pipeline of the default
+//bridge answers P4Runtime requests too and the startup wait for the
+//dataplane is over, as no endpoint can be created before.
+//Both answer 200 with the result of every check, or 503 if one of them
+//failed. The dataplane checks are skipped when the plugin runs without
+//the ipdk container, as then only the IPAM driver or veth networks are
+//available.
+
+//healthProbe is a record written to the global table by every probe
+const healthProbe = "healthz"
+
+type healthReport struct {
+	Status string
+	Checks map[string]string
+}
+
+//checkStore verifies that the state store accepts writes
+func checkStore() error {
+	return dbAdd("global", healthProbe, time.Now().Unix())
+}
+
+//checkGNMI verifies that infrap4d answers gNMI requests. The probe asks
+//for a port that may not exist, any answer of infrap4d will do.
+func checkGNMI() error {
+	netname, _ := vhostNames(0)
+	_, err := ipdkExec("gnmi-cli", "get", fmt.Sprintf("device:virtual-device,name:%s,device-type", netname))
+	if err != nil && gnmiUnreachable(err) {
+		return err
+	}
+	return nil
+}
+
+//gnmiUnreachable reports whether a gNMI request failed for lack of an
+//answer of infrap4d
+func gnmiUnreachable(err error) bool {
+	if e := lookupErrorCatalog(err.Error()); e != nil {
+		switch e.Code {
+		case "DOCKER_UNAVAILABLE", "IPDK_CONTAINER_DOWN", "IPDK_GNMI_UNAVAILABLE":
+			return true
+		}
+	}
+	return false
+}
+
+//checkPipeline verifies that the pipeline of the default bridge is
+//loaded and answers P4Runtime requests
+func checkPipeline() error {
+	_, err := dumpHostEntries(defaultBridge)
+	return err
+}
+
+//runHealthChecks runs checks in order, the dataplane ones only if the
+//ipdk container was found at startup
+func runHealthChecks(checks ...string) healthReport {
+	funcs := map[string]func() error{
+		"store":    checkStore,
+		"gnmi":     checkGNMI,
+		"pipeline": checkPipeline,
+		"startup":  checkStartup,
+	}
+
+	report := healthReport{Status: "ok", Checks: make(map[string]string)}
+	for _, name := range checks {
+		if name != "store" && name != "startup" && !caps.IPDK {
+			report.Checks[name] = "skipped"
+			continue
+		}
+		if err := funcs[name](); err != nil {
+			slog.Warn("Health check failed", "check", name, "err", err)
+			report.Checks[name] = err.Error()
+			report.Status = "failing"
+			continue
+		}
+		report.Checks[name] = "ok"
+	}
+	return report
+}
+
+func sendHealthReport(w http.ResponseWriter, report healthReport) {
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	sendResponse(report, w)
+}
+
+func handlerHealthz(w http.ResponseWriter, r *http.Request) {
+	sendHealthReport(w, runHealthChecks("store", "gnmi"))
+}
+
+func handlerReadyz(w http.ResponseWriter, r *http.Request) {
+	sendHealthReport(w, runHealthChecks("store", "startup", "gnmi", "pipeline"))
+}
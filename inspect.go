@@ -0,0 +1,252 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+)
+
+//GET /v1/networks and /v1/endpoints list the networks and endpoints known
+//to the plugin, and /v1/networks/{id} and /v1/endpoints/{id} show one of
+//them, along with what the dataplane has of them: whether the bridge of a
+//network exists, and whether the port and host entry of an endpoint are
+//in place. ?status=false leaves the dataplane out, which is much faster
+//on hosts with many endpoints. Tenants only see their own, see
+//tenants.go.
+
+//networkStatus is the dataplane state of a network
+type networkStatus struct {
+	BridgePresent bool
+	Error         string `json:",omitempty"`
+}
+
+type networkState struct {
+	ID        string
+	Network   nwVal
+	Endpoints []string
+	Status    *networkStatus `json:",omitempty"`
+}
+
+//endpointStatus is the dataplane state of an endpoint. The port of VF and
+//veth endpoints and the host entry of veth endpoints are not in the
+//pipeline and are always reported present.
+type endpointStatus struct {
+	PortPresent  bool
+	EntryPresent bool
+	Error        string `json:",omitempty"`
+}
+
+type endpointState struct {
+	ID       string
+	Endpoint epVal
+	Status   *endpointStatus `json:",omitempty"`
+}
+
+//inspectNetworks returns the state of the networks whose ID is in ids,
+//or of all of them if ids is nil
+func inspectNetworks(ids map[string]bool, status bool) []networkState {
+	nwMap.Lock()
+	epMap.Lock()
+	var states []networkState
+	for id, nw := range nwMap.m {
+		if ids == nil || ids[id] {
+			states = append(states, networkState{ID: id, Network: *nw, Endpoints: []string{}})
+		}
+	}
+	for i := range states {
+		for epID, ep := range epMap.m {
+			if ep.NetworkID == states[i].ID {
+				states[i].Endpoints = append(states[i].Endpoints, epID)
+			}
+		}
+		sort.Strings(states[i].Endpoints)
+	}
+	epMap.Unlock()
+	nwMap.Unlock()
+
+	sort.Slice(states, func(i, j int) bool { return states[i].ID < states[j].ID })
+	if !status {
+		return states
+	}
+
+	//The dataplane is queried without holding any lock
+	var bridges map[string]bool
+	var err error
+	if caps.IPDK {
+		bridges, err = listBridges()
+	}
+	for i := range states {
+		nw := &states[i].Network
+		s := &networkStatus{BridgePresent: true}
+		switch {
+		case nw.Fallback || nw.Bridge == defaultBridge:
+		case !caps.IPDK:
+			s.Error = requireDocker().Error()
+		case err != nil:
+			s.Error = err.Error()
+		default:
+			s.BridgePresent = bridges[nw.Bridge]
+		}
+		states[i].Status = s
+	}
+	return states
+}
+
+//inspectEndpoints returns the state of the endpoints whose ID is in ids,
+//or of all of them if ids is nil
+func inspectEndpoints(ids map[string]bool, status bool) []endpointState {
+	nwMap.Lock()
+	epMap.Lock()
+	var states []endpointState
+	bridges := make(map[string]string)
+	for id, ep := range epMap.m {
+		if ids != nil && !ids[id] {
+			continue
+		}
+		states = append(states, endpointState{ID: id, Endpoint: *ep})
+		if nw, ok := nwMap.m[ep.NetworkID]; ok && !nw.Fallback {
+			bridges[id] = nw.Bridge
+		}
+	}
+	epMap.Unlock()
+	nwMap.Unlock()
+
+	sort.Slice(states, func(i, j int) bool { return states[i].ID < states[j].ID })
+	if !status {
+		return states
+	}
+
+	//Host entries of each bridge, dumped on first use
+	dumps := make(map[string]map[string]int)
+	for i := range states {
+		ep := &states[i].Endpoint
+		s := &endpointStatus{PortPresent: true, EntryPresent: true}
+		states[i].Status = s
+		if ep.PortType == portTypeVeth {
+			continue
+		}
+		if !caps.IPDK {
+			s.PortPresent, s.EntryPresent = false, false
+			s.Error = requireDocker().Error()
+			continue
+		}
+
+		if device := portDevice(ep); device != "" {
+			s.PortPresent = deviceExists(device)
+		}
+
+		bridge, ok := bridges[states[i].ID]
+		if !ok {
+			s.EntryPresent = false
+			s.Error = "unknown network " + ep.NetworkID
+			continue
+		}
+		entries, ok := dumps[bridge]
+		if !ok {
+			var err error
+			if entries, err = dumpHostEntries(bridge); err != nil {
+				s.EntryPresent = false
+				s.Error = err.Error()
+				continue
+			}
+			dumps[bridge] = entries
+		}
+		port, ok := entries[ep.VhostuserPort]
+		s.EntryPresent = ok && port == ep.IpdkInterface
+	}
+	return states
+}
+
+//statusRequested reports whether the dataplane state is requested, it
+//is unless ?status=false
+func statusRequested(r *http.Request) bool {
+	return r.URL.Query().Get("status") != "false"
+}
+
+func adminListNetworks(w http.ResponseWriter, r *http.Request) {
+	states := inspectNetworks(tenantNetworks(requestTenant(r)), statusRequested(r))
+	if states == nil {
+		states = []networkState{}
+	}
+	sendResponse(states, w)
+}
+
+func adminGetNetwork(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	states := inspectNetworks(map[string]bool{id: true}, statusRequested(r))
+	if len(states) == 0 {
+		adminError(w, http.StatusNotFound, "network %s not found", id)
+		return
+	}
+	sendResponse(states[0], w)
+}
+
+func adminListEndpoints(w http.ResponseWriter, r *http.Request) {
+	states := inspectEndpoints(tenantEndpoints(requestTenant(r)), statusRequested(r))
+	if states == nil {
+		states = []endpointState{}
+	}
+	sendResponse(states, w)
+}
+
+func adminGetEndpoint(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	states := inspectEndpoints(map[string]bool{id: true}, statusRequested(r))
+	if len(states) == 0 {
+		adminError(w, http.StatusNotFound, "endpoint %s not found", id)
+		return
+	}
+	sendResponse(states[0], w)
+}
+
+//forceDeleteReport is the outcome of a forced endpoint deletion
+type forceDeleteReport struct {
+	Err string `json:",omitempty"` //Error of the deletion, if it failed
+	GC  gcReport
+}
+
+//adminDeleteEndpoint deletes an endpoint docker no longer knows about, or
+//whose deletion is stuck. The endpoint is forgotten even if the deletion
+//fails half way, and whatever it left behind is garbage collected.
+func adminDeleteEndpoint(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	epMap.Lock()
+	ep, ok := epMap.m[id]
+	networkID := ""
+	if ok {
+		networkID = ep.NetworkID
+	}
+	epMap.Unlock()
+	if !ok {
+		adminError(w, http.StatusNotFound, "endpoint %s not found", id)
+		return
+	}
+
+	report := forceDeleteReport{}
+	err := driverRequest(serialized("NetworkDriver.DeleteEndpoint", handlerDeleteEndpoint), map[string]string{"NetworkID": networkID, "EndpointID": id})
+	if err != nil {
+		slog.Warn("Forced deletion of endpoint failed", "endpoint", id, "err", err)
+		report.Err = err.Error()
+	}
+	report.GC = gc()
+	sendResponse(report, w)
+}
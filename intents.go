@@ -0,0 +1,171 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+//Creating or deleting an endpoint takes many steps against infrap4d and
+//the kernel, and the plugin may crash half way through. Both operations
+//follow the same protocol so that the plugin knows afterwards what must
+//exist:
+//
+//  1. An intent record naming the endpoint, its port and interface ID is
+//     written, along with the removal of the endpoint record on delete.
+//  2. The dataplane is changed.
+//  3. On create, the endpoint record is written and the intent dropped
+//     in the same transaction. On delete, the intent is dropped once the
+//     port and link are gone.
+//
+//An endpoint record thus only exists for an endpoint that was completely
+//created, and an intent left at startup belongs to an endpoint that must
+//not exist: its creation didn't complete, or its deletion did start.
+//Whatever it left in the dataplane is removed before the plugin serves
+//requests.
+const (
+	intentCreate = "create"
+	intentDelete = "delete"
+)
+
+//intent is the record of an endpoint operation in progress
+type intent struct {
+	Op       string
+	Endpoint *epVal
+	Started  time.Time
+}
+
+//recoverIntents removes what the endpoint operations interrupted by a
+//crash left in the dataplane, and drops their intents
+func recoverIntents() error {
+	intents, err := loadIntents()
+	if err != nil || len(intents) == 0 {
+		return err
+	}
+
+	nwMap.Lock()
+	defer nwMap.Unlock()
+
+	epMap.Lock()
+	defer epMap.Unlock()
+
+	brMap.Lock()
+	defer brMap.Unlock()
+
+	var ops []dbOp
+	for id, in := range intents {
+		slog.Info("Recovery: removing the endpoint of an interrupted operation", "op", in.Op, "endpoint", id, "started", in.Started)
+		if _, ok := epMap.m[id]; !ok && in.Endpoint != nil {
+			teardownEndpoint(id, in.Endpoint)
+		}
+		ops = append(ops, delIntent(id))
+	}
+	return dbUpdate(ops...)
+}
+
+//teardownEndpoint removes the entries, port, link and socket directory of
+//an endpoint, leaving alone those another endpoint or network uses.
+//nwMap, epMap and brMap must be locked by the caller.
+func teardownEndpoint(id string, ep *epVal) {
+	removeOwnedEntries(endpointOwner(id))
+
+	used := usedIntfs()
+	ipUsed, linkUsed := false, false
+	for _, other := range allEndpoints() {
+		ipUsed = ipUsed || other.VhostuserPort == ep.VhostuserPort
+		linkUsed = linkUsed || (other.PortType == "" && dummyLink(other) == dummyLink(ep))
+	}
+
+	if nw := nwMap.m[ep.NetworkID]; nw != nil && !used[ep.IpdkInterface] {
+		leaveFloodGroup(ep.NetworkID, nw, ep.IpdkInterface)
+		trimFloodGroup(ep.NetworkID, nw)
+		if err := dbUpdate(putNetwork(ep.NetworkID, nw)); err != nil {
+			slog.Error("Unable to update db", "network", ep.NetworkID, "err", err)
+		}
+	}
+
+	switch {
+	case used[ep.IpdkInterface]:
+	case ep.PortType == portTypeVeth:
+		if err := deleteFallbackEndpoint(ep); err != nil && !isNotFound(err) {
+			slog.Error("Recovery: unable to delete veth pair", "endpoint", id, "err", err)
+		}
+	case ep.PortType == portTypeTAP:
+		if err := deleteTapPort(ep.IpdkInterface); err != nil {
+			slog.Info("Recovery: couldn't delete TAP port", "endpoint", id, "port", tapName(ep.IpdkInterface), "err", err)
+		}
+	case ep.PortType == "":
+		if vhostPortExists(ep.IpdkInterface) {
+			if err := deleteVhostPort(ep.IpdkInterface); err != nil {
+				slog.Error("Recovery: unable to delete vhost port", "endpoint", id, "port", ep.IpdkInterface, "err", err)
+			}
+		}
+	}
+
+	if ep.Mirror != nil && ep.Mirror.Capture != "" && !used[ep.Mirror.Port] {
+		if err := deleteTapPort(ep.Mirror.Port); err != nil {
+			slog.Info("Recovery: couldn't delete capture port", "endpoint", id, "port", tapName(ep.Mirror.Port), "err", err)
+		}
+	}
+
+	if ep.PortType != "" {
+		return
+	}
+	if !linkUsed {
+		if err := deleteDummyLink(dummyLink(ep)); err != nil && !isNotFound(err) {
+			slog.Error("Recovery: unable to delete dummy link", "endpoint", id, "link", dummyLink(ep), "err", err)
+		}
+	}
+	if ipUsed {
+		return
+	}
+	if err := removeSocketDir(endpointSocketDir(ep)); err != nil {
+		slog.Error("Recovery: unable to remove socket directory", "endpoint", id, "err", err)
+	}
+}
+
+//trimFloodGroup removes the members of the replication group of a
+//network beyond its flood ports, which an interrupted creation may have
+//added
+func trimFloodGroup(networkID string, nw *nwVal) {
+	if nw.Segment == 0 {
+		return
+	}
+	entries, err := ownedEntries()
+	if err != nil {
+		slog.Error("Unable to list owned entries", "network", networkID, "err", err)
+		return
+	}
+
+	members := make(map[string]bool)
+	for i := range nw.FloodPorts {
+		members[floodMemberMatch(nw.Segment, i)] = true
+	}
+	for _, e := range entries {
+		if e.Owner == networkOwner(networkID) && e.Bridge == nw.Bridge && e.Table == floodGroupTable && !members[e.Match] {
+			removeFloodEntry(e.Bridge, e.Table, e.Match)
+		}
+	}
+}
+
+//finishIntent drops the intent of an endpoint whose deletion completed
+func finishIntent(id string) {
+	if err := dbUpdate(delIntent(id)); err != nil {
+		slog.Error("Unable to update db", "endpoint", id, "err", err)
+	}
+}
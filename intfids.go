@@ -0,0 +1,160 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+)
+
+//Interface IDs name the vhost-user, TAP and physical ports of the IPDK
+//target, and are their pipeline port numbers. They are handed out from
+//brMap.intfCount, which would otherwise only grow on a long-lived host.
+//The garbage collector puts the IDs no network or endpoint uses on a
+//free list once infrap4d confirms that no port of theirs is left, and
+//they are handed out again, lowest first, before the counter moves on.
+
+//allocIntf hands out an interface ID. brMap must be locked by the
+//caller, who stores the counter and the free list along with the user
+//of the ID.
+func allocIntf() int {
+	if len(brMap.freeIntfs) > 0 {
+		intf := brMap.freeIntfs[0]
+		brMap.freeIntfs = brMap.freeIntfs[1:]
+		return intf
+	}
+	intf := brMap.intfCount
+	brMap.intfCount = brMap.intfCount + 1
+	return intf
+}
+
+//usedIntfs returns the interface IDs of the networks and endpoints,
+//created or being created. nwMap and epMap must be locked by the caller.
+func usedIntfs() map[int]bool {
+	used := make(map[int]bool)
+	for _, nw := range nwMap.m {
+		if nw.UplinkPort != 0 {
+			used[nw.UplinkPort] = true
+		}
+		if nw.GatewayPort != 0 {
+			used[nw.GatewayPort] = true
+		}
+	}
+	for _, ep := range allEndpoints() {
+		used[ep.IpdkInterface] = true
+		if ep.Mirror != nil {
+			used[ep.Mirror.Port] = true
+		}
+	}
+	return used
+}
+
+//gnmiDeviceGone reports whether infrap4d answered that a device does not
+//exist, as opposed to not answering at all
+func gnmiDeviceGone(kind string, name string) bool {
+	_, err := ipdkExec("gnmi-cli", "get", fmt.Sprintf("device:%s,name:%s,device-type", kind, name))
+	return err != nil && !gnmiUnreachable(err)
+}
+
+//intfPortsGone reports whether no port of any type is left for an
+//interface ID
+func intfPortsGone(intf int) bool {
+	link, _ := vethNames(intf)
+	if _, err := net.InterfaceByName(link); err == nil {
+		return false
+	}
+
+	netname, _ := vhostNames(intf)
+	return gnmiDeviceGone("virtual-device", netname) &&
+		gnmiDeviceGone("virtual-device", tapName(intf)) &&
+		gnmiDeviceGone("physical-device", physicalPortName(intf))
+}
+
+//unusedIntfs returns the interface IDs handed out that are neither used
+//nor on the free list. nwMap, epMap and brMap must be locked by the
+//caller.
+func unusedIntfs() map[int]bool {
+	used := usedIntfs()
+	for _, intf := range brMap.freeIntfs {
+		used[intf] = true
+	}
+
+	unused := make(map[int]bool)
+	for intf := 1; intf < brMap.intfCount; intf++ {
+		if !used[intf] {
+			unused[intf] = true
+		}
+	}
+	return unused
+}
+
+//reclaimIntfs puts the interface IDs handed out but no longer used on the
+//free list once their ports are confirmed gone, and returns them. The
+//ports are probed without holding the map locks: an ID that is neither
+//used nor free is not handed out meanwhile. gcRuns must be held by the
+//caller, so that no other collection reclaims the same IDs.
+func reclaimIntfs() []int {
+	nwMap.Lock()
+	epMap.Lock()
+	brMap.Lock()
+	candidates := unusedIntfs()
+	brMap.Unlock()
+	epMap.Unlock()
+	nwMap.Unlock()
+
+	gone := []int{}
+	for intf := range candidates {
+		if intfPortsGone(intf) {
+			gone = append(gone, intf)
+		}
+	}
+	if len(gone) == 0 {
+		return gone
+	}
+
+	nwMap.Lock()
+	defer nwMap.Unlock()
+
+	epMap.Lock()
+	defer epMap.Unlock()
+
+	brMap.Lock()
+	defer brMap.Unlock()
+
+	//A db restore may have changed the IDs meanwhile
+	unused := unusedIntfs()
+	reclaimed := []int{}
+	for _, intf := range gone {
+		if unused[intf] {
+			reclaimed = append(reclaimed, intf)
+		}
+	}
+	if len(reclaimed) == 0 {
+		return reclaimed
+	}
+	sort.Ints(reclaimed)
+
+	slog.Info("GC: reclaiming interface IDs", "ids", reclaimed)
+	brMap.freeIntfs = append(brMap.freeIntfs, reclaimed...)
+	sort.Ints(brMap.freeIntfs)
+	if err := dbUpdate(putFreeIntfs(brMap.freeIntfs)); err != nil {
+		slog.Error("Unable to update db", "err", err)
+	}
+	return reclaimed
+}
@@ -0,0 +1,403 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//The IPAM driver tracks the pools it hands out and the addresses
+//allocated in them, so it can also be used with docker's builtin network
+//drivers, e.g. docker network create -d macvlan --ipam-driver ipdk.
+//Pools requested without a subnet are carved out of -default-pools, a
+//comma separated list of <range>:<prefix length> tried in order, e.g.
+//10.200.0.0/16:24 for /24 pools out of 10.200.0.0/16, the default. IPv6
+//pools are only carved out of IPv6 ranges listed there.
+//
+//Pool IDs name the pool they refer to, as <address space>/<pool> or
+//<address space>/<pool>/<sub pool>, the way docker's builtin IPAM driver
+//does. Docker keeps the IDs of the pools of its networks, so a pool
+//missing from the db, e.g. after restoring an older backup, is registered
+//again from its ID the first time docker uses it.
+//
+//With -ipam=false the plugin is a network driver only, paired with
+//docker's default IPAM or another IPAM plugin: it doesn't announce the
+//IPAM driver on activation nor serve its requests.
+var ipamDriver = flag.Bool("ipam", true, "serve the IPAM driver along with the network driver")
+var defaultPools = flag.String("default-pools", "10.200.0.0/16:24", "comma separated <range>:<prefix length> pools without a subnet are carved out of")
+
+//defaultPool is a range pools are carved out of, Prefix being the prefix
+//length of the pools
+type defaultPool struct {
+	Range  *net.IPNet
+	Prefix int
+}
+
+//parseDefaultPools parses -default-pools
+func parseDefaultPools(v string) ([]defaultPool, error) {
+	var pools []defaultPool
+	for _, item := range splitOption(v) {
+		i := strings.LastIndex(item, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid default pool %q, expected <range>:<prefix length>", item)
+		}
+		_, r, err := net.ParseCIDR(item[:i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid default pool %q: %v", item, err)
+		}
+		prefix, err := strconv.Atoi(item[i+1:])
+		ones, bits := r.Mask.Size()
+		//Pools need room for a gateway and an endpoint
+		if err != nil || prefix < ones || prefix > bits-2 {
+			return nil, fmt.Errorf("invalid prefix length in default pool %q, expected %d to %d", item, ones, bits-2)
+		}
+		pools = append(pools, defaultPool{Range: r, Prefix: prefix})
+	}
+	return pools, nil
+}
+
+//ipamPool is a pool handed out by RequestPool
+type ipamPool struct {
+	AddressSpace string
+	Pool         string          //The pool CIDR
+	SubPool      string          //Addresses are allocated from here if set
+	Allocated    map[string]bool //Allocated addresses
+}
+
+var poolMap struct {
+	sync.Mutex
+	m map[string]*ipamPool
+}
+
+func init() {
+	poolMap.m = make(map[string]*ipamPool)
+}
+
+func networksOverlap(a *net.IPNet, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+//poolOverlaps reports whether subnet overlaps a pool of the address
+//space. poolMap must be locked by the caller.
+func poolOverlaps(addressSpace string, subnet *net.IPNet) bool {
+	for _, p := range poolMap.m {
+		if p.AddressSpace != addressSpace {
+			continue
+		}
+		_, n, err := net.ParseCIDR(p.Pool)
+		if err == nil && networksOverlap(n, subnet) {
+			return true
+		}
+	}
+	return false
+}
+
+//nextIP returns ip + 1
+func nextIP(ip net.IP) net.IP {
+	n := new(big.Int).SetBytes(ip)
+	n.Add(n, big.NewInt(1))
+
+	b := n.Bytes()
+	next := make(net.IP, len(ip))
+	copy(next[len(next)-len(b):], b)
+	return next
+}
+
+//lastIP returns the last address of a network
+func lastIP(n *net.IPNet) net.IP {
+	last := make(net.IP, len(n.IP))
+	for i := range n.IP {
+		last[i] = n.IP[i] | ^n.Mask[i]
+	}
+	return last
+}
+
+//carvePool returns the first default pool of the family not overlapping
+//an existing one. poolMap must be locked by the caller.
+func carvePool(addressSpace string, v6 bool) (*net.IPNet, error) {
+	pools, err := parseDefaultPools(stringSetting(defaultPools))
+	if err != nil {
+		return nil, err
+	}
+
+	var ranges []string
+	for _, p := range pools {
+		if (p.Range.IP.To4() == nil) != v6 {
+			continue
+		}
+		ranges = append(ranges, p.Range.String())
+
+		r := p.Range
+		bits := len(r.IP) * 8
+		mask := net.CIDRMask(p.Prefix, bits)
+		for ip := r.IP.Mask(mask); r.Contains(ip); {
+			candidate := &net.IPNet{IP: ip, Mask: mask}
+			if !poolOverlaps(addressSpace, candidate) {
+				return candidate, nil
+			}
+			//Jump to the first address of the next candidate, unless
+			//this one ends the range
+			last := lastIP(candidate)
+			if last.Equal(lastIP(r)) {
+				break
+			}
+			ip = nextIP(last)
+		}
+	}
+	switch {
+	case len(ranges) == 0 && v6:
+		return nil, fmt.Errorf("IPv6 pools must be given explicitly with --subnet, or carved out of an IPv6 range of -default-pools")
+	case len(ranges) == 0:
+		return nil, fmt.Errorf("no IPv4 range in -default-pools, pools must be given explicitly with --subnet")
+	}
+	return nil, fmt.Errorf("no free pool left in %v", strings.Join(ranges, ", "))
+}
+
+//requestPool registers a pool, carving one out of the defaults when the
+//request does not name one
+func requestPool(addressSpace string, pool string, subPool string, v6 bool) (string, string, error) {
+	//Other nodes of the swarm may have allocated pools since
+	if *driverScope == scopeGlobal {
+		if err := loadPools(); err != nil {
+			return "", "", err
+		}
+	}
+
+	poolMap.Lock()
+	defer poolMap.Unlock()
+
+	var subnet *net.IPNet
+	if pool == "" {
+		var err error
+		if subnet, err = carvePool(addressSpace, v6); err != nil {
+			return "", "", err
+		}
+	} else {
+		var err error
+		if _, subnet, err = net.ParseCIDR(pool); err != nil {
+			return "", "", fmt.Errorf("invalid pool %v: %v", pool, err)
+		}
+		if poolOverlaps(addressSpace, subnet) {
+			return "", "", fmt.Errorf("pool %v overlaps with an existing pool", subnet)
+		}
+	}
+
+	if subPool != "" {
+		_, sub, err := net.ParseCIDR(subPool)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid sub pool %v: %v", subPool, err)
+		}
+		if !subnet.Contains(sub.IP) {
+			return "", "", fmt.Errorf("sub pool %v is not part of pool %v", sub, subnet)
+		}
+	}
+
+	p := &ipamPool{
+		AddressSpace: addressSpace,
+		Pool:         subnet.String(),
+		SubPool:      subPool,
+		Allocated:    make(map[string]bool),
+	}
+	id := poolID(p)
+	created, err := dbCreate("poolMap", id, p)
+	if err != nil {
+		return "", "", err
+	}
+	if !created {
+		return "", "", fmt.Errorf("pool %v is already allocated", p.Pool)
+	}
+	poolMap.m[id] = p
+
+	slog.Info("Allocated pool", "pool", id, "subnet", p.Pool)
+	return id, p.Pool, nil
+}
+
+//poolID returns the ID a pool is known by
+func poolID(p *ipamPool) string {
+	id := p.AddressSpace + "/" + p.Pool
+	if p.SubPool != "" {
+		id += "/" + p.SubPool
+	}
+	return id
+}
+
+//parsePoolID returns the pool named by id. Pools allocated by older
+//versions of the plugin have random IDs that cannot be parsed.
+func parsePoolID(id string) (*ipamPool, error) {
+	parts := strings.Split(id, "/")
+	if len(parts) != 3 && len(parts) != 5 {
+		return nil, fmt.Errorf("unknown pool %v", id)
+	}
+
+	p := &ipamPool{
+		AddressSpace: parts[0],
+		Allocated:    make(map[string]bool),
+	}
+	_, subnet, err := net.ParseCIDR(parts[1] + "/" + parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("unknown pool %v", id)
+	}
+	p.Pool = subnet.String()
+	if len(parts) == 5 {
+		_, sub, err := net.ParseCIDR(parts[3] + "/" + parts[4])
+		if err != nil || !subnet.Contains(sub.IP) {
+			return nil, fmt.Errorf("unknown pool %v", id)
+		}
+		p.SubPool = parts[3] + "/" + parts[4]
+	}
+	return p, nil
+}
+
+//lookupPool returns the pool of id, registering it again if docker uses
+//a pool the db has lost track of. poolMap must be locked by the caller.
+func lookupPool(id string) (*ipamPool, error) {
+	if p, ok := poolMap.m[id]; ok {
+		return p, nil
+	}
+
+	p, err := parsePoolID(id)
+	if err != nil {
+		return nil, err
+	}
+	_, subnet, _ := net.ParseCIDR(p.Pool)
+	if poolOverlaps(p.AddressSpace, subnet) {
+		return nil, fmt.Errorf("unknown pool %v overlaps with an existing pool", id)
+	}
+
+	if err := dbAdd("poolMap", id, p); err != nil {
+		return nil, err
+	}
+	poolMap.m[id] = p
+	slog.Warn("Pool was missing from the db, registered it again", "pool", id)
+	return p, nil
+}
+
+func releasePool(id string) error {
+	poolMap.Lock()
+	defer poolMap.Unlock()
+
+	if _, ok := poolMap.m[id]; !ok {
+		if _, err := parsePoolID(id); err != nil {
+			return err
+		}
+		//Nothing to release, the pool was lost along with its db record
+		return nil
+	}
+	if err := dbDelete("poolMap", id); err != nil {
+		return err
+	}
+	delete(poolMap.m, id)
+	return nil
+}
+
+//requestAddress allocates address, or the first free address of the
+//pool if address is empty, and returns it in CIDR notation
+func requestAddress(id string, address string) (string, error) {
+	poolMap.Lock()
+	defer poolMap.Unlock()
+
+	p, err := lookupPool(id)
+	if err != nil {
+		return "", err
+	}
+
+	_, subnet, err := net.ParseCIDR(p.Pool)
+	if err != nil {
+		return "", err
+	}
+	ones, bits := subnet.Mask.Size()
+
+	var ip net.IP
+	if address != "" {
+		if ip = net.ParseIP(address); ip == nil || !subnet.Contains(ip) {
+			return "", fmt.Errorf("address %v is not part of pool %v", address, p.Pool)
+		}
+		if p.Allocated[ip.String()] {
+			return "", fmt.Errorf("address %v is already allocated", ip)
+		}
+	} else {
+		r := subnet
+		if p.SubPool != "" {
+			if _, r, err = net.ParseCIDR(p.SubPool); err != nil {
+				return "", err
+			}
+		}
+
+		//Skip the network address, and the broadcast address of IPv4 pools
+		broadcast := make(net.IP, len(subnet.IP))
+		for i := range subnet.IP {
+			broadcast[i] = subnet.IP[i] | ^subnet.Mask[i]
+		}
+		for candidate := nextIP(r.IP); r.Contains(candidate); candidate = nextIP(candidate) {
+			if p.Allocated[candidate.String()] || (bits == 32 && candidate.Equal(broadcast)) {
+				continue
+			}
+			ip = candidate
+			break
+		}
+		if ip == nil {
+			return "", fmt.Errorf("pool %v is exhausted", p.Pool)
+		}
+	}
+
+	p.Allocated[ip.String()] = true
+	if err := dbAdd("poolMap", id, p); err != nil {
+		delete(p.Allocated, ip.String())
+		return "", err
+	}
+	return fmt.Sprintf("%s/%d", ip, ones), nil
+}
+
+func releaseAddress(id string, address string) error {
+	poolMap.Lock()
+	defer poolMap.Unlock()
+
+	p, err := lookupPool(id)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return fmt.Errorf("invalid address %v", address)
+	}
+	delete(p.Allocated, ip.String())
+	return dbAdd("poolMap", id, p)
+}
+
+//loadPools restores the pools from the db
+func loadPools() error {
+	poolMap.Lock()
+	defer poolMap.Unlock()
+
+	return dbLoadTable("poolMap", func() interface{} { return &ipamPool{} },
+		func(key string, value interface{}) {
+			p := value.(*ipamPool)
+			if p.Allocated == nil {
+				p.Allocated = make(map[string]bool)
+			}
+			poolMap.m[key] = p
+			slog.Debug("Restored pool", "pool", key, "subnet", p.Pool)
+		})
+}
@@ -0,0 +1,143 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+)
+
+//Dual-stack networks, docker network create --ipv6, forward IPv6 as well.
+//Traffic for the IPv6 address of an endpoint is sent to its port by the
+//ingress.ipv6_host table, scoped to the VLAN of the network if it has
+//one. The pipeline does not flood IPv6 multicast, so neighbor
+//solicitations for the gateway and the endpoints are answered by the
+//pipeline from the ingress.nd_responder table, with the MAC address ARP
+//requests for their IPv4 address are answered with. Overlay networks
+//only carry IPv4, and L2 networks forward IPv6 by MAC address already.
+const (
+	ipv6HostTable      = "ingress.ipv6_host"
+	ipv6HostAction     = "ingress.send"
+	vlanIPv6HostTable  = "ingress.vlan_ipv6_host"
+	vlanIPv6HostAction = vlanHostAction
+	ndTable            = "ingress.nd_responder"
+	ndAction           = "ingress.na_reply"
+)
+
+func ipv6HostMatch(ip string) string {
+	return fmt.Sprintf("hdr.ipv6.dst_addr=%s", ip)
+}
+
+func vlanIPv6HostMatch(vlan int, ip string) string {
+	return fmt.Sprintf("meta.vlan_id=%d,%s", vlan, ipv6HostMatch(ip))
+}
+
+//ndMatch matches the neighbor solicitations for ip
+func ndMatch(ip string) string {
+	return fmt.Sprintf("hdr.icmpv6.type=135,hdr.ndp.target_addr=%s", ip)
+}
+
+func removeIPv6Entry(bridge string, table string, m string) {
+	if err := deleteEntry(bridge, table, m); err != nil {
+		slog.Error("Unable to remove IPv6 entry", "match", m, "err", err)
+	}
+}
+
+//ipv6Forwarding reports whether the pipeline forwards the IPv6 traffic
+//of a network by address
+func ipv6Forwarding(nw *nwVal) bool {
+	return nw.Subnet6.IP != nil && nw.Forwarding != forwardingL2 && nw.VNI == 0
+}
+
+//parseEndpointIPv6 parses the IPv6 address docker assigned to an
+//endpoint, "" if it has none
+func parseEndpointIPv6(nw *nwVal, address string) (string, error) {
+	if address == "" {
+		return "", nil
+	}
+
+	ip, _, err := net.ParseCIDR(address)
+	if err != nil || ip.To4() != nil {
+		return "", fmt.Errorf("invalid IPv6 address %q", address)
+	}
+	if nw.Subnet6.IP != nil && !nw.Subnet6.Contains(ip) {
+		return "", fmt.Errorf("IPv6 address %v is not part of %v", ip, nw.Subnet6.String())
+	}
+	return ip.String(), nil
+}
+
+//programIPv6 answers the neighbor solicitations for the IPv6 gateway of
+//a network
+func programIPv6(networkID string, nw *nwVal) error {
+	if !ipv6Forwarding(nw) || nw.Gateway6.IP == nil || nw.Gateway.IP == nil {
+		return nil
+	}
+
+	mac, err := gatewayMAC(nw)
+	if err != nil {
+		return err
+	}
+	return addEntry(networkOwner(networkID), nw.Bridge, ndTable, ndMatch(nw.Gateway6.IP.String()),
+		fmt.Sprintf("%s(%s)", ndAction, mac))
+}
+
+//unprogramIPv6 removes the entry installed by programIPv6
+func unprogramIPv6(nw *nwVal) {
+	if nw == nil || !ipv6Forwarding(nw) || nw.Gateway6.IP == nil || nw.Gateway.IP == nil {
+		return
+	}
+	removeIPv6Entry(nw.Bridge, ndTable, ndMatch(nw.Gateway6.IP.String()))
+}
+
+//programEndpointIPv6 forwards the traffic for the IPv6 address of an
+//endpoint to its port and answers the neighbor solicitations for it
+func programEndpointIPv6(endpointID string, nw *nwVal, ip string, mac string, intf int) error {
+	if ip == "" || !ipv6Forwarding(nw) {
+		return nil
+	}
+
+	owner := endpointOwner(endpointID)
+	table, m, action := ipv6HostTable, ipv6HostMatch(ip), ipv6HostAction
+	if nw.VLAN != 0 {
+		table, m, action = vlanIPv6HostTable, vlanIPv6HostMatch(nw.VLAN, ip), vlanIPv6HostAction
+	}
+	if err := addEntry(owner, nw.Bridge, table, m, fmt.Sprintf("%s(%d)", action, intf)); err != nil {
+		return err
+	}
+
+	if err := addEntry(owner, nw.Bridge, ndTable, ndMatch(ip), fmt.Sprintf("%s(%s)", ndAction, mac)); err != nil {
+		removeIPv6Entry(nw.Bridge, table, m)
+		return err
+	}
+	return nil
+}
+
+//unprogramEndpointIPv6 removes the entries installed by
+//programEndpointIPv6
+func unprogramEndpointIPv6(nw *nwVal, ip string) {
+	if nw == nil || ip == "" || !ipv6Forwarding(nw) {
+		return
+	}
+
+	removeIPv6Entry(nw.Bridge, ndTable, ndMatch(ip))
+	if nw.VLAN != 0 {
+		removeIPv6Entry(nw.Bridge, vlanIPv6HostTable, vlanIPv6HostMatch(nw.VLAN, ip))
+		return
+	}
+	removeIPv6Entry(nw.Bridge, ipv6HostTable, ipv6HostMatch(ip))
+}
@@ -0,0 +1,294 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+//Every network has a segment ID, and the traffic received from the
+//port of an endpoint is classified into the segment of its network by
+//the port segment table. Traffic between networks is dropped by entries
+//of the isolation table keyed on source segment and destination subnet,
+//in both directions, so a container can't get around them by spoofing
+//its source address.
+//
+//With -isolate-networks, the default, networks can only reach each
+//other once explicitly connected through the admin API:
+//
+//  curl -X POST -d '{"Network": "<peer-id>"}' http://127.0.0.1:9075/v1/networks/<id>/connections
+//
+//Isolation groups let several docker networks share or exclude
+//reachability, e.g.
+//
+//  docker network create -d ipdk -o com.ipdk.isolation_group=tenant-a,shared ...
+//  docker network create -d ipdk -o com.ipdk.isolation_exclude=tenant-a ...
+//
+//Two networks may reach each other when they share at least one group,
+//or are connected, and neither excludes a group the other is a member
+//of. Networks that are members of no group reach each other unless
+//-isolate-networks is set.
+var isolateNetworks = flag.Bool("isolate-networks", true, "block traffic between networks that are not explicitly connected")
+
+const (
+	optIsolationGroup   = "com.ipdk.isolation_group"
+	optIsolationExclude = "com.ipdk.isolation_exclude"
+
+	isolationTable  = "ingress.network_isolation"
+	isolationAction = "ingress.drop"
+	segmentTable    = "ingress.port_segment"
+	segmentAction   = "ingress.set_segment"
+)
+
+func hasAny(list []string, items []string) bool {
+	for _, a := range list {
+		for _, b := range items {
+			if a == b {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//isolationAllowed reports whether traffic may flow between two networks
+func isolationAllowed(aID string, a *nwVal, bID string, b *nwVal) bool {
+	if hasAny(a.IsolationExclude, b.IsolationGroups) ||
+		hasAny(b.IsolationExclude, a.IsolationGroups) {
+		return false
+	}
+	if hasAny(a.Connected, []string{bID}) || hasAny(b.Connected, []string{aID}) ||
+		hasAny(a.Routed, []string{bID}) || hasAny(b.Routed, []string{aID}) {
+		return true
+	}
+	if len(a.IsolationGroups) == 0 && len(b.IsolationGroups) == 0 {
+		return !*isolateNetworks
+	}
+	return hasAny(a.IsolationGroups, b.IsolationGroups)
+}
+
+func isolationMatch(src *nwVal, dst *nwVal) string {
+	if src.Segment == 0 {
+		return legacyIsolationMatch(src, dst)
+	}
+	return fmt.Sprintf("meta.segment_id=%d,hdr.ipv4.dst_addr=%s", src.Segment, dst.Subnet.String())
+}
+
+//legacyIsolationMatch is the match of the entries installed before
+//networks had segments
+func legacyIsolationMatch(src *nwVal, dst *nwVal) string {
+	return fmt.Sprintf("hdr.ipv4.src_addr=%s,hdr.ipv4.dst_addr=%s",
+		src.Subnet.String(), dst.Subnet.String())
+}
+
+func segmentMatch(intf int) string {
+	return fmt.Sprintf("istd.ingress_port=%d", intf)
+}
+
+//addEndpointSegment classifies the traffic of the port intf into the
+//segment of its network
+func addEndpointSegment(endpointID string, nw *nwVal, intf int) error {
+	if nw.Segment == 0 {
+		return nil
+	}
+	return addEntry(endpointOwner(endpointID), nw.Bridge, segmentTable, segmentMatch(intf),
+		fmt.Sprintf("%s(%d)", segmentAction, nw.Segment))
+}
+
+//isolatePair installs the drop entries between two networks
+func isolatePair(networkID string, nw *nwVal, peer *nwVal) error {
+	for _, m := range []string{isolationMatch(nw, peer), isolationMatch(peer, nw)} {
+		if err := addEntry(networkOwner(networkID), nw.Bridge, isolationTable, m, isolationAction); err != nil {
+			removeIsolationPair(nw, peer)
+			return err
+		}
+	}
+	return nil
+}
+
+//programIsolation installs drop entries between the network and every
+//network of peers it must not reach
+func programIsolation(networkID string, nw *nwVal, peers map[string]*nwVal) error {
+	if nw.Subnet.IP == nil {
+		return nil
+	}
+
+	var added []*nwVal
+	for id, peer := range peers {
+		if id == networkID || peer.Subnet.IP == nil || isolationAllowed(networkID, nw, id, peer) {
+			continue
+		}
+
+		slog.Info("Isolating network", "network", networkID, "peer", id)
+		if err := isolatePair(networkID, nw, peer); err != nil {
+			for _, p := range added {
+				removeIsolationPair(nw, p)
+			}
+			return fmt.Errorf("unable to isolate network from %v: %v", id, err)
+		}
+		added = append(added, peer)
+	}
+	return nil
+}
+
+//unprogramIsolation removes the drop entries installed for the network
+//against peers
+func unprogramIsolation(networkID string, nw *nwVal, peers map[string]*nwVal) {
+	if nw == nil || nw.Subnet.IP == nil {
+		return
+	}
+
+	for id, peer := range peers {
+		if id == networkID || peer.Subnet.IP == nil {
+			continue
+		}
+		removeIsolationPair(nw, peer)
+	}
+}
+
+//removeIsolationPair removes the drop entries between two networks,
+//from the bridge of whichever of them installed them
+func removeIsolationPair(a *nwVal, b *nwVal) {
+	for _, m := range []string{isolationMatch(a, b), isolationMatch(b, a),
+		legacyIsolationMatch(a, b), legacyIsolationMatch(b, a)} {
+		for _, bridge := range []string{a.Bridge, b.Bridge} {
+			if !isOwnedEntry(bridge, isolationTable, m) {
+				continue
+			}
+			if err := deleteEntry(bridge, isolationTable, m); err != nil {
+				slog.Error("Unable to remove isolation entry", "match", m, "err", err)
+			}
+		}
+	}
+}
+
+//adminConnectedNetworks returns a network and the peer of a connection
+//request. nwMap must be locked by the caller.
+func adminConnectedNetworks(w http.ResponseWriter, id string, peerID string) (*nwVal, *nwVal) {
+	nw, ok := nwMap.m[id]
+	if !ok {
+		adminError(w, http.StatusNotFound, "network %s not found", id)
+		return nil, nil
+	}
+	peer, ok := nwMap.m[peerID]
+	if !ok || peerID == id {
+		adminError(w, http.StatusNotFound, "network %s not found", peerID)
+		return nil, nil
+	}
+	return nw, peer
+}
+
+func adminListConnections(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	nwMap.Lock()
+	defer nwMap.Unlock()
+
+	nw, ok := nwMap.m[id]
+	if !ok {
+		adminError(w, http.StatusNotFound, "network %s not found", id)
+		return
+	}
+	sendResponse(nw.Connected, w)
+}
+
+//adminConnectNetworks lets two networks reach each other
+func adminConnectNetworks(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	body, err := getBody(r)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	req := struct{ Network string }{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		adminError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	nwMap.Lock()
+	defer nwMap.Unlock()
+
+	nw, peer := adminConnectedNetworks(w, id, req.Network)
+	if nw == nil {
+		return
+	}
+	if hasAny(nw.Connected, []string{req.Network}) {
+		sendResponse(nw.Connected, w)
+		return
+	}
+
+	nw.Connected = append(nw.Connected, req.Network)
+	peer.Connected = append(peer.Connected, id)
+	if isolationAllowed(id, nw, req.Network, peer) {
+		removeIsolationPair(nw, peer)
+	}
+	if err := dbUpdate(putNetwork(id, nw), putNetwork(req.Network, peer)); err != nil {
+		slog.Error("Unable to update db", "err", err)
+	}
+	sendResponse(nw.Connected, w)
+}
+
+func removeConnection(connected []string, id string) []string {
+	var kept []string
+	for _, v := range connected {
+		if v != id {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+//adminDisconnectNetworks isolates two connected networks again
+func adminDisconnectNetworks(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	nwMap.Lock()
+	defer nwMap.Unlock()
+
+	nw, peer := adminConnectedNetworks(w, id, vars["peer"])
+	if nw == nil {
+		return
+	}
+	if !hasAny(nw.Connected, []string{vars["peer"]}) {
+		adminError(w, http.StatusNotFound, "network %s is not connected to %s", id, vars["peer"])
+		return
+	}
+
+	nw.Connected = removeConnection(nw.Connected, vars["peer"])
+	peer.Connected = removeConnection(peer.Connected, id)
+	if !isolationAllowed(id, nw, vars["peer"], peer) && nw.Subnet.IP != nil && peer.Subnet.IP != nil {
+		if err := isolatePair(id, nw, peer); err != nil {
+			nw.Connected = append(nw.Connected, vars["peer"])
+			peer.Connected = append(peer.Connected, id)
+			adminError(w, http.StatusInternalServerError, "unable to isolate %s from %s: %v", id, vars["peer"], err)
+			return
+		}
+	}
+	if err := dbUpdate(putNetwork(id, nw), putNetwork(vars["peer"], peer)); err != nil {
+		slog.Error("Unable to update db", "err", err)
+	}
+	sendResponse(nw.Connected, w)
+}
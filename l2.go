@@ -0,0 +1,77 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+//Networks created with -o com.ipdk.forwarding=l2 forward on the
+//destination MAC address instead of the destination IPv4 address, so
+//non-IP traffic between endpoints goes through. The MAC addresses of all
+//endpoints are known to the plugin, the ingress.l2_fwd table is
+//populated with them as endpoints are created, rather than learned by
+//the pipeline. Endpoints docker has no MAC address for are given one
+//derived from their IPv4 address, as docker does for bridge networks.
+const (
+	optForwarding = "com.ipdk.forwarding"
+
+	forwardingL3 = "l3"
+	forwardingL2 = "l2"
+
+	l2Table  = "ingress.l2_fwd"
+	l2Action = "ingress.send"
+)
+
+//parseForwarding parses the forwarding mode of a network, "" for l3
+func parseForwarding(v string) (string, error) {
+	switch v {
+	case "", forwardingL3:
+		return "", nil
+	case forwardingL2:
+		return forwardingL2, nil
+	}
+	return "", fmt.Errorf("invalid %s %q, expected %s or %s", optForwarding, v, forwardingL3, forwardingL2)
+}
+
+//endpointMAC returns the MAC address of an endpoint, the one requested
+//by docker or one generated from its address
+func endpointMAC(requested string, ip net.IP) (string, error) {
+	if requested != "" {
+		mac, err := net.ParseMAC(requested)
+		if err != nil {
+			return "", fmt.Errorf("invalid MAC address %q", requested)
+		}
+		return mac.String(), nil
+	}
+
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return "", fmt.Errorf("unable to generate a MAC address for %v", ip)
+	}
+	return net.HardwareAddr{0x02, 0x42, ip4[0], ip4[1], ip4[2], ip4[3]}.String(), nil
+}
+
+func l2Match(mac string) string {
+	return fmt.Sprintf("hdr.ethernet.dst_addr=%s", mac)
+}
+
+//addL2Endpoint forwards traffic for mac to the pipeline port intf
+func addL2Endpoint(owner string, bridge string, mac string, intf int) error {
+	return addEntry(owner, bridge, l2Table, l2Match(mac), fmt.Sprintf("%s(%d)", l2Action, intf))
+}
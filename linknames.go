@@ -0,0 +1,124 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//The dummy link of a vhost-user endpoint, which docker programs the
+//address of the endpoint on and moves into the container, is named from
+//the -link-name template. The template may use:
+//
+//  {endpoint}, {endpoint:N}  the endpoint ID, or its first N characters
+//  {network}, {network:N}    the network ID, or its first N characters
+//  {ip}                      the IPv4 address of the endpoint
+//  {intf}                    the interface ID of the endpoint
+//
+//Link names are at most 15 characters long. The name is recorded with
+//the endpoint, so that changing the template doesn't affect existing
+//endpoints. Endpoints created before it was recorded, and with the {ip}
+//template, have a link named after their address, which can't be told
+//apart across networks reusing addresses and doesn't fit IPv6 addresses.
+var linkNameTemplate = flag.String("link-name", "ipdk-{endpoint:8}", "template of the names of the dummy links of the endpoints, with {endpoint[:N]}, {network[:N]}, {ip} and {intf}")
+
+var linkNamePlaceholder = regexp.MustCompile(`\{(endpoint|network|ip|intf)(?::([0-9]+))?\}`)
+
+//renderLinkName names the link of an endpoint after a template
+func renderLinkName(template string, endpointID string, ep *epVal) string {
+	return linkNamePlaceholder.ReplaceAllStringFunc(template, func(s string) string {
+		m := linkNamePlaceholder.FindStringSubmatch(s)
+		v := ""
+		switch m[1] {
+		case "endpoint":
+			v = endpointID
+		case "network":
+			v = ep.NetworkID
+		case "ip":
+			v = ep.VhostuserPort
+		case "intf":
+			v = strconv.Itoa(ep.IpdkInterface)
+		}
+		if n, err := strconv.Atoi(m[2]); err == nil && n < len(v) {
+			v = v[:n]
+		}
+		return v
+	})
+}
+
+//checkLinkName validates -link-name against the longest values of its
+//placeholders
+func checkLinkName(template string) error {
+	if !linkNamePlaceholder.MatchString(template) {
+		return fmt.Errorf("invalid -link-name %q, expected at least one of {endpoint}, {network}, {ip} or {intf}", template)
+	}
+	id := strings.Repeat("f", 64)
+	name := renderLinkName(template, id, &epVal{NetworkID: id, VhostuserPort: "255.255.255.255", IpdkInterface: 99999})
+	if err := validLinkName(name); err != nil {
+		return fmt.Errorf("invalid -link-name %q, names such as %q are not valid link names", template, name)
+	}
+	return nil
+}
+
+//linkNamePrefix returns the text -link-name starts with before its
+//first placeholder
+func linkNamePrefix() string {
+	loc := linkNamePlaceholder.FindStringIndex(*linkNameTemplate)
+	if loc == nil {
+		return *linkNameTemplate
+	}
+	return (*linkNameTemplate)[:loc[0]]
+}
+
+//isEndpointLink reports whether a dummy link is named like the link of
+//an endpoint
+func isEndpointLink(name string) bool {
+	if net.ParseIP(name) != nil {
+		return true
+	}
+	prefix := linkNamePrefix()
+	return prefix != "" && strings.HasPrefix(name, prefix)
+}
+
+//dummyLink returns the name of the dummy link of an endpoint
+func dummyLink(ep *epVal) string {
+	if ep.Link != "" {
+		return ep.Link
+	}
+	return ep.VhostuserPort
+}
+
+//allocLink names the dummy link of an endpoint, refusing a name another
+//endpoint uses. epMap must be locked by the caller.
+func allocLink(endpointID string, ep *epVal) error {
+	name := renderLinkName(*linkNameTemplate, endpointID, ep)
+	if err := validLinkName(name); err != nil {
+		return err
+	}
+	for id, other := range allEndpoints() {
+		if other.PortType == "" && dummyLink(other) == name && id != endpointID {
+			return fmt.Errorf("link %v is already used by endpoint %v, change -link-name", name, id)
+		}
+	}
+	ep.Link = name
+	return nil
+}
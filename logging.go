@@ -0,0 +1,124 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+//The plugin logs through log/slog, as text or JSON on stderr, with the
+//network and endpoint IDs of driver requests as fields. Request and
+//response bodies and the commands run in the IPDK container are logged
+//at the debug level. The level can be changed at runtime through
+//PUT /v1/log-level, and SIGUSR1 toggles between the debug level and the
+//level the plugin was started with.
+var (
+	logLevelName = flag.String("log-level", "info", "log level: debug, info, warn or error")
+	logFormat    = flag.String("log-format", "text", "log format: text or json")
+)
+
+var logLevel = new(slog.LevelVar)
+
+//parseLogLevel parses a level name
+func parseLogLevel(v string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(v))); err != nil {
+		return 0, fmt.Errorf("invalid log level %q, expected debug, info, warn or error", v)
+	}
+	return level, nil
+}
+
+//initLogging installs the default logger selected by the flags
+func initLogging() error {
+	level, err := parseLogLevel(*logLevelName)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(level)
+
+	options := &slog.HandlerOptions{Level: logLevel}
+	switch *logFormat {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, options)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, options)))
+	default:
+		return fmt.Errorf("invalid log format %q, expected text or json", *logFormat)
+	}
+
+	go toggleDebugOnSignal()
+	return nil
+}
+
+//toggleDebugOnSignal switches between the debug level and the level of
+//-log-level on every SIGUSR1
+func toggleDebugOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	for range c {
+		next := slog.LevelDebug
+		if logLevel.Level() == slog.LevelDebug {
+			next, _ = parseLogLevel(stringSetting(logLevelName))
+		}
+		logLevel.Set(next)
+		slog.Warn("Log level changed", "level", next.String())
+	}
+}
+
+//fatal logs an error and exits
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+type logLevelRequest struct {
+	Level string
+}
+
+func adminGetLogLevel(w http.ResponseWriter, r *http.Request) {
+	sendResponse(logLevelRequest{Level: logLevel.Level().String()}, w)
+}
+
+func adminSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	body, err := getBody(r)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	req := logLevelRequest{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		adminError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	level, err := parseLogLevel(req.Level)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	logLevel.Set(level)
+	slog.Warn("Log level changed", "level", level.String())
+	sendResponse(logLevelRequest{Level: level.String()}, w)
+}
@@ -0,0 +1,166 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+//Besides its dummy link, see linknames.go, every endpoint is
+//described by a metadata file, <-metadata-dir>/<endpoint>.json, so that
+//runtimes can find its vhost-user socket without guessing:
+//
+//  {
+//      "EndpointID": "3f2a...",
+//      "NetworkID": "9b1c...",
+//      "PortType": "vhost",
+//      "SocketPath": "/run/ipdk/vhost/10.10.0.2/vhu.sock",
+//      "MAC": "02:42:0a:0a:00:02",
+//      "Queues": 4,
+//      "Interface": 3,
+//      ...
+//  }
+//
+//Once the endpoint joins a sandbox, the file is also linked from
+//<-metadata-dir>/sandboxes/<sandbox>/<endpoint>.json, the sandbox being
+//the last element of the path of its network namespace.
+var metadataDir = flag.String("metadata-dir", "/run/ipdk/endpoints", "directory of the endpoint metadata files, \"\" to disable them")
+
+//endpointMetadata is the content of a metadata file
+type endpointMetadata struct {
+	EndpointID string
+	NetworkID  string
+	Sandbox    string `json:",omitempty"`
+	PortType   string
+	SocketPath string `json:",omitempty"`
+	Link       string //Link handed to docker
+	MAC        string `json:",omitempty"`
+	IP         string
+	IPv6       string `json:",omitempty"`
+	MTU        int    `json:",omitempty"`
+	Queues     int
+	Interface  int    //ID of the port in the pipeline
+	VF         string `json:",omitempty"`
+}
+
+func metadataPath(endpointID string) string {
+	return filepath.Join(*metadataDir, endpointID+".json")
+}
+
+func sandboxMetadataPath(sandbox string, endpointID string) string {
+	return filepath.Join(*metadataDir, "sandboxes", sandbox, endpointID+".json")
+}
+
+//writeEndpointMetadata writes the metadata file of an endpoint, replacing
+//the previous one atomically
+func writeEndpointMetadata(endpointID string, ep *epVal, sandbox string) {
+	if *metadataDir == "" {
+		return
+	}
+
+	m := endpointMetadata{
+		EndpointID: endpointID,
+		NetworkID:  ep.NetworkID,
+		Sandbox:    sandbox,
+		PortType:   ep.PortType,
+		Link:       endpointLink(ep),
+		MAC:        ep.MAC,
+		IP:         ep.IP,
+		IPv6:       ep.IPv6,
+		MTU:        ep.MTU,
+		Queues:     1,
+		Interface:  ep.IpdkInterface,
+		VF:         ep.VF,
+	}
+	if m.PortType == "" {
+		m.PortType = portTypeVhost
+		m.SocketPath = endpointSocketDir(ep) + "/vhu.sock"
+		m.Queues = vhostQueues(ep.Queues)
+	}
+
+	data, err := json.MarshalIndent(m, "", "    ")
+	if err == nil {
+		err = os.MkdirAll(*metadataDir, 0755)
+	}
+	if err == nil {
+		tmp := metadataPath(endpointID) + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, metadataPath(endpointID))
+		}
+	}
+	if err != nil {
+		slog.Error("Unable to write endpoint metadata", "endpoint", endpointID, "err", err)
+	}
+}
+
+//linkSandboxMetadata writes the metadata file of an endpoint joining a
+//sandbox and links it from the directory of the sandbox
+func linkSandboxMetadata(endpointID string, ep *epVal, sandboxKey string) {
+	if *metadataDir == "" || sandboxKey == "" {
+		return
+	}
+
+	sandbox := filepath.Base(sandboxKey)
+	writeEndpointMetadata(endpointID, ep, sandbox)
+
+	link := sandboxMetadataPath(sandbox, endpointID)
+	err := os.MkdirAll(filepath.Dir(link), 0755)
+	if err == nil {
+		os.Remove(link)
+		err = os.Symlink(metadataPath(endpointID), link)
+	}
+	if err != nil {
+		slog.Error("Unable to link endpoint metadata to sandbox", "endpoint", endpointID, "sandbox", sandbox, "err", err)
+	}
+}
+
+//unlinkSandboxMetadata undoes linkSandboxMetadata when an endpoint leaves
+//its sandbox
+func unlinkSandboxMetadata(endpointID string, ep *epVal) {
+	if *metadataDir == "" {
+		return
+	}
+
+	data, err := ioutil.ReadFile(metadataPath(endpointID))
+	m := endpointMetadata{}
+	if err != nil || json.Unmarshal(data, &m) != nil || m.Sandbox == "" {
+		return
+	}
+	link := sandboxMetadataPath(m.Sandbox, endpointID)
+	if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+		slog.Error("Unable to remove sandbox link", "link", link, "err", err)
+	}
+	//Only succeeds once the last endpoint of the sandbox left
+	os.Remove(filepath.Dir(link))
+
+	writeEndpointMetadata(endpointID, ep, "")
+}
+
+//removeEndpointMetadata removes the metadata file of a deleted endpoint
+func removeEndpointMetadata(endpointID string) {
+	if *metadataDir == "" {
+		return
+	}
+	if err := os.Remove(metadataPath(endpointID)); err != nil && !os.IsNotExist(err) {
+		slog.Error("Unable to remove endpoint metadata", "endpoint", endpointID, "err", err)
+	}
+}
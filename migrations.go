@@ -0,0 +1,200 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+)
+
+//Records are stored as JSON documents. The schema version of the whole
+//db is kept in the global table, and every change to the layout of a
+//record that older code could not decode, or that needs existing
+//records to be rewritten, is done by appending a migration below.
+//New fields that default sensibly when missing need no migration.
+//
+//Migrations run in order when the db is opened. The writes of each
+//migration are applied in a single transaction along with its schema
+//version, so every migration sees the records left by the previous one;
+//a db written by a newer plugin is refused rather than guessed at.
+const dbSchemaKey = "schemaVersion"
+
+type dbMigration struct {
+	version     int
+	description string
+	migrate     func() ([]dbOp, error)
+}
+
+var dbMigrations = []dbMigration{
+	{1, "re-encode gob records as JSON", migrateGobToJSON},
+	{2, "record the bridge of networks and pipeline entries", migrateBridges},
+	{3, "give every network a segment ID", migrateSegments},
+}
+
+//dbSchemaVersion is the schema version written by this plugin
+func dbSchemaVersion() int {
+	return dbMigrations[len(dbMigrations)-1].version
+}
+
+func dbMigrate() error {
+	version := 0
+	v, err := store.Get("global", dbSchemaKey)
+	if err != nil {
+		return err
+	}
+	if v != nil {
+		if err := json.Unmarshal(v, &version); err != nil {
+			return fmt.Errorf("Decode Error: %v %v", dbSchemaKey, err)
+		}
+	}
+
+	if version > dbSchemaVersion() {
+		return fmt.Errorf("db schema version %d is newer than the supported version %d",
+			version, dbSchemaVersion())
+	}
+
+	for _, m := range dbMigrations {
+		if m.version <= version {
+			continue
+		}
+		slog.Info("Migrating db to schema version", "version", m.version, "description", m.description)
+		ops, err := m.migrate()
+		if err != nil {
+			return fmt.Errorf("db migration %d failed: %v", m.version, err)
+		}
+		if err := dbUpdate(append(ops, dbPut("global", dbSchemaKey, m.version))...); err != nil {
+			return fmt.Errorf("db migration %d failed: %v", m.version, err)
+		}
+		version = m.version
+	}
+	return nil
+}
+
+//recodeTable decodes every gob record of a table into the value
+//returned by newValue and returns the writes storing it back as JSON
+func recodeTable(table string, newValue func() interface{}) ([]dbOp, error) {
+	records, err := store.List(table)
+	if err != nil {
+		return nil, err
+	}
+
+	var ops []dbOp
+	for k, v := range records {
+		if k == dbSchemaKey {
+			continue
+		}
+		value := newValue()
+		if err := gob.NewDecoder(bytes.NewReader(v)).Decode(value); err != nil {
+			return nil, fmt.Errorf("Decode Error: %v %v %v", table, k, err)
+		}
+		ops = append(ops, dbPut(table, k, value))
+	}
+	return ops, nil
+}
+
+func migrateGobToJSON() ([]dbOp, error) {
+	tables := []struct {
+		name     string
+		newValue func() interface{}
+	}{
+		{"global", func() interface{} { return new(int) }},
+		{"nwMap", func() interface{} { return &nwVal{} }},
+		{"epMap", func() interface{} { return &epVal{} }},
+		{"brMap", func() interface{} { return new(int) }},
+		{"snapshots", func() interface{} { return &snapshot{} }},
+	}
+
+	var ops []dbOp
+	for _, t := range tables {
+		tops, err := recodeTable(t.name, t.newValue)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, tops...)
+	}
+	return ops, nil
+}
+
+//migrateBridges moves the networks and pipeline entries recorded before
+//bridges were per network to br0, the only bridge they could be using
+func migrateBridges() ([]dbOp, error) {
+	var ops []dbOp
+
+	networks, err := store.List("nwMap")
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range networks {
+		nw := &nwVal{}
+		if err := json.Unmarshal(v, nw); err != nil {
+			return nil, fmt.Errorf("Decode Error: nwMap %v %v", k, err)
+		}
+		if nw.Bridge != defaultBridge {
+			nw.Bridge = defaultBridge
+			ops = append(ops, dbPut("nwMap", k, nw))
+		}
+	}
+
+	entries, err := store.List("entries")
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range entries {
+		e := pipelineEntry{}
+		if err := json.Unmarshal(v, &e); err != nil {
+			return nil, fmt.Errorf("Decode Error: entries %v %v", k, err)
+		}
+		if e.Bridge != "" {
+			continue
+		}
+		e.Bridge = defaultBridge
+		ops = append(ops, dbDel("entries", k), dbPut("entries", entryKey(e.Bridge, e.Table, e.Match), e))
+	}
+	return ops, nil
+}
+
+//migrateSegments uses the bridge ID of existing networks, unique to
+//each of them, as their segment ID
+func migrateSegments() ([]dbOp, error) {
+	networks, err := store.List("nwMap")
+	if err != nil {
+		return nil, err
+	}
+
+	var ops []dbOp
+	for k, v := range networks {
+		nw := &nwVal{}
+		if err := json.Unmarshal(v, nw); err != nil {
+			return nil, fmt.Errorf("Decode Error: nwMap %v %v", k, err)
+		}
+		id, err := store.Get("brMap", k)
+		if err != nil {
+			return nil, err
+		}
+		if nw.Segment != 0 || id == nil {
+			continue
+		}
+		if err := json.Unmarshal(id, &nw.Segment); err != nil {
+			return nil, fmt.Errorf("Decode Error: brMap %v %v", k, err)
+		}
+		ops = append(ops, dbPut("nwMap", k, nw))
+	}
+	return ops, nil
+}
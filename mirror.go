@@ -0,0 +1,215 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+//All the traffic of an endpoint can be mirrored to a pipeline port, e.g.
+//the vhost-user port of a collector, or to another endpoint:
+//
+//  curl -X POST -d '{"Endpoint": "<collector-endpoint-id>"}' http://127.0.0.1:9075/v1/endpoints/<id>/mirror
+//  curl -X POST -d '{"Port": 42}' http://127.0.0.1:9075/v1/endpoints/<id>/mirror
+//
+//The pipeline clones the traffic received from the port of the endpoint,
+//matched in ingress.mirror_rx, and the traffic forwarded to it, matched
+//on its output port in ingress.mirror_tx, to the clone session of the
+//mirror port.
+const (
+	mirrorRxTable = "ingress.mirror_rx"
+	mirrorTxTable = "ingress.mirror_tx"
+	mirrorAction  = "ingress.clone_to"
+)
+
+//mirrorSession is the destination of the mirrored traffic of an endpoint
+type mirrorSession struct {
+	Port     int    //Pipeline port of the destination
+	Endpoint string `json:",omitempty"` //Destination endpoint, if any
+	Capture  string `json:",omitempty"` //pcap file of captures. See capture.go.
+}
+
+func mirrorRxMatch(intf int) string {
+	return fmt.Sprintf("istd.ingress_port=%d", intf)
+}
+
+func mirrorTxMatch(intf int) string {
+	return fmt.Sprintf("meta.out_port=%d", intf)
+}
+
+//startMirror clones the traffic of an endpoint to the mirror port
+func startMirror(endpointID string, nw *nwVal, ep *epVal, m *mirrorSession) error {
+	owner := endpointOwner(endpointID)
+	action := fmt.Sprintf("%s(%d)", mirrorAction, m.Port)
+	if err := addEntry(owner, nw.Bridge, mirrorRxTable, mirrorRxMatch(ep.IpdkInterface), action); err != nil {
+		return err
+	}
+	if err := addEntry(owner, nw.Bridge, mirrorTxTable, mirrorTxMatch(ep.IpdkInterface), action); err != nil {
+		removeMirrorEntry(nw.Bridge, mirrorRxTable, mirrorRxMatch(ep.IpdkInterface))
+		return err
+	}
+	return nil
+}
+
+//stopMirror removes the entries installed by startMirror
+func stopMirror(nw *nwVal, ep *epVal) {
+	if nw == nil || ep.Mirror == nil {
+		return
+	}
+	removeMirrorEntry(nw.Bridge, mirrorTxTable, mirrorTxMatch(ep.IpdkInterface))
+	removeMirrorEntry(nw.Bridge, mirrorRxTable, mirrorRxMatch(ep.IpdkInterface))
+}
+
+func removeMirrorEntry(bridge string, table string, m string) {
+	if err := deleteEntry(bridge, table, m); err != nil {
+		slog.Error("Unable to remove mirror entry", "match", m, "err", err)
+	}
+}
+
+//stopMirrorsTo stops the mirrors whose destination is an endpoint being
+//deleted. nwMap and epMap must be locked by the caller.
+func stopMirrorsTo(endpointID string) []dbOp {
+	var ops []dbOp
+	for id, ep := range epMap.m {
+		if ep.Mirror == nil || ep.Mirror.Endpoint != endpointID {
+			continue
+		}
+		slog.Info("Stopping the mirror to deleted endpoint", "endpoint", id, "destination", endpointID)
+		stopMirror(nwMap.m[ep.NetworkID], ep)
+		ep.Mirror = nil
+		ops = append(ops, putEndpoint(id, ep))
+	}
+	return ops
+}
+
+func adminGetMirror(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	epMap.Lock()
+	defer epMap.Unlock()
+
+	ep, ok := epMap.m[id]
+	if !ok {
+		adminError(w, http.StatusNotFound, "endpoint %s not found", id)
+		return
+	}
+	if ep.Mirror == nil {
+		adminError(w, http.StatusNotFound, "endpoint %s is not mirrored", id)
+		return
+	}
+	sendResponse(ep.Mirror, w)
+}
+
+func adminStartMirror(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	body, err := getBody(r)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	m := &mirrorSession{}
+	if err := json.Unmarshal(body, m); err != nil {
+		adminError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	if m.Capture != "" {
+		adminError(w, http.StatusBadRequest, "captures are started through /v1/endpoints/%s/capture", id)
+		return
+	}
+
+	nwMap.Lock()
+	defer nwMap.Unlock()
+	epMap.Lock()
+	defer epMap.Unlock()
+
+	ep, ok := epMap.m[id]
+	if !ok {
+		adminError(w, http.StatusNotFound, "endpoint %s not found", id)
+		return
+	}
+	nw := nwMap.m[ep.NetworkID]
+	if nw == nil {
+		adminError(w, http.StatusConflict, "network %s of endpoint %s not found", ep.NetworkID, id)
+		return
+	}
+	if ep.Mirror != nil {
+		adminError(w, http.StatusConflict, "endpoint %s is already mirrored to port %d", id, ep.Mirror.Port)
+		return
+	}
+
+	if m.Endpoint != "" {
+		dst, ok := epMap.m[m.Endpoint]
+		if !ok || m.Endpoint == id {
+			adminError(w, http.StatusBadRequest, "invalid mirror endpoint %s", m.Endpoint)
+			return
+		}
+		if dst.NetworkID != ep.NetworkID && nwMap.m[dst.NetworkID] != nil && nwMap.m[dst.NetworkID].Bridge != nw.Bridge {
+			adminError(w, http.StatusBadRequest, "mirror endpoint %s is on another bridge", m.Endpoint)
+			return
+		}
+		m.Port = dst.IpdkInterface
+	}
+	if m.Port < 1 || m.Port == ep.IpdkInterface {
+		adminError(w, http.StatusBadRequest, "invalid mirror port %d", m.Port)
+		return
+	}
+
+	if err := startMirror(id, nw, ep, m); err != nil {
+		adminError(w, http.StatusInternalServerError, "unable to mirror endpoint %s: %v", id, err)
+		return
+	}
+	ep.Mirror = m
+	if err := dbUpdate(putEndpoint(id, ep)); err != nil {
+		slog.Error("Unable to update db", "err", err)
+	}
+	sendResponse(ep.Mirror, w)
+}
+
+func adminStopMirror(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	nwMap.Lock()
+	defer nwMap.Unlock()
+	epMap.Lock()
+	defer epMap.Unlock()
+
+	ep, ok := epMap.m[id]
+	if !ok {
+		adminError(w, http.StatusNotFound, "endpoint %s not found", id)
+		return
+	}
+	if ep.Mirror == nil {
+		adminError(w, http.StatusNotFound, "endpoint %s is not mirrored", id)
+		return
+	}
+
+	//The stopped session is returned
+	m := ep.Mirror
+	stopMirror(nwMap.m[ep.NetworkID], ep)
+	stopCapture(id, m)
+	ep.Mirror = nil
+	if err := dbUpdate(putEndpoint(id, ep)); err != nil {
+		slog.Error("Unable to update db", "err", err)
+	}
+	sendResponse(m, w)
+}
@@ -0,0 +1,83 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+//The MTU of a network is set with the standard docker option,
+//docker network create -o com.docker.network.driver.mtu=9000, and can be
+//overridden per endpoint with --driver-opt. It is applied to the dummy
+//interface docker moves into the container and to the vhost-user port
+//backing it. 0 leaves both at their defaults.
+//
+//Vhost-user ports only take frames of up to a standard MTU unless they
+//are given a larger maximum frame size and mergeable receive buffers, so
+//that the guest can receive a jumbo frame across several descriptors.
+//Both are set on the ports of endpoints with a larger MTU.
+const (
+	optMTU = "com.docker.network.driver.mtu"
+
+	minMTU      = 68
+	maxMTU      = 9216
+	standardMTU = 1500
+
+	//Ethernet header, VLAN tag and FCS
+	frameOverhead = 14 + 4 + 4
+)
+
+//parseMTU parses an MTU option, 0 means the default
+func parseMTU(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+
+	mtu, err := strconv.Atoi(v)
+	if err != nil || mtu < minMTU || mtu > maxMTU {
+		return 0, fmt.Errorf("invalid %s %q, expected %d to %d", optMTU, v, minMTU, maxMTU)
+	}
+	return mtu, nil
+}
+
+//endpointMTU returns the MTU of an endpoint, its own if it was given one
+//or the MTU of its network
+func endpointMTU(nw *nwVal, options map[string]interface{}) (int, error) {
+	mtu, err := parseMTU(endpointOption(options, optMTU))
+	if err != nil || mtu != 0 {
+		return mtu, err
+	}
+	return nw.MTU, nil
+}
+
+//jumboConfig returns the gNMI parameters letting a vhost-user port carry
+//frames of an MTU, "" for standard frames
+func jumboConfig(mtu int) string {
+	if mtu <= standardMTU {
+		return ""
+	}
+	return fmt.Sprintf(",max-frame-size:%d,mrg-rxbuf:true", mtu+frameOverhead)
+}
+
+//probeMTUOf returns the MTU the path to an endpoint is probed with
+func probeMTUOf(ep *epVal) int {
+	if ep.MTU != 0 {
+		return ep.MTU
+	}
+	return intSetting(mtuProbeMTU)
+}
@@ -0,0 +1,151 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//The MTU prober looks for path MTU blackholes: destinations that answer
+//small packets but silently drop full sized ones with the DF bit set,
+//typically because an overlay adds encapsulation overhead the underlay
+//MTU does not account for. Every endpoint is probed, along with the
+//uplink targets given with -mtu-probe-targets (e.g. remote VTEPs).
+var mtuProbeInterval = flag.Duration("mtu-probe-interval", 0, "interval between path MTU blackhole probes, 0 to disable")
+var mtuProbeMTU = flag.Int("mtu-probe-mtu", 1500, "MTU expected on the paths probed for blackholes")
+var mtuProbeTargets = flag.String("mtu-probe-targets", "", "comma separated uplink addresses probed for path MTU blackholes")
+
+//ipv4 and icmp headers, not part of the ping payload
+const icmpOverhead = 28
+
+type mtuProbeResult struct {
+	Target    string
+	NetworkID string `json:",omitempty"`
+	MTU       int    //Size of the full sized packets
+	Reachable bool   //A minimal ping is answered
+	FullSize  bool   //A ping of the expected MTU with DF set is answered
+	Blackhole bool   //Reachable but full sized packets are lost
+}
+
+var mtuProbes struct {
+	sync.Mutex
+	last    time.Time
+	results []mtuProbeResult
+}
+
+//ping sends a single ping of the given size with the DF bit set
+func ping(target string, size int) bool {
+	_, err := hostOutput("ping", "-c", "1", "-W", "1", "-M", "do", "-s", fmt.Sprintf("%d", size), target)
+	return err == nil
+}
+
+func probeTarget(target string, mtu int) mtuProbeResult {
+	res := mtuProbeResult{Target: target, MTU: mtu}
+	res.Reachable = ping(target, 8)
+	if res.Reachable {
+		res.FullSize = ping(target, mtu-icmpOverhead)
+	}
+	res.Blackhole = res.Reachable && !res.FullSize
+	return res
+}
+
+//probeMTU probes every endpoint and uplink target
+func probeMTU() []mtuProbeResult {
+	var results []mtuProbeResult
+
+	targets := make(map[string]epVal)
+	epMap.Lock()
+	for _, ep := range epMap.m {
+		targets[ep.VhostuserPort] = *ep
+	}
+	epMap.Unlock()
+
+	//Endpoints with an MTU of their own are probed with it
+	for target, ep := range targets {
+		res := probeTarget(target, probeMTUOf(&ep))
+		res.NetworkID = ep.NetworkID
+		results = append(results, res)
+	}
+
+	for _, target := range splitOption(stringSetting(mtuProbeTargets)) {
+		if net.ParseIP(target) == nil {
+			slog.Error("Invalid MTU probe target", "target", target)
+			continue
+		}
+		results = append(results, probeTarget(target, intSetting(mtuProbeMTU)))
+	}
+
+	for _, res := range results {
+		if res.Blackhole {
+			slog.Warn("Path MTU blackhole, packets are lost", "target", res.Target, "network", res.NetworkID, "mtu", res.MTU)
+		}
+	}
+	return results
+}
+
+func mtuProbeLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		results := probeMTU()
+
+		mtuProbes.Lock()
+		mtuProbes.last = time.Now().UTC()
+		mtuProbes.results = results
+		mtuProbes.Unlock()
+	}
+}
+
+//mtuReport is the result of the last probe round
+type mtuReport struct {
+	Time             time.Time
+	MTU              int
+	Results          []mtuProbeResult
+	AffectedNetworks []string
+	UplinkBlackholes []string
+}
+
+func adminMTUReport(w http.ResponseWriter, r *http.Request) {
+	mtuProbes.Lock()
+	defer mtuProbes.Unlock()
+
+	report := mtuReport{
+		Time:             mtuProbes.last,
+		MTU:              intSetting(mtuProbeMTU),
+		Results:          mtuProbes.results,
+		AffectedNetworks: []string{},
+		UplinkBlackholes: []string{},
+	}
+
+	affected := make(map[string]bool)
+	for _, res := range mtuProbes.results {
+		if !res.Blackhole {
+			continue
+		}
+		if res.NetworkID == "" {
+			report.UplinkBlackholes = append(report.UplinkBlackholes, res.Target)
+		} else if !affected[res.NetworkID] {
+			affected[res.NetworkID] = true
+			report.AffectedNetworks = append(report.AffectedNetworks, res.NetworkID)
+		}
+	}
+	sendResponse(report, w)
+}
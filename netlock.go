@@ -0,0 +1,129 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"sync"
+)
+
+//Driver requests on a network and its endpoints are serialized by a lock
+//of the network, held for the whole request, while nwMap, epMap and
+//brMap are only held to read and update the maps and hand out IDs. The
+//ports, entries and bridges of networks and endpoints are set up without
+//holding them, so that the commands run, which take seconds, don't hold
+//up the requests on other networks. CreateEndpoint only shares the lock
+//of its network: endpoints of the same network are created concurrently,
+//and only the changes to the flood group of the network are serialized,
+//by its members lock. The lock of a network is taken before any of the
+//map locks.
+var netLocks = struct {
+	sync.Mutex
+	m map[string]*networkLock
+}{m: make(map[string]*networkLock)}
+
+//Network creations and deletions are serialized by networkChanges, taken
+//after the lock of the network, so that the networks a network is checked
+//against and isolated from don't change meanwhile. A network is only
+//added to nwMap once set up, and removed from it before it is torn down;
+//the garbage collector, while it takes the state of the networks, and db
+//restores take networkChanges too, so that they don't take a network
+//being set up for a deleted one.
+var networkChanges sync.Mutex
+
+//networkLock is the lock of a network, and the number of requests
+//holding or waiting for it
+type networkLock struct {
+	sync.RWMutex
+	members sync.Mutex //Held while the flood group of the network changes
+	refs    int
+}
+
+//refNetworkLock returns the lock of a network, counting the caller as a
+//user of it until unrefNetworkLock
+func refNetworkLock(id string) *networkLock {
+	netLocks.Lock()
+	defer netLocks.Unlock()
+
+	l, ok := netLocks.m[id]
+	if !ok {
+		l = &networkLock{}
+		netLocks.m[id] = l
+	}
+	l.refs++
+	return l
+}
+
+func unrefNetworkLock(id string, l *networkLock) {
+	netLocks.Lock()
+	defer netLocks.Unlock()
+
+	l.refs--
+	if l.refs == 0 {
+		delete(netLocks.m, id)
+	}
+}
+
+//lockNetwork locks a network and returns the function unlocking it
+func lockNetwork(id string) func() {
+	l := refNetworkLock(id)
+	l.Lock()
+	return func() {
+		l.Unlock()
+		unrefNetworkLock(id, l)
+	}
+}
+
+//shareNetwork locks a network for an endpoint creation, which may run
+//along with the other endpoint creations of the network, and returns the
+//function unlocking it
+func shareNetwork(id string) func() {
+	l := refNetworkLock(id)
+	l.RLock()
+	return func() {
+		l.RUnlock()
+		unrefNetworkLock(id, l)
+	}
+}
+
+//lockNetworkMembers serializes the changes to the flood group of a
+//network between its endpoint creations. The network must be shared by
+//the caller.
+func lockNetworkMembers(id string) func() {
+	l := refNetworkLock(id)
+	l.members.Lock()
+	return func() {
+		l.members.Unlock()
+		unrefNetworkLock(id, l)
+	}
+}
+
+//allEndpoints returns the endpoints along with those being created, whose
+//IDs, ports and directories are taken. epMap must be locked by the
+//caller.
+func allEndpoints() map[string]*epVal {
+	if len(epMap.pending) == 0 {
+		return epMap.m
+	}
+	all := make(map[string]*epVal, len(epMap.m)+len(epMap.pending))
+	for id, ep := range epMap.m {
+		all[id] = ep
+	}
+	for id, ep := range epMap.pending {
+		all[id] = ep
+	}
+	return all
+}
@@ -0,0 +1,196 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/docker/libnetwork/discoverapi"
+	api "github.com/docker/libnetwork/drivers/remote/api"
+)
+
+//In swarm mode docker notifies the drivers of the nodes joining and
+//leaving the cluster with DiscoverNew and DiscoverDelete. The plugin
+//records their addresses and uses them as the remote VTEPs of the overlay
+//networks created without com.ipdk.vxlan_remote, whose tunnels follow the
+//nodes of the swarm. The address of the local node stands for the local
+//VTEP when neither -vtep-ip nor IPDK_VTEP_IP is set.
+
+//nodeMap holds the addresses of the other nodes and of the local node
+var nodeMap = struct {
+	sync.Mutex
+	self string
+	m    map[string]bool
+}{m: make(map[string]bool)}
+
+//selfKey is the key of the local node in the nodes table, which is
+//otherwise keyed by address
+const selfKey = "self"
+
+func loadNodes() error {
+	nodeMap.Lock()
+	defer nodeMap.Unlock()
+
+	return dbLoadTable("nodes", func() interface{} { return new(string) },
+		func(key string, value interface{}) {
+			if key == selfKey {
+				nodeMap.self = *value.(*string)
+				return
+			}
+			nodeMap.m[key] = true
+		})
+}
+
+//discoveredNodes returns the sorted addresses of the other nodes
+func discoveredNodes() []string {
+	nodeMap.Lock()
+	defer nodeMap.Unlock()
+
+	var nodes []string
+	for ip := range nodeMap.m {
+		nodes = append(nodes, ip)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+//discoveredSelf returns the address of the local node, "" if unknown
+func discoveredSelf() string {
+	nodeMap.Lock()
+	defer nodeMap.Unlock()
+	return nodeMap.self
+}
+
+//parseNodeDiscovery decodes a node discovery notification, nil for the
+//other kinds of notifications
+func parseNodeDiscovery(body []byte) (*discoverapi.NodeDiscoveryData, error) {
+	req := struct {
+		DiscoveryType discoverapi.DiscoveryType
+		DiscoveryData json.RawMessage
+	}{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+	if req.DiscoveryType != discoverapi.NodeDiscovery {
+		return nil, nil
+	}
+
+	data := &discoverapi.NodeDiscoveryData{}
+	if err := json.Unmarshal(req.DiscoveryData, data); err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(data.Address)
+	if ip == nil || ip.To4() == nil {
+		return nil, fmt.Errorf("invalid node address %q", data.Address)
+	}
+	data.Address = ip.String()
+	return data, nil
+}
+
+//updateNode records a node joining or leaving the swarm
+func updateNode(data *discoverapi.NodeDiscoveryData, joined bool) error {
+	nodeMap.Lock()
+	defer nodeMap.Unlock()
+
+	if data.Self {
+		if !joined {
+			return nil
+		}
+		nodeMap.self = data.Address
+		return dbAdd("nodes", selfKey, data.Address)
+	}
+	if joined {
+		nodeMap.m[data.Address] = true
+		return dbAdd("nodes", data.Address, data.Address)
+	}
+	delete(nodeMap.m, data.Address)
+	return dbDelete("nodes", data.Address)
+}
+
+//followNodes reprograms the tunnels of the overlay networks following
+//the nodes of the swarm. nwMap must be locked by the caller.
+func followNodes() {
+	nodes := discoveredNodes()
+	for id, nw := range nwMap.m {
+		if !nw.FollowNodes {
+			continue
+		}
+
+		unprogramVXLAN(nw)
+		nw.VTEPs = nodes
+		//Peers behind a node that left are gone with it
+		var kept []vxlanPeer
+		for _, p := range nw.Peers {
+			for _, vtep := range nodes {
+				if p.VTEP == vtep {
+					kept = append(kept, p)
+					break
+				}
+			}
+		}
+		nw.Peers = kept
+		if err := programVXLAN(id, nw); err != nil {
+			slog.Error("Unable to program the tunnels to the nodes", "network", id, "nodes", nodes, "err", err)
+		}
+		if err := dbUpdate(putNetwork(id, nw)); err != nil {
+			slog.Error("Unable to update db", "err", err)
+		}
+	}
+}
+
+func handleNodeDiscovery(w http.ResponseWriter, r *http.Request, joined bool) {
+	resp := api.DiscoveryResponse{}
+
+	body, err := getBody(r)
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+
+	data, err := parseNodeDiscovery(body)
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+	if data == nil {
+		sendResponse(resp, w)
+		return
+	}
+	if joined {
+		slog.Info("Node joined", "address", data.Address, "self", data.Self)
+	} else {
+		slog.Info("Node left", "address", data.Address, "self", data.Self)
+	}
+
+	if err := updateNode(data, joined); err != nil {
+		slog.Error("Unable to update db", "err", err)
+	}
+	if !data.Self {
+		nwMap.Lock()
+		followNodes()
+		nwMap.Unlock()
+	}
+	sendResponse(resp, w)
+}
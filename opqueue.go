@@ -0,0 +1,131 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+//Docker may send overlapping requests for an endpoint, e.g. a Join, a
+//Leave and a DeleteEndpoint during a restart storm. The requests on an
+//endpoint are queued and run one at a time, in arrival order, so that
+//the commands they run on its port never interleave. A request arriving
+//while an identical one, same operation and same body, is still waiting
+//in the queue is coalesced into it: it is not run again and gets the
+//response of the waiting one. The queue of an endpoint is taken before
+//the lock of its network.
+
+//endpointOp is a request on an endpoint, and its response once it ran
+type endpointOp struct {
+	name string
+	body []byte
+	turn chan struct{} //Closed when the request may run
+	done chan struct{} //Closed once it ran
+	resp []byte
+}
+
+//endpointOps holds the requests of every endpoint with requests
+//running or waiting, the first of a queue being the running one
+var endpointOps = struct {
+	sync.Mutex
+	m map[string][]*endpointOp
+}{m: make(map[string][]*endpointOp)}
+
+//enqueueEndpointOp queues a request on an endpoint. It returns the
+//identical request waiting in the queue and false if there is one.
+func enqueueEndpointOp(id string, name string, body []byte) (*endpointOp, bool) {
+	endpointOps.Lock()
+	defer endpointOps.Unlock()
+
+	q := endpointOps.m[id]
+	for i := 1; i < len(q); i++ {
+		if q[i].name == name && bytes.Equal(q[i].body, body) {
+			return q[i], false
+		}
+	}
+
+	op := &endpointOp{name: name, body: body, turn: make(chan struct{}), done: make(chan struct{})}
+	if len(q) == 0 {
+		close(op.turn)
+	}
+	endpointOps.m[id] = append(q, op)
+	return op, true
+}
+
+//finishEndpointOp removes the running request of an endpoint from its
+//queue and lets the next one run
+func finishEndpointOp(id string, op *endpointOp) {
+	endpointOps.Lock()
+	defer endpointOps.Unlock()
+
+	q := endpointOps.m[id][1:]
+	if len(q) == 0 {
+		delete(endpointOps.m, id)
+	} else {
+		endpointOps.m[id] = q
+		close(q[0].turn)
+	}
+	close(op.done)
+}
+
+//queuedEndpointOps returns the number of requests running or waiting on
+//every endpoint
+func queuedEndpointOps() map[string]int {
+	endpointOps.Lock()
+	defer endpointOps.Unlock()
+
+	queued := make(map[string]int)
+	for id, q := range endpointOps.m {
+		queued[id] = len(q)
+	}
+	return queued
+}
+
+//serialized runs a driver handler in the queue of the endpoint of the
+//request. Requests without an endpoint are run right away.
+func serialized(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		ids := struct{ EndpointID string }{}
+		if err != nil || json.Unmarshal(body, &ids) != nil || ids.EndpointID == "" {
+			h(w, r)
+			return
+		}
+
+		op, queued := enqueueEndpointOp(ids.EndpointID, name, body)
+		if !queued {
+			slog.Info("Coalescing request with an identical waiting one", "op", name, "endpoint", ids.EndpointID)
+			<-op.done
+			w.Write(op.resp)
+			return
+		}
+
+		<-op.turn
+		rec := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			op.resp = rec.body.Bytes()
+			finishEndpointOp(ids.EndpointID, op)
+		}()
+		h(rec, r)
+	}
+}
@@ -0,0 +1,183 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//Options are passed with docker network create -o, in the generic map of
+//the request, and for endpoints with docker network connect --driver-opt
+//as well. Endpoints inherit the options given for their network, except
+//the tenant, see tenants.go. Every com.ipdk.* option must be known at the
+//level it is given at and have a string value, so that a typo is rejected
+//instead of silently leaving the default in place. Other options belong
+//to docker and are left alone.
+const optPrefix = "com.ipdk."
+
+//endpointOptions are the options of endpoints, which can also be given
+//for their network
+var endpointOptions = map[string]bool{
+	optACL:            true,
+	optDSCP:           true,
+	optExpose:         true,
+	optPortType:       true,
+	optQueues:         true,
+	optRSSFields:      true,
+	optRSSKey:         true,
+	optSecurityGroups: true,
+	optVhostDevice:    true,
+}
+
+//networkOptions are the options only given for networks
+var networkOptions = map[string]bool{
+	optBridge:           true,
+	optDefaultDeny:      true,
+	optFallback:         true,
+	optForwarding:       true,
+	optGatewayMode:      true,
+	optIsolationExclude: true,
+	optIsolationGroup:   true,
+	optP4Program:        true,
+	optPipeline:         true,
+	optProxyARP:         true,
+	optStateful:         true,
+	optTrafficClasses:   true,
+	optUplink:           true,
+	optVLAN:             true,
+	optVXLANRemote:      true,
+	optVXLANVNI:         true,
+	optVhostDir:         true,
+}
+
+//checkOptions verifies that the com.ipdk.* options of a map are known to
+//one of the option sets and have a string value
+func checkOptions(options map[string]interface{}, level string, known ...map[string]bool) error {
+	var keys []string
+	for k := range options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if !strings.HasPrefix(k, optPrefix) {
+			continue
+		}
+		ok := false
+		for _, m := range known {
+			ok = ok || m[k]
+		}
+		if !ok {
+			return fmt.Errorf("unknown %s option %s", level, k)
+		}
+		if _, ok := options[k].(string); !ok {
+			return fmt.Errorf("invalid %s %v, expected a string", k, options[k])
+		}
+	}
+	return nil
+}
+
+//genericOptions returns the generic map of the options of a request
+func genericOptions(options map[string]interface{}) (map[string]interface{}, error) {
+	v, ok := options["com.docker.network.generic"]
+	if !ok || v == nil {
+		return nil, nil
+	}
+	generic, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid com.docker.network.generic %v, expected a map", v)
+	}
+	return generic, nil
+}
+
+//checkNetworkOptions verifies the options of a CreateNetwork request
+func checkNetworkOptions(options map[string]interface{}) error {
+	generic, err := genericOptions(options)
+	if err != nil {
+		return err
+	}
+	return checkOptions(generic, "network", networkOptions, endpointOptions, tenantOptions)
+}
+
+//checkEndpointOptions verifies the options of a CreateEndpoint request
+func checkEndpointOptions(options map[string]interface{}) error {
+	generic, err := genericOptions(options)
+	if err != nil {
+		return err
+	}
+	if err := checkOptions(generic, "network", networkOptions, endpointOptions, tenantOptions); err != nil {
+		return err
+	}
+	return checkOptions(options, "endpoint", endpointOptions, tenantOptions)
+}
+
+//checkIPAMOptions verifies the options of an IPAM request, the IPAM
+//driver has none of its own
+func checkIPAMOptions(options map[string]string) error {
+	for k := range options {
+		if strings.HasPrefix(k, optPrefix) {
+			return fmt.Errorf("unknown IPAM option %s", k)
+		}
+	}
+	return nil
+}
+
+//networkConfig returns the effective configuration of a network, by
+//option, for the logs
+func networkConfig(nw *nwVal) map[string]interface{} {
+	return map[string]interface{}{
+		optMTU:              nw.MTU,
+		optQueues:           nw.Queues,
+		optRSSKey:           nw.RSS,
+		optVhostDir:         nw.VhostDir,
+		optFallback:         nw.Fallback,
+		optIsolationGroup:   nw.IsolationGroups,
+		optIsolationExclude: nw.IsolationExclude,
+		optDSCP:             nw.DSCP,
+		optTrafficClasses:   nw.TrafficClasses,
+		optDefaultDeny:      nw.DefaultDeny,
+		optExpose:           nw.Services,
+		optForwarding:       nw.Forwarding,
+		optStateful:         nw.Stateful,
+		optProxyARP:         nw.ProxyARP,
+		optVLAN:             nw.VLAN,
+		optVXLANVNI:         nw.VNI,
+		optVXLANRemote:      nw.VTEPs,
+		optP4Program:        nw.P4Program,
+		optUplink:           nw.Uplink,
+		optGatewayMode:      nw.GatewayMode,
+		optTenant:           nw.Tenant,
+	}
+}
+
+//endpointConfig returns the effective configuration of an endpoint, by
+//option, for the logs
+func endpointConfig(ep *epVal) map[string]interface{} {
+	return map[string]interface{}{
+		optMTU:            ep.MTU,
+		optQueues:         ep.Queues,
+		optRSSKey:         ep.RSS,
+		optPortType:       ep.PortType,
+		optDSCP:           ep.DSCP,
+		optExpose:         ep.Services,
+		optACL:            ep.ACL,
+		optSecurityGroups: ep.SecurityGroups,
+		optVhostDevice:    ep.SocketDir,
+	}
+}
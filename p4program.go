@@ -0,0 +1,358 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+//Networks with a bridge of their own can run a P4 program of their
+//choosing instead of simple_l3:
+//
+//  docker network create -d ipdk --subnet 10.20.0.0/24 \
+//      -o com.ipdk.p4program=/root/examples/my_l3/my_l3.p4 net1
+//
+//The program is a path in the IPDK container. Its directory holds the
+//ovs_pipeline_builder configuration, my_l3.conf, and a mapping file,
+//my_l3.map.json, naming the tables, actions and match fields of the
+//program the plugin populates in place of those of simple_l3:
+//
+//  {
+//      "Tables":  {"ingress.ipv4_host": "MainControlImpl.fwd"},
+//      "Actions": {"ingress.send": "MainControlImpl.send_to_port"},
+//      "Fields":  {"hdr.ipv4.dst_addr": "hdr.ip.dst"}
+//  }
+//
+//Names missing from the mapping are used as they are. Entries are still
+//recorded under the simple_l3 names, they are only translated when
+//handed to ovs-p4ctl.
+const (
+	optP4Program = "com.ipdk.p4program"
+	optPipeline  = "com.ipdk.pipeline"
+)
+
+//The pipeline of br0 is loaded from the prebuilt binary of the default
+//program when it is missing at startup, or compiled from source first
+//with -program-pipeline. Either way a pipeline already loaded is left
+//alone, as ovs-p4ctl set-pipe can't be run twice on a bridge.
+var programPipeline = flag.Bool("program-pipeline", false, "compile the default P4 program and load it into br0 at startup unless a pipeline is already loaded")
+
+//Programs live in the IPDK container in a directory of their name under
+//-p4-dir, <dir>/<name>/<name>.p4, like simple_l3, the default program
+//loaded into br0 and the bridges of the networks. The default program
+//is populated with the names of simple_l3, it needs no mapping file.
+//The artifacts of a program, its pipeline binary, P4Info and the output
+//of p4c, are written next to it, or to a directory of its name under
+//-p4-output-dir.
+var (
+	p4Dir       = flag.String("p4-dir", "/root/examples", "directory of the P4 programs in the IPDK container")
+	p4Default   = flag.String("p4-program", "simple_l3", "name of the P4 program loaded into br0 and the bridges of the networks")
+	p4OutputDir = flag.String("p4-output-dir", "", "directory of the compiled P4 artifacts in the IPDK container (default the directory of each program)")
+)
+
+//Program paths are handed to a shell in the IPDK container
+var (
+	p4ProgramPath = regexp.MustCompile(`^/[A-Za-z0-9_./-]+\.p4$`)
+	p4ProgramName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	p4DirPath     = regexp.MustCompile(`^/[A-Za-z0-9_./-]*$`)
+)
+
+//checkP4Settings validates the P4 flags
+func checkP4Settings() error {
+	dirs := map[string]string{"p4-dir": *p4Dir}
+	if *p4OutputDir != "" {
+		dirs["p4-output-dir"] = *p4OutputDir
+	}
+	for name, dir := range dirs {
+		if !p4DirPath.MatchString(dir) || strings.Contains(dir, "..") {
+			return fmt.Errorf("invalid -%s %q, expected an absolute path", name, dir)
+		}
+	}
+	if !p4ProgramName.MatchString(*p4Default) {
+		return fmt.Errorf("invalid -p4-program %q, expected the name of a program of %s", *p4Default, *p4Dir)
+	}
+	return nil
+}
+
+//p4Source returns the path of a program selected by name
+func p4Source(name string) string {
+	return path.Join(*p4Dir, name, name+".p4")
+}
+
+//networkP4Source returns the P4 program selected for a network by path
+//or by name, "" for simple_l3
+func networkP4Source(options map[string]interface{}) (string, error) {
+	source := networkOption(options, optP4Program)
+	name := networkOption(options, optPipeline)
+	if name == "" {
+		return source, nil
+	}
+	if source != "" {
+		return "", fmt.Errorf("%s and %s are mutually exclusive", optP4Program, optPipeline)
+	}
+	if !p4ProgramName.MatchString(name) {
+		return "", fmt.Errorf("invalid %s %q, expected the name of a program of %s", optPipeline, name, *p4Dir)
+	}
+	return p4Source(name), nil
+}
+
+//p4Mapping maps the simple_l3 names used by the plugin to those of a
+//P4 program
+type p4Mapping struct {
+	Tables  map[string]string `json:",omitempty"`
+	Actions map[string]string `json:",omitempty"`
+	Fields  map[string]string `json:",omitempty"`
+}
+
+func rename(names map[string]string, name string) string {
+	if v, ok := names[name]; ok && v != "" {
+		return v
+	}
+	return name
+}
+
+//table returns the name of a table in the program, a nil mapping
+//leaves every name alone
+func (m *p4Mapping) table(name string) string {
+	if m == nil {
+		return name
+	}
+	return rename(m.Tables, name)
+}
+
+//field returns the name of a match field in the program
+func (m *p4Mapping) field(name string) string {
+	if m == nil {
+		return name
+	}
+	return rename(m.Fields, name)
+}
+
+//match translates the fields of a match, field=value[,field=value...]
+func (m *p4Mapping) match(match string) string {
+	if m == nil {
+		return match
+	}
+	fields := strings.Split(match, ",")
+	for i, f := range fields {
+		if kv := strings.SplitN(f, "=", 2); len(kv) == 2 {
+			fields[i] = m.field(kv[0]) + "=" + kv[1]
+		}
+	}
+	return strings.Join(fields, ",")
+}
+
+//action translates the name of an action, action[(parameters)]
+func (m *p4Mapping) action(action string) string {
+	if m == nil {
+		return action
+	}
+	name, params := action, ""
+	if i := strings.Index(action, "("); i >= 0 {
+		name, params = action[:i], action[i:]
+	}
+	return rename(m.Actions, name) + params
+}
+
+//p4Program is a compiled P4 program ready to be loaded into a bridge
+type p4Program struct {
+	Source  string
+	Binary  string
+	P4Info  string
+	Mapping *p4Mapping
+}
+
+//pipelines holds the mapping of the program loaded into every bridge not
+//running simple_l3. It has a lock of its own as entries are added with
+//nwMap held.
+var pipelines = struct {
+	sync.Mutex
+	m map[string]*p4Mapping
+}{m: make(map[string]*p4Mapping)}
+
+//pipelineMapping returns the mapping of the program of a bridge, nil for
+//simple_l3
+func pipelineMapping(bridge string) *p4Mapping {
+	pipelines.Lock()
+	defer pipelines.Unlock()
+	return pipelines.m[bridge]
+}
+
+func setPipelineMapping(bridge string, m *p4Mapping) {
+	pipelines.Lock()
+	defer pipelines.Unlock()
+	if m == nil {
+		delete(pipelines.m, bridge)
+		return
+	}
+	pipelines.m[bridge] = m
+}
+
+//p4OutputPath returns the directory of the artifacts of a program
+func p4OutputPath(source string) string {
+	if *p4OutputDir == "" {
+		return path.Dir(source)
+	}
+	return path.Join(*p4OutputDir, strings.TrimSuffix(path.Base(source), ".p4"))
+}
+
+//p4Artifacts returns a program along with the paths of its pipeline
+//binary and P4Info, built or not
+func p4Artifacts(source string) *p4Program {
+	out := p4OutputPath(source)
+	return &p4Program{
+		Source: source,
+		Binary: path.Join(out, strings.TrimSuffix(path.Base(source), ".p4")+".pb.bin"),
+		P4Info: path.Join(out, "p4Info.txt"),
+	}
+}
+
+//defaultArtifacts returns the pipeline binary and P4Info of the default
+//program
+func defaultArtifacts() (string, string) {
+	prog := p4Artifacts(p4Source(*p4Default))
+	return prog.Binary, prog.P4Info
+}
+
+//compileP4 compiles a P4 program with p4c and builds the pipeline
+//binary of ovs-p4ctl from it. The builder runs in the output directory,
+//so that the relative paths of its configuration point to the output of
+//p4c.
+func compileP4(source string) (*p4Program, error) {
+	if !p4ProgramPath.MatchString(source) || strings.Contains(source, "..") {
+		return nil, fmt.Errorf("invalid P4 program %q, expected an absolute path to a .p4 file", source)
+	}
+	name := strings.TrimSuffix(path.Base(source), ".p4")
+	out := p4OutputPath(source)
+
+	prog := p4Artifacts(source)
+	conf := path.Join(path.Dir(source), name+".conf")
+
+	if p4ArtifactsCurrent(prog, conf) {
+		slog.Debug("P4 program is up to date, skipping compilation", "source", source)
+		return prog, nil
+	}
+
+	if out != path.Dir(source) {
+		if _, err := ipdkExec("mkdir", "-p", out); err != nil {
+			return nil, fmt.Errorf("unable to create the P4 output directory %v: %v", out, err)
+		}
+	}
+
+	ifc, err := ipdkExec("p4c", "--arch", "psa", "--target", "dpdk",
+		"--output", path.Join(out, "pipe"),
+		"--p4runtime-files", prog.P4Info,
+		"--bf-rt-schema", path.Join(out, "bf-rt.json"),
+		"--context", path.Join(out, "pipe", "context.json"),
+		source)
+	if err != nil {
+		return nil, fmt.Errorf("p4c building error [%v]", err)
+	}
+	slog.Debug("Result of p4c", "output", ifc)
+
+	ifc, err = ipdkExec("bash", "-c", `cd "$1" && ovs_pipeline_builder --p4c_conf_file="$2" --bf_pipeline_config_binary_file="$3"`,
+		"bash", out, conf, path.Base(prog.Binary))
+	if err != nil {
+		return nil, fmt.Errorf("P4 programming error [%v]", err)
+	}
+	slog.Debug("Result of ovs_pipeline_builder", "output", ifc)
+
+	return prog, nil
+}
+
+//p4ArtifactsCurrent reports whether the pipeline binary and P4Info of a
+//program are newer than its source and builder configuration
+func p4ArtifactsCurrent(prog *p4Program, conf string) bool {
+	output, err := ipdkOutput("bash", "-c", `if [ "$1" -nt "$2" ] && [ "$1" -nt "$3" ] && [ "$4" -nt "$2" ]; then echo current; fi`,
+		"bash", prog.Binary, prog.Source, conf, prog.P4Info)
+	return err == nil && strings.TrimSpace(string(output)) == "current"
+}
+
+//loadP4Program compiles a P4 program selected for a network and reads
+//its mapping file
+func loadP4Program(source string) (*p4Program, error) {
+	prog, err := compileP4(source)
+	if err != nil {
+		return nil, err
+	}
+
+	mapFile := strings.TrimSuffix(source, ".p4") + ".map.json"
+	output, err := ipdkOutput("cat", mapFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the mapping file %v of %v: %v", mapFile, source, err)
+	}
+	prog.Mapping = &p4Mapping{}
+	if err := json.Unmarshal(output, prog.Mapping); err != nil {
+		return nil, fmt.Errorf("invalid mapping file %v: %v", mapFile, err)
+	}
+	return prog, nil
+}
+
+//defaultPipeline returns the program to load into the default bridge,
+//nil for the prebuilt default program
+func defaultPipeline() (*p4Program, error) {
+	if !*programPipeline {
+		return nil, nil
+	}
+	return compileP4(p4Source(*p4Default))
+}
+
+//pipelineLoaded reports whether a pipeline is loaded into a bridge
+func pipelineLoaded(bridge string) (bool, error) {
+	_, err := dumpHostEntries(bridge)
+	if e := lookupErrorCatalog(fmt.Sprint(err)); err != nil && e != nil && e.Code == "IPDK_PIPELINE_NOT_SET" {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+//programP4 loads the default program into the default bridge unless a
+//pipeline is already loaded
+func programP4() error {
+	loaded, err := pipelineLoaded(defaultBridge)
+	if err != nil {
+		return err
+	}
+	if loaded {
+		slog.Info("A pipeline is already loaded, leaving it alone", "bridge", defaultBridge)
+		return nil
+	}
+
+	prog, err := defaultPipeline()
+	if err != nil {
+		return err
+	}
+	binary, p4Info := defaultArtifacts()
+	if prog != nil {
+		binary, p4Info = prog.Binary, prog.P4Info
+	}
+
+	output, err := ipdkExec("ovs-p4ctl", "set-pipe", defaultBridge, binary, p4Info)
+	if err != nil {
+		return fmt.Errorf("unable to load %v into %v: %v", binary, defaultBridge, err)
+	}
+	slog.Debug("Result of ovs-p4ctl", "output", output)
+	slog.Info("Loaded the pipeline", "bridge", defaultBridge, "binary", binary)
+	return nil
+}
@@ -17,46 +17,172 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/gob"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
-	"time"
 
-	"github.com/01org/ciao/uuid"
-	"github.com/boltdb/bolt"
 	"github.com/docker/libnetwork/drivers/remote/api"
 	ipamapi "github.com/docker/libnetwork/ipams/remote/api"
-	"github.com/golang/glog"
 	"github.com/gorilla/mux"
-	"github.com/joho/godotenv"
+	bolt "go.etcd.io/bbolt"
 )
 
 type epVal struct {
 	IP            string
-	vhostuserPort string //The dpdk vhost user port
-	ipdkInterface  string
+	IPv6          string //IPv6 address on dual-stack networks, or ""
+	NetworkID     string
+	VhostuserPort string //The dpdk vhost user port
+	Link          string `json:",omitempty"` //Dummy link, "" if named after the address. See linknames.go.
+	SocketDir     string //Directory of the vhost-user socket, "" for the legacy location
+	IpdkInterface int    //The IPDK interface ID, also the pipeline port
+	MAC           string //Only set if explicit, or on L2 and proxy ARP networks
+	MTU           int    //0 for the default
+	Queues        int    //Virtio queues, 0 for one
+	RSS           *rssConfig
+
+	//Port type, "" for vhost-user, the PCI address of the virtual
+	//function of vf endpoints and the netdev of vf and tap endpoints.
+	//See sriov.go and tap.go.
+	PortType  string `json:",omitempty"`
+	VF        string `json:",omitempty"`
+	Netdev    string `json:",omitempty"`
+	DSCP      int    //0 if unmarked. See qos.go.
+	SNATBlock int    //Source port block on the uplink, 0 if none. See external.go.
+	Published []publishedPort
+
+	//Services exposed by the endpoint on a default-deny network
+	Services []serviceRule
+
+	//ACL rules filtering the traffic sent by the endpoint, and its
+	//security groups. See acl.go and secgroups.go.
+	ACL            []aclRule
+	SecurityGroups []string
+
+	//Destination of the mirrored traffic of the endpoint, nil if it is
+	//not mirrored. See mirror.go.
+	Mirror *mirrorSession
 }
 
 type nwVal struct {
 	Bridge  string //The bridge on which the ports will be created
 	Gateway net.IPNet
+	Subnet  net.IPNet
+	MTU     int        //MTU of the endpoints, 0 for the default. See mtu.go.
+	Queues  int        //Virtio queues of the endpoints, 0 for one. See queues.go.
+	RSS     *rssConfig //RSS of the ports, nil for the default. See rss.go.
+
+	//Secondary IPv4 subnets, the endpoints have an on-link route to.
+	//See routing.go.
+	Subnets []net.IPNet
+
+	//Base directory of the vhost-user sockets of the endpoints, "" for
+	//-vhost-dir
+	VhostDir string
+
+	//Whether the network is a plain Linux bridge with veth endpoints,
+	//Bridge being its name. See fallback.go.
+	Fallback bool `json:",omitempty"`
+
+	//IPv6 gateway and subnet of dual-stack networks. See ipv6.go.
+	Gateway6 net.IPNet
+	Subnet6  net.IPNet
+
+	//Isolation groups this network belongs to, and groups it must never
+	//be able to reach. See isolation.go.
+	IsolationGroups  []string
+	IsolationExclude []string
+
+	//Segment the traffic of the endpoints is classified into, and the
+	//networks explicitly connected to this one
+	Segment   int
+	Connected []string
+
+	//Networks this network is routed to. See routing.go.
+	Routed []string
+
+	//DSCP value the traffic of the endpoints is marked with, 0 if
+	//unmarked, and the output queues of DSCP values. See qos.go.
+	DSCP           int
+	TrafficClasses []trafficClass
+
+	//Ports of the replication group of the network, by member index.
+	//See flood.go.
+	FloodPorts []int
+
+	//Groups spreading the traffic for a prefix across endpoints. See
+	//ecmp.go.
+	NextHopGroups []*nextHopGroup
+
+	//Default-deny networks only accept traffic for exposed services.
+	//See services.go.
+	DefaultDeny bool
+	Services    []serviceRule
+
+	//Forwarding mode, l2 or "" for l3. See l2.go.
+	Forwarding string
+
+	//Whether only established connections and published ports are let
+	//in from outside the network. See stateful.go.
+	Stateful bool
+
+	//Whether ARP requests for endpoints are answered by the pipeline.
+	//See arp.go.
+	ProxyARP bool
+
+	//VLAN of the network, 0 if it shares the flat forwarding table.
+	//See vlan.go.
+	VLAN int
+
+	//VXLAN network identifier of overlay networks, their remote VTEPs
+	//and the remote addresses declared as peers. See vxlan.go.
+	VNI   int
+	VTEPs []string
+	Peers []vxlanPeer
+
+	//Whether the remote VTEPs are the nodes of the swarm. See nodes.go.
+	FollowNodes bool `json:",omitempty"`
+
+	//P4 program loaded into the bridge of the network and the mapping of
+	//its names, empty for simple_l3. See p4program.go.
+	P4Program string
+	P4Map     *p4Mapping
+
+	//Whether the bridge was named with com.ipdk.bridge, being shared with
+	//the other networks naming it, and whether the plugin created it.
+	//See bridge.go.
+	NamedBridge   bool `json:",omitempty"`
+	BridgeCreated bool `json:",omitempty"`
+
+	//PCI address of the physical port of the network, and its interface
+	//ID. See uplink.go.
+	Uplink     string
+	UplinkPort int
+
+	//How the gateway is answered for, "" for the pipeline, and the
+	//interface ID of the TAP port holding it in host mode. See
+	//gateway.go.
+	GatewayMode string `json:",omitempty"`
+	GatewayPort int    `json:",omitempty"`
+
+	//Tenant the network belongs to, "" for none. See tenants.go.
+	Tenant string `json:",omitempty"`
 }
 
-var intfCounter int
-
 var epMap struct {
 	sync.Mutex
 	m map[string]*epVal
+
+	//Endpoints being created, see reserveEndpoint
+	pending map[string]*epVal
 }
 
 var nwMap struct {
@@ -66,37 +192,44 @@ var nwMap struct {
 
 var brMap struct {
 	sync.Mutex
-	brCount int
+	brCount   int
 	intfCount int
-	m       map[string]int
+	freeIntfs []int //Released interface IDs, see intfids.go
+	m         map[string]int
 }
 
+//defaultDbFile is used unless overridden with -db-path or IPDK_DB_PATH
+const defaultDbFile = "/var/lib/ipdk-docker-plugin/state.db"
+
 var dbFile string
+
+//db is the local bolt db, nil unless the bolt store is used
 var db *bolt.DB
 
 func init() {
 	epMap.m = make(map[string]*epVal)
+	epMap.pending = make(map[string]*epVal)
 	nwMap.m = make(map[string]*nwVal)
 	brMap.m = make(map[string]int)
 	brMap.brCount = 1
 	brMap.intfCount = 1
-	dbFile = "/tmp/dpdk_bolt.db"
+	dbFile = defaultDbFile
 }
 
 //We should never see any errors in this function
 func sendResponse(resp interface{}, w http.ResponseWriter) {
 	rb, err := json.Marshal(resp)
 	if err != nil {
-		glog.Errorf("unable to marshal response %v", err)
+		slog.Error("unable to marshal response", "err", err)
 	}
-	glog.Infof("Sending response := %v, %v", resp, err)
+	slog.Debug("Sending response", "resp", resp)
 	fmt.Fprintf(w, "%s", rb)
 	return
 }
 
 func getBody(r *http.Request) ([]byte, error) {
 	body, err := ioutil.ReadAll(r.Body)
-	glog.Infof("URL [%s] Body [%s] Error [%v]", r.URL.Path[1:], string(body), err)
+	slog.Debug("Request", "path", r.URL.Path[1:], "body", string(body), "err", err)
 	return body, err
 }
 
@@ -109,22 +242,59 @@ func handler(w http.ResponseWriter, r *http.Request) {
 
 func handlerPluginActivate(w http.ResponseWriter, r *http.Request) {
 	_, _ = getBody(r)
-	//TODO: Where is this encoding?
-	resp := `{
-    "Implements": ["NetworkDriver", "IpamDriver"]
-}`
-	fmt.Fprintf(w, "%s", resp)
+	pluginActivated()
+	implements := []string{"NetworkDriver"}
+	//Without the IPDK backend only the IPAM driver is usable
+	if !caps.IPDK && !*vethFallback {
+		slog.Info("IPDK backend unavailable, registering the IPAM driver only")
+		implements = nil
+	}
+	if *ipamDriver {
+		implements = append(implements, "IpamDriver")
+	}
+	if len(implements) == 0 {
+		slog.Warn("IPDK backend unavailable and IPAM driver disabled, registering no driver")
+	}
+	sendResponse(struct{ Implements []string }{implements}, w)
 }
 
 func handlerGetCapabilities(w http.ResponseWriter, r *http.Request) {
 	_, _ = getBody(r)
-	resp := api.GetCapabilityResponse{Scope: "local"}
+	resp := api.GetCapabilityResponse{Scope: *driverScope, ConnectivityScope: *driverScope}
 	sendResponse(resp, w)
 }
 
+//checkNetworkConflicts checks that no network uses the VLAN, VNI or
+//uplink of a new network. nwMap must be locked by the caller.
+func checkNetworkConflicts(vlan int, vni int, uplink string) error {
+	if id := vlanNetwork(vlan); vlan != 0 && id != "" {
+		return fmt.Errorf("VLAN %d is already used by network %s", vlan, id)
+	}
+	if id := vxlanNetwork(vni); vni != 0 && id != "" {
+		return fmt.Errorf("VNI %d is already used by network %s", vni, id)
+	}
+	if id := uplinkNetwork(uplink); uplink != "" && id != "" {
+		return fmt.Errorf("uplink %s is already used by network %s", uplink, id)
+	}
+	return nil
+}
+
+//networkSnapshot returns copies of the networks other than except, for
+//the commands run against them once nwMap is unlocked. nwMap must be
+//locked by the caller.
+func networkSnapshot(except string) map[string]*nwVal {
+	networks := make(map[string]*nwVal, len(nwMap.m))
+	for id, nw := range nwMap.m {
+		if id != except {
+			c := *nw
+			networks[id] = &c
+		}
+	}
+	return networks
+}
+
 func handlerCreateNetwork(w http.ResponseWriter, r *http.Request) {
 	resp := api.CreateNetworkResponse{}
-	bridge := "br"
 
 	body, err := getBody(r)
 	if err != nil {
@@ -140,290 +310,1309 @@ func handlerCreateNetwork(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	nwMap.Lock()
-	defer nwMap.Unlock()
-
-	//Record the docker network UUID to SDN bridge mapping
-	//This has to survive a plugin crash/restart and needs to be persisted
-	nwMap.m[req.NetworkID] = &nwVal{
-		Bridge:  bridge,
-		Gateway: *req.IPv4Data[0].Gateway,
+	if err := checkNetworkOptions(req.Options); err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
 	}
 
-	if err := dbAdd("nwMap", req.NetworkID, nwMap.m[req.NetworkID]); err != nil {
-		glog.Errorf("Unable to update db %v", err)
+	//The gateway of the first IPv4 pool is the gateway of the network
+	if len(req.IPv4Data) == 0 || req.IPv4Data[0].Gateway == nil {
+		resp.Err = "Error: the network has no IPv4 gateway"
+		sendResponse(resp, w)
+		return
 	}
 
-	// For IPDK, we are connecting endpoints via a bridge which requires
-	// a unique integer ID.
-	brMap.Lock()
-	brMap.m[req.NetworkID] = brMap.brCount
-	brMap.brCount = brMap.brCount + 1
-	if err := dbAdd("brMap", req.NetworkID, brMap.m[req.NetworkID]); err != nil {
-		glog.Errorf("Unable to update db %v", err)
+	fallback, err := parseFallback(networkOption(req.Options, optFallback))
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
 	}
-	brMap.Unlock()
-
-	sendResponse(resp, w)
-}
 
-func handlerDeleteNetwork(w http.ResponseWriter, r *http.Request) {
-	resp := api.DeleteNetworkResponse{}
+	defaultDeny := false
+	if v := networkOption(req.Options, optDefaultDeny); v != "" {
+		if defaultDeny, err = strconv.ParseBool(v); err != nil {
+			resp.Err = fmt.Sprintf("Error: invalid %s %q", optDefaultDeny, v)
+			sendResponse(resp, w)
+			return
+		}
+	}
 
-	body, err := getBody(r)
+	services, err := parseServiceRules(networkOption(req.Options, optExpose))
 	if err != nil {
 		resp.Err = "Error: " + err.Error()
 		sendResponse(resp, w)
 		return
 	}
 
-	req := api.DeleteNetworkRequest{}
-	if err = json.Unmarshal(body, &req); err != nil {
+	mtu, err := parseMTU(networkOption(req.Options, optMTU))
+	if err != nil {
 		resp.Err = "Error: " + err.Error()
 		sendResponse(resp, w)
 		return
 	}
 
-	glog.Infof("Delete Network := %v", req.NetworkID)
-
-	nwMap.Lock()
-	defer nwMap.Unlock()
-
-	bridge := nwMap.m[req.NetworkID].Bridge
-	delete(nwMap.m, req.NetworkID)
-	if err := dbDelete("nwMap", req.NetworkID); err != nil {
-		glog.Errorf("Unable to update db %v %v", err, bridge)
+	queues, err := parseQueues(networkOption(req.Options, optQueues))
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
 	}
 
-	brMap.Lock()
-	delete(brMap.m, req.NetworkID)
-	if err := dbDelete("brMap", req.NetworkID); err != nil {
-		glog.Errorf("Unable to update db %v %v", err, bridge)
+	rss, err := parseRSS(networkOption(req.Options, optRSSKey), networkOption(req.Options, optRSSFields))
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
 	}
-	brMap.Unlock()
-
-	sendResponse(resp, w)
-	return
-}
-
-func handlerEndpointOperInfof(w http.ResponseWriter, r *http.Request) {
-	resp := api.EndpointInfoResponse{}
-	body, err := getBody(r)
 
+	vhostDir, err := parseVhostDir(networkOption(req.Options, optVhostDir))
 	if err != nil {
 		resp.Err = "Error: " + err.Error()
 		sendResponse(resp, w)
 		return
 	}
 
-	req := api.EndpointInfoRequest{}
-	err = json.Unmarshal(body, &req)
+	tenant, err := parseTenant(networkOption(req.Options, optTenant))
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
 
+	uplink, err := parseUplink(networkOption(req.Options, optUplink))
 	if err != nil {
 		resp.Err = "Error: " + err.Error()
 		sendResponse(resp, w)
 		return
 	}
 
-	sendResponse(resp, w)
-}
+	vlan, err := parseVLAN(networkOption(req.Options, optVLAN))
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
 
-func handlerCreateEndpoint(w http.ResponseWriter, r *http.Request) {
-	resp := api.CreateEndpointResponse{}
+	forwarding, err := parseForwarding(networkOption(req.Options, optForwarding))
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
 
-	body, err := getBody(r)
+	dscp, err := parseDSCP(networkOption(req.Options, optDSCP))
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+	classes, err := parseTrafficClasses(networkOption(req.Options, optTrafficClasses))
 	if err != nil {
 		resp.Err = "Error: " + err.Error()
 		sendResponse(resp, w)
 		return
 	}
 
-	req := api.CreateEndpointRequest{}
-	if err = json.Unmarshal(body, &req); err != nil {
+	stateful, err := parseStateful(networkOption(req.Options, optStateful))
+	if err != nil {
 		resp.Err = "Error: " + err.Error()
 		sendResponse(resp, w)
 		return
 	}
 
-	if req.Interface.Address == "" {
-		resp.Err = "Error: IP Address parameter not provided in docker run"
+	proxyARP, err := parseProxyARP(networkOption(req.Options, optProxyARP))
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+	gatewayMode, err := parseGatewayMode(networkOption(req.Options, optGatewayMode))
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
 		sendResponse(resp, w)
 		return
 	}
 
-	ip, _, err := net.ParseCIDR(req.Interface.Address)
+	vni, err := parseVNI(networkOption(req.Options, optVXLANVNI))
 	if err != nil {
-		resp.Err = "Error: Invalid IP Address " + err.Error()
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+	vteps, err := parseVTEPs(networkOption(req.Options, optVXLANRemote))
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+	if vni != 0 && vlan != 0 {
+		resp.Err = fmt.Sprintf("Error: %s and %s are mutually exclusive", optVLAN, optVXLANVNI)
+		sendResponse(resp, w)
+		return
+	}
+	if forwarding == forwardingL2 && (vlan != 0 || vni != 0) {
+		resp.Err = fmt.Sprintf("Error: %s=%s can't be combined with %s or %s", optForwarding, forwardingL2, optVLAN, optVXLANVNI)
 		sendResponse(resp, w)
 		return
 	}
 
-	nwMap.Lock()
-	bridge := nwMap.m[req.NetworkID].Bridge
-	nwMap.Unlock()
+	named, err := parseBridge(networkOption(req.Options, optBridge))
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+	source, err := networkP4Source(req.Options)
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
 
-	if bridge == "" {
-		resp.Err = "Error: incompatible network"
+	if fallback && (vlan != 0 || vni != 0 || uplink != "" || source != "" || named != "") {
+		resp.Err = fmt.Sprintf("Error: %s, %s, %s, %s, %s and %s need the IPDK dataplane", optVLAN, optVXLANVNI, optUplink, optP4Program, optPipeline, optBridge)
+		sendResponse(resp, w)
+		return
+	}
+	if fallback && gatewayMode == gatewayPipeline {
+		resp.Err = fmt.Sprintf("Error: %s=%s needs the IPDK dataplane", optGatewayMode, gatewayPipeline)
 		sendResponse(resp, w)
 		return
 	}
 
-	nwMap.Lock()
-	defer nwMap.Unlock()
+	//Selected programs run in a bridge other than br0, and are compiled
+	//before any lock is taken as p4c takes a while
+	var prog *p4Program
+	if source != "" {
+		if named == defaultBridge || !*bridgePerNetwork && named == "" {
+			resp.Err = fmt.Sprintf("Error: the program of br0 can't be changed, the plugin must be started with -bridge-per-network or given %s", optBridge)
+			sendResponse(resp, w)
+			return
+		}
+		if err := requireDocker(); err != nil {
+			resp.Err = "Error: " + err.Error()
+			sendResponse(resp, w)
+			return
+		}
+		if prog, err = loadP4Program(source); err != nil {
+			resp.Err = "Error: " + err.Error()
+			sendResponse(resp, w)
+			return
+		}
+	}
 
-	epMap.Lock()
-	defer epMap.Unlock()
+	//Isolation, default-deny, overlays and uplinks need the dataplane at
+	//creation time
+	if !fallback && (defaultDeny || vni != 0 || uplink != "" || *isolateNetworks || networkOption(req.Options, optIsolationGroup) != "" ||
+		networkOption(req.Options, optIsolationExclude) != "") {
+		if err := requireDocker(); err != nil {
+			resp.Err = "Error: " + err.Error()
+			sendResponse(resp, w)
+			return
+		}
+	}
 
-	brMap.Lock()
-	defer brMap.Unlock()
+	defer lockNetwork(req.NetworkID)()
 
-	//Generate a vhost-user port name to use with dummy interface.
-	//We'll use the interfaces IP address
-	vhostPort := fmt.Sprintf("%s", ip)
+	//No other network is created or deleted meanwhile, see netlock.go
+	networkChanges.Lock()
+	defer networkChanges.Unlock()
+
+	//nwMap and brMap are only held to check the network against the
+	//others and hand out its IDs, not while the dataplane is set up
+	nwMap.Lock()
+	brMap.Lock()
+	done := createdNetwork(w, &req, resp)
+	if !done {
+		err = checkNetworkConflicts(vlan, vni, uplink)
+	}
+	// For IPDK, we are connecting endpoints via a bridge which requires
+	// a unique integer ID.
+	brID := brMap.brCount
+	uplinkPort, gatewayPort := 0, 0
+	if !done && err == nil {
+		if uplink != "" {
+			//The uplink port takes an interface ID like endpoints do
+			uplinkPort = allocIntf()
+		}
+		if gatewayMode == gatewayHost && !fallback {
+			//So does the TAP port holding the gateway
+			gatewayPort = allocIntf()
+		}
+	}
+	sharedID, shared := "", (*nwVal)(nil)
+	if named != "" {
+		sharedID, shared = bridgeNetwork(named, "")
+	}
+	peers := networkSnapshot(req.NetworkID)
+	brMap.Unlock()
+	nwMap.Unlock()
 
-	//Create a unique path on the host to place the socket
-	socketpath := fmt.Sprintf("/tmp/vhostuser_%s", ip)
-	glog.Infof("INFO: Creating directory %v", socketpath)
-	err = os.Mkdir(socketpath, 0755)
+	if done {
+		return
+	}
 	if err != nil {
-		resp.Err = fmt.Sprintf("Error making socket path %s: err: %v", socketpath, err)
+		resp.Err = "Error: " + err.Error()
 		sendResponse(resp, w)
 		return
 	}
 
-	// Create a unique name and host
-	ipdk_intf := brMap.intfCount
-	brMap.intfCount = brMap.intfCount + 1
-	netnamet := fmt.Sprintf("net_vhost%d", ipdk_intf)
-	netname := strings.Replace(netnamet, ".", "", -1)
-	nethostt := fmt.Sprintf("host_%d", ipdk_intf)
-	nethost := strings.Replace(nethostt, ".", "", -1)
+	if *driverScope == scopeGlobal {
+		//The network has the same segment on every node
+		if brID, err = claimSegment(req.NetworkID); err != nil {
+			resp.Err = "Error: " + err.Error()
+			sendResponse(resp, w)
+			return
+		}
+	}
+	bridge := networkBridge(brID)
+	created := false
+	if fallback {
+		bridge = fallbackBridge(brID)
+	} else if named != "" {
+		bridge = named
+		if named != defaultBridge {
+			if err = requireDocker(); err == nil {
+				created, err = attachNamedBridge(named, prog, sharedID, shared)
+			}
+			if err != nil {
+				resp.Err = "Error: " + err.Error()
+				sendResponse(resp, w)
+				return
+			}
+		}
+	} else if bridge != defaultBridge {
+		if err := requireDocker(); err != nil {
+			resp.Err = "Error: " + err.Error()
+			sendResponse(resp, w)
+			return
+		}
+		if err := createBridge(bridge, prog); err != nil {
+			resp.Err = "Error: " + err.Error()
+			sendResponse(resp, w)
+			return
+		}
+	}
+
+	//Record the docker network UUID to SDN bridge mapping
+	//This has to survive a plugin crash/restart and needs to be persisted
+	nw := &nwVal{
+		Bridge:           bridge,
+		Segment:          brID,
+		Gateway:          *req.IPv4Data[0].Gateway,
+		MTU:              mtu,
+		Queues:           queues,
+		RSS:              rss,
+		IsolationGroups:  splitOption(networkOption(req.Options, optIsolationGroup)),
+		IsolationExclude: splitOption(networkOption(req.Options, optIsolationExclude)),
+		DefaultDeny:      defaultDeny,
+		Services:         services,
+		Forwarding:       forwarding,
+		Stateful:         stateful,
+		ProxyARP:         proxyARP,
+		DSCP:             dscp,
+		TrafficClasses:   classes,
+		VLAN:             vlan,
+		VNI:              vni,
+		VTEPs:            vteps,
+		FollowNodes:      vni != 0 && len(vteps) == 0,
+		Uplink:           uplink,
+		VhostDir:         vhostDir,
+		Fallback:         fallback,
+		NamedBridge:      named != "" && named != defaultBridge,
+		BridgeCreated:    created,
+		GatewayMode:      gatewayMode,
+		Tenant:           tenant,
+		UplinkPort:       uplinkPort,
+		GatewayPort:      gatewayPort,
+	}
+	if nw.FollowNodes {
+		nw.VTEPs = discoveredNodes()
+	}
+	if prog != nil {
+		nw.P4Program = prog.Source
+		nw.P4Map = prog.Mapping
+	}
+	if req.IPv4Data[0].Pool != nil {
+		nw.Subnet = *req.IPv4Data[0].Pool
+	}
+	for _, data := range req.IPv4Data[1:] {
+		if data.Pool != nil {
+			nw.Subnets = append(nw.Subnets, *data.Pool)
+		}
+	}
+	if len(req.IPv6Data) > 0 {
+		if req.IPv6Data[0].Pool != nil {
+			nw.Subnet6 = *req.IPv6Data[0].Pool
+		}
+		if req.IPv6Data[0].Gateway != nil {
+			nw.Gateway6 = *req.IPv6Data[0].Gateway
+		}
+	}
 
-	//Generate IPDK vhost-user interface:
-	//docker exec -it ipdk gnmi-cli set "device:virtual-device,name:net_vhost0,host:host1,device-type:VIRTIO_NET,queues:1,socket-path:/tmp/vhost-user-0,port-type:LINK"
-	cmd := "docker"
-	args := []string{"exec", "ipdk", "gnmi-cli", "set", fmt.Sprintf("device:virtual-device,name:%s,host:%s,device-type:VIRTIO_NET,queues:1,socket-path:%s/vhu.sock,port-type:LINK", netname, nethost, socketpath)}
-	glog.Infof("INFO: Running command [%v] with args [%v]", cmd, args)
-	//if err := exec.Command(cmd, args...).Run(); err != nil {
-	output, err := exec.Command(cmd, args...).Output()
+	//Program the inter-network allow/deny rules implied by the isolation
+	//groups before any endpoint can attach to the new network, which is
+	//only added to nwMap once set up. Networks in veth mode only have
+	//their Linux bridge.
+	if nw.Fallback {
+		err = createFallbackBridge(nw)
+	} else {
+		err = programIsolation(req.NetworkID, nw, peers)
+	}
+	if err == nil && !nw.Fallback {
+		if err = programDefaultDeny(req.NetworkID, nw); err != nil {
+			unprogramIsolation(req.NetworkID, nw, peers)
+		}
+	}
+	if err == nil && !nw.Fallback {
+		if err = programVXLAN(req.NetworkID, nw); err != nil {
+			unprogramDefaultDeny(nw)
+			unprogramIsolation(req.NetworkID, nw, peers)
+		}
+	}
+	if err == nil && !nw.Fallback {
+		if err = programARP(req.NetworkID, nw); err != nil {
+			unprogramVXLAN(nw)
+			unprogramDefaultDeny(nw)
+			unprogramIsolation(req.NetworkID, nw, peers)
+		}
+	}
+	if err == nil && !nw.Fallback {
+		if err = programFlood(req.NetworkID, nw); err != nil {
+			unprogramARP(nw)
+			unprogramVXLAN(nw)
+			unprogramDefaultDeny(nw)
+			unprogramIsolation(req.NetworkID, nw, peers)
+		}
+	}
+	if err == nil && !nw.Fallback {
+		if err = programTrafficClasses(req.NetworkID, nw); err != nil {
+			unprogramFlood(nw)
+			unprogramARP(nw)
+			unprogramVXLAN(nw)
+			unprogramDefaultDeny(nw)
+			unprogramIsolation(req.NetworkID, nw, peers)
+		}
+	}
+	if err == nil && !nw.Fallback {
+		if err = programStateful(req.NetworkID, nw); err != nil {
+			unprogramTrafficClasses(nw)
+			unprogramFlood(nw)
+			unprogramARP(nw)
+			unprogramVXLAN(nw)
+			unprogramDefaultDeny(nw)
+			unprogramIsolation(req.NetworkID, nw, peers)
+		}
+	}
+	if err == nil && !nw.Fallback {
+		if err = programIPv6(req.NetworkID, nw); err != nil {
+			unprogramStateful(nw)
+			unprogramTrafficClasses(nw)
+			unprogramFlood(nw)
+			unprogramARP(nw)
+			unprogramVXLAN(nw)
+			unprogramDefaultDeny(nw)
+			unprogramIsolation(req.NetworkID, nw, peers)
+		}
+	}
+	if err == nil && !nw.Fallback {
+		if err = programUplink(req.NetworkID, nw); err != nil {
+			unprogramIPv6(nw)
+			unprogramStateful(nw)
+			unprogramTrafficClasses(nw)
+			unprogramFlood(nw)
+			unprogramARP(nw)
+			unprogramVXLAN(nw)
+			unprogramDefaultDeny(nw)
+			unprogramIsolation(req.NetworkID, nw, peers)
+		}
+	}
+	if err == nil && !nw.Fallback {
+		if err = programGateway(req.NetworkID, nw); err != nil {
+			unprogramUplink(req.NetworkID, nw)
+			unprogramIPv6(nw)
+			unprogramStateful(nw)
+			unprogramTrafficClasses(nw)
+			unprogramFlood(nw)
+			unprogramARP(nw)
+			unprogramVXLAN(nw)
+			unprogramDefaultDeny(nw)
+			unprogramIsolation(req.NetworkID, nw, peers)
+		}
+	}
 	if err != nil {
-		glog.Infof("ERROR: [%v] [%v] [%v] ", cmd, args, err)
-		resp.Err = fmt.Sprintf("Error EndPointCreate: [%v] [%v] [%v]",
-			cmd, args, err)
+		if ownsBridge(nw) || created {
+			if err := deleteBridge(bridge); err != nil {
+				slog.Error("Unable to delete bridge", "bridge", bridge, "err", err)
+			}
+		}
+		resp.Err = "Error: " + err.Error()
 		sendResponse(resp, w)
 		return
 	}
 
-	ifcb, _, err := bufio.NewReader(bytes.NewReader(output)).ReadLine()
-	ifc := string(ifcb)
+	nwMap.Lock()
+	brMap.Lock()
+	nwMap.m[req.NetworkID] = nw
+	brMap.m[req.NetworkID] = brID
+	if brID >= brMap.brCount {
+		brMap.brCount = brID + 1
+	}
+
+	//The network, its bridge ID and the bridge counter are written in a
+	//single transaction so a crash can't leave only some of them behind
+	if err := dbUpdate(
+		putNetwork(req.NetworkID, nw),
+		putBridge(req.NetworkID, brID),
+		putCounter("brCount", brMap.brCount),
+		putCounter("intfCount", brMap.intfCount),
+		putFreeIntfs(brMap.freeIntfs),
+	); err != nil {
+		slog.Error("Unable to update db", "network", req.NetworkID, "err", err)
+	}
+	brMap.Unlock()
+	nwMap.Unlock()
+	slog.Info("Created network", "network", req.NetworkID, "bridge", bridge, "subnet", nw.Subnet.String(), "config", networkConfig(nw))
+
+	sendResponse(resp, w)
+}
 
-	glog.Infof("INFO: Result of gnmi-cli command [%v]", ifc)
+func handlerDeleteNetwork(w http.ResponseWriter, r *http.Request) {
+	resp := api.DeleteNetworkResponse{}
 
-	// Run ovs-p4ctl to add a pipeline entry
-	cmd = "docker"
-	args = []string{"exec", "ipdk", "ovs-p4ctl", "add-entry", "br0", "ingress.ipv4_host", fmt.Sprintf("hdr.ipv4.dst_addr=%s,action=ingress.send(%d)", ip, ipdk_intf)}
-	glog.Infof("INFO: Running command [%v] with args [%v]", cmd, args)
-	output, err = exec.Command(cmd, args...).Output()
+	body, err := getBody(r)
 	if err != nil {
-		glog.Infof("ERROR: [%v] [%v] [%v] ", cmd, args, err)
-		resp.Err = fmt.Sprintf("Error ovs-p4ctl : [%v] [%v] [%v]",
-			cmd, args, err)
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+
+	req := api.DeleteNetworkRequest{}
+	if err = json.Unmarshal(body, &req); err != nil {
+		resp.Err = "Error: " + err.Error()
 		sendResponse(resp, w)
 		return
 	}
 
-	ifcb, _, err = bufio.NewReader(bytes.NewReader(output)).ReadLine()
-	ifc = string(ifcb)
+	slog.Info("Delete Network", "network", req.NetworkID)
 
-	glog.Infof("INFO: Result of ovs-p4ctl command [%v]", ifc)
+	defer lockNetwork(req.NetworkID)()
 
-	/* Setup the dummy interface corresponding to the dpdk port
-	 * This is done so that docker CNM will program the IP Address
-	 * and other properties on this Interface
-	 * This dummy interface will be discovered by clear containers
-	 * which then maps the actual vhost-user port to the VM
-	 * This is needed today as docker does not pass any information
-	 * from the network plugin to the runtime
-	 */
-	cmd = "ip"
-	args = []string{"link", "add", vhostPort, "type", "dummy"}
-	if err := exec.Command(cmd, args...).Run(); err != nil {
-		resp.Err = fmt.Sprintf("Error EndPointCreate: [%v] [%v] [%v]",
-			cmd, args, err)
+	//No other network is created or deleted meanwhile, see netlock.go
+	networkChanges.Lock()
+	defer networkChanges.Unlock()
+
+	//The network is removed from nwMap before it is torn down, nwMap and
+	//brMap not being held meanwhile
+	nwMap.Lock()
+
+	//The network may be gone with a lost db, docker must still be able
+	//to delete it
+	nw := nwMap.m[req.NetworkID]
+	if nw == nil {
+		nwMap.Unlock()
+		slog.Warn("Deleting unknown network", "network", req.NetworkID)
 		sendResponse(resp, w)
 		return
 	}
 
-	glog.Infof("Setup dummy port %v %v ", cmd, args)
+	//The routes change the other networks and their endpoints, they are
+	//removed with the maps locked like through the admin API
+	epMap.Lock()
+	ops := unprogramRoutes(req.NetworkID, nw)
+	epMap.Unlock()
+	delete(nwMap.m, req.NetworkID)
+	deleteNamed := false
+	if !nw.Fallback && !ownsBridge(nw) && nw.NamedBridge {
+		var named []dbOp
+		named, deleteNamed = releaseNamedBridge(req.NetworkID, nw)
+		ops = append(ops, named...)
+	}
+	peers := networkSnapshot(req.NetworkID)
 
-	epMap.m[req.EndpointID] = &epVal{
-		IP:            req.Interface.Address,
-		vhostuserPort: vhostPort,
-		ipdkInterface:  fmt.Sprintf("%d", brMap.intfCount),
+	brMap.Lock()
+	delete(brMap.m, req.NetworkID)
+	brMap.Unlock()
+	nwMap.Unlock()
+
+	bridge := nw.Bridge
+	if !nw.Fallback {
+		unprogramGateway(req.NetworkID, nw)
+	}
+	unprogramUplink(req.NetworkID, nw)
+	if nw.Fallback {
+		deleteFallbackBridge(nw)
+	} else if ownsBridge(nw) {
+		//Deleting the bridge of the network deletes all of its entries
+		if err := deleteBridge(bridge); err != nil {
+			slog.Error("Unable to delete bridge", "bridge", bridge, "err", err)
+		}
+		unprogramIsolation(req.NetworkID, nw, peers)
+	} else {
+		unprogramIsolation(req.NetworkID, nw, peers)
+		unprogramDefaultDeny(nw)
+		unprogramVXLAN(nw)
+		unprogramARP(nw)
+		unprogramFlood(nw)
+		unprogramTrafficClasses(nw)
+		unprogramStateful(nw)
+		unprogramIPv6(nw)
+		unprogramNextHopGroups(nw)
+		if deleteNamed {
+			if err := deleteBridge(bridge); err != nil {
+				slog.Error("Unable to delete bridge", "bridge", bridge, "err", err)
+			}
+		}
+	}
+
+	if *driverScope == scopeGlobal {
+		ops = append(ops, releaseSegment(nw.Segment))
+	}
+	if err := dbUpdate(append(ops,
+		delNetwork(req.NetworkID),
+		delBridge(req.NetworkID),
+	)...); err != nil {
+		slog.Error("Unable to update db", "network", req.NetworkID, "err", err)
+	}
+
+	sendResponse(resp, w)
+	return
+}
+
+func handlerEndpointOperInfof(w http.ResponseWriter, r *http.Request) {
+	resp := api.EndpointInfoResponse{}
+	body, err := getBody(r)
+
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+
+	req := api.EndpointInfoRequest{}
+	err = json.Unmarshal(body, &req)
+
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+
+	epMap.Lock()
+	device := ""
+	if ep, ok := epMap.m[req.EndpointID]; ok {
+		resp.Value = endpointOperInfo(ep)
+		device = portDevice(ep)
+	}
+	epMap.Unlock()
+
+	//Counters are read without holding any lock
+	if device != "" && caps.IPDK {
+		counters, err := readPortCounters(device)
+		if err != nil {
+			slog.Warn("Unable to read port counters", "endpoint", req.EndpointID, "err", err)
+		} else {
+			resp.Value[optCounters] = counters
+		}
+	}
+
+	sendResponse(resp, w)
+}
+
+//createdEndpoint answers a CreateEndpoint request that docker retried,
+//or sent again after a restart, for an endpoint which was created, and
+//returns false for a new endpoint.
+//Endpoints are only added to epMap once fully created, a failed creation
+//having undone its steps. epMap must be locked by the caller.
+func createdEndpoint(w http.ResponseWriter, req *api.CreateEndpointRequest, resp api.CreateEndpointResponse) bool {
+	ep, ok := epMap.m[req.EndpointID]
+	if !ok {
+		return false
+	}
+
+	if ep.NetworkID != req.NetworkID || ep.IP != req.Interface.Address {
+		resp.Err = fmt.Sprintf("Error: endpoint %s already exists with address %s on network %s", req.EndpointID, ep.IP, ep.NetworkID)
+	} else {
+		slog.Info("Endpoint already created", "network", req.NetworkID, "endpoint", req.EndpointID)
+		if req.Interface.MacAddress == "" && ep.MAC != "" {
+			resp.Interface = &api.EndpointInterface{MacAddress: ep.MAC}
+		}
+		if err := verifyEndpoint(ep); err != nil {
+			slog.Warn("Endpoint is missing from the dataplane", "endpoint", req.EndpointID, "err", err)
+			requestResync("endpoint " + req.EndpointID)
+		}
+	}
+	sendResponse(resp, w)
+	return true
+}
+
+//endpointWithIP returns the ID of an endpoint, created or being created,
+//an endpoint with address ip can't coexist with, or "". IPDK endpoints
+//are named after their address on the host, so their addresses must be
+//unique across networks, those of veth endpoints only within their
+//network. epMap must be locked by the caller.
+func endpointWithIP(networkID string, ip string, veth bool) string {
+	for id, ep := range allEndpoints() {
+		if ep.VhostuserPort != ip {
+			continue
+		}
+		if ep.NetworkID == networkID || (!veth && ep.PortType != portTypeVeth) {
+			return id
+		}
+	}
+	return ""
+}
+
+//rollback holds the steps undoing the completed steps of an operation
+type rollback []func()
+
+func (r *rollback) add(undo func()) {
+	*r = append(*r, undo)
+}
+
+//run undoes the completed steps, last first
+func (r rollback) run() {
+	for i := len(r) - 1; i >= 0; i-- {
+		r[i]()
+	}
+}
+
+//reserveEndpoint hands out the interface ID of a new endpoint, and its
+//virtual function or socket directory, and records it as being created,
+//so that they are neither handed out again nor garbage collected while
+//its ports and entries are set up without holding the map locks. The
+//endpoint is set up with the copy of its network returned.
+func reserveEndpoint(id string, ep *epVal, device string) (*virtualFunction, *nwVal, error) {
+	nwMap.Lock()
+	defer nwMap.Unlock()
+
+	epMap.Lock()
+	defer epMap.Unlock()
+
+	brMap.Lock()
+	defer brMap.Unlock()
+
+	nw := nwMap.m[ep.NetworkID]
+	if nw == nil {
+		return nil, nil, fmt.Errorf("unknown network %s", ep.NetworkID)
+	}
+	if other := endpointWithIP(ep.NetworkID, ep.VhostuserPort, false); other != "" {
+		return nil, nil, fmt.Errorf("address %v is already used by endpoint %v", ep.VhostuserPort, other)
+	}
+
+	var vf *virtualFunction
+	switch ep.PortType {
+	case portTypeVF:
+		//The representor of the VF stands for the vhost-user port
+		var err error
+		if vf, err = allocVF(); err != nil {
+			return nil, nil, err
+		}
+		ep.IpdkInterface = vfPort(vf)
+		ep.VF = vf.PCI
+		ep.Netdev = vf.Netdev
+	case portTypeTAP:
+		ep.IpdkInterface = allocIntf()
+		ep.Netdev = tapName(ep.IpdkInterface)
+	default:
+		//Create a unique path on the host to place the socket, unless
+		//the endpoint uses the directory of a device of a pod
+		ep.SocketDir = vhostSocketDir(nw.VhostDir, ep.VhostuserPort)
+		if device != "" {
+			ep.SocketDir = vhostDeviceDir(device)
+			if other := socketDirEndpoint(ep.SocketDir); other != "" {
+				return nil, nil, fmt.Errorf("device %v is used by endpoint %v", device, other)
+			}
+		}
+
+		// Create a unique name and host
+		ep.IpdkInterface = allocIntf()
+		if err := allocLink(id, ep); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	//The intent is written before the dataplane is touched, along with
+	//the interface counter so the ID isn't handed out again after a crash
+	err := dbUpdate(putIntent(id, intentCreate, ep), putCounter("intfCount", brMap.intfCount), putFreeIntfs(brMap.freeIntfs))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	epMap.pending[id] = ep
+	c := *nw
+	return vf, &c, nil
+}
+
+//releaseEndpoint forgets an endpoint whose creation failed, once what it
+//set up has been removed
+func releaseEndpoint(id string) {
+	epMap.Lock()
+	defer epMap.Unlock()
+	delete(epMap.pending, id)
+	if err := dbUpdate(delIntent(id)); err != nil {
+		slog.Error("Unable to update db", "endpoint", id, "err", err)
+	}
+}
+
+//commitEndpoint adds a created endpoint to epMap. Its port joined the
+//flood group of its network already, see joinNetworkFloodGroup.
+func commitEndpoint(id string, ep *epVal) {
+	epMap.Lock()
+	defer epMap.Unlock()
+
+	brMap.Lock()
+	defer brMap.Unlock()
+
+	delete(epMap.pending, id)
+	epMap.m[id] = ep
+
+	//The endpoint replaces its intent, see intents.go
+	if err := dbUpdate(putEndpoint(id, ep), delIntent(id), putCounter("intfCount", brMap.intfCount), putFreeIntfs(brMap.freeIntfs)); err != nil {
+		slog.Error("Unable to update db", "endpoint", id, "err", err)
+	}
+	writeEndpointMetadata(id, ep, "")
+}
+
+func handlerCreateEndpoint(w http.ResponseWriter, r *http.Request) {
+	resp := api.CreateEndpointResponse{}
+
+	body, err := getBody(r)
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+
+	req := api.CreateEndpointRequest{}
+	if err = json.Unmarshal(body, &req); err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+
+	if err := checkEndpointOptions(req.Options); err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+
+	if req.Interface.Address == "" {
+		resp.Err = "Error: IP Address parameter not provided in docker run"
+		sendResponse(resp, w)
+		return
+	}
+
+	ip, _, err := net.ParseCIDR(req.Interface.Address)
+	if err != nil {
+		resp.Err = "Error: Invalid IP Address " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+
+	if err := requireNetAdmin(); err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+
+	services, err := parseServiceRules(endpointOption(req.Options, optExpose))
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+
+	acl, err := parseACLRules(endpointOption(req.Options, optACL))
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+
+	//The endpoints of the same network are created concurrently, up to
+	//-endpoint-workers at a time across all networks
+	defer endpointWorker()()
+	defer shareNetwork(req.NetworkID)()
+
+	nwMap.Lock()
+	nw := nwMap.m[req.NetworkID]
+	bridge := ""
+	if nw != nil {
+		bridge = nw.Bridge
+	}
+	nwMap.Unlock()
+
+	if nw == nil {
+		resp.Err = "Error: unknown network " + req.NetworkID
+		sendResponse(resp, w)
+		return
+	}
+	if bridge == "" {
+		resp.Err = "Error: incompatible network"
+		sendResponse(resp, w)
+		return
+	}
+	if err := checkEndpointTenant(req.Options, nw); err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+
+	if nw.Fallback {
+		createFallbackEndpoint(w, &req, nw, ip)
+		return
+	}
+	if err := requireDocker(); err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+
+	mtu, err := endpointMTU(nw, req.Options)
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+
+	portType, err := parsePortType(endpointOption(req.Options, optPortType))
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+
+	queues, err := endpointQueues(nw, req.Options)
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+
+	rss, err := endpointRSS(nw, req.Options)
+	if err == nil && rss != nil && vhostQueues(queues) == 1 && portType == "" {
+		err = fmt.Errorf("%s needs more than one queue, set %s", optRSSFields, optQueues)
+	}
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+
+	dscp, err := endpointDSCP(nw, req.Options)
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+
+	ip6, err := parseEndpointIPv6(nw, req.Interface.AddressIPv6)
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+
+	device, err := parseVhostDevice(endpointOption(req.Options, optVhostDevice))
+	if err == nil && device != "" && portType != "" {
+		err = fmt.Errorf("%s needs a vhost-user port", optVhostDevice)
+	}
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+
+	//Explicit MAC addresses are set on the device, generated ones are
+	//only needed by L2 and proxy ARP networks
+	mac := ""
+	if nw.Forwarding == forwardingL2 || nw.ProxyARP || req.Interface.MacAddress != "" {
+		if mac, err = endpointMAC(req.Interface.MacAddress, ip); err != nil {
+			resp.Err = "Error: " + err.Error()
+			sendResponse(resp, w)
+			return
+		}
+		if req.Interface.MacAddress == "" {
+			resp.Interface = &api.EndpointInterface{MacAddress: mac}
+		}
+	}
+
+	epMap.Lock()
+	created := createdEndpoint(w, &req, resp)
+	epMap.Unlock()
+	if created {
+		return
+	}
+
+	//Generate a vhost-user port name to use with dummy interface.
+	//We'll use the interfaces IP address
+	vhostPort := fmt.Sprintf("%s", ip)
+
+	//An entry for the address left over, or installed by another
+	//controller, would be overwritten
+	if err := checkHostEntry(req.EndpointID, bridge, vhostPort); err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+
+	ep := &epVal{
+		IP:            req.Interface.Address,
+		IPv6:          ip6,
+		NetworkID:     req.NetworkID,
+		VhostuserPort: vhostPort,
+		MAC:           mac,
+		MTU:           mtu,
+		Queues:        queues,
+		RSS:           rss,
+		PortType:      portType,
+		DSCP:          dscp,
+		Services:      services,
+		ACL:           acl,
+	}
+	vf, nw, err := reserveEndpoint(req.EndpointID, ep, device)
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+	ipdk_intf := ep.IpdkInterface
+	socketpath := ep.SocketDir
+
+	//Every completed step is undone if a later one fails
+	var undo rollback
+	undo.add(func() { releaseEndpoint(req.EndpointID) })
+
+	if portType == portTypeTAP {
+		if err := createTapPort(ipdk_intf, mtu); err != nil {
+			resp.Err = "Error: " + err.Error()
+			undo.run()
+			sendResponse(resp, w)
+			return
+		}
+		undo.add(func() {
+			if err := deleteTapPort(ipdk_intf); err != nil {
+				slog.Error("Rollback: unable to delete TAP port", "endpoint", req.EndpointID, "err", err)
+			}
+		})
+	} else if portType == "" {
+		//The directory may be left over by a creation that didn't
+		//complete, no endpoint uses it
+		err = makeSocketDir(socketpath)
+		if os.IsExist(err) {
+			err = nil
+		}
+		if err != nil {
+			resp.Err = "Error: " + hostError("HOST_SOCKET_DIR_FAILED", "creating the socket directory failed", err).Error()
+			undo.run()
+			sendResponse(resp, w)
+			return
+		}
+		undo.add(func() {
+			if err := removeSocketDir(socketpath); err != nil {
+				slog.Error("Rollback: unable to remove socket directory", "endpoint", req.EndpointID, "path", socketpath, "err", err)
+			}
+		})
+
+		//Generate IPDK vhost-user interface
+		if err := createVhostPort(ipdk_intf, socketpath, vhostPortConfig{MTU: mtu, Queues: queues, RSS: rss, MAC: mac}); err != nil {
+			resp.Err = "Error: " + err.Error()
+			undo.run()
+			sendResponse(resp, w)
+			return
+		}
+		undo.add(func() {
+			if err := deleteVhostPort(ipdk_intf); err != nil {
+				slog.Error("Rollback: unable to delete vhost port", "endpoint", req.EndpointID, "port", ipdk_intf, "err", err)
+			}
+		})
+	}
+
+	//The pipeline entries of the endpoint are recorded as owned by it
+	undo.add(func() { removeOwnedEntries(endpointOwner(req.EndpointID)) })
+
+	// Run ovs-p4ctl to add a pipeline entry
+	if err := addEndpointForwarding(req.EndpointID, nw, vhostPort, mac, ipdk_intf); err != nil {
+		resp.Err = "Error: " + err.Error()
+		undo.run()
+		sendResponse(resp, w)
+		return
+	}
+
+	if err := programEndpointARP(req.EndpointID, nw, vhostPort, mac); err != nil {
+		resp.Err = "Error: " + err.Error()
+		undo.run()
+		sendResponse(resp, w)
+		return
+	}
+
+	//Neighbor solicitations are answered with the MAC address docker
+	//derives from the IPv4 address unless the endpoint has one
+	ndMAC := mac
+	if ndMAC == "" {
+		ndMAC, _ = endpointMAC("", ip)
+	}
+	if err := programEndpointIPv6(req.EndpointID, nw, ip6, ndMAC, ipdk_intf); err != nil {
+		resp.Err = "Error: " + err.Error()
+		undo.run()
+		sendResponse(resp, w)
+		return
+	}
+
+	if err := addEndpointSegment(req.EndpointID, nw, ipdk_intf); err != nil {
+		resp.Err = "Error: " + err.Error()
+		undo.run()
+		sendResponse(resp, w)
+		return
+	}
+
+	if err := programEndpointDSCP(req.EndpointID, nw, ipdk_intf, dscp); err != nil {
+		resp.Err = "Error: " + err.Error()
+		undo.run()
+		sendResponse(resp, w)
+		return
+	}
+
+	if err := programACL(endpointOwner(req.EndpointID), nw.Bridge, ipdk_intf, acl, aclTopPriority); err != nil {
+		resp.Err = "Error: " + err.Error()
+		undo.run()
+		sendResponse(resp, w)
+		return
+	}
+
+	sgMap.Lock()
+	groups, err := parseSecurityGroups(endpointOption(req.Options, optSecurityGroups))
+	if err == nil {
+		err = programACL(endpointOwner(req.EndpointID), nw.Bridge, ipdk_intf, securityGroupRules(groups), sgTopPriority)
+	}
+	sgMap.Unlock()
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+		undo.run()
+		sendResponse(resp, w)
+		return
+	}
+
+	if err := joinNetworkFloodGroup(req.NetworkID, nw, ipdk_intf); err != nil {
+		resp.Err = "Error: " + err.Error()
+		undo.run()
+		sendResponse(resp, w)
+		return
+	}
+	undo.add(func() { leaveNetworkFloodGroup(req.NetworkID, nw, ipdk_intf) })
+
+	if err := programEndpointServices(req.EndpointID, nw, vhostPort, services); err != nil {
+		resp.Err = "Error: " + err.Error()
+		undo.run()
+		sendResponse(resp, w)
+		return
+	}
+
+	/* Setup the dummy interface corresponding to the dpdk port
+	 * This is done so that docker CNM will program the IP Address
+	 * and other properties on this Interface
+	 * This dummy interface will be discovered by clear containers
+	 * which then maps the actual vhost-user port to the VM
+	 * This is needed today as docker does not pass any information
+	 * from the network plugin to the runtime
+	 */
+	if vf != nil {
+		//The VF netdev is handed to docker instead
+		if mtu != 0 {
+			err = host.SetLinkMTU(vf.Netdev, mtu)
+		}
+		if err == nil && mac != "" {
+			err = host.SetLinkMAC(vf.Netdev, mac)
+		}
+	} else if portType == portTypeTAP {
+		if mac != "" {
+			err = host.SetLinkMAC(tapName(ipdk_intf), mac)
+		}
+	} else {
+		//The link may be left behind by a failed addDummyLink
+		link := dummyLink(ep)
+		undo.add(func() {
+			if err := deleteDummyLink(link); err != nil {
+				slog.Info("Rollback: unable to delete dummy link", "endpoint", req.EndpointID, "link", link, "err", err)
+			}
+		})
+		err = addDummyLink(link, mtu, mac)
+	}
+	if err != nil {
+		resp.Err = "Error: " + hostError("HOST_LINK_FAILED", "setting up the endpoint link failed", err).Error()
+		undo.run()
+		sendResponse(resp, w)
+		return
+	}
+
+	ep.SecurityGroups = groups
+	if err := programEndpointNeighbor(req.EndpointID, nw, ep); err != nil {
+		resp.Err = "Error: " + err.Error()
+		undo.run()
+		sendResponse(resp, w)
+		return
+	}
+	config := endpointConfig(ep)
+	commitEndpoint(req.EndpointID, ep)
+	slog.Info("Created endpoint", "network", req.NetworkID, "endpoint", req.EndpointID, "ip", ep.IP, "port", ipdk_intf, "config", config)
+
+	sendResponse(resp, w)
+}
+
+func handlerDeleteEndpoint(w http.ResponseWriter, r *http.Request) {
+	resp := api.DeleteEndpointResponse{}
+
+	body, err := getBody(r)
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+
+	req := api.DeleteEndpointRequest{}
+	if err = json.Unmarshal(body, &req); err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+
+	if err := requireNetAdmin(); err != nil {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+
+	defer lockNetwork(req.NetworkID)()
+
+	nwMap.Lock()
+	epMap.Lock()
+
+	//Docker retries driver calls, the endpoint may be gone already
+	m := epMap.m[req.EndpointID]
+	if m == nil {
+		epMap.Unlock()
+		nwMap.Unlock()
+		slog.Info("Endpoint already deleted", "endpoint", req.EndpointID)
+		sendResponse(resp, w)
+		return
+	}
+
+	//The endpoint is removed from the dataplane with a copy of its network,
+	//without holding the map locks. What can't be removed is left to the
+	//garbage collector.
+	var nw *nwVal
+	if v := nwMap.m[m.NetworkID]; v != nil {
+		c := *v
+		nw = &c
+	}
+	var sgRules []aclRule
+	if m.PortType != portTypeVeth {
+		//Next-hop groups are shared with the network
+		leaveNextHopGroups(m.NetworkID, nwMap.m[m.NetworkID], req.EndpointID)
+		sgMap.Lock()
+		sgRules = securityGroupRules(m.SecurityGroups)
+		sgMap.Unlock()
+	}
+
+	delete(epMap.m, req.EndpointID)
+	ops := append(stopMirrorsTo(req.EndpointID), delEndpoint(req.EndpointID), putIntent(req.EndpointID, intentDelete, m))
+	if err := dbUpdate(ops...); err != nil {
+		slog.Error("Unable to update db", "endpoint", req.EndpointID, "err", err)
+	}
+	removeEndpointMetadata(req.EndpointID)
+	epMap.Unlock()
+	nwMap.Unlock()
+
+	vhostPort := m.VhostuserPort
+	//Nothing is programmed for the endpoints of veth mode networks
+	if m.PortType != portTypeVeth && nw != nil {
+		unprogramEndpointServices(nw, vhostPort, m.Services)
+		unprogramPublishedPorts(nw, vhostPort, m.Published)
+		unprogramEndpointARP(nw, vhostPort)
+		unprogramEndpointNeighbor(nw, m)
+		unprogramEndpointIPv6(nw, m.IPv6)
+		unprogramSNAT(nw, m)
+		leaveFloodGroup(m.NetworkID, nw, m.IpdkInterface)
+		stopMirror(nw, m)
+		unprogramACL(nw.Bridge, m.IpdkInterface, m.ACL, aclTopPriority)
+		unprogramACL(nw.Bridge, m.IpdkInterface, sgRules, sgTopPriority)
+
+		nwMap.Lock()
+		if v := nwMap.m[m.NetworkID]; v != nil {
+			v.FloodPorts = nw.FloodPorts
+			if err := dbUpdate(putNetwork(m.NetworkID, v)); err != nil {
+				slog.Error("Unable to update db", "network", m.NetworkID, "err", err)
+			}
+		}
+		nwMap.Unlock()
 	}
-
-	if err := dbAdd("epMap", req.EndpointID, epMap.m[req.EndpointID]); err != nil {
-		glog.Errorf("Unable to update db %v %v", err, ip)
+	//The forwarding, VLAN, L2, segment and DSCP entries of the endpoint
+	//have no unprogram call of their own, they are removed through the
+	//ownership registry
+	removeOwnedEntries(endpointOwner(req.EndpointID))
+	if m.PortType != portTypeVeth {
+		stopCapture(req.EndpointID, m.Mirror)
 	}
 
-	sendResponse(resp, w)
-}
-
-func handlerDeleteEndpoint(w http.ResponseWriter, r *http.Request) {
-	resp := api.DeleteEndpointResponse{}
-
-	body, err := getBody(r)
-	if err != nil {
-		resp.Err = "Error: " + err.Error()
+	//The VF is back in the host namespace once docker is done with it,
+	//it is free again as soon as the endpoint is gone
+	if m.PortType == portTypeVF {
+		finishIntent(req.EndpointID)
 		sendResponse(resp, w)
 		return
 	}
 
-	req := api.DeleteEndpointRequest{}
-	if err = json.Unmarshal(body, &req); err != nil {
-		resp.Err = "Error: " + err.Error()
+	//Like the TAP port, the veth pair usually went away with the
+	//namespace of the container
+	if m.PortType == portTypeVeth {
+		if err := deleteFallbackEndpoint(m); err != nil {
+			slog.Info("Couldn't delete veth pair", "endpoint", req.EndpointID, "err", err)
+		}
+		finishIntent(req.EndpointID)
 		sendResponse(resp, w)
 		return
 	}
 
-	epMap.Lock()
-	nwMap.Lock()
-
-	m := epMap.m[req.EndpointID]
-	vhostPort := m.vhostuserPort
-
-	delete(epMap.m, req.EndpointID)
-	if err := dbDelete("epMap", req.EndpointID); err != nil {
-		glog.Errorf("Unable to update db %v %v", err, m)
+	//The TAP port went away with the namespace of the container, unless
+	//it was never moved there
+	if m.PortType == portTypeTAP {
+		if err := deleteTapPort(m.IpdkInterface); err != nil {
+			slog.Info("Couldn't delete TAP port", "endpoint", req.EndpointID, "port", tapName(m.IpdkInterface), "err", err)
+		}
+		finishIntent(req.EndpointID)
+		sendResponse(resp, w)
+		return
 	}
-	nwMap.Unlock()
-	epMap.Unlock()
 
-	// Need to delete port using openconfig when we can
+	//delete vhost port, the intent is kept if it fails so the port is
+	//removed at the next start
+	slog.Info("Deleting vhost port", "endpoint", req.EndpointID, "port", m.IpdkInterface)
+	if err := deleteVhostPort(m.IpdkInterface); err != nil && !isNotFound(err) {
+		resp.Err = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
 
 	//delete dummy port
-	cmd := "ip"
-	args := []string{"link", "del", vhostPort}
-	glog.Infof("INFO: Deleting dummy port [%v]", vhostPort)
-	if err := exec.Command(cmd, args...).Run(); err != nil {
-		resp.Err = fmt.Sprintf("Error EndPointCreate: [%v] [%v] [%v]",
-			cmd, args, err)
+	slog.Info("Deleting dummy port", "endpoint", req.EndpointID, "link", dummyLink(m))
+	if err := deleteDummyLink(dummyLink(m)); err != nil && !isNotFound(err) {
+		resp.Err = "Error: " + hostError("HOST_LINK_FAILED", "deleting the endpoint link failed", err).Error()
 		sendResponse(resp, w)
 		return
 	}
 
-	glog.Infof("Deleted dummy port %v %v ", cmd, args)
-
-	// vhostPort contains the IP address
-	glog.Infof("INFO: Removing directory and files at [/tmp/vhostuser_%v]", vhostPort)
-	os.RemoveAll(fmt.Sprintf("/tmp/vhostuser_%s", vhostPort))
-	if err != nil {
-		glog.Infof("Couldn't remove /tmp/vhostuser_%s", vhostPort)
-		resp.Err = fmt.Sprintf("Couldn't delete /tmp/vhostuser_%s: %v", vhostPort, err)
+	socketpath := endpointSocketDir(m)
+	if err := removeSocketDir(socketpath); err != nil {
+		slog.Info("Couldn't remove socket directory", "endpoint", req.EndpointID, "path", socketpath)
+		resp.Err = "Error: " + hostError("HOST_SOCKET_DIR_FAILED", "removing the socket directory failed", err).Error()
 		sendResponse(resp, w)
 		return
 	}
 
+	finishIntent(req.EndpointID)
 	sendResponse(resp, w)
 }
 
@@ -448,15 +1637,25 @@ func handlerJoin(w http.ResponseWriter, r *http.Request) {
 	epMap.Lock()
 	nm := nwMap.m[req.NetworkID]
 	em := epMap.m[req.EndpointID]
+	if nm != nil && em != nil {
+		linkSandboxMetadata(req.EndpointID, em, req.SandboxKey)
+		resp.StaticRoutes = joinRoutes(nm, em)
+	}
 	nwMap.Unlock()
 	epMap.Unlock()
 
+	if nm == nil || em == nil {
+		resp.Err = fmt.Sprintf("Error: unknown endpoint %s of network %s", req.EndpointID, req.NetworkID)
+		sendResponse(resp, w)
+		return
+	}
+
 	resp.Gateway = nm.Gateway.IP.String()
 	resp.InterfaceName = &api.InterfaceName{
-		SrcName:   em.vhostuserPort,
+		SrcName:   endpointLink(em),
 		DstPrefix: "eth",
 	}
-	glog.Infof("Join Response %v %v", resp, em.vhostuserPort)
+	slog.Info("Join", "network", req.NetworkID, "endpoint", req.EndpointID, "link", endpointLink(em), "routes", len(resp.StaticRoutes))
 	sendResponse(resp, w)
 }
 
@@ -477,11 +1676,25 @@ func handlerLeave(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	epMap.Lock()
+	if ep, ok := epMap.m[req.EndpointID]; ok {
+		unlinkSandboxMetadata(req.EndpointID, ep)
+	}
+	epMap.Unlock()
+
 	sendResponse(resp, w)
 }
 
 func handlerDiscoverNew(w http.ResponseWriter, r *http.Request) {
-	resp := api.DiscoveryResponse{}
+	handleNodeDiscovery(w, r, true)
+}
+
+func handlerDiscoverDelete(w http.ResponseWriter, r *http.Request) {
+	handleNodeDiscovery(w, r, false)
+}
+
+func handlerExternalConnectivity(w http.ResponseWriter, r *http.Request) {
+	resp := api.ProgramExternalConnectivityResponse{}
 
 	body, err := getBody(r)
 	if err != nil {
@@ -490,53 +1703,118 @@ func handlerDiscoverNew(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	req := api.DiscoveryNotification{}
+	req := api.ProgramExternalConnectivityRequest{}
 	if err := json.Unmarshal(body, &req); err != nil {
 		resp.Err = "Error: " + err.Error()
 		sendResponse(resp, w)
 		return
 	}
 
-	sendResponse(resp, w)
-}
-
-func handlerDiscoverDelete(w http.ResponseWriter, r *http.Request) {
-	resp := api.DiscoveryResponse{}
-
-	body, err := getBody(r)
+	uplink, err := externalUplink()
 	if err != nil {
 		resp.Err = "Error: " + err.Error()
 		sendResponse(resp, w)
 		return
 	}
-
-	req := api.DiscoveryNotification{}
-	if err := json.Unmarshal(body, &req); err != nil {
+	ports, err := parsePortMap(req.Options, uplink)
+	if err != nil {
 		resp.Err = "Error: " + err.Error()
 		sendResponse(resp, w)
 		return
 	}
+	if uplink == "" {
+		if len(ports) != 0 {
+			resp.Err = "Error: publishing ports needs an uplink, set -uplink-port"
+		}
+		sendResponse(resp, w)
+		return
+	}
 
-	sendResponse(resp, w)
-}
-
-func handlerExternalConnectivity(w http.ResponseWriter, r *http.Request) {
-	resp := api.ProgramExternalConnectivityResponse{}
+	//The endpoint is not deleted while its network is locked
+	defer lockNetwork(req.NetworkID)()
 
-	body, err := getBody(r)
-	if err != nil {
-		resp.Err = "Error: " + err.Error()
+	//The entries are programmed with copies of the network and endpoint,
+	//without holding the map locks. The SNAT block and the published
+	//ports are reserved on the endpoint meanwhile, so that no other
+	//endpoint takes them.
+	nwMap.Lock()
+	epMap.Lock()
+	nw := nwMap.m[req.NetworkID]
+	ep := epMap.m[req.EndpointID]
+	if nw == nil || ep == nil {
+		epMap.Unlock()
+		nwMap.Unlock()
+		resp.Err = fmt.Sprintf("Error: unknown endpoint %s of network %s", req.EndpointID, req.NetworkID)
 		sendResponse(resp, w)
 		return
 	}
 
-	req := api.ProgramExternalConnectivityRequest{}
-	if err := json.Unmarshal(body, &req); err != nil {
+	//Docker programs the connectivity again when an endpoint is restored
+	var publish []publishedPort
+	if len(ep.Published) == 0 && len(ports) != 0 {
+		for _, p := range ports {
+			if id := publishedBy(p); id != "" {
+				err = fmt.Errorf("port %v is already published by endpoint %s", p, id)
+				break
+			}
+		}
+		publish = ports
+	}
+	block := 0
+	if err == nil && ep.SNATBlock == 0 {
+		block, err = allocSNATBlock()
+	}
+	if err != nil {
+		epMap.Unlock()
+		nwMap.Unlock()
 		resp.Err = "Error: " + err.Error()
 		sendResponse(resp, w)
 		return
 	}
+	if block != 0 {
+		ep.SNATBlock = block
+	}
+	if publish != nil {
+		ep.Published = publish
+	}
+	c := *nw
+	nw = &c
+	e := *ep
+	epMap.Unlock()
+	nwMap.Unlock()
+
+	var snatErr, publishErr error
+	if block != 0 {
+		snatErr = programSNAT(req.EndpointID, nw, &e, uplink, block)
+	}
+	if snatErr == nil && publish != nil {
+		publishErr = programPublishedPorts(req.EndpointID, nw, &e, publish)
+	}
+
+	//What failed is released, what was programmed is stored, unless a
+	//db restore replaced the endpoint meanwhile
+	epMap.Lock()
+	if epMap.m[req.EndpointID] == ep {
+		if snatErr != nil {
+			ep.SNATBlock = 0
+		}
+		if publish != nil && (snatErr != nil || publishErr != nil) {
+			ep.Published = nil
+		}
+		if (block != 0 && snatErr == nil) || (publish != nil && publishErr == nil) {
+			if err := dbUpdate(putEndpoint(req.EndpointID, ep)); err != nil {
+				slog.Error("Unable to update db", "err", err)
+			}
+		}
+	}
+	epMap.Unlock()
 
+	if err = snatErr; err == nil {
+		err = publishErr
+	}
+	if err != nil {
+		resp.Err = "Error: " + err.Error()
+	}
 	sendResponse(resp, w)
 }
 
@@ -550,19 +1828,54 @@ func handlerRevokeExternalConnectivity(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	req := api.RevokeExternalConnectivityResponse{}
+	req := api.RevokeExternalConnectivityRequest{}
 	if err := json.Unmarshal(body, &req); err != nil {
 		resp.Err = "Error: " + err.Error()
 		sendResponse(resp, w)
 		return
 	}
 
+	defer lockNetwork(req.NetworkID)()
+
+	//The entries are removed with copies of the network and endpoint, the
+	//SNAT block and published ports staying reserved until they are gone
+	nwMap.Lock()
+	epMap.Lock()
+	ep := epMap.m[req.EndpointID]
+	revoke := ep != nil && (ep.SNATBlock != 0 || len(ep.Published) != 0)
+	var nw *nwVal
+	var e epVal
+	if revoke {
+		if v := nwMap.m[req.NetworkID]; v != nil {
+			c := *v
+			nw = &c
+		}
+		e = *ep
+	}
+	epMap.Unlock()
+	nwMap.Unlock()
+
+	if revoke {
+		unprogramPublishedPorts(nw, e.VhostuserPort, e.Published)
+		unprogramSNAT(nw, &e)
+
+		epMap.Lock()
+		if epMap.m[req.EndpointID] == ep {
+			ep.SNATBlock = 0
+			ep.Published = nil
+			if err := dbUpdate(putEndpoint(req.EndpointID, ep)); err != nil {
+				slog.Error("Unable to update db", "err", err)
+			}
+		}
+		epMap.Unlock()
+	}
+
 	sendResponse(resp, w)
 }
 
 func ipamGetCapabilities(w http.ResponseWriter, r *http.Request) {
 	if _, err := getBody(r); err != nil {
-		glog.Infof("ipamGetCapabilities: unable to get request body [%v]", err)
+		slog.Info("ipamGetCapabilities: unable to get request body", "err", err)
 	}
 	resp := ipamapi.GetCapabilityResponse{RequiresMACAddress: true}
 	sendResponse(resp, w)
@@ -571,7 +1884,7 @@ func ipamGetCapabilities(w http.ResponseWriter, r *http.Request) {
 func ipamGetDefaultAddressSpaces(w http.ResponseWriter, r *http.Request) {
 	resp := ipamapi.GetAddressSpacesResponse{}
 	if _, err := getBody(r); err != nil {
-		glog.Infof("ipamGetDefaultAddressSpaces: unable to get request body [%v]", err)
+		slog.Info("ipamGetDefaultAddressSpaces: unable to get request body", "err", err)
 	}
 
 	resp.GlobalDefaultAddressSpace = ""
@@ -596,8 +1909,16 @@ func ipamRequestPool(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp.PoolID = uuid.Generate().String()
-	resp.Pool = req.Pool
+	if err := checkIPAMOptions(req.Options); err != nil {
+		resp.Error = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+
+	resp.PoolID, resp.Pool, err = requestPool(req.AddressSpace, req.Pool, req.SubPool, req.V6)
+	if err != nil {
+		resp.Error = "Error: " + err.Error()
+	}
 	sendResponse(resp, w)
 }
 
@@ -618,6 +1939,10 @@ func ipamReleasePool(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := releasePool(req.PoolID); err != nil {
+		resp.Error = "Error: " + err.Error()
+	}
+
 	sendResponse(resp, w)
 }
 
@@ -638,11 +1963,15 @@ func ipamRequestAddress(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//TODO: Should come from the subnet mask for the subnet
-	if req.Address != "" {
-		resp.Address = req.Address + "/24"
-	} else {
-		resp.Error = "Error: Request does not have IP address. Specify using --ip"
+	if err := checkIPAMOptions(req.Options); err != nil {
+		resp.Error = "Error: " + err.Error()
+		sendResponse(resp, w)
+		return
+	}
+
+	resp.Address, err = requestAddress(req.PoolID, req.Address)
+	if err != nil {
+		resp.Error = "Error: " + err.Error()
 	}
 	sendResponse(resp, w)
 }
@@ -664,271 +1993,359 @@ func ipamReleaseAddress(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := releaseAddress(req.PoolID, req.Address); err != nil {
+		resp.Error = "Error: " + err.Error()
+	}
+
 	sendResponse(resp, w)
 }
 
 func dbTableInit(tables []string) (err error) {
 
-	glog.Infof("dbInit Tables := %v", tables)
-	for i, v := range tables {
-		glog.Infof("table[%v] := %v, %v", i, v, []byte(v))
-	}
-
-	err = db.Update(func(tx *bolt.Tx) error {
-		for _, table := range tables {
-			_, err := tx.CreateBucketIfNotExists([]byte(table))
-			if err != nil {
-				return fmt.Errorf("Bucket creation error: %v %v", table, err)
-			}
-		}
-		return nil
-	})
+	slog.Debug("Initializing tables", "tables", tables)
 
+	err = store.Init(tables)
 	if err != nil {
-		glog.Errorf("Table creation error %v", err)
+		slog.Error("Table creation error", "err", err)
 	}
 
 	return err
 }
 
-func dbAdd(table string, key string, value interface{}) (err error) {
+//dbOp is a single write of a dbUpdate transaction, a nil value deletes
+//the key
+type dbOp struct {
+	table string
+	key   string
+	value []byte
+	err   error //Encoding error, reported by dbUpdate
+}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		var v bytes.Buffer
+//dbPut stores value under key in table
+func dbPut(table string, key string, value interface{}) dbOp {
+	v, err := json.Marshal(value)
+	if err != nil {
+		slog.Error("Encode Error", "err", err)
+	}
+	return dbOp{table: table, key: key, value: v, err: err}
+}
 
-		if err := gob.NewEncoder(&v).Encode(value); err != nil {
-			glog.Errorf("Encode Error: %v %v", err, value)
-			return err
-		}
+//dbDel deletes key from table
+func dbDel(table string, key string) dbOp {
+	return dbOp{table: table, key: key}
+}
 
-		bucket := tx.Bucket([]byte(table))
-		if bucket == nil {
-			return fmt.Errorf("Bucket %v not found", table)
+//dbUpdate applies all ops in a single transaction, either all of them
+//are persisted or none is
+func dbUpdate(ops ...dbOp) error {
+	for _, op := range ops {
+		if op.err != nil {
+			return fmt.Errorf("Key Store error: %v %v %v", op.table, op.key, op.err)
 		}
+	}
+	return store.Batch(ops)
+}
 
-		err = bucket.Put([]byte(key), v.Bytes())
-		if err != nil {
-			return fmt.Errorf("Key Store error: %v %v %v %v", table, key, value, err)
-		}
-		return nil
-	})
+func dbAdd(table string, key string, value interface{}) (err error) {
+	return dbUpdate(dbPut(table, key, value))
+}
 
-	return err
+//dbCreate stores value under key unless the key exists, and reports
+//whether it did
+func dbCreate(table string, key string, value interface{}) (bool, error) {
+	op := dbPut(table, key, value)
+	if op.err != nil {
+		return false, fmt.Errorf("Key Store error: %v %v %v", op.table, op.key, op.err)
+	}
+	return store.Create(op.table, op.key, op.value)
 }
 
 func dbDelete(table string, key string) (err error) {
-
-	err = db.Update(func(tx *bolt.Tx) error {
-
-		bucket := tx.Bucket([]byte(table))
-		if bucket == nil {
-			return fmt.Errorf("Bucket %v not found", table)
-		}
-
-		err = bucket.Delete([]byte(key))
-		if err != nil {
-			return fmt.Errorf("Key Delete error: %v %v ", key, err)
-		}
-		return nil
-	})
-
-	return err
+	return dbUpdate(dbDel(table, key))
 }
 
-func dbGet(table string, key string) (value interface{}, err error) {
-
-	err = db.View(func(tx *bolt.Tx) error {
-
-		bucket := tx.Bucket([]byte(table))
-		if bucket == nil {
-			return fmt.Errorf("Bucket %v not found", table)
-		}
-
-		val := bucket.Get([]byte(key))
-		if val == nil {
-			return nil
-		}
-
-		v := bytes.NewReader(val)
-		if err := gob.NewDecoder(v).Decode(value); err != nil {
-			glog.Errorf("Decode Error: %v %v %v", table, key, err)
-			return err
-		}
-
-		return nil
-	})
+//checkDbDir creates the directory holding the db, readable by root only,
+//and verifies that it is writable
+func checkDbDir(path string) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("unable to create db directory %v: %v", dir, err)
+	}
 
-	return value, err
+	probe, err := ioutil.TempFile(dir, ".probe")
+	if err != nil {
+		return fmt.Errorf("db directory %v is not writable: %v", dir, err)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
 }
 
 func initDb() error {
 
-	options := bolt.Options{
-		Timeout: 3 * time.Second,
-	}
-
 	var err error
-	db, err = bolt.Open(dbFile, 0644, &options)
+	if *driverScope == scopeGlobal {
+		store, err = openGlobalStore(*storeURL)
+	} else {
+		store, err = openStore(*storeURL)
+	}
 	if err != nil {
 		return fmt.Errorf("dbInit failed %v", err)
 	}
 
-	tables := []string{"global", "nwMap", "epMap", "brMap"}
+	tables := []string{"global", "nwMap", "epMap", "brMap", "snapshots", "entries", "poolMap", "sgMap", "segments", "nodes", "intents"}
 	if err := dbTableInit(tables); err != nil {
 		return fmt.Errorf("dbInit failed %v", err)
 	}
 
-	c, err := dbGet("global", "counter")
-	if err != nil {
-		glog.Errorf("dbGet failed %v", err)
-		intfCounter = 100
-	} else {
-		var ok bool
-		intfCounter, ok = c.(int)
-		if !ok {
-			intfCounter = 100
-		}
+	//Bring records written by older versions of the plugin up to date
+	//before decoding any of them
+	if err := dbMigrate(); err != nil {
+		return fmt.Errorf("dbInit failed %v", err)
 	}
 
-	err = db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("nwMap"))
+	//Restore the bridge and interface ID counters, and the free list, so
+	//that IDs in use before a restart are not handed out again
+	brMap.brCount, err = loadCounter("brCount", 1)
+	if err != nil {
+		return fmt.Errorf("dbInit failed %v", err)
+	}
+	brMap.intfCount, err = loadCounter("intfCount", 1)
+	if err != nil {
+		return fmt.Errorf("dbInit failed %v", err)
+	}
+	brMap.freeIntfs, err = loadFreeIntfs()
+	if err != nil {
+		return fmt.Errorf("dbInit failed %v", err)
+	}
+	slog.Info("Restored counters", "br_count", brMap.brCount, "intf_count", brMap.intfCount, "free_intfs", len(brMap.freeIntfs))
 
-		err := b.ForEach(func(k, v []byte) error {
-			vr := bytes.NewReader(v)
-			nVal := &nwVal{}
-			if err := gob.NewDecoder(vr).Decode(nVal); err != nil {
-				return fmt.Errorf("Decode Error: %v %v %v", string(k), string(v), err)
-			}
-			nwMap.m[string(k)] = nVal
-			glog.Infof("nwMap key=%v, value=%v\n", string(k), nVal)
-			return nil
-		})
+	nwMap.m, err = loadNetworks()
+	if err != nil {
 		return err
-	})
+	}
+	for k, v := range nwMap.m {
+		slog.Debug("Restored network", "network", k, "bridge", v.Bridge, "subnet", v.Subnet.String())
+		if v.P4Map != nil {
+			setPipelineMapping(v.Bridge, v.P4Map)
+		}
+	}
 
+	epMap.m, err = loadEndpoints()
 	if err != nil {
 		return err
 	}
+	for k, v := range epMap.m {
+		slog.Debug("Restored endpoint", "endpoint", k, "network", v.NetworkID, "ip", v.IP)
+	}
 
-	err = db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("epMap"))
-
-		err := b.ForEach(func(k, v []byte) error {
-			vr := bytes.NewReader(v)
-			eVal := &epVal{}
-			if err := gob.NewDecoder(vr).Decode(eVal); err != nil {
-				return fmt.Errorf("Decode Error: %v %v %v", string(k), string(v), err)
-			}
-			epMap.m[string(k)] = eVal
-			glog.Infof("epMap key=%v, value=%v\n", string(k), eVal)
-			return nil
-		})
+	brMap.m, err = loadBridges()
+	if err != nil {
 		return err
-	})
+	}
+	for k, v := range brMap.m {
+		slog.Debug("Restored bridge ID", "network", k, "segment", v)
+	}
 
+	sgMap.m, err = loadSecurityGroups()
 	if err != nil {
 		return err
 	}
 
-	err = db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("brMap"))
-
-		err := b.ForEach(func(k, v []byte) error {
-			vr := bytes.NewReader(v)
-			brVal := 0
-			if err := gob.NewDecoder(vr).Decode(&brVal); err != nil {
-				return fmt.Errorf("Decode Error: %v %v %v", string(k), string(v), err)
-			}
-			brMap.m[string(k)] = brVal
-			glog.Infof("brMap key=%v, value=%v\n", string(k), brVal)
-			return nil
-		})
+	if err := loadNodes(); err != nil {
 		return err
-	})
+	}
 
-	return err
+	return loadPools()
 }
 
-func programP4() error {
-	cmd := "docker"
-	args := []string{"exec", "ipdk", "p4c", "--arch", "psa", "--target", "dpdk", "--output", "/root/examples/simple_l3/pipe", "--p4runtime-files", "/root/examples/simple_l3/p4Info.txt", "--bf-rt-schema", "/root/examples/simple_l3/bf-rt.json", "--context", "/root/examples/simple_l3/pipe/context.json", "/root/examples/simple_l3/simple_l3.p4"}
-	glog.Infof("INFO: Running command [%v] with args [%v]", cmd, args)
-	output, err := exec.Command(cmd, args...).Output()
-	if err != nil {
-		return fmt.Errorf("p4c building error [%v]", err)
-	}
-
-	ifcb, _, err := bufio.NewReader(bytes.NewReader(output)).ReadLine()
-	ifc := string(ifcb)
+//vhostConfig returns the configuration of the vhost-user port of an
+//endpoint
+func (ep *epVal) vhostConfig() vhostPortConfig {
+	return vhostPortConfig{MTU: ep.MTU, Queues: ep.Queues, RSS: ep.RSS, MAC: ep.MAC}
+}
 
-	glog.Infof("INFO: Result of building p4c program [%v]", ifc)
+//networkOption returns the value of a driver option passed with
+//docker network create -o key=value, or "" if it was not set
+func networkOption(options map[string]interface{}, key string) string {
+	generic, ok := options["com.docker.network.generic"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	v, ok := generic[key].(string)
+	if !ok {
+		return ""
+	}
+	return v
+}
 
-	cmd = "docker"
-	args = []string{"exec", "ipdk", "bash", "-c", "cd /root/examples/simple_l3 && ovs_pipeline_builder --p4c_conf_file=/root/examples/simple_l3/simple_l3.conf --bf_pipeline_config_binary_file=simple_l3.pb.bin"}
-	glog.Infof("INFO: Running command [%v] with args [%v]", cmd, args)
-	output, err = exec.Command(cmd, args...).Output()
-	if err != nil {
-		return fmt.Errorf("P4 programming error [%v]", err)
+//endpointOption returns the value of a driver option passed for an
+//endpoint, e.g. with docker network connect --driver-opt key=value
+func endpointOption(options map[string]interface{}, key string) string {
+	if v, ok := options[key].(string); ok {
+		return v
 	}
+	return networkOption(options, key)
+}
 
-	ifcb, _, err = bufio.NewReader(bytes.NewReader(output)).ReadLine()
-	ifc = string(ifcb)
+//splitOption splits a comma separated option value, dropping empty items
+func splitOption(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
 
-	glog.Infof("INFO: Result of P4 pipeline programming [%v]", ifc)
+func main() {
+	reconcileOnStart := flag.Bool("reconcile", true, "repair drift between the db and the dataplane at startup")
+	dbPath := flag.String("db-path", "", "path of the state db (default "+defaultDbFile+", or $IPDK_DB_PATH)")
+	flag.Parse()
 
-	cmd = "docker"
-	args = []string{"exec", "ipdk", "bash", "-c", "cd /root/examples/simple_l3 && ovs-p4ctl set-pipe br0 /root/examples/simple_l3/simple_l3.pb.bin /root/examples/simple_l3/p4Info.txt"}
-	glog.Infof("INFO: Running command [%v] with args [%v]", cmd, args)
-	output, err = exec.Command(cmd, args...).Output()
-	if err != nil {
-		return fmt.Errorf("ovs-p4ctl error [%v]", err)
+	//The configuration file may set the log level, its errors are logged
+	//with the defaults
+	configErr := applyConfig()
+	if err := initLogging(); err != nil {
+		fatal("invalid logging configuration", "err", err)
+	}
+	if configErr != nil {
+		fatal("invalid configuration, quitting", "err", configErr)
 	}
+	logConfig()
+	go reloadOnSignal()
 
-	ifcb, _, err = bufio.NewReader(bytes.NewReader(output)).ReadLine()
-	ifc = string(ifcb)
+	switch *role {
+	case "all":
+	case "frontend":
+		//A dry run has nothing to delegate
+		if !*dryRun {
+			host = helperHostOps{path: *helperSocket}
+		}
+	case "helper":
+		if err := serveHelper(*helperSocket, *helperGroup); err != nil {
+			fatal("privileged helper failed, quitting", "err", err)
+		}
+		return
+	default:
+		fatal("unknown role", "role", *role)
+	}
 
-	glog.Infof("INFO: Result of ovs-p4ctl [%v]", ifc)
+	if *driverScope != scopeLocal && *driverScope != scopeGlobal {
+		fatal("unknown scope", "scope", *driverScope)
+	}
+	if err := checkP4Settings(); err != nil {
+		fatal("invalid P4 settings", "err", err)
+	}
+	if err := checkLinkName(*linkNameTemplate); err != nil {
+		fatal("invalid link names", "err", err)
+	}
+	if _, err := parseDefaultPools(*defaultPools); err != nil {
+		fatal("invalid default pools", "err", err)
+	}
+	if err := checkAdminAuth(); err != nil {
+		fatal("invalid admin API authentication", "err", err)
+	}
+	if err := checkPrivilegeSettings(); err != nil {
+		fatal("invalid privilege settings", "err", err)
+	}
+	if err := checkEndpointWorkers(); err != nil {
+		fatal("invalid endpoint workers", "err", err)
+	}
+	if err := checkGRPCTargets(); err != nil {
+		fatal("invalid infrap4d settings", "err", err)
+	}
 
-	return nil
-}
+	caps = detectCapabilities()
+	initTracing()
+	initDiagnostics()
 
-func main() {
-	flag.Parse()
+	if flag.Arg(0) == "bench" {
+		if err := runBenchmark(flag.Args()[1:]); err != nil {
+			fatal("benchmark failed", "err", err)
+		}
+		return
+	}
 
-	godotenv.Load("~/.ipdk/ipdk.env")
+	if *dbPath != "" {
+		dbFile = *dbPath
+	}
+	//The state of a dry run is kept apart, the real one must not record
+	//what was never programmed
+	if *dryRun {
+		dbFile += ".dry-run"
+		*storePrefix += "-dry-run"
+		slog.Warn("Dry run, the dataplane and the host are left alone", "db", dbFile)
+	}
 
 	if err := initDb(); err != nil {
-		glog.Fatalf("db init failed, quitting [%v]", err)
+		fatal("db init failed, quitting", "err", err)
 	}
 	defer func() {
-		err := db.Close()
-		glog.Errorf("unable to close database [%v]", err)
+		err := store.Close()
+		slog.Error("unable to close database", "err", err)
 	}()
 
+	startReadinessGate(*reconcileOnStart)
+
+	if *snapshotInterval > 0 {
+		go snapshotLoop(*snapshotInterval)
+	}
+
+	if *mtuProbeInterval > 0 {
+		go mtuProbeLoop(*mtuProbeInterval)
+	}
+
+	if *gcInterval > 0 {
+		go gcLoop(*gcInterval)
+	}
+
 	r := mux.NewRouter()
 	r.HandleFunc("/Plugin.Activate", handlerPluginActivate)
-	r.HandleFunc("/NetworkDriver.GetCapabilities", handlerGetCapabilities)
-	r.HandleFunc("/NetworkDriver.CreateNetwork", handlerCreateNetwork)
-	r.HandleFunc("/NetworkDriver.DeleteNetwork", handlerDeleteNetwork)
-	r.HandleFunc("/NetworkDriver.CreateEndpoint", handlerCreateEndpoint)
-	r.HandleFunc("/NetworkDriver.DeleteEndpoint", handlerDeleteEndpoint)
-	r.HandleFunc("/NetworkDriver.EndpointOperInfo", handlerEndpointOperInfof)
-	r.HandleFunc("/NetworkDriver.Join", handlerJoin)
-	r.HandleFunc("/NetworkDriver.Leave", handlerLeave)
-	r.HandleFunc("/NetworkDriver.DiscoverNew", handlerDiscoverNew)
-	r.HandleFunc("/NetworkDriver.DiscoverDelete", handlerDiscoverDelete)
-	r.HandleFunc("/NetworkDriver.ProgramExternalConnectivity", handlerExternalConnectivity)
-	r.HandleFunc("/NetworkDriver.RevokeExternalConnectivity", handlerRevokeExternalConnectivity)
-
-	r.HandleFunc("/IpamDriver.GetCapabilities", ipamGetCapabilities)
-	r.HandleFunc("/IpamDriver.GetDefaultAddressSpaces", ipamGetDefaultAddressSpaces)
-	r.HandleFunc("/IpamDriver.RequestPool", ipamRequestPool)
-	r.HandleFunc("/IpamDriver.ReleasePool", ipamReleasePool)
-	r.HandleFunc("/IpamDriver.RequestAddress", ipamRequestAddress)
+	r.HandleFunc("/NetworkDriver.GetCapabilities", traced("NetworkDriver.GetCapabilities", handlerGetCapabilities))
+	r.HandleFunc("/NetworkDriver.CreateNetwork", traced("NetworkDriver.CreateNetwork", gated(handlerCreateNetwork)))
+	r.HandleFunc("/NetworkDriver.DeleteNetwork", traced("NetworkDriver.DeleteNetwork", gated(handlerDeleteNetwork)))
+	r.HandleFunc("/NetworkDriver.CreateEndpoint", traced("NetworkDriver.CreateEndpoint", gated(serialized("NetworkDriver.CreateEndpoint", handlerCreateEndpoint))))
+	r.HandleFunc("/NetworkDriver.DeleteEndpoint", traced("NetworkDriver.DeleteEndpoint", gated(serialized("NetworkDriver.DeleteEndpoint", handlerDeleteEndpoint))))
+	r.HandleFunc("/NetworkDriver.EndpointOperInfo", traced("NetworkDriver.EndpointOperInfo", handlerEndpointOperInfof))
+	r.HandleFunc("/NetworkDriver.Join", traced("NetworkDriver.Join", serialized("NetworkDriver.Join", handlerJoin)))
+	r.HandleFunc("/NetworkDriver.Leave", traced("NetworkDriver.Leave", serialized("NetworkDriver.Leave", handlerLeave)))
+	r.HandleFunc("/NetworkDriver.DiscoverNew", traced("NetworkDriver.DiscoverNew", handlerDiscoverNew))
+	r.HandleFunc("/NetworkDriver.DiscoverDelete", traced("NetworkDriver.DiscoverDelete", handlerDiscoverDelete))
+	r.HandleFunc("/NetworkDriver.ProgramExternalConnectivity", traced("NetworkDriver.ProgramExternalConnectivity", serialized("NetworkDriver.ProgramExternalConnectivity", handlerExternalConnectivity)))
+	r.HandleFunc("/NetworkDriver.RevokeExternalConnectivity", traced("NetworkDriver.RevokeExternalConnectivity", serialized("NetworkDriver.RevokeExternalConnectivity", handlerRevokeExternalConnectivity)))
+
+	if *ipamDriver {
+		r.HandleFunc("/IpamDriver.GetCapabilities", traced("IpamDriver.GetCapabilities", ipamGetCapabilities))
+		r.HandleFunc("/IpamDriver.GetDefaultAddressSpaces", traced("IpamDriver.GetDefaultAddressSpaces", ipamGetDefaultAddressSpaces))
+		r.HandleFunc("/IpamDriver.RequestPool", traced("IpamDriver.RequestPool", ipamRequestPool))
+		r.HandleFunc("/IpamDriver.ReleasePool", traced("IpamDriver.ReleasePool", ipamReleasePool))
+		r.HandleFunc("/IpamDriver.RequestAddress", traced("IpamDriver.RequestAddress", ipamRequestAddress))
+		r.HandleFunc("/IpamDriver.ReleaseAddress", traced("IpamDriver.ReleaseAddress", ipamReleaseAddress))
+	}
+
+	registerAdminRoutes(r)
 
 	r.HandleFunc("/", handler)
-	err := http.ListenAndServe("127.0.0.1:9075", r)
+	l, err := listen(*listenAddr)
+	if err == nil {
+		l, err = serveTLS(l)
+	}
+	if err != nil {
+		fatal("unable to listen", "addr", *listenAddr, "err", err)
+	}
+	//Nothing is served before the privileges are dropped
+	if err := dropPrivileges(); err != nil {
+		fatal("unable to drop privileges", "err", err)
+	}
+	if *runAs != "" {
+		caps = detectCapabilities()
+	}
+	if !authRequired() && !strings.HasPrefix(*listenAddr, unixScheme) {
+		slog.Warn("The admin API is not authenticated, set -admin-tokens or -tls-client-ca", "addr", *listenAddr)
+	}
+	err = http.Serve(l, r)
 	if err != nil {
-		glog.Errorf("docker plugin http server failed, [%v]", err)
+		slog.Error("docker plugin http server failed", "err", err)
 	}
 }
@@ -0,0 +1,165 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+)
+
+//Ports published with docker run -p are delivered in the options of
+//ProgramExternalConnectivity. Traffic received on the uplink for a
+//published host address and port is translated to the endpoint by
+//ingress.dnat, and the source of the replies is translated back by
+//ingress.undnat. A host address of 0.0.0.0 stands for the uplink
+//address.
+const (
+	optPortMap = "com.docker.network.portmap"
+
+	dnatTable    = "ingress.dnat"
+	dnatAction   = "ingress.dnat_send"
+	undnatTable  = "ingress.undnat"
+	undnatAction = "ingress.undnat_send"
+)
+
+//publishedPort is a port binding as sent by docker, Proto being the IP
+//protocol number
+type publishedPort struct {
+	Proto       int
+	IP          string
+	Port        int
+	HostIP      string
+	HostPort    int
+	HostPortEnd int
+}
+
+func (p publishedPort) String() string {
+	return fmt.Sprintf("%s:%d/%d", p.HostIP, p.HostPort, p.Proto)
+}
+
+//parsePortMap parses the port bindings of an endpoint. Docker leaves the
+//choice of unset host ports to the driver, they are published on the
+//port of the container.
+func parsePortMap(options map[string]interface{}, uplink string) ([]publishedPort, error) {
+	v, ok := options[optPortMap]
+	if !ok || v == nil {
+		return nil, nil
+	}
+
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var ports []publishedPort
+	if err := json.Unmarshal(raw, &ports); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", optPortMap, err)
+	}
+
+	for i, p := range ports {
+		//tcp or udp
+		if p.Proto != 6 && p.Proto != 17 {
+			return nil, fmt.Errorf("unsupported protocol %d for published port %d", p.Proto, p.Port)
+		}
+		if p.Port < 1 || p.Port > 65535 || p.HostPort < 0 || p.HostPort > 65535 {
+			return nil, fmt.Errorf("invalid published port %d:%d", p.HostPort, p.Port)
+		}
+		if p.HostPort == 0 {
+			p.HostPort = p.Port
+		}
+		p.HostPortEnd = p.HostPort
+		if ip := net.ParseIP(p.HostIP); ip == nil || ip.IsUnspecified() {
+			p.HostIP = uplink
+		} else if ip.To4() == nil {
+			return nil, fmt.Errorf("unsupported host address %v for published port %d", p.HostIP, p.Port)
+		}
+		ports[i] = p
+	}
+	return ports, nil
+}
+
+//publishedBy returns the ID of the endpoint publishing a host port, or "".
+//epMap must be locked by the caller.
+func publishedBy(p publishedPort) string {
+	for id, ep := range epMap.m {
+		for _, v := range ep.Published {
+			if v.HostIP == p.HostIP && v.HostPort == p.HostPort && v.Proto == p.Proto {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+func dnatMatch(p publishedPort) string {
+	return fmt.Sprintf("hdr.ipv4.dst_addr=%s,hdr.ipv4.protocol=%d,meta.l4_dst_port=%d", p.HostIP, p.Proto, p.HostPort)
+}
+
+func undnatMatch(ip string, p publishedPort) string {
+	return fmt.Sprintf("hdr.ipv4.src_addr=%s,hdr.ipv4.protocol=%d,meta.l4_src_port=%d", ip, p.Proto, p.Port)
+}
+
+//programPublishedPorts installs the translation entries of the ports
+//published by an endpoint
+func programPublishedPorts(endpointID string, nw *nwVal, ep *epVal, ports []publishedPort) error {
+	owner := endpointOwner(endpointID)
+	for i, p := range ports {
+		if err := addEntry(owner, nw.Bridge, dnatTable, dnatMatch(p),
+			fmt.Sprintf("%s(%s,%d,%d)", dnatAction, ep.VhostuserPort, p.Port, ep.IpdkInterface)); err != nil {
+			unprogramPublishedPorts(nw, ep.VhostuserPort, ports[:i])
+			return err
+		}
+		if err := addEntry(owner, nw.Bridge, undnatTable, undnatMatch(ep.VhostuserPort, p),
+			fmt.Sprintf("%s(%s,%d,%d)", undnatAction, p.HostIP, p.HostPort, *uplinkPort)); err != nil {
+			if err := deleteEntry(nw.Bridge, dnatTable, dnatMatch(p)); err != nil {
+				slog.Error("Unable to remove DNAT entry", "port", p, "err", err)
+			}
+			unprogramPublishedPorts(nw, ep.VhostuserPort, ports[:i])
+			return err
+		}
+		if err := allowPublishedPort(owner, nw, ep.VhostuserPort, p); err != nil {
+			if err := deleteEntry(nw.Bridge, undnatTable, undnatMatch(ep.VhostuserPort, p)); err != nil {
+				slog.Error("Unable to remove DNAT entry", "port", p, "err", err)
+			}
+			if err := deleteEntry(nw.Bridge, dnatTable, dnatMatch(p)); err != nil {
+				slog.Error("Unable to remove DNAT entry", "port", p, "err", err)
+			}
+			unprogramPublishedPorts(nw, ep.VhostuserPort, ports[:i])
+			return err
+		}
+	}
+	return nil
+}
+
+//unprogramPublishedPorts removes the entries installed by
+//programPublishedPorts
+func unprogramPublishedPorts(nw *nwVal, ip string, ports []publishedPort) {
+	if nw == nil {
+		return
+	}
+
+	for _, p := range ports {
+		revokePublishedPort(nw, ip, p)
+		if err := deleteEntry(nw.Bridge, undnatTable, undnatMatch(ip, p)); err != nil {
+			slog.Error("Unable to remove DNAT entry", "port", p, "err", err)
+		}
+		if err := deleteEntry(nw.Bridge, dnatTable, dnatMatch(p)); err != nil {
+			slog.Error("Unable to remove DNAT entry", "port", p, "err", err)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+//Started as root, the plugin binds its socket, opens the db and then,
+//with -run-as, switches to a dedicated user before serving any request,
+//keeping only the capabilities of -keep-caps: CAP_NET_ADMIN for the
+//links and CAP_DAC_OVERRIDE for the socket directories and virtual
+//functions, or none in the frontend role, whose links are managed by the
+//privileged helper. The capabilities are made ambient, so that the
+//commands run by the plugin get them too, and every other one is dropped
+//from the bounding set. The user keeps its groups, e.g. docker for the
+//docker socket.
+//
+//-seccomp then forbids the system calls the plugin and its commands never
+//make, such as mount, ptrace, module loading or reboot, which fail with
+//EPERM. Both act on every thread of the plugin, which the Go runtime only
+//supports in builds without cgo (CGO_ENABLED=0).
+var (
+	runAs      = flag.String("run-as", "", "user, name or ID, the plugin switches to once its socket and db are open, empty to keep running as is. The bolt db is handed over to the user, and its directory too if it is a 0700 directory of its own; otherwise db compaction and restores fail unless CAP_DAC_OVERRIDE is kept")
+	keepCaps   = flag.String("keep-caps", "", "comma separated capabilities kept by -run-as, e.g. net_admin,dac_override (default those of the role)")
+	useSeccomp = flag.Bool("seccomp", false, "forbid the system calls the plugin never makes once it serves requests")
+)
+
+//capabilityNumbers are the capabilities -keep-caps knows about
+var capabilityNumbers = map[string]uint{
+	"chown":            0,
+	"dac_override":     1,
+	"fowner":           3,
+	"net_bind_service": 10,
+	"net_admin":        capNetAdmin,
+	"net_raw":          13,
+}
+
+const (
+	prSetKeepCaps     = 8
+	prSetSeccomp      = 22
+	prCapBSetDrop     = 24
+	prSetNoNewPrivs   = 38
+	prCapAmbient      = 47
+	prCapAmbientRaise = 2
+
+	linuxCapabilityVersion3 = 0x20080522
+	maxCapability           = 63
+)
+
+//roleCapabilities returns the capabilities needed by the role of the
+//plugin
+func roleCapabilities() string {
+	if *role == "frontend" {
+		return ""
+	}
+	return "net_admin,dac_override"
+}
+
+//parseCapabilities parses a comma separated list of capabilities
+func parseCapabilities(v string) ([]uint, error) {
+	var caps []uint
+	for _, name := range splitOption(v) {
+		c, ok := capabilityNumbers[strings.TrimPrefix(strings.ToLower(name), "cap_")]
+		if !ok {
+			return nil, fmt.Errorf("unknown capability %q", name)
+		}
+		caps = append(caps, c)
+	}
+	return caps, nil
+}
+
+//checkPrivilegeSettings checks -run-as and -keep-caps
+func checkPrivilegeSettings() error {
+	if *runAs == "" {
+		if *keepCaps != "" {
+			return fmt.Errorf("-keep-caps needs -run-as")
+		}
+		return nil
+	}
+	if _, err := user.Lookup(*runAs); err != nil {
+		if _, err := user.LookupId(*runAs); err != nil {
+			return fmt.Errorf("unknown user %q", *runAs)
+		}
+	}
+	_, err := parseCapabilities(*keepCaps)
+	return err
+}
+
+//allThreadsPrctl runs prctl on every thread of the plugin
+func allThreadsPrctl(option uintptr, arg2 uintptr, arg3 uintptr) error {
+	_, _, errno := syscall.AllThreadsSyscall6(syscall.SYS_PRCTL, option, arg2, arg3, 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+//dropPrivileges switches to the user of -run-as with the capabilities of
+//-keep-caps, then applies the seccomp filter of -seccomp
+func dropPrivileges() error {
+	if *runAs != "" {
+		if err := switchUser(); err != nil {
+			return err
+		}
+	}
+	if *useSeccomp {
+		if err := applySeccomp(); err != nil {
+			return fmt.Errorf("unable to apply the seccomp filter: %v", err)
+		}
+		slog.Info("Seccomp filter applied", "denied", len(deniedSyscalls))
+	}
+	return nil
+}
+
+func switchUser() error {
+	u, err := user.Lookup(*runAs)
+	if err != nil {
+		if u, err = user.LookupId(*runAs); err != nil {
+			return fmt.Errorf("unknown user %q", *runAs)
+		}
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	var groups []int
+	gids, err := u.GroupIds()
+	if err != nil {
+		return err
+	}
+	for _, g := range gids {
+		if id, err := strconv.Atoi(g); err == nil {
+			groups = append(groups, id)
+		}
+	}
+
+	names := *keepCaps
+	if names == "" {
+		names = roleCapabilities()
+	}
+	kept, err := parseCapabilities(names)
+	if err != nil {
+		return err
+	}
+	var mask uint64
+	for _, c := range kept {
+		mask |= 1 << c
+	}
+
+	if err := allThreadsPrctl(prSetKeepCaps, 1, 0); err != nil {
+		if err == syscall.ENOTSUP {
+			return fmt.Errorf("-run-as needs a build without cgo")
+		}
+		return fmt.Errorf("unable to keep the capabilities: %v", err)
+	}
+	for c := uintptr(0); c <= maxCapability; c++ {
+		if mask&(1<<c) != 0 {
+			continue
+		}
+		//Capabilities past the last one of the kernel are invalid
+		if err := allThreadsPrctl(prCapBSetDrop, c, 0); err != nil && err != syscall.EINVAL {
+			return fmt.Errorf("unable to drop capability %d: %v", c, err)
+		}
+	}
+
+	handOverDb(uid, gid)
+
+	if err := syscall.Setgroups(groups); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return err
+	}
+
+	hdr := capHeader{version: linuxCapabilityVersion3}
+	data := [2]capData{
+		{effective: uint32(mask), permitted: uint32(mask), inheritable: uint32(mask)},
+		{effective: uint32(mask >> 32), permitted: uint32(mask >> 32), inheritable: uint32(mask >> 32)},
+	}
+	_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0)
+	runtime.KeepAlive(&hdr)
+	runtime.KeepAlive(&data)
+	if errno != 0 {
+		return fmt.Errorf("unable to set the capabilities: %v", errno)
+	}
+	for _, c := range kept {
+		if err := allThreadsPrctl(prCapAmbient, prCapAmbientRaise, uintptr(c)); err != nil {
+			return fmt.Errorf("unable to pass capability %d to the commands: %v", c, err)
+		}
+	}
+
+	slog.Info("Switched user", "user", u.Username, "uid", uid, "gid", gid, "groups", groups, "capabilities", names)
+	return nil
+}
+
+//handOverDb gives the bolt db to the user of -run-as, along with its
+//directory, where compaction and restores stage their files and rename
+//them into place. The directory is only handed over if it is the
+//plugin's own, private like checkDbDir creates it.
+func handOverDb(uid int, gid int) {
+	if db == nil {
+		return
+	}
+
+	for _, path := range []string{dbFile, dbFile + ".pre-restore"} {
+		if err := os.Chown(path, uid, gid); err != nil && !os.IsNotExist(err) {
+			slog.Warn("Unable to hand the db over to the plugin user", "path", path, "err", err)
+		}
+	}
+
+	dir := filepath.Dir(dbFile)
+	st, err := os.Stat(dir)
+	if err == nil && st.Mode().Perm() != 0700 {
+		err = fmt.Errorf("mode %v, not a private directory of the plugin", st.Mode().Perm())
+	}
+	if err == nil {
+		err = os.Chown(dir, uid, gid)
+	}
+	if err != nil {
+		slog.Warn("The db directory stays read-only to the plugin user, db compaction and restores will fail", "dir", dir, "err", err)
+	}
+}
+
+//deniedSyscalls are the system calls forbidden by -seccomp
+var deniedSyscalls = []uintptr{
+	syscall.SYS_ACCT,
+	syscall.SYS_ADD_KEY,
+	syscall.SYS_CHROOT,
+	syscall.SYS_CLOCK_SETTIME,
+	syscall.SYS_DELETE_MODULE,
+	syscall.SYS_INIT_MODULE,
+	syscall.SYS_KEXEC_LOAD,
+	syscall.SYS_KEYCTL,
+	syscall.SYS_MOUNT,
+	syscall.SYS_PERF_EVENT_OPEN,
+	syscall.SYS_PIVOT_ROOT,
+	syscall.SYS_PTRACE,
+	syscall.SYS_REBOOT,
+	syscall.SYS_REQUEST_KEY,
+	syscall.SYS_SETTIMEOFDAY,
+	syscall.SYS_SWAPOFF,
+	syscall.SYS_SWAPON,
+	syscall.SYS_UMOUNT2,
+}
+
+//auditArch is the architecture seccomp reports for the system calls of
+//the plugin, by GOARCH
+var auditArch = map[string]uint32{
+	"amd64": 0xc000003e,
+	"arm64": 0xc00000b7,
+}
+
+type sockFilter struct {
+	code uint16
+	jt   uint8
+	jf   uint8
+	k    uint32
+}
+
+type sockFprog struct {
+	len    uint16
+	filter *sockFilter
+}
+
+const (
+	bpfLdAbsW = 0x20 //BPF_LD | BPF_W | BPF_ABS
+	bpfJeqK   = 0x15 //BPF_JMP | BPF_JEQ | BPF_K
+	bpfJgeK   = 0x35 //BPF_JMP | BPF_JGE | BPF_K
+	bpfRetK   = 0x06 //BPF_RET | BPF_K
+
+	seccompModeFilter = 2
+	seccompRetAllow   = 0x7fff0000
+	seccompRetErrno   = 0x00050000
+
+	//Offsets of the number and architecture in struct seccomp_data
+	seccompDataNr   = 0
+	seccompDataArch = 4
+
+	//Bit of the x32 system calls on amd64
+	x32SyscallBit = 0x40000000
+)
+
+//seccompFilter returns the BPF program failing the denied system calls,
+//and every system call of another architecture, with EPERM
+func seccompFilter() ([]sockFilter, error) {
+	arch, ok := auditArch[runtime.GOARCH]
+	if !ok {
+		return nil, fmt.Errorf("unsupported architecture %v", runtime.GOARCH)
+	}
+
+	n := len(deniedSyscalls)
+	//The deny instruction follows the n checks and the allow
+	deny := func(pc int) uint8 { return uint8(4 + n + 1 - pc - 1) }
+	prog := []sockFilter{
+		{code: bpfLdAbsW, k: seccompDataArch},
+		{code: bpfJeqK, jt: 0, jf: deny(1), k: arch},
+		{code: bpfLdAbsW, k: seccompDataNr},
+		{code: bpfJgeK, jt: deny(3), jf: 0, k: x32SyscallBit},
+	}
+	for i, nr := range deniedSyscalls {
+		prog = append(prog, sockFilter{code: bpfJeqK, jt: deny(4 + i), jf: 0, k: uint32(nr)})
+	}
+	prog = append(prog,
+		sockFilter{code: bpfRetK, k: seccompRetAllow},
+		sockFilter{code: bpfRetK, k: seccompRetErrno | uint32(syscall.EPERM)})
+	return prog, nil
+}
+
+//applySeccomp installs the filter of seccompFilter on every thread
+func applySeccomp() error {
+	prog, err := seccompFilter()
+	if err != nil {
+		return err
+	}
+	if err := allThreadsPrctl(prSetNoNewPrivs, 1, 0); err != nil {
+		if err == syscall.ENOTSUP {
+			return fmt.Errorf("-seccomp needs a build without cgo")
+		}
+		return err
+	}
+	fprog := sockFprog{len: uint16(len(prog)), filter: &prog[0]}
+	err = allThreadsPrctl(prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(&fprog)))
+	runtime.KeepAlive(&fprog)
+	runtime.KeepAlive(prog)
+	return err
+}
@@ -0,0 +1,580 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/rpc"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//The host level operations (links, vhost-user socket directories and
+//virtual functions)
+//need root, the HTTP front end does not. With -role=helper the plugin
+//only serves these operations on a unix socket, and with -role=frontend
+//it serves docker and delegates them to the helper, so the network
+//facing process can run unprivileged. The default role, all, does
+//everything in a single process.
+var role = flag.String("role", "all", "process role: all, frontend or helper")
+var helperSocket = flag.String("helper-socket", "/run/ipdk-docker-plugin/helper.sock", "unix socket between the frontend and helper roles")
+var helperGroup = flag.String("helper-group", "", "group allowed to connect to the helper socket")
+var helperVhostDirs = flag.String("helper-vhost-dirs", "", "comma separated socket directory bases of the networks created with com.ipdk.vhost_dir, which the helper may use besides -vhost-dir")
+
+//hostOps are the privileged operations done on the host
+type hostOps interface {
+	AddDummyLink(name string) error
+	DeleteDummyLink(name string) error
+	DummyLinks() (map[string]bool, error)
+	SetLinkMTU(name string, mtu int) error
+	SetLinkMAC(name string, mac string) error
+	MakeSocketDir(path string) error
+	RemoveSocketDir(path string) error
+	BindVF(pci string) error
+	AddBridgeLink(name string, addr string) error
+	AddVethLink(v VethLink) error
+	AddLinkAddr(name string, addr string) error
+	DeleteLink(name string) error
+}
+
+var host hostOps = localHostOps{}
+
+//localHostOps runs host operations in the plugin process
+type localHostOps struct{}
+
+func (localHostOps) AddDummyLink(name string) error {
+	_, err := hostOutput("ip", "link", "add", name, "type", "dummy")
+	return err
+}
+
+func (localHostOps) DeleteDummyLink(name string) error {
+	_, err := hostOutput("ip", "link", "del", name)
+	return err
+}
+
+func (localHostOps) DummyLinks() (map[string]bool, error) {
+	output, err := hostOutput("ip", "-o", "link", "show", "type", "dummy")
+	if err != nil {
+		return nil, err
+	}
+	return parseDummyLinks(output), nil
+}
+
+func (localHostOps) SetLinkMTU(name string, mtu int) error {
+	_, err := hostOutput("ip", "link", "set", "dev", name, "mtu", strconv.Itoa(mtu))
+	return err
+}
+
+func (localHostOps) SetLinkMAC(name string, mac string) error {
+	_, err := hostOutput("ip", "link", "set", "dev", name, "address", mac)
+	return err
+}
+
+func (localHostOps) MakeSocketDir(path string) error {
+	if skipOperation("mkdir " + path) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.Mkdir(path, 0755)
+}
+
+func (localHostOps) RemoveSocketDir(path string) error {
+	if skipOperation("rm -r " + path) {
+		return nil
+	}
+	return os.RemoveAll(path)
+}
+
+//AddBridgeLink creates a Linux bridge, with an address if addr is not ""
+func (localHostOps) AddBridgeLink(name string, addr string) error {
+	if _, err := hostOutput("ip", "link", "add", name, "type", "bridge"); err != nil {
+		return err
+	}
+	if addr != "" {
+		if _, err := hostOutput("ip", "addr", "add", addr, "dev", name); err != nil {
+			return err
+		}
+	}
+	_, err := hostOutput("ip", "link", "set", "dev", name, "up")
+	return err
+}
+
+//AddVethLink creates a veth pair with one end on a bridge
+func (localHostOps) AddVethLink(v VethLink) error {
+	if _, err := hostOutput("ip", "link", "add", v.Name, "type", "veth", "peer", "name", v.Peer); err != nil {
+		return err
+	}
+	if v.MTU != 0 {
+		for _, name := range []string{v.Name, v.Peer} {
+			if _, err := hostOutput("ip", "link", "set", "dev", name, "mtu", strconv.Itoa(v.MTU)); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := hostOutput("ip", "link", "set", "dev", v.Name, "master", v.Master); err != nil {
+		return err
+	}
+	_, err := hostOutput("ip", "link", "set", "dev", v.Name, "up")
+	return err
+}
+
+//AddLinkAddr assigns an address to a link and brings it up
+func (localHostOps) AddLinkAddr(name string, addr string) error {
+	if _, err := hostOutput("ip", "addr", "add", addr, "dev", name); err != nil {
+		return err
+	}
+	_, err := hostOutput("ip", "link", "set", "dev", name, "up")
+	return err
+}
+
+func (localHostOps) DeleteLink(name string) error {
+	_, err := hostOutput("ip", "link", "del", name)
+	return err
+}
+
+//BindVF binds a virtual function to the -vf-driver kernel driver
+func (localHostOps) BindVF(pci string) error {
+	override := filepath.Join("/sys/bus/pci/devices", pci, "driver_override")
+	if skipOperation("bind " + pci + " to " + *vfDriver) {
+		return nil
+	}
+	if err := ioutil.WriteFile(override, []byte(*vfDriver), 0200); err != nil {
+		return err
+	}
+	return ioutil.WriteFile("/sys/bus/pci/drivers_probe", []byte(pci), 0200)
+}
+
+//helperHostOps delegates host operations to the helper process
+type helperHostOps struct {
+	path string
+}
+
+func (h helperHostOps) call(method string, arg interface{}, reply interface{}) (err error) {
+	s := startCommandSpan("helper "+method, map[string]string{"ipdk.helper.method": method})
+	defer func() { s.end(err) }()
+
+	c, err := rpc.Dial("unix", h.path)
+	if err != nil {
+		return fmt.Errorf("unable to reach privileged helper: %v", err)
+	}
+	defer c.Close()
+	return c.Call("HostHelper."+method, arg, reply)
+}
+
+//ping checks that the helper answers
+func (h helperHostOps) ping() error {
+	var links map[string]bool
+	return h.call("DummyLinks", false, &links)
+}
+
+func (h helperHostOps) AddDummyLink(name string) error {
+	var ok bool
+	return h.call("AddDummyLink", name, &ok)
+}
+
+func (h helperHostOps) DeleteDummyLink(name string) error {
+	var ok bool
+	return h.call("DeleteDummyLink", name, &ok)
+}
+
+func (h helperHostOps) DummyLinks() (map[string]bool, error) {
+	links := make(map[string]bool)
+	err := h.call("DummyLinks", true, &links)
+	return links, err
+}
+
+func (h helperHostOps) SetLinkMTU(name string, mtu int) error {
+	var ok bool
+	return h.call("SetLinkMTU", LinkMTU{Name: name, MTU: mtu}, &ok)
+}
+
+func (h helperHostOps) SetLinkMAC(name string, mac string) error {
+	var ok bool
+	return h.call("SetLinkMAC", LinkMAC{Name: name, MAC: mac}, &ok)
+}
+
+func (h helperHostOps) MakeSocketDir(path string) error {
+	var ok bool
+	err := h.call("MakeSocketDir", path, &ok)
+	if err != nil && strings.HasSuffix(err.Error(), "file exists") {
+		//Keep os.IsExist working across the RPC boundary
+		return &os.PathError{Op: "mkdir", Path: path, Err: os.ErrExist}
+	}
+	return err
+}
+
+func (h helperHostOps) RemoveSocketDir(path string) error {
+	var ok bool
+	return h.call("RemoveSocketDir", path, &ok)
+}
+
+func (h helperHostOps) AddBridgeLink(name string, addr string) error {
+	var ok bool
+	return h.call("AddBridgeLink", BridgeLink{Name: name, Addr: addr}, &ok)
+}
+
+func (h helperHostOps) AddVethLink(v VethLink) error {
+	var ok bool
+	return h.call("AddVethLink", v, &ok)
+}
+
+func (h helperHostOps) AddLinkAddr(name string, addr string) error {
+	var ok bool
+	return h.call("AddLinkAddr", LinkAddr{Name: name, Addr: addr}, &ok)
+}
+
+func (h helperHostOps) DeleteLink(name string) error {
+	var ok bool
+	return h.call("DeleteLink", name, &ok)
+}
+
+func (h helperHostOps) BindVF(pci string) error {
+	var ok bool
+	return h.call("BindVF", pci, &ok)
+}
+
+var linkNameRe = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,15}$`)
+
+func validLinkName(name string) error {
+	if !linkNameRe.MatchString(name) || name == "." || name == ".." {
+		return fmt.Errorf("invalid link name %q", name)
+	}
+	return nil
+}
+
+//validSocketDir only lets the helper touch vhost-user socket
+//directories: those named after the address of an endpoint, in the
+//legacy location, under -vhost-dir or under a base of
+//-helper-vhost-dirs, and the directories of the devices of the device
+//plugin
+func validSocketDir(path string) error {
+	invalid := fmt.Errorf("invalid socket directory %q", path)
+	if !filepath.IsAbs(path) || filepath.Clean(path) != path {
+		return invalid
+	}
+
+	isAddress := func(name string) bool {
+		return validLinkName(name) == nil && net.ParseIP(name) != nil
+	}
+	if strings.HasPrefix(path, legacySocketDirPrefix) {
+		if !isAddress(strings.TrimPrefix(path, legacySocketDirPrefix)) {
+			return invalid
+		}
+		return nil
+	}
+
+	dir, name := filepath.Dir(path), filepath.Base(path)
+	if dir == filepath.Join(*vhostDir, "devices") && vhostDeviceName.MatchString(name) {
+		return nil
+	}
+	if !isAddress(name) {
+		return invalid
+	}
+	if dir == filepath.Clean(*vhostDir) {
+		return nil
+	}
+	for _, base := range splitOption(*helperVhostDirs) {
+		if dir == filepath.Clean(base) {
+			return nil
+		}
+	}
+	return invalid
+}
+
+//LinkMTU is the argument of HostHelper.SetLinkMTU
+type LinkMTU struct {
+	Name string
+	MTU  int
+}
+
+//LinkMAC is the argument of HostHelper.SetLinkMAC
+type LinkMAC struct {
+	Name string
+	MAC  string
+}
+
+//BridgeLink is the argument of HostHelper.AddBridgeLink
+type BridgeLink struct {
+	Name string
+	Addr string
+}
+
+//LinkAddr is the argument of HostHelper.AddLinkAddr
+type LinkAddr struct {
+	Name string
+	Addr string
+}
+
+//VethLink is a veth pair, Name being the end attached to the Master
+//bridge, and the argument of HostHelper.AddVethLink
+type VethLink struct {
+	Name   string
+	Peer   string
+	Master string
+	MTU    int
+}
+
+//validEndpointLink only lets the helper touch the dummy links of the
+//endpoints, named after -link-name or their address
+func validEndpointLink(name string) error {
+	if err := validLinkName(name); err != nil {
+		return err
+	}
+	if !isEndpointLink(name) {
+		return fmt.Errorf("%q is not named like the link of an endpoint", name)
+	}
+	return nil
+}
+
+//validManagedLink only lets the helper configure the links the plugin
+//hands to docker: the dummy links of the endpoints, the TAP ports of the
+//pipeline and the virtual functions of -sriov-pf
+func validManagedLink(name string) error {
+	if err := validLinkName(name); err != nil {
+		return err
+	}
+	if isEndpointLink(name) || strings.HasPrefix(name, "ipdktap") {
+		return nil
+	}
+	if *sriovPF != "" {
+		vfs, _ := listVFs()
+		for _, vf := range vfs {
+			if vf.Netdev == name {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%q is not a link of the plugin", name)
+}
+
+//validFallbackLink only lets the helper create the links of veth mode
+//networks, named after prefix and a number by fallbackBridge and
+//vethNames
+func validFallbackLink(name string, prefix string) error {
+	if err := validLinkName(name); err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(name, prefix))
+	if !strings.HasPrefix(name, prefix) || err != nil || n < 0 {
+		return fmt.Errorf("%q is not a link of a veth mode network", name)
+	}
+	return nil
+}
+
+//HostHelper is the RPC service of the helper role. Every argument is
+//validated, the helper must not be usable to run arbitrary operations.
+type HostHelper struct{}
+
+func (HostHelper) AddDummyLink(name string, ok *bool) error {
+	if err := validEndpointLink(name); err != nil {
+		return err
+	}
+	*ok = true
+	return localHostOps{}.AddDummyLink(name)
+}
+
+func (HostHelper) DeleteDummyLink(name string, ok *bool) error {
+	if err := validEndpointLink(name); err != nil {
+		return err
+	}
+	//A link that doesn't exist is left to ip link del to report
+	if links, err := (localHostOps{}).DummyLinks(); err == nil && !links[name] {
+		if _, err := net.InterfaceByName(name); err == nil {
+			return fmt.Errorf("%q is not a dummy link", name)
+		}
+	}
+	*ok = true
+	return localHostOps{}.DeleteDummyLink(name)
+}
+
+func (HostHelper) DummyLinks(_ bool, links *map[string]bool) error {
+	l, err := localHostOps{}.DummyLinks()
+	*links = l
+	return err
+}
+
+func (HostHelper) SetLinkMTU(arg LinkMTU, ok *bool) error {
+	if err := validManagedLink(arg.Name); err != nil {
+		return err
+	}
+	if arg.MTU < minMTU || arg.MTU > maxMTU {
+		return fmt.Errorf("invalid MTU %d", arg.MTU)
+	}
+	*ok = true
+	return localHostOps{}.SetLinkMTU(arg.Name, arg.MTU)
+}
+
+func (HostHelper) SetLinkMAC(arg LinkMAC, ok *bool) error {
+	if err := validManagedLink(arg.Name); err != nil {
+		return err
+	}
+	mac, err := net.ParseMAC(arg.MAC)
+	if err != nil || len(mac) != 6 {
+		return fmt.Errorf("invalid MAC address %q", arg.MAC)
+	}
+	*ok = true
+	return localHostOps{}.SetLinkMAC(arg.Name, mac.String())
+}
+
+func (HostHelper) MakeSocketDir(path string, ok *bool) error {
+	if err := validSocketDir(path); err != nil {
+		return err
+	}
+	*ok = true
+	return localHostOps{}.MakeSocketDir(path)
+}
+
+func (HostHelper) RemoveSocketDir(path string, ok *bool) error {
+	if err := validSocketDir(path); err != nil {
+		return err
+	}
+	*ok = true
+	return localHostOps{}.RemoveSocketDir(path)
+}
+
+//AddBridgeLink only creates the bridges of veth mode networks
+func (HostHelper) AddBridgeLink(arg BridgeLink, ok *bool) error {
+	if err := validFallbackLink(arg.Name, "ipdkfb"); err != nil {
+		return err
+	}
+	if _, _, err := net.ParseCIDR(arg.Addr); arg.Addr != "" && err != nil {
+		return fmt.Errorf("invalid address %q", arg.Addr)
+	}
+	*ok = true
+	return localHostOps{}.AddBridgeLink(arg.Name, arg.Addr)
+}
+
+//AddVethLink only creates the veth pairs of veth mode networks, on their
+//bridge
+func (HostHelper) AddVethLink(arg VethLink, ok *bool) error {
+	links := [][2]string{{arg.Name, "ipdkv"}, {arg.Peer, "ipdkc"}, {arg.Master, "ipdkfb"}}
+	for _, l := range links {
+		if err := validFallbackLink(l[0], l[1]); err != nil {
+			return err
+		}
+	}
+	if arg.MTU != 0 && (arg.MTU < minMTU || arg.MTU > maxMTU) {
+		return fmt.Errorf("invalid MTU %d", arg.MTU)
+	}
+	*ok = true
+	return localHostOps{}.AddVethLink(arg)
+}
+
+//AddLinkAddr only assigns addresses to the TAP ports of the pipeline,
+//which hold the gateway of host mode networks
+func (HostHelper) AddLinkAddr(arg LinkAddr, ok *bool) error {
+	if err := validLinkName(arg.Name); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(arg.Name, "ipdktap") {
+		return fmt.Errorf("%q is not a TAP port of the pipeline", arg.Name)
+	}
+	if _, _, err := net.ParseCIDR(arg.Addr); err != nil {
+		return fmt.Errorf("invalid address %q", arg.Addr)
+	}
+	*ok = true
+	return localHostOps{}.AddLinkAddr(arg.Name, arg.Addr)
+}
+
+//DeleteLink only deletes the links created by AddBridgeLink and
+//AddVethLink for veth mode networks
+func (HostHelper) DeleteLink(name string, ok *bool) error {
+	if err := validLinkName(name); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(name, "ipdkfb") && !strings.HasPrefix(name, "ipdkv") {
+		return fmt.Errorf("%q is not a link of a veth mode network", name)
+	}
+	*ok = true
+	return localHostOps{}.DeleteLink(name)
+}
+
+func (HostHelper) BindVF(pci string, ok *bool) error {
+	if !pciAddressRe.MatchString(pci) {
+		return fmt.Errorf("invalid PCI address %q", pci)
+	}
+	//Only virtual functions of the physical function may be bound
+	vfs, err := listVFs()
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, vf := range vfs {
+		found = found || vf.PCI == pci
+	}
+	if !found {
+		return fmt.Errorf("%v is not a virtual function of %v", pci, *sriovPF)
+	}
+	*ok = true
+	return localHostOps{}.BindVF(pci)
+}
+
+//serveHelper serves the host operations on the helper socket
+func serveHelper(path string, group string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	os.Remove(path)
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	mode := os.FileMode(0600)
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return err
+		}
+		gid, err := strconv.Atoi(g.Gid)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(path, 0, gid); err != nil {
+			return err
+		}
+		mode = 0660
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+
+	if err := rpc.Register(HostHelper{}); err != nil {
+		return err
+	}
+
+	slog.Info("Privileged helper listening", "path", path)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go rpc.ServeConn(conn)
+	}
+}
@@ -0,0 +1,52 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"testing"
+)
+
+func TestHelperRejectsForeignLinks(t *testing.T) {
+	var h HostHelper
+
+	for _, name := range []string{"docker0", "eth0", "ipdkfb", "ipdkfbx", "ipdkv1", "../ipdkfb1"} {
+		ok := false
+		if err := h.AddBridgeLink(BridgeLink{Name: name, Addr: "10.1.0.1/24"}, &ok); err == nil || ok {
+			t.Errorf("AddBridgeLink accepted %q", name)
+		}
+	}
+
+	for _, v := range []VethLink{
+		{Name: "ipdkv1", Peer: "ipdkc1", Master: "docker0"},
+		{Name: "ipdkv1", Peer: "ipdkc1", Master: "br0"},
+		{Name: "eth0", Peer: "ipdkc1", Master: "ipdkfb1"},
+		{Name: "ipdkv1", Peer: "eth0", Master: "ipdkfb1"},
+		{Name: "ipdkfb1", Peer: "ipdkc1", Master: "ipdkfb1"},
+	} {
+		ok := false
+		if err := h.AddVethLink(v, &ok); err == nil || ok {
+			t.Errorf("AddVethLink accepted %+v", v)
+		}
+	}
+
+	for _, name := range []string{"docker0", "eth0", "ipdkc1"} {
+		ok := false
+		if err := h.DeleteLink(name, &ok); err == nil || ok {
+			t.Errorf("DeleteLink accepted %q", name)
+		}
+	}
+}
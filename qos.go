@@ -0,0 +1,146 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+//Traffic sent by the endpoints of a network, or by a single endpoint
+//with --driver-opt, can be marked with a DSCP value:
+//
+//  docker network create -d ipdk -o com.ipdk.dscp=46 \
+//      -o com.ipdk.traffic_classes=46:1,34:2 ...
+//
+//The ingress.dscp_mark table marks the IPv4 traffic received from the
+//port of the endpoint. The traffic classes of a network map DSCP values
+//to the queue of the output port their traffic is sent on, through the
+//egress.dscp_queue table; unmapped traffic uses queue 0.
+const (
+	optDSCP           = "com.ipdk.dscp"
+	optTrafficClasses = "com.ipdk.traffic_classes"
+
+	dscpMarkTable   = "ingress.dscp_mark"
+	dscpMarkAction  = "ingress.set_dscp"
+	dscpQueueTable  = "egress.dscp_queue"
+	dscpQueueAction = "egress.set_queue"
+
+	maxDSCP  = 63
+	maxQueue = 7
+)
+
+//trafficClass maps a DSCP value to an output queue
+type trafficClass struct {
+	DSCP  int
+	Queue int
+}
+
+//parseDSCP parses a DSCP option, 0 means traffic is left unmarked
+func parseDSCP(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+
+	dscp, err := strconv.Atoi(v)
+	if err != nil || dscp < 1 || dscp > maxDSCP {
+		return 0, fmt.Errorf("invalid %s %q, expected 1 to %d", optDSCP, v, maxDSCP)
+	}
+	return dscp, nil
+}
+
+//parseTrafficClasses parses a comma separated list of dscp:queue pairs
+func parseTrafficClasses(v string) ([]trafficClass, error) {
+	var classes []trafficClass
+	seen := make(map[int]bool)
+	for _, item := range splitOption(v) {
+		parts := strings.Split(item, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid traffic class %q, expected <dscp>:<queue>", item)
+		}
+		dscp, err := strconv.Atoi(parts[0])
+		if err != nil || dscp < 0 || dscp > maxDSCP || seen[dscp] {
+			return nil, fmt.Errorf("invalid DSCP value in traffic class %q", item)
+		}
+		queue, err := strconv.Atoi(parts[1])
+		if err != nil || queue < 0 || queue > maxQueue {
+			return nil, fmt.Errorf("invalid queue in traffic class %q, expected 0 to %d", item, maxQueue)
+		}
+		seen[dscp] = true
+		classes = append(classes, trafficClass{DSCP: dscp, Queue: queue})
+	}
+	return classes, nil
+}
+
+//endpointDSCP returns the DSCP value of an endpoint, its own if it was
+//given one or the value of its network
+func endpointDSCP(nw *nwVal, options map[string]interface{}) (int, error) {
+	dscp, err := parseDSCP(endpointOption(options, optDSCP))
+	if err != nil || dscp != 0 {
+		return dscp, err
+	}
+	return nw.DSCP, nil
+}
+
+func dscpMarkMatch(intf int) string {
+	return fmt.Sprintf("istd.ingress_port=%d", intf)
+}
+
+func dscpQueueMatch(segment int, dscp int) string {
+	return fmt.Sprintf("meta.segment_id=%d,hdr.ipv4.dscp=%d", segment, dscp)
+}
+
+//programEndpointDSCP marks the traffic of an endpoint
+func programEndpointDSCP(endpointID string, nw *nwVal, intf int, dscp int) error {
+	if dscp == 0 {
+		return nil
+	}
+	return addEntry(endpointOwner(endpointID), nw.Bridge, dscpMarkTable, dscpMarkMatch(intf),
+		fmt.Sprintf("%s(%d)", dscpMarkAction, dscp))
+}
+
+//programTrafficClasses installs the queue mapping of a network
+func programTrafficClasses(networkID string, nw *nwVal) error {
+	if nw.Segment == 0 {
+		return nil
+	}
+
+	for i, c := range nw.TrafficClasses {
+		if err := addEntry(networkOwner(networkID), nw.Bridge, dscpQueueTable, dscpQueueMatch(nw.Segment, c.DSCP),
+			fmt.Sprintf("%s(%d)", dscpQueueAction, c.Queue)); err != nil {
+			unprogramTrafficClasses(&nwVal{Bridge: nw.Bridge, Segment: nw.Segment, TrafficClasses: nw.TrafficClasses[:i]})
+			return err
+		}
+	}
+	return nil
+}
+
+//unprogramTrafficClasses removes the entries installed by
+//programTrafficClasses
+func unprogramTrafficClasses(nw *nwVal) {
+	if nw == nil || nw.Segment == 0 {
+		return
+	}
+
+	for _, c := range nw.TrafficClasses {
+		if err := deleteEntry(nw.Bridge, dscpQueueTable, dscpQueueMatch(nw.Segment, c.DSCP)); err != nil {
+			slog.Error("Unable to remove traffic class", "dscp", c.DSCP, "err", err)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+)
+
+//Multi-queue workloads ask for more virtio queue pairs on the vhost-user
+//port of their endpoints with docker network create -o com.ipdk.queues=4,
+//overridden per endpoint with --driver-opt. The target limits the number
+//of queues of a port, -max-queues is set to match it.
+var maxQueues = flag.Int("max-queues", 8, "maximum number of virtio queues of a vhost-user port supported by the target")
+
+const (
+	optQueues = "com.ipdk.queues"
+
+	defaultQueues = 1
+)
+
+//parseQueues parses a queue count option, 0 means the default
+func parseQueues(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+
+	queues, err := strconv.Atoi(v)
+	if err != nil || queues < 1 || queues > *maxQueues {
+		return 0, fmt.Errorf("invalid %s %q, expected 1 to %d", optQueues, v, *maxQueues)
+	}
+	return queues, nil
+}
+
+//endpointQueues returns the queue count of an endpoint, its own if it
+//was given one or that of its network
+func endpointQueues(nw *nwVal, options map[string]interface{}) (int, error) {
+	queues, err := parseQueues(endpointOption(options, optQueues))
+	if err != nil || queues != 0 {
+		return queues, err
+	}
+	return nw.Queues, nil
+}
+
+//vhostQueues returns the queue count a vhost-user port is created with
+func vhostQueues(queues int) int {
+	if queues == 0 {
+		return defaultQueues
+	}
+	return queues
+}
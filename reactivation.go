@@ -0,0 +1,199 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	api "github.com/docker/libnetwork/drivers/remote/api"
+)
+
+//When dockerd restarts it activates the plugin again, and may send
+//CreateNetwork and CreateEndpoint again for the networks and endpoints it
+//restores. Unless docker runs with live-restore, the ipdk container is
+//restarted along with it and infrap4d comes back without the ports and
+//pipeline entries of the plugin. Every activation after the first one
+//of the process therefore detects the capabilities again, as does one
+//while docker wasn't reachable, so that the drivers registered follow
+//what is available, then resyncs the dataplane in the background: once
+//it is ready again, the intents are recovered and the endpoints
+//reconciled. Creations of known networks and endpoints are checked
+//against the request and the dataplane instead of provisioning them
+//again, a missing port or bridge starting a resync as well.
+
+//activations counts the activations of the plugin by docker
+var activations = struct {
+	sync.Mutex
+	count     int
+	last      time.Time
+	resyncing bool
+}{}
+
+//activationState is what the debug state dump shows of the activations
+type activationState struct {
+	Count     int
+	Last      time.Time
+	Resyncing bool
+}
+
+func pluginActivations() activationState {
+	activations.Lock()
+	defer activations.Unlock()
+	return activationState{Count: activations.count, Last: activations.last, Resyncing: activations.resyncing}
+}
+
+//pluginActivated records an activation of the plugin by docker, and
+//detects the capabilities again and resyncs the dataplane when docker
+//restarted or became reachable
+func pluginActivated() {
+	activations.Lock()
+	activations.count++
+	activations.last = time.Now()
+	again := activations.count > 1
+	activations.Unlock()
+
+	if !again && caps.Docker {
+		return
+	}
+	if again {
+		slog.Info("Docker activated the plugin again, it probably restarted")
+	}
+
+	prev := caps
+	caps = detectCapabilities()
+	if caps != prev {
+		slog.Info("Capabilities changed", "net_admin", caps.NetAdmin, "docker", caps.Docker, "ipdk", caps.IPDK)
+	}
+	if again || caps.Docker && !prev.Docker {
+		requestResync("reactivation")
+	}
+}
+
+//requestResync resyncs the dataplane in the background, unless a resync
+//is already running
+func requestResync(reason string) {
+	if !caps.Docker {
+		return
+	}
+
+	activations.Lock()
+	defer activations.Unlock()
+	if activations.resyncing {
+		return
+	}
+	activations.resyncing = true
+	go resync(reason)
+}
+
+//resync waits for the dataplane, then recovers the intents and
+//reconciles the endpoints
+func resync(reason string) {
+	defer func() {
+		activations.Lock()
+		activations.resyncing = false
+		activations.Unlock()
+	}()
+
+	//The startup wait does the same
+	<-dataplaneReady
+
+	slog.Info("Resyncing the dataplane", "reason", reason)
+	if err := awaitDataplane(); err != nil {
+		slog.Error("The IPDK dataplane is not ready, resync abandoned", "timeout", durationSetting(readyTimeout), "err", err)
+		return
+	}
+	startupRecovery(true)
+}
+
+//createdNetwork answers a CreateNetwork request for a network which was
+//created, as sent again by docker after a restart, and returns false for
+//a new network. nwMap must be locked by the caller.
+func createdNetwork(w http.ResponseWriter, req *api.CreateNetworkRequest, resp api.CreateNetworkResponse) bool {
+	nw, ok := nwMap.m[req.NetworkID]
+	if !ok {
+		return false
+	}
+
+	var subnet, gateway net.IPNet
+	if len(req.IPv4Data) > 0 && req.IPv4Data[0].Pool != nil {
+		subnet = *req.IPv4Data[0].Pool
+	}
+	if len(req.IPv4Data) > 0 && req.IPv4Data[0].Gateway != nil {
+		gateway = *req.IPv4Data[0].Gateway
+	}
+	if subnet.String() != nw.Subnet.String() || gateway.String() != nw.Gateway.String() {
+		resp.Err = fmt.Sprintf("Error: network %s already exists with subnet %s and gateway %s", req.NetworkID, nw.Subnet.String(), nw.Gateway.String())
+	} else {
+		slog.Info("Network already created", "network", req.NetworkID)
+		if err := verifyNetwork(nw); err != nil {
+			slog.Warn("Network is missing from the dataplane", "network", req.NetworkID, "err", err)
+			requestResync("network " + req.NetworkID)
+		}
+	}
+	sendResponse(resp, w)
+	return true
+}
+
+//verifyNetwork checks that the bridge of a network exists
+func verifyNetwork(nw *nwVal) error {
+	if nw.Fallback {
+		if _, err := net.InterfaceByName(nw.Bridge); err != nil {
+			return fmt.Errorf("bridge %v: %v", nw.Bridge, err)
+		}
+		return nil
+	}
+	if !caps.Docker {
+		return nil
+	}
+
+	bridges, err := listBridges()
+	if err != nil {
+		return err
+	}
+	if !bridges[nw.Bridge] {
+		return fmt.Errorf("bridge %v not found", nw.Bridge)
+	}
+	return nil
+}
+
+//verifyEndpoint checks that the port of an endpoint exists. The dummy
+//link and the container end of a veth pair are moved to the container
+//by docker, so they are not looked for.
+func verifyEndpoint(ep *epVal) error {
+	switch ep.PortType {
+	case portTypeVeth:
+		link, _ := vethNames(ep.IpdkInterface)
+		if _, err := net.InterfaceByName(link); err != nil {
+			return fmt.Errorf("veth %v: %v", link, err)
+		}
+	case portTypeTAP:
+		if caps.Docker && !deviceExists(tapName(ep.IpdkInterface)) {
+			return fmt.Errorf("TAP port %v not found", tapName(ep.IpdkInterface))
+		}
+	case "":
+		if caps.Docker && !vhostPortExists(ep.IpdkInterface) {
+			netname, _ := vhostNames(ep.IpdkInterface)
+			return fmt.Errorf("vhost port %v not found", netname)
+		}
+	}
+	return nil
+}
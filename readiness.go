@@ -0,0 +1,172 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	api "github.com/docker/libnetwork/drivers/remote/api"
+)
+
+//After a host boot the plugin usually starts before the IPDK container,
+//or before infrap4d accepts connections, and the pipeline of br0 is not
+//loaded. Rather than failing the first docker runs, the plugin waits at
+//startup, for up to -ready-timeout, for the container, infrap4d and the
+//pipeline, loading simple_l3 into br0 if no pipeline is set, and only
+//then runs the startup reconciliation. Requests programming the
+//dataplane received meanwhile are held until the wait is over, for at
+//most readyRequestWait as docker gives up on a plugin request after
+//about 30 seconds, and fail with IPDK_NOT_READY after that. Once the
+//timeout is reached they are served anyway and fail with the error of
+//the dataplane.
+var readyTimeout = flag.Duration("ready-timeout", 5*time.Minute, "how long to wait at startup for the IPDK dataplane before serving endpoint requests, 0 to not wait")
+
+const (
+	readyPollInterval = 2 * time.Second
+	readyRequestWait  = 20 * time.Second
+)
+
+//dataplaneReady is closed when the startup wait is over
+var dataplaneReady = make(chan struct{})
+
+//probeDataplane checks that the ipdk container runs, that infrap4d
+//answers and that the pipeline of the default bridge is loaded, creating
+//the bridge or loading the pipeline if they are missing
+func probeDataplane() error {
+	if _, err := ipdkExec("true"); err != nil {
+		return err
+	}
+	if err := checkGNMI(); err != nil {
+		return err
+	}
+
+	bridges, err := listBridges()
+	if err != nil {
+		return err
+	}
+	if !bridges[defaultBridge] {
+		slog.Info("Creating the default bridge", "bridge", defaultBridge)
+		prog, err := defaultPipeline()
+		if err != nil {
+			return err
+		}
+		return createBridge(defaultBridge, prog)
+	}
+	return programP4()
+}
+
+//waitForDataplane polls the dataplane until it is ready or -ready-timeout
+//is reached, then runs the startup reconciliation if asked to and opens
+//the gate. caps.IPDK is set before the gate opens when the ipdk container
+//shows up late.
+func waitForDataplane(reconcileOnStart bool) {
+	defer close(dataplaneReady)
+
+	if err := awaitDataplane(); err != nil {
+		slog.Error("The IPDK dataplane is still not ready, serving requests anyway", "timeout", durationSetting(readyTimeout), "err", err)
+		return
+	}
+	startupRecovery(reconcileOnStart)
+}
+
+//awaitDataplane polls the dataplane until it is ready, returning the last
+//error once -ready-timeout is reached
+func awaitDataplane() error {
+	start := time.Now()
+	last := ""
+	for {
+		err := probeDataplane()
+		if err == nil {
+			break
+		}
+		if time.Since(start) >= durationSetting(readyTimeout) {
+			return err
+		}
+		if err.Error() != last {
+			slog.Info("Waiting for the IPDK dataplane", "err", err)
+			last = err.Error()
+		}
+		time.Sleep(readyPollInterval)
+	}
+
+	if !caps.IPDK {
+		slog.Info("The ipdk container is running, the dataplane is available")
+		caps.IPDK = true
+	}
+	slog.Info("The IPDK dataplane is ready", "after", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+//startupRecovery removes what the endpoint operations interrupted by a
+//crash left behind, then runs the startup reconciliation if asked to
+func startupRecovery(reconcileOnStart bool) {
+	if err := recoverIntents(); err != nil {
+		slog.Error("recovery of interrupted endpoint operations failed", "err", err)
+	}
+	if reconcileOnStart {
+		if err := reconcile(); err != nil {
+			slog.Error("dataplane reconciliation failed", "err", err)
+		}
+	}
+}
+
+//startReadinessGate starts the startup wait, or opens the gate right away
+//if it is disabled or the dataplane can't be reached through docker, in
+//which case -program-pipeline failing is fatal
+func startReadinessGate(reconcileOnStart bool) {
+	if *readyTimeout > 0 && caps.Docker {
+		go waitForDataplane(reconcileOnStart)
+		return
+	}
+
+	if *programPipeline {
+		if err := programP4(); err != nil {
+			fatal("unable to program the pipeline, quitting", "err", err)
+		}
+	}
+	startupRecovery(reconcileOnStart)
+	close(dataplaneReady)
+}
+
+//checkStartup verifies that the startup wait is over
+func checkStartup() error {
+	select {
+	case <-dataplaneReady:
+		return nil
+	default:
+		return fmt.Errorf("waiting for the IPDK dataplane")
+	}
+}
+
+//gated holds a driver request until the startup wait is over, failing it
+//if that takes longer than readyRequestWait
+func gated(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-dataplaneReady:
+		case <-time.After(readyRequestWait):
+			err := &catalogError{msg: "the IPDK dataplane is not ready", entry: catalogCode("IPDK_NOT_READY")}
+			sendResponse(api.Response{Err: "Error: " + err.Error()}, w)
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,159 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+//reconcile repairs drift between the endpoints restored from the db and
+//the state of infrap4d and the kernel: missing vhost-user ports, host
+//entries and dummy links are re-created, then the artifacts no known
+//endpoint uses are garbage collected.
+func reconcile() error {
+	if err := requireDocker(); err != nil {
+		return err
+	}
+	if err := repairDrift(); err != nil {
+		return err
+	}
+
+	//Remove whatever failed creations and deletions left behind
+	gc()
+
+	return nil
+}
+
+//repairDrift re-creates the missing ports, entries and links of the
+//endpoints
+func repairDrift() error {
+	nwMap.Lock()
+	defer nwMap.Unlock()
+
+	epMap.Lock()
+	defer epMap.Unlock()
+
+	brMap.Lock()
+	defer brMap.Unlock()
+
+	//Host entries of each bridge, dumped on first use
+	dumps := make(map[string]map[string]int)
+
+	links, err := dummyLinks()
+	if err != nil {
+		return fmt.Errorf("unable to list dummy links: %v", err)
+	}
+
+	for id, nw := range nwMap.m {
+		resyncFloodGroup(id, nw)
+	}
+
+	for id, ep := range epMap.m {
+		if ep.IpdkInterface == 0 {
+			//Endpoints persisted before the interface ID was stored
+			slog.Warn("Endpoint has no interface ID, skipping", "endpoint", id)
+			continue
+		}
+
+		socketpath := endpointSocketDir(ep)
+		if ep.PortType == "" && !vhostPortExists(ep.IpdkInterface) {
+			slog.Info("Reconcile: re-creating vhost port", "endpoint", id, "port", ep.IpdkInterface)
+			if err := makeSocketDir(socketpath); err != nil && !os.IsExist(err) {
+				slog.Error("Reconcile: unable to create socket directory", "endpoint", id, "path", socketpath, "err", err)
+				continue
+			}
+			if err := createVhostPort(ep.IpdkInterface, socketpath, ep.vhostConfig()); err != nil {
+				slog.Error("Reconcile: unable to create vhost port", "endpoint", id, "err", err)
+			}
+		}
+
+		nw := nwMap.m[ep.NetworkID]
+		if nw == nil {
+			slog.Warn("Endpoint belongs to an unknown network, skipping", "endpoint", id, "network", ep.NetworkID)
+			continue
+		}
+		if nw.Fallback {
+			continue
+		}
+
+		if nw.Forwarding == forwardingL2 {
+			if !isOwnedEntry(nw.Bridge, l2Table, l2Match(ep.MAC)) {
+				slog.Info("Reconcile: re-creating L2 entry", "endpoint", id, "mac", ep.MAC)
+				if err := addL2Endpoint(endpointOwner(id), nw.Bridge, ep.MAC, ep.IpdkInterface); err != nil {
+					slog.Error("Reconcile: unable to add L2 entry", "endpoint", id, "err", err)
+				}
+			}
+		} else if nw.VLAN != 0 {
+			//The VLAN tables can't be dumped, program them again
+			slog.Info("Reconcile: re-creating VLAN entries", "endpoint", id, "vlan", nw.VLAN)
+			deleteVLANEndpoint(nw.Bridge, nw.VLAN, ep.VhostuserPort, ep.IpdkInterface)
+			if err := addVLANEndpoint(endpointOwner(id), nw.Bridge, nw.VLAN, ep.VhostuserPort, ep.IpdkInterface); err != nil {
+				slog.Error("Reconcile: unable to add VLAN entries", "endpoint", id, "err", err)
+			}
+		} else {
+			entries, ok := dumps[nw.Bridge]
+			if !ok {
+				if entries, err = dumpHostEntries(nw.Bridge); err != nil {
+					return fmt.Errorf("unable to dump pipeline entries of %v: %v", nw.Bridge, err)
+				}
+				dumps[nw.Bridge] = entries
+			}
+
+			if port, ok := entries[ep.VhostuserPort]; !ok || port != ep.IpdkInterface {
+				slog.Info("Reconcile: re-creating host entry", "endpoint", id, "ip", ep.VhostuserPort)
+				if ok {
+					if err := deleteHostEntry(nw.Bridge, ep.VhostuserPort); err != nil {
+						slog.Error("Reconcile: unable to delete host entry", "endpoint", id, "err", err)
+					}
+				}
+				if err := addHostEntry(endpointOwner(id), nw.Bridge, ep.VhostuserPort, ep.IpdkInterface); err != nil {
+					slog.Error("Reconcile: unable to add host entry", "endpoint", id, "err", err)
+				}
+			}
+		}
+
+		if nw.Segment != 0 && !isOwnedEntry(nw.Bridge, segmentTable, segmentMatch(ep.IpdkInterface)) {
+			slog.Info("Reconcile: classifying port into segment", "endpoint", id, "port", ep.IpdkInterface, "segment", nw.Segment)
+			if err := addEndpointSegment(id, nw, ep.IpdkInterface); err != nil {
+				slog.Error("Reconcile: unable to add segment entry", "endpoint", id, "err", err)
+			}
+		}
+
+		resumeCapture(id, ep)
+
+		if ep.PortType == "" && !links[dummyLink(ep)] {
+			slog.Info("Reconcile: re-creating dummy link", "endpoint", id, "link", dummyLink(ep))
+			if err := addDummyLink(dummyLink(ep), ep.MTU, ep.MAC); err != nil {
+				slog.Error("Reconcile: unable to add dummy link", "endpoint", id, "err", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+//adminReconcile runs a reconciliation on demand
+func adminReconcile(w http.ResponseWriter, r *http.Request) {
+	if err := reconcile(); err != nil {
+		adminError(w, http.StatusInternalServerError, "reconciliation failed: %v", err)
+		return
+	}
+	sendResponse(struct{}{}, w)
+}
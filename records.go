@@ -0,0 +1,165 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+//Typed accessors of the records of the state tables. The put and del
+//variants return a dbOp so that related records can still be written
+//in a single dbUpdate transaction.
+
+//dbLoad decodes the record stored under key into value, which must be a
+//pointer, and reports whether the record exists
+func dbLoad(table string, key string, value interface{}) (bool, error) {
+	v, err := store.Get(table, key)
+	if err != nil || v == nil {
+		return false, err
+	}
+
+	if err := json.Unmarshal(v, value); err != nil {
+		return false, fmt.Errorf("Decode Error: %v %v %v", table, key, err)
+	}
+	return true, nil
+}
+
+//dbLoadTable decodes every record of a table into a value returned by
+//newValue and hands it to add
+func dbLoadTable(table string, newValue func() interface{}, add func(key string, value interface{})) error {
+	records, err := store.List(table)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range records {
+		value := newValue()
+		if err := json.Unmarshal(v, value); err != nil {
+			return fmt.Errorf("Decode Error: %v %v %v", k, string(v), err)
+		}
+		add(k, value)
+	}
+	return nil
+}
+
+func putNetwork(id string, nw *nwVal) dbOp {
+	return dbPut("nwMap", id, nw)
+}
+
+func delNetwork(id string) dbOp {
+	return dbDel("nwMap", id)
+}
+
+//loadNetwork returns the stored network, or nil if it does not exist
+func loadNetwork(id string) (*nwVal, error) {
+	nw := &nwVal{}
+	if ok, err := dbLoad("nwMap", id, nw); !ok {
+		return nil, err
+	}
+	return nw, nil
+}
+
+func loadNetworks() (map[string]*nwVal, error) {
+	networks := make(map[string]*nwVal)
+	err := dbLoadTable("nwMap", func() interface{} { return &nwVal{} },
+		func(key string, value interface{}) { networks[key] = value.(*nwVal) })
+	return networks, err
+}
+
+func putEndpoint(id string, ep *epVal) dbOp {
+	return dbPut("epMap", id, ep)
+}
+
+func delEndpoint(id string) dbOp {
+	return dbDel("epMap", id)
+}
+
+//loadEndpoint returns the stored endpoint, or nil if it does not exist
+func loadEndpoint(id string) (*epVal, error) {
+	ep := &epVal{}
+	if ok, err := dbLoad("epMap", id, ep); !ok {
+		return nil, err
+	}
+	return ep, nil
+}
+
+func loadEndpoints() (map[string]*epVal, error) {
+	endpoints := make(map[string]*epVal)
+	err := dbLoadTable("epMap", func() interface{} { return &epVal{} },
+		func(key string, value interface{}) { endpoints[key] = value.(*epVal) })
+	return endpoints, err
+}
+
+func putBridge(networkID string, id int) dbOp {
+	return dbPut("brMap", networkID, id)
+}
+
+func delBridge(networkID string) dbOp {
+	return dbDel("brMap", networkID)
+}
+
+func loadBridges() (map[string]int, error) {
+	bridges := make(map[string]int)
+	err := dbLoadTable("brMap", func() interface{} { return new(int) },
+		func(key string, value interface{}) { bridges[key] = *value.(*int) })
+	return bridges, err
+}
+
+//putCounter stores a counter of the global table
+func putCounter(key string, value int) dbOp {
+	return dbPut("global", key, value)
+}
+
+//putFreeIntfs stores the free list of interface IDs
+func putFreeIntfs(ids []int) dbOp {
+	return dbPut("global", "intfFree", ids)
+}
+
+//loadFreeIntfs returns the free list of interface IDs
+func loadFreeIntfs() ([]int, error) {
+	var ids []int
+	_, err := dbLoad("global", "intfFree", &ids)
+	return ids, err
+}
+
+//loadCounter returns the counter stored under key in the global table,
+//or def if it has never been stored
+func loadCounter(key string, def int) (int, error) {
+	counter := def
+	if _, err := dbLoad("global", key, &counter); err != nil {
+		return def, err
+	}
+	return counter, nil
+}
+
+//putIntent records an endpoint operation in progress
+func putIntent(id string, op string, ep *epVal) dbOp {
+	return dbPut("intents", id, &intent{Op: op, Endpoint: ep, Started: time.Now()})
+}
+
+func delIntent(id string) dbOp {
+	return dbDel("intents", id)
+}
+
+func loadIntents() (map[string]*intent, error) {
+	intents := make(map[string]*intent)
+	err := dbLoadTable("intents", func() interface{} { return &intent{} },
+		func(key string, value interface{}) { intents[key] = value.(*intent) })
+	return intents, err
+}
@@ -0,0 +1,193 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+//useTestStore points the store at a bolt db in a temporary directory
+//for the duration of a test
+func useTestStore(t *testing.T) {
+	s, err := openBoltStore(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatalf("unable to open the store: %v", err)
+	}
+	if err := s.Init([]string{"global", "nwMap", "epMap", "brMap", "intents"}); err != nil {
+		t.Fatalf("unable to create the tables: %v", err)
+	}
+
+	saved := store
+	store = s
+	t.Cleanup(func() {
+		store = saved
+		s.Close()
+	})
+}
+
+func testNetwork() *nwVal {
+	return &nwVal{
+		Bridge:     "br1",
+		Gateway:    net.IPNet{IP: net.ParseIP("10.1.0.1"), Mask: net.CIDRMask(24, 32)},
+		Subnet:     net.IPNet{IP: net.ParseIP("10.1.0.0"), Mask: net.CIDRMask(24, 32)},
+		MTU:        9000,
+		Queues:     4,
+		RSS:        &rssConfig{Key: "6d5a", Fields: []string{"ipv4", "tcp"}},
+		VhostDir:   "/run/ipdk/blue",
+		Segment:    7,
+		Connected:  []string{"other"},
+		DSCP:       46,
+		FloodPorts: []int{3, 5, 8},
+		Forwarding: forwardingL2,
+	}
+}
+
+func testEndpoint() *epVal {
+	return &epVal{
+		IP:             "10.1.0.2/24",
+		NetworkID:      "network",
+		VhostuserPort:  "10.1.0.2",
+		SocketDir:      "/run/ipdk/blue/10.1.0.2",
+		IpdkInterface:  3,
+		MAC:            "02:42:0a:01:00:02",
+		MTU:            9000,
+		Queues:         4,
+		RSS:            &rssConfig{Key: "6d5a", Fields: []string{"ipv4"}},
+		SNATBlock:      12,
+		Published:      []publishedPort{{Proto: 6, IP: "10.1.0.2", Port: 80, HostIP: "192.168.1.10", HostPort: 8080, HostPortEnd: 8080}},
+		SecurityGroups: []string{"web"},
+	}
+}
+
+func TestNetworkRoundTrip(t *testing.T) {
+	useTestStore(t)
+
+	want := testNetwork()
+	if err := dbUpdate(putNetwork("network", want)); err != nil {
+		t.Fatalf("putNetwork: %v", err)
+	}
+
+	got, err := loadNetwork("network")
+	if err != nil {
+		t.Fatalf("loadNetwork: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loadNetwork = %+v, want %+v", got, want)
+	}
+
+	all, err := loadNetworks()
+	if err != nil {
+		t.Fatalf("loadNetworks: %v", err)
+	}
+	if len(all) != 1 || !reflect.DeepEqual(all["network"], want) {
+		t.Errorf("loadNetworks = %+v, want network only", all)
+	}
+
+	if err := dbUpdate(delNetwork("network")); err != nil {
+		t.Fatalf("delNetwork: %v", err)
+	}
+	if got, err := loadNetwork("network"); got != nil || err != nil {
+		t.Errorf("loadNetwork after delete = %+v, %v, want nil, nil", got, err)
+	}
+}
+
+func TestEndpointRoundTrip(t *testing.T) {
+	useTestStore(t)
+
+	want := testEndpoint()
+	if err := dbUpdate(putEndpoint("endpoint", want)); err != nil {
+		t.Fatalf("putEndpoint: %v", err)
+	}
+
+	got, err := loadEndpoint("endpoint")
+	if err != nil {
+		t.Fatalf("loadEndpoint: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loadEndpoint = %+v, want %+v", got, want)
+	}
+
+	all, err := loadEndpoints()
+	if err != nil {
+		t.Fatalf("loadEndpoints: %v", err)
+	}
+	if len(all) != 1 || !reflect.DeepEqual(all["endpoint"], want) {
+		t.Errorf("loadEndpoints = %+v, want endpoint only", all)
+	}
+
+	if err := dbUpdate(delEndpoint("endpoint")); err != nil {
+		t.Fatalf("delEndpoint: %v", err)
+	}
+	if got, err := loadEndpoint("endpoint"); got != nil || err != nil {
+		t.Errorf("loadEndpoint after delete = %+v, %v, want nil, nil", got, err)
+	}
+}
+
+func TestCountersRoundTrip(t *testing.T) {
+	useTestStore(t)
+
+	err := dbUpdate(putCounter("intfCount", 42), putFreeIntfs([]int{7, 9}), putBridge("network", 3))
+	if err != nil {
+		t.Fatalf("dbUpdate: %v", err)
+	}
+
+	if n, err := loadCounter("intfCount", 1); n != 42 || err != nil {
+		t.Errorf("loadCounter = %d, %v, want 42", n, err)
+	}
+	if ids, err := loadFreeIntfs(); !reflect.DeepEqual(ids, []int{7, 9}) || err != nil {
+		t.Errorf("loadFreeIntfs = %v, %v, want [7 9]", ids, err)
+	}
+	if bridges, err := loadBridges(); !reflect.DeepEqual(bridges, map[string]int{"network": 3}) || err != nil {
+		t.Errorf("loadBridges = %v, %v, want network:3", bridges, err)
+	}
+
+	//A nil free list is stored as such
+	if err := dbUpdate(putFreeIntfs(nil)); err != nil {
+		t.Fatalf("putFreeIntfs: %v", err)
+	}
+	if ids, err := loadFreeIntfs(); ids != nil || err != nil {
+		t.Errorf("loadFreeIntfs = %v, %v, want nil", ids, err)
+	}
+}
+
+func TestLoadMissing(t *testing.T) {
+	useTestStore(t)
+
+	if nw, err := loadNetwork("missing"); nw != nil || err != nil {
+		t.Errorf("loadNetwork = %+v, %v, want nil, nil", nw, err)
+	}
+	if ep, err := loadEndpoint("missing"); ep != nil || err != nil {
+		t.Errorf("loadEndpoint = %+v, %v, want nil, nil", ep, err)
+	}
+	if n, err := loadCounter("brCount", 1); n != 1 || err != nil {
+		t.Errorf("loadCounter = %d, %v, want the default 1", n, err)
+	}
+	if ids, err := loadFreeIntfs(); ids != nil || err != nil {
+		t.Errorf("loadFreeIntfs = %v, %v, want nil", ids, err)
+	}
+	if all, err := loadEndpoints(); len(all) != 0 || err != nil {
+		t.Errorf("loadEndpoints = %v, %v, want none", all, err)
+	}
+
+	//Deleting a missing record is not an error
+	if err := dbUpdate(delEndpoint("missing")); err != nil {
+		t.Errorf("delEndpoint: %v", err)
+	}
+}
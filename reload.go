@@ -0,0 +1,157 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//SIGHUP reloads the tunables of the configuration file without
+//restarting the plugin, which would interrupt the network operations of
+//docker. Tunables missing from the file get their default back, and
+//those given on the command line or in the environment are left alone.
+//The other settings and the env section are only read at startup, a
+//change to them is logged as needing a restart. A file with an invalid
+//tunable is rejected as a whole.
+var reloadableSettings = map[string]bool{
+	"log-level":          true,
+	"exec-timeout":       true,
+	"compile-timeout":    true,
+	"ready-timeout":      true,
+	"mtu-probe-mtu":      true,
+	"mtu-probe-targets":  true,
+	"snapshot-retention": true,
+	"default-pools":      true,
+}
+
+//settings guards the flags of the tunables, which are read through
+//durationSetting, intSetting and stringSetting
+var settings sync.RWMutex
+
+func durationSetting(p *time.Duration) time.Duration {
+	settings.RLock()
+	defer settings.RUnlock()
+	return *p
+}
+
+func intSetting(p *int) int {
+	settings.RLock()
+	defer settings.RUnlock()
+	return *p
+}
+
+func stringSetting(p *string) string {
+	settings.RLock()
+	defer settings.RUnlock()
+	return *p
+}
+
+//reloadOnSignal reloads the configuration file on every SIGHUP
+func reloadOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		if err := reloadConfig(); err != nil {
+			slog.Error("Configuration not reloaded", "file", *configFile, "err", err)
+		}
+	}
+}
+
+//reloadConfig applies the tunables of the configuration file
+func reloadConfig() error {
+	loaded, _, err := loadConfig(*configFile, settingSources["config"] == sourceDefault)
+	if err != nil {
+		return err
+	}
+
+	//Settings given on the command line or in the environment win over
+	//the file
+	next := make(map[string]string)
+	var restart []string
+	flag.VisitAll(func(f *flag.Flag) {
+		if source := settingSources[f.Name]; source == sourceFlag || source == sourceEnv {
+			return
+		}
+		v, ok := loaded[f.Name]
+		if !reloadableSettings[f.Name] {
+			if ok && v != f.Value.String() {
+				restart = append(restart, f.Name)
+			}
+			return
+		}
+		if !ok {
+			v = f.DefValue
+		}
+		if v != f.Value.String() {
+			next[f.Name] = v
+		}
+	})
+	if len(restart) > 0 {
+		slog.Warn("Settings changed in the configuration file need a restart", "settings", strings.Join(restart, ","))
+	}
+	if v, ok := next["log-level"]; ok {
+		if _, err := parseLogLevel(v); err != nil {
+			return err
+		}
+	}
+	if v, ok := next["default-pools"]; ok {
+		if _, err := parseDefaultPools(v); err != nil {
+			return err
+		}
+	}
+
+	settings.Lock()
+	defer settings.Unlock()
+
+	var names []string
+	prev := make(map[string]string)
+	for name := range next {
+		names = append(names, name)
+		prev[name] = flag.Lookup(name).Value.String()
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := flag.Set(name, next[name]); err != nil {
+			for name, v := range prev {
+				flag.Set(name, v)
+			}
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	for _, name := range names {
+		settingSources[name] = sourceDefault
+		if _, ok := loaded[name]; ok {
+			settingSources[name] = sourceFile
+		}
+	}
+
+	if _, ok := next["log-level"]; ok {
+		level, _ := parseLogLevel(*logLevelName)
+		logLevel.Set(level)
+	}
+	slog.Info("Configuration reloaded", "file", *configFile, "changed", strings.Join(names, ","))
+	return nil
+}
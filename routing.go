@@ -0,0 +1,395 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+
+	api "github.com/docker/libnetwork/drivers/remote/api"
+	"github.com/gorilla/mux"
+)
+
+//Networks sharing a bridge can be made routable to each other through
+//the admin API, for applications whose tiers live on separate networks:
+//
+//  curl -X POST -d '{"Network": "<peer-id>"}' http://127.0.0.1:9075/v1/networks/<id>/routes
+//
+//Traffic from the segment of one network for the subnet of the other
+//matches ingress.l3_route, which moves it into the segment of the other
+//network with the MAC address of its gateway as source, the way a router
+//on the gateway would. ingress.l3_neighbor then rewrites the destination
+//MAC address to that of the endpoint, so the endpoints of routed
+//networks have a neighbor entry. Routed networks are connected as far as
+//isolation is concerned.
+const (
+	routeTable     = "ingress.l3_route"
+	routeAction    = "ingress.route"
+	neighborTable  = "ingress.l3_neighbor"
+	neighborAction = "ingress.set_dst_mac"
+)
+
+//Containers attached to several networks only have a default route
+//through the gateway of one of them. Endpoints are given static routes
+//when they join a container: an on-link route to the subnets of their
+//network other than the one of their address, as docker only sets up
+//the latter, and a route through the gateway of their network to the
+//subnet of every network it is routed to. Routes changed afterwards only
+//apply to the containers joining from then on.
+const (
+	//Route types of libnetwork
+	routeNextHop   = 0
+	routeConnected = 1
+)
+
+//networkSubnets returns the IPv4 subnets of a network, the primary one
+//first
+func networkSubnets(nw *nwVal) []net.IPNet {
+	if nw.Subnet.IP == nil {
+		return nw.Subnets
+	}
+	return append([]net.IPNet{nw.Subnet}, nw.Subnets...)
+}
+
+//joinRoutes returns the static routes of an endpoint joining a
+//container. nwMap must be locked by the caller.
+func joinRoutes(nw *nwVal, ep *epVal) []api.StaticRoute {
+	routes := []api.StaticRoute{}
+	ip, _, err := net.ParseCIDR(ep.IP)
+	if err != nil {
+		return routes
+	}
+
+	for _, subnet := range networkSubnets(nw) {
+		if !subnet.Contains(ip) {
+			routes = append(routes, api.StaticRoute{Destination: subnet.String(), RouteType: routeConnected})
+		}
+	}
+
+	if nw.Gateway.IP == nil {
+		return routes
+	}
+	for _, id := range nw.Routed {
+		//Only the primary subnet of a peer is routed, see routeMatch
+		if peer := nwMap.m[id]; peer != nil && peer.Subnet.IP != nil {
+			routes = append(routes, api.StaticRoute{
+				Destination: peer.Subnet.String(),
+				RouteType:   routeNextHop,
+				NextHop:     nw.Gateway.IP.String(),
+			})
+		}
+	}
+	return routes
+}
+
+func routeMatch(src *nwVal, dst *nwVal) string {
+	return fmt.Sprintf("meta.segment_id=%d,hdr.ipv4.dst_addr=%s", src.Segment, dst.Subnet.String())
+}
+
+func neighborMatch(segment int, ip string) string {
+	return fmt.Sprintf("meta.segment_id=%d,hdr.ipv4.dst_addr=%s", segment, ip)
+}
+
+func removeRoutingEntry(bridge string, table string, m string) {
+	if err := deleteEntry(bridge, table, m); err != nil {
+		slog.Error("Unable to remove routing entry", "match", m, "err", err)
+	}
+}
+
+//routable reports why two networks can't be routed to each other, or
+//returns nil
+func routable(nw *nwVal, peer *nwVal) error {
+	switch {
+	case nw.Bridge != peer.Bridge:
+		return fmt.Errorf("networks on different bridges can't be routed")
+	case nw.Forwarding == forwardingL2 || peer.Forwarding == forwardingL2:
+		return fmt.Errorf("l2 networks can't be routed")
+	case nw.Segment == 0 || peer.Segment == 0:
+		return fmt.Errorf("networks without a segment can't be routed")
+	case nw.Subnet.IP == nil || peer.Subnet.IP == nil || peer.Gateway.IP == nil || nw.Gateway.IP == nil:
+		return fmt.Errorf("networks without an IPv4 subnet and gateway can't be routed")
+	}
+	return nil
+}
+
+//addRoute routes the traffic of src for the subnet of dst
+func addRoute(owner string, src *nwVal, dst *nwVal) error {
+	mac, err := gatewayMAC(dst)
+	if err != nil {
+		return err
+	}
+	return addEntry(owner, src.Bridge, routeTable, routeMatch(src, dst),
+		fmt.Sprintf("%s(%d,%s)", routeAction, dst.Segment, mac))
+}
+
+//programRoutePair installs the routes between two networks, in both
+//directions
+func programRoutePair(networkID string, nw *nwVal, peer *nwVal) error {
+	owner := networkOwner(networkID)
+	if err := addRoute(owner, nw, peer); err != nil {
+		return err
+	}
+	if err := addRoute(owner, peer, nw); err != nil {
+		removeRoutingEntry(nw.Bridge, routeTable, routeMatch(nw, peer))
+		return err
+	}
+	return nil
+}
+
+func unprogramRoutePair(nw *nwVal, peer *nwVal) {
+	removeRoutingEntry(nw.Bridge, routeTable, routeMatch(nw, peer))
+	removeRoutingEntry(nw.Bridge, routeTable, routeMatch(peer, nw))
+}
+
+//endpointNeighbor returns the address and MAC address of an endpoint.
+//Docker derives the MAC address of endpoints the driver has none for
+//from their address, as endpointMAC does.
+func endpointNeighbor(ep *epVal) (string, string, error) {
+	ip, _, err := net.ParseCIDR(ep.IP)
+	if err != nil {
+		return "", "", err
+	}
+	mac, err := endpointMAC(ep.MAC, ip)
+	return ip.String(), mac, err
+}
+
+//programEndpointNeighbor installs the neighbor entry of an endpoint of a
+//routed network
+func programEndpointNeighbor(endpointID string, nw *nwVal, ep *epVal) error {
+	if len(nw.Routed) == 0 {
+		return nil
+	}
+
+	ip, mac, err := endpointNeighbor(ep)
+	if err != nil {
+		return err
+	}
+	return addEntry(endpointOwner(endpointID), nw.Bridge, neighborTable, neighborMatch(nw.Segment, ip),
+		fmt.Sprintf("%s(%s)", neighborAction, mac))
+}
+
+func unprogramEndpointNeighbor(nw *nwVal, ep *epVal) {
+	if nw == nil || len(nw.Routed) == 0 {
+		return
+	}
+
+	ip, _, err := endpointNeighbor(ep)
+	if err != nil {
+		slog.Error("Unable to remove neighbor entry", "ip", ep.IP, "err", err)
+		return
+	}
+	removeRoutingEntry(nw.Bridge, neighborTable, neighborMatch(nw.Segment, ip))
+}
+
+//networkEndpoints returns the endpoints of a network. epMap must be
+//locked by the caller.
+func networkEndpoints(networkID string) map[string]*epVal {
+	endpoints := make(map[string]*epVal)
+	for id, ep := range epMap.m {
+		if ep.NetworkID == networkID {
+			endpoints[id] = ep
+		}
+	}
+	return endpoints
+}
+
+//programNeighbors installs the neighbor entries of the endpoints of a
+//network that becomes routed. epMap must be locked by the caller.
+func programNeighbors(networkID string, nw *nwVal) error {
+	var added []*epVal
+	for id, ep := range networkEndpoints(networkID) {
+		if err := programEndpointNeighbor(id, nw, ep); err != nil {
+			for _, v := range added {
+				unprogramEndpointNeighbor(nw, v)
+			}
+			return err
+		}
+		added = append(added, ep)
+	}
+	return nil
+}
+
+//unprogramNeighbors removes the neighbor entries of the endpoints of a
+//network. epMap must be locked by the caller.
+func unprogramNeighbors(networkID string, nw *nwVal) {
+	for _, ep := range networkEndpoints(networkID) {
+		unprogramEndpointNeighbor(nw, ep)
+	}
+}
+
+//routeNetworks makes two networks routable to each other. nwMap and
+//epMap must be locked by the caller.
+func routeNetworks(id string, nw *nwVal, peerID string, peer *nwVal) error {
+	if err := routable(nw, peer); err != nil {
+		return err
+	}
+	if err := programRoutePair(id, nw, peer); err != nil {
+		return err
+	}
+
+	//Neighbor entries are installed when a network gets its first route
+	for _, v := range []struct {
+		id   string
+		nw   *nwVal
+		peer string
+	}{{id, nw, peerID}, {peerID, peer, id}} {
+		v.nw.Routed = append(v.nw.Routed, v.peer)
+		if len(v.nw.Routed) > 1 {
+			continue
+		}
+		if err := programNeighbors(v.id, v.nw); err != nil {
+			unrouteNetworks(id, nw, peerID, peer)
+			return err
+		}
+	}
+
+	if isolationAllowed(id, nw, peerID, peer) {
+		removeIsolationPair(nw, peer)
+	}
+	return nil
+}
+
+//unrouteNetworks removes the routes between two networks, and the
+//neighbor entries of those left without routes. nwMap and epMap must be
+//locked by the caller.
+func unrouteNetworks(id string, nw *nwVal, peerID string, peer *nwVal) {
+	unprogramRoutePair(nw, peer)
+	for _, v := range []struct {
+		id   string
+		nw   *nwVal
+		peer string
+	}{{id, nw, peerID}, {peerID, peer, id}} {
+		if !hasAny(v.nw.Routed, []string{v.peer}) {
+			continue
+		}
+		if len(v.nw.Routed) == 1 {
+			unprogramNeighbors(v.id, v.nw)
+		}
+		v.nw.Routed = removeConnection(v.nw.Routed, v.peer)
+	}
+}
+
+//unprogramRoutes removes the routes of a network being deleted.
+//nwMap and epMap must be locked by the caller.
+func unprogramRoutes(networkID string, nw *nwVal) []dbOp {
+	if nw == nil {
+		return nil
+	}
+
+	var ops []dbOp
+	for _, peerID := range append([]string{}, nw.Routed...) {
+		peer, ok := nwMap.m[peerID]
+		if !ok {
+			continue
+		}
+		unrouteNetworks(networkID, nw, peerID, peer)
+		ops = append(ops, putNetwork(peerID, peer))
+	}
+	return ops
+}
+
+func adminListRoutes(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	nwMap.Lock()
+	defer nwMap.Unlock()
+
+	nw, ok := nwMap.m[id]
+	if !ok {
+		adminError(w, http.StatusNotFound, "network %s not found", id)
+		return
+	}
+	sendResponse(nw.Routed, w)
+}
+
+//adminAddRoute makes two networks routable to each other
+func adminAddRoute(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	body, err := getBody(r)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	req := struct{ Network string }{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		adminError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	nwMap.Lock()
+	defer nwMap.Unlock()
+	epMap.Lock()
+	defer epMap.Unlock()
+
+	nw, peer := adminConnectedNetworks(w, id, req.Network)
+	if nw == nil {
+		return
+	}
+	if hasAny(nw.Routed, []string{req.Network}) {
+		sendResponse(nw.Routed, w)
+		return
+	}
+	if err := routable(nw, peer); err != nil {
+		adminError(w, http.StatusConflict, "unable to route %s to %s: %v", id, req.Network, err)
+		return
+	}
+
+	if err := routeNetworks(id, nw, req.Network, peer); err != nil {
+		adminError(w, http.StatusInternalServerError, "unable to route %s to %s: %v", id, req.Network, err)
+		return
+	}
+	if err := dbUpdate(putNetwork(id, nw), putNetwork(req.Network, peer)); err != nil {
+		slog.Error("Unable to update db", "err", err)
+	}
+	sendResponse(nw.Routed, w)
+}
+
+//adminRemoveRoute removes the routes between two networks, isolating
+//them again unless they are otherwise allowed to reach each other
+func adminRemoveRoute(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	nwMap.Lock()
+	defer nwMap.Unlock()
+	epMap.Lock()
+	defer epMap.Unlock()
+
+	nw, peer := adminConnectedNetworks(w, id, vars["peer"])
+	if nw == nil {
+		return
+	}
+	if !hasAny(nw.Routed, []string{vars["peer"]}) {
+		adminError(w, http.StatusNotFound, "network %s is not routed to %s", id, vars["peer"])
+		return
+	}
+
+	unrouteNetworks(id, nw, vars["peer"], peer)
+	if !isolationAllowed(id, nw, vars["peer"], peer) {
+		if err := isolatePair(id, nw, peer); err != nil {
+			slog.Error("Unable to isolate networks", "network", id, "peer", vars["peer"], "err", err)
+		}
+	}
+	if err := dbUpdate(putNetwork(id, nw), putNetwork(vars["peer"], peer)); err != nil {
+		slog.Error("Unable to update db", "err", err)
+	}
+	sendResponse(nw.Routed, w)
+}
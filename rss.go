@@ -0,0 +1,93 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+//Traffic received by a multi-queue port is spread across its queues by
+//RSS. The hashed header fields are set with
+//
+//  docker network create -d ipdk -o com.ipdk.queues=4 \
+//      -o com.ipdk.rss_fields=ipv4,tcp,udp -o com.ipdk.rss_key=<hex> ...
+//
+//on the network, applying to the vhost-user ports of its endpoints and
+//to its uplink, or per endpoint with --driver-opt. Without a key the
+//well-known default Toeplitz key is used, so that a flow always lands on
+//the same queue whatever the port and host. Ports without RSS fields are
+//left to the defaults of the target.
+const (
+	optRSSKey    = "com.ipdk.rss_key"
+	optRSSFields = "com.ipdk.rss_fields"
+
+	defaultRSSKey = "6d5a56da255b0ec24167253d43a38fb0d0ca2bcbae7b30b477cb2da38030f20c6a42b73bbeac01fa"
+)
+
+var rssHashFields = map[string]bool{"l2": true, "ipv4": true, "ipv6": true, "tcp": true, "udp": true, "sctp": true}
+
+//rssConfig is the RSS configuration of a port
+type rssConfig struct {
+	Key    string
+	Fields []string
+}
+
+//parseRSS parses the RSS options of a network or endpoint, nil means
+//the defaults of the target
+func parseRSS(key string, fields string) (*rssConfig, error) {
+	if fields == "" {
+		if key != "" {
+			return nil, fmt.Errorf("%s needs %s", optRSSKey, optRSSFields)
+		}
+		return nil, nil
+	}
+
+	rss := &rssConfig{Key: strings.ToLower(key)}
+	for _, f := range splitOption(fields) {
+		if !rssHashFields[f] {
+			return nil, fmt.Errorf("invalid %s field %q", optRSSFields, f)
+		}
+		rss.Fields = append(rss.Fields, f)
+	}
+	if rss.Key == "" {
+		rss.Key = defaultRSSKey
+	}
+	if b, err := hex.DecodeString(rss.Key); err != nil || (len(b) != 40 && len(b) != 52) {
+		return nil, fmt.Errorf("invalid %s, expected 40 or 52 bytes in hexadecimal", optRSSKey)
+	}
+	return rss, nil
+}
+
+//endpointRSS returns the RSS configuration of an endpoint, its own if it
+//was given one or that of its network
+func endpointRSS(nw *nwVal, options map[string]interface{}) (*rssConfig, error) {
+	rss, err := parseRSS(endpointOption(options, optRSSKey), endpointOption(options, optRSSFields))
+	if err != nil || rss != nil {
+		return rss, err
+	}
+	return nw.RSS, nil
+}
+
+//config returns the gNMI parameters of an RSS configuration, nil-safe
+func (rss *rssConfig) config() string {
+	if rss == nil {
+		return ""
+	}
+	return fmt.Sprintf(",rss-hash:%s,rss-key:%s", strings.Join(rss.Fields, "+"), rss.Key)
+}
@@ -0,0 +1,84 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+//The configuration of gnmi-cli and the match and action of ovs-p4ctl are
+//lists the tools split themselves, on , then : or =. Addresses, names and
+//paths from the options of docker end up in them, so every element is
+//checked before the command runs: a value with a , = ( or space in it
+//would otherwise add keys or table fields of its own. The commands are
+//run without a shell, the arguments given to bash -c are passed as
+//positional parameters.
+var (
+	gnmiItemPattern   = regexp.MustCompile(`^[a-z][a-z0-9-]*(:[A-Za-z0-9_./:+-]+)?$`)
+	p4NamePattern     = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+	matchItemPattern  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*=[A-Za-z0-9_./:-]+$`)
+	actionPattern     = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*(\([A-Za-z0-9_./:,-]*\))?$`)
+	commandArgPattern = regexp.MustCompile(`^[A-Za-z0-9_./:+-]+$`)
+)
+
+//checkGNMIConfig checks the key:value list given to gnmi-cli, a key
+//given twice being a value that smuggled in a key of its own
+func checkGNMIConfig(config string) error {
+	keys := make(map[string]bool)
+	for _, item := range strings.Split(config, ",") {
+		key := strings.SplitN(item, ":", 2)[0]
+		if !gnmiItemPattern.MatchString(item) || keys[key] {
+			return fmt.Errorf("refusing to run gnmi-cli with %q, invalid element %q", config, item)
+		}
+		keys[key] = true
+	}
+	return nil
+}
+
+//checkEntry checks the bridge, table, match and action of an ovs-p4ctl
+//entry, the action being "" for a delete
+func checkEntry(bridge string, table string, match string, action string) error {
+	if err := checkCommandArg(bridge); err != nil {
+		return err
+	}
+	if !p4NamePattern.MatchString(table) {
+		return fmt.Errorf("refusing to run ovs-p4ctl on table %q", table)
+	}
+	fields := make(map[string]bool)
+	for _, item := range strings.Split(match, ",") {
+		field := strings.SplitN(item, "=", 2)[0]
+		if !matchItemPattern.MatchString(item) || field == "action" || fields[field] {
+			return fmt.Errorf("refusing to run ovs-p4ctl with match %q, invalid field %q", match, item)
+		}
+		fields[field] = true
+	}
+	if action != "" && !actionPattern.MatchString(action) {
+		return fmt.Errorf("refusing to run ovs-p4ctl with action %q", action)
+	}
+	return nil
+}
+
+//checkCommandArg checks a value passed to a command as an argument of
+//its own, which must not be taken for an option
+func checkCommandArg(v string) error {
+	if !commandArgPattern.MatchString(v) || strings.HasPrefix(v, "-") {
+		return fmt.Errorf("refusing to run a command with argument %q", v)
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+//Security groups are named sets of ACL rules managed through the admin
+//API and shared by endpoints:
+//
+//  curl -X PUT -d '{"Rules": ["allow:tcp:0.0.0.0/0:443", "deny:any:0.0.0.0/0"]}' \
+//      http://127.0.0.1:9075/v1/security-groups/web
+//  docker network connect --driver-opt com.ipdk.security_groups=web ...
+//
+//The rules of the groups of an endpoint, in the order the groups are
+//listed, are installed in the endpoint ACL table below its own ACL
+//rules. Replacing the rules of a group re-programs every member.
+const (
+	optSecurityGroups = "com.ipdk.security_groups"
+
+	//Group rules come after the ACL rules of the endpoint
+	sgTopPriority = aclTopPriority / 2
+)
+
+var sgNameRe = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+type securityGroup struct {
+	Rules []aclRule
+}
+
+//sgMap holds the security groups. It is locked after nwMap and epMap.
+var sgMap struct {
+	sync.Mutex
+	m map[string]*securityGroup
+}
+
+func putSecurityGroup(name string, sg *securityGroup) dbOp {
+	return dbPut("sgMap", name, sg)
+}
+
+func delSecurityGroup(name string) dbOp {
+	return dbDel("sgMap", name)
+}
+
+func loadSecurityGroups() (map[string]*securityGroup, error) {
+	groups := make(map[string]*securityGroup)
+	err := dbLoadTable("sgMap", func() interface{} { return &securityGroup{} },
+		func(key string, value interface{}) { groups[key] = value.(*securityGroup) })
+	return groups, err
+}
+
+//parseSecurityGroups parses the security groups of an endpoint, which
+//must exist. sgMap must be locked by the caller.
+func parseSecurityGroups(v string) ([]string, error) {
+	groups := splitOption(v)
+	for _, name := range groups {
+		if _, ok := sgMap.m[name]; !ok {
+			return nil, fmt.Errorf("unknown security group %q", name)
+		}
+	}
+	return groups, nil
+}
+
+//securityGroupRules returns the rules of a list of groups, in order.
+//sgMap must be locked by the caller.
+func securityGroupRules(groups []string) []aclRule {
+	var rules []aclRule
+	for _, name := range groups {
+		if sg, ok := sgMap.m[name]; ok {
+			rules = append(rules, sg.Rules...)
+		}
+	}
+	return rules
+}
+
+//securityGroupMembers returns the IDs of the endpoints of a group.
+//epMap must be locked by the caller.
+func securityGroupMembers(name string) []string {
+	members := []string{}
+	for id, ep := range epMap.m {
+		if hasAny(ep.SecurityGroups, []string{name}) {
+			members = append(members, id)
+		}
+	}
+	sort.Strings(members)
+	return members
+}
+
+type securityGroupResponse struct {
+	Name    string
+	Rules   []aclRule
+	Members []string
+}
+
+//listSecurityGroups returns the security groups sorted by name. epMap
+//and sgMap must be locked by the caller.
+func listSecurityGroups() []securityGroupResponse {
+	groups := []securityGroupResponse{}
+	for name, sg := range sgMap.m {
+		groups = append(groups, securityGroupResponse{name, sg.Rules, securityGroupMembers(name)})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups
+}
+
+func adminListSecurityGroups(w http.ResponseWriter, r *http.Request) {
+	epMap.Lock()
+	defer epMap.Unlock()
+	sgMap.Lock()
+	defer sgMap.Unlock()
+
+	sendResponse(listSecurityGroups(), w)
+}
+
+func adminGetSecurityGroup(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	epMap.Lock()
+	defer epMap.Unlock()
+	sgMap.Lock()
+	defer sgMap.Unlock()
+
+	sg, ok := sgMap.m[name]
+	if !ok {
+		adminError(w, http.StatusNotFound, "security group %s not found", name)
+		return
+	}
+	sendResponse(securityGroupResponse{name, sg.Rules, securityGroupMembers(name)}, w)
+}
+
+//adminPutSecurityGroup creates a group or replaces its rules, and
+//re-programs the ACL entries of its members
+func adminPutSecurityGroup(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !sgNameRe.MatchString(name) {
+		adminError(w, http.StatusBadRequest, "invalid security group name %q", name)
+		return
+	}
+
+	body, err := getBody(r)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	req := struct{ Rules []string }{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		adminError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	sg := &securityGroup{Rules: []aclRule{}}
+	for _, v := range req.Rules {
+		rule, err := parseACLRule(v)
+		if err != nil {
+			adminError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		sg.Rules = append(sg.Rules, rule)
+	}
+
+	nwMap.Lock()
+	defer nwMap.Unlock()
+	epMap.Lock()
+	defer epMap.Unlock()
+	sgMap.Lock()
+	defer sgMap.Unlock()
+
+	members := securityGroupMembers(name)
+	old := make(map[string][]aclRule)
+	for _, id := range members {
+		old[id] = securityGroupRules(epMap.m[id].SecurityGroups)
+	}
+
+	prev, existed := sgMap.m[name]
+	sgMap.m[name] = sg
+
+	//Members are re-programmed one at a time. A member that fails is
+	//left without the rules of its groups and reported, the others keep
+	//the new rules.
+	var failed []string
+	for _, id := range members {
+		ep := epMap.m[id]
+		nw := nwMap.m[ep.NetworkID]
+		if nw == nil {
+			continue
+		}
+		unprogramACL(nw.Bridge, ep.IpdkInterface, old[id], sgTopPriority)
+		if err := programACL(endpointOwner(id), nw.Bridge, ep.IpdkInterface,
+			securityGroupRules(ep.SecurityGroups), sgTopPriority); err != nil {
+			slog.Error("Unable to program security groups", "endpoint", id, "err", err)
+			failed = append(failed, id)
+		}
+	}
+
+	if err := dbUpdate(putSecurityGroup(name, sg)); err != nil {
+		if existed {
+			sgMap.m[name] = prev
+		} else {
+			delete(sgMap.m, name)
+		}
+		adminError(w, http.StatusInternalServerError, "unable to store security group %s: %v", name, err)
+		return
+	}
+	if len(failed) != 0 {
+		adminError(w, http.StatusInternalServerError, "unable to program security group %s on endpoints %v", name, failed)
+		return
+	}
+	sendResponse(securityGroupResponse{name, sg.Rules, members}, w)
+}
+
+func adminDeleteSecurityGroup(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	epMap.Lock()
+	defer epMap.Unlock()
+	sgMap.Lock()
+	defer sgMap.Unlock()
+
+	if _, ok := sgMap.m[name]; !ok {
+		adminError(w, http.StatusNotFound, "security group %s not found", name)
+		return
+	}
+	if members := securityGroupMembers(name); len(members) != 0 {
+		adminError(w, http.StatusConflict, "security group %s is used by endpoints %v", name, members)
+		return
+	}
+
+	if err := dbUpdate(delSecurityGroup(name)); err != nil {
+		adminError(w, http.StatusInternalServerError, "unable to delete security group %s: %v", name, err)
+		return
+	}
+	delete(sgMap.m, name)
+	sendResponse(listSecurityGroups(), w)
+}
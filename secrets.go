@@ -0,0 +1,203 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//Tokens and keys are better kept out of the environment and of the
+//configuration file. -admin-tokens-file and -tenant-tokens-file read the
+//tokens from files, such as the mounts of docker secrets under
+///run/secrets, with one <role>=<token> or <tenant>=<token> pair per line.
+//The files, and the key of -tls-key, must belong to root or to the user
+//of the plugin and must not be writable by anyone else, nor readable by
+//anyone else outside of /run/secrets. Every file is read again once it
+//changes, so tokens and certificates are rotated by replacing the files,
+//without restarting the plugin; a file that becomes invalid fails the
+//requests using it instead of falling back to stale credentials.
+var (
+	adminTokensFile  = flag.String("admin-tokens-file", "", "file of the <role>=<token> pairs of the admin API, one per line, instead of -admin-tokens")
+	tenantTokensFile = flag.String("tenant-tokens-file", "", "file of the <tenant>=<token> pairs of the tenants, one per line, instead of -tenant-tokens")
+)
+
+//dockerSecretsDir is where docker mounts the secrets of a container,
+//world readable by default
+const dockerSecretsDir = "/run/secrets"
+
+//secretFile is the content of a file as of its last change
+type secretFile struct {
+	modTime time.Time
+	size    int64
+	data    []byte
+}
+
+//secretFiles caches the files read by readSecret, by path
+var secretFiles = struct {
+	sync.Mutex
+	m map[string]*secretFile
+}{m: make(map[string]*secretFile)}
+
+//checkSecretPermissions verifies that only root or the plugin may change
+//a file, and read it outside of the secrets of docker
+func checkSecretPermissions(path string, fi os.FileInfo) error {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if ok && st.Uid != 0 && int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("%v belongs to user %d, expected root or the plugin user", path, st.Uid)
+	}
+	mode := fi.Mode().Perm()
+	if mode&0022 != 0 {
+		return fmt.Errorf("%v is writable by others, mode %04o", path, mode)
+	}
+	if mode&0044 != 0 && !strings.HasPrefix(filepath.Clean(path), dockerSecretsDir+"/") {
+		return fmt.Errorf("%v is readable by others, mode %04o", path, mode)
+	}
+	return nil
+}
+
+//readSecret returns the content of a file holding credentials, read again
+//whenever the file changes
+func readSecret(path string, secret bool) ([]byte, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if secret {
+		if err := checkSecretPermissions(path, fi); err != nil {
+			return nil, err
+		}
+	}
+
+	secretFiles.Lock()
+	defer secretFiles.Unlock()
+
+	if f, ok := secretFiles.m[path]; ok && f.modTime.Equal(fi.ModTime()) && f.size == fi.Size() {
+		return f.data, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := secretFiles.m[path]; ok {
+		slog.Info("Credentials file changed, reloaded", "path", path)
+	}
+	secretFiles.m[path] = &secretFile{modTime: fi.ModTime(), size: fi.Size(), data: data}
+	return data, nil
+}
+
+//tokenSetting returns the pairs of a token flag, or of its file if set,
+//comma separated
+func tokenSetting(value *string, file *string) (string, error) {
+	if *file == "" {
+		return *value, nil
+	}
+	data, err := readSecret(*file, true)
+	if err != nil {
+		return "", err
+	}
+	var pairs []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			pairs = append(pairs, line)
+		}
+	}
+	return strings.Join(pairs, ","), nil
+}
+
+//adminTokenRoles returns the roles of the admin tokens, by token
+func adminTokenRoles() (map[string]string, error) {
+	v, err := tokenSetting(adminTokens, adminTokensFile)
+	if err != nil {
+		return nil, err
+	}
+	return parseRoles("admin-tokens", v)
+}
+
+//tenantTokenTenants returns the tenants of the tenant tokens, by token
+func tenantTokenTenants() (map[string]string, error) {
+	v, err := tokenSetting(tenantTokens, tenantTokensFile)
+	if err != nil {
+		return nil, err
+	}
+	return parseTenantTokens(v)
+}
+
+//checkSecretSettings checks that the token files are readable and valid,
+//and not given along with the tokens themselves
+func checkSecretSettings() error {
+	if *adminTokensFile != "" && *adminTokens != "" {
+		return fmt.Errorf("-admin-tokens and -admin-tokens-file are mutually exclusive")
+	}
+	if *tenantTokensFile != "" && *tenantTokens != "" {
+		return fmt.Errorf("-tenant-tokens and -tenant-tokens-file are mutually exclusive")
+	}
+	if _, err := adminTokenRoles(); err != nil {
+		return err
+	}
+	if _, err := tenantTokenTenants(); err != nil {
+		return err
+	}
+	if *tlsKey != "" {
+		if _, err := readSecret(*tlsKey, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//serverCertificate returns the certificate of -tls-cert, as of the last
+//change of its files
+func serverCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certPEM, err := readSecret(*tlsCert, false)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := readSecret(*tlsKey, true)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %v: %v", *tlsCert, err)
+	}
+	return &cert, nil
+}
+
+//clientCAs returns the certificates of -tls-client-ca, as of the last
+//change of the file
+func clientCAs() (*x509.CertPool, error) {
+	pem, err := readSecret(*tlsClientCA, false)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %v", *tlsClientCA)
+	}
+	return pool, nil
+}
@@ -0,0 +1,190 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+//Networks created with -o com.ipdk.default_deny=true drop all traffic
+//towards their subnet, except for the services explicitly exposed with
+//-o com.ipdk.expose=tcp/80,udp/53 (network wide), the same option passed
+//as an endpoint driver option (that endpoint only), or the admin API.
+//
+//Entries live in the ternary service ACL table: a low priority drop for
+//the subnet and higher priority allow entries for each exposed service.
+const (
+	optDefaultDeny = "com.ipdk.default_deny"
+	optExpose      = "com.ipdk.expose"
+
+	serviceTable       = "ingress.service_acl"
+	serviceAllowAction = "ingress.allow"
+	serviceDropAction  = "ingress.drop"
+
+	serviceAllowPriority = 100
+	serviceDropPriority  = 1
+)
+
+type serviceRule struct {
+	Protocol string //tcp or udp
+	Port     int
+}
+
+func (s serviceRule) String() string {
+	return fmt.Sprintf("%s/%d", s.Protocol, s.Port)
+}
+
+func (s serviceRule) ipProto() int {
+	if s.Protocol == "udp" {
+		return 17
+	}
+	return 6
+}
+
+//parseServiceRule parses a proto/port pair such as tcp/80
+func parseServiceRule(v string) (serviceRule, error) {
+	parts := strings.Split(strings.ToLower(v), "/")
+	if len(parts) != 2 || (parts[0] != "tcp" && parts[0] != "udp") {
+		return serviceRule{}, fmt.Errorf("invalid service %q, expected tcp/<port> or udp/<port>", v)
+	}
+
+	port, err := strconv.Atoi(parts[1])
+	if err != nil || port < 1 || port > 65535 {
+		return serviceRule{}, fmt.Errorf("invalid service port %q", v)
+	}
+	return serviceRule{Protocol: parts[0], Port: port}, nil
+}
+
+//parseServiceRules parses a comma separated list of proto/port pairs
+func parseServiceRules(v string) ([]serviceRule, error) {
+	var rules []serviceRule
+	for _, item := range splitOption(v) {
+		rule, err := parseServiceRule(item)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func serviceMatch(dst string, s serviceRule) string {
+	return fmt.Sprintf("hdr.ipv4.dst_addr=%s,hdr.ipv4.protocol=%d,meta.l4_dst_port=%d",
+		dst, s.ipProto(), s.Port)
+}
+
+//allowService opens a service towards dst, an address or subnet
+func allowService(owner string, bridge string, dst string, s serviceRule) error {
+	m := fmt.Sprintf("%s,priority=%d", serviceMatch(dst, s), serviceAllowPriority)
+	return addEntry(owner, bridge, serviceTable, m, serviceAllowAction)
+}
+
+func revokeService(bridge string, dst string, s serviceRule) {
+	m := fmt.Sprintf("%s,priority=%d", serviceMatch(dst, s), serviceAllowPriority)
+	if err := deleteEntry(bridge, serviceTable, m); err != nil {
+		slog.Error("Unable to remove service entry", "match", m, "err", err)
+	}
+}
+
+//programDefaultDeny installs the subnet wide drop entry of a default-deny
+//network along with its network wide services
+func programDefaultDeny(networkID string, nw *nwVal) error {
+	if !nw.DefaultDeny {
+		return nil
+	}
+
+	subnet := nw.Subnet.String()
+	m := fmt.Sprintf("hdr.ipv4.dst_addr=%s,priority=%d", subnet, serviceDropPriority)
+	if err := addEntry(networkOwner(networkID), nw.Bridge, serviceTable, m, serviceDropAction); err != nil {
+		return err
+	}
+
+	for i, s := range nw.Services {
+		if err := allowService(networkOwner(networkID), nw.Bridge, subnet, s); err != nil {
+			for _, added := range nw.Services[:i] {
+				revokeService(nw.Bridge, subnet, added)
+			}
+			unprogramDefaultDeny(&nwVal{Bridge: nw.Bridge, DefaultDeny: true, Subnet: nw.Subnet})
+			return err
+		}
+	}
+	return nil
+}
+
+func unprogramDefaultDeny(nw *nwVal) {
+	if nw == nil || !nw.DefaultDeny {
+		return
+	}
+
+	subnet := nw.Subnet.String()
+	for _, s := range nw.Services {
+		revokeService(nw.Bridge, subnet, s)
+	}
+
+	m := fmt.Sprintf("hdr.ipv4.dst_addr=%s,priority=%d", subnet, serviceDropPriority)
+	if err := deleteEntry(nw.Bridge, serviceTable, m); err != nil {
+		slog.Error("Unable to remove service entry", "match", m, "err", err)
+	}
+}
+
+//programEndpointServices opens the services exposed by an endpoint on a
+//default-deny network
+func programEndpointServices(endpointID string, nw *nwVal, ip string, services []serviceRule) error {
+	if !nw.DefaultDeny {
+		return nil
+	}
+
+	for i, s := range services {
+		if err := allowService(endpointOwner(endpointID), nw.Bridge, ip+"/32", s); err != nil {
+			unprogramEndpointServices(nw, ip, services[:i])
+			return err
+		}
+	}
+	return nil
+}
+
+func unprogramEndpointServices(nw *nwVal, ip string, services []serviceRule) {
+	if nw == nil || !nw.DefaultDeny {
+		return
+	}
+
+	for _, s := range services {
+		revokeService(nw.Bridge, ip+"/32", s)
+	}
+}
+
+func hasService(services []serviceRule, s serviceRule) bool {
+	for _, v := range services {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func removeService(services []serviceRule, s serviceRule) []serviceRule {
+	var kept []serviceRule
+	for _, v := range services {
+		if v != s {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,203 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+var snapshotInterval = flag.Duration("snapshot-interval", 5*time.Minute, "interval between table occupancy snapshots, 0 to disable")
+var snapshotRetention = flag.Duration("snapshot-retention", 30*24*time.Hour, "how long table occupancy snapshots are kept")
+
+//snapshotTables are the pipeline tables whose occupancy is recorded
+var snapshotTables = []string{"ingress.ipv4_host", isolationTable, serviceTable, vlanPortTable, vlanHostTable, vxlanEncapTable, snatTable, dnatTable, l2Table, arpTable, aclTable, ctTable, mirrorRxTable, ecmpNextHopTable, routeTable, neighborTable, ipv6HostTable, ndTable}
+
+//snapshot records the occupancy of the plugin state and pipeline tables
+//at a point in time
+type snapshot struct {
+	Time      time.Time
+	Networks  int
+	Endpoints int
+	Ports     int            //Dummy links backing the vhost-user ports
+	Tables    map[string]int //Entries per pipeline table, -1 if unreadable
+}
+
+//countTableEntries counts the entries of a pipeline table of a bridge.
+//Every entry in the ovs-p4ctl dump-entries output carries exactly one
+//action line.
+func countTableEntries(bridge string, table string) (int, error) {
+	output, err := ipdkOutput("ovs-p4ctl", "dump-entries", bridge, pipelineMapping(bridge).table(table))
+	if err != nil {
+		return -1, err
+	}
+
+	count := 0
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		if strings.HasPrefix(strings.TrimSpace(scanner.Text()), "action") {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func takeSnapshot() snapshot {
+	s := snapshot{
+		Time:   time.Now().UTC(),
+		Tables: make(map[string]int),
+	}
+
+	nwMap.Lock()
+	s.Networks = len(nwMap.m)
+	bridges := networkBridges()
+	nwMap.Unlock()
+
+	epMap.Lock()
+	s.Endpoints = len(epMap.m)
+	epMap.Unlock()
+
+	if links, err := dummyLinks(); err == nil {
+		s.Ports = len(links)
+	} else {
+		s.Ports = -1
+	}
+
+	for _, table := range snapshotTables {
+		if !caps.Docker {
+			s.Tables[table] = -1
+			continue
+		}
+		//Entries are summed over the pipelines of all bridges
+		for _, bridge := range bridges {
+			count, err := countTableEntries(bridge, table)
+			if err != nil {
+				slog.Info("Snapshot: unable to count entries", "table", table, "bridge", bridge, "err", err)
+				s.Tables[table] = -1
+				break
+			}
+			s.Tables[table] += count
+		}
+	}
+	return s
+}
+
+//recordSnapshot stores a snapshot keyed by its timestamp and prunes the
+//snapshots older than the retention period
+func recordSnapshot(s snapshot) error {
+	records, err := store.List("snapshots")
+	if err != nil {
+		return err
+	}
+
+	ops := []dbOp{dbPut("snapshots", s.Time.Format(time.RFC3339Nano), s)}
+	cutoff := s.Time.Add(-durationSetting(snapshotRetention)).Format(time.RFC3339Nano)
+	for k := range records {
+		if k < cutoff {
+			ops = append(ops, dbDel("snapshots", k))
+		}
+	}
+	return dbUpdate(ops...)
+}
+
+//loadSnapshots returns the stored snapshots taken at or after since,
+//oldest first
+func loadSnapshots(since time.Time) ([]snapshot, error) {
+	var snapshots []snapshot
+	from := since.UTC().Format(time.RFC3339Nano)
+
+	records, err := store.List("snapshots")
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for k := range records {
+		if k >= from {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := snapshot{}
+		if err := json.Unmarshal(records[k], &s); err != nil {
+			return nil, fmt.Errorf("Decode Error: %v %v", k, err)
+		}
+		snapshots = append(snapshots, s)
+	}
+	return snapshots, nil
+}
+
+func snapshotLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := recordSnapshot(takeSnapshot()); err != nil {
+			slog.Error("Unable to record snapshot", "err", err)
+		}
+	}
+}
+
+//snapshotTrend summarizes the snapshots of a time window
+type snapshotTrend struct {
+	Snapshots []snapshot
+	Growth    map[string]int //Change between the first and last snapshot
+}
+
+//adminListSnapshots returns the snapshots of the window given by the
+//since query parameter, a duration such as 168h (default 24h) or an
+//RFC 3339 timestamp
+func adminListSnapshots(w http.ResponseWriter, r *http.Request) {
+	since := time.Now().Add(-24 * time.Hour)
+	if v := r.URL.Query().Get("since"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			since = time.Now().Add(-d)
+		} else if t, err := time.Parse(time.RFC3339, v); err == nil {
+			since = t
+		} else {
+			adminError(w, http.StatusBadRequest, "invalid since %q", v)
+			return
+		}
+	}
+
+	snapshots, err := loadSnapshots(since)
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	trend := snapshotTrend{Snapshots: snapshots, Growth: make(map[string]int)}
+	if len(snapshots) > 1 {
+		first, last := snapshots[0], snapshots[len(snapshots)-1]
+		trend.Growth["networks"] = last.Networks - first.Networks
+		trend.Growth["endpoints"] = last.Endpoints - first.Endpoints
+		trend.Growth["ports"] = last.Ports - first.Ports
+		for table, count := range last.Tables {
+			if prev, ok := first.Tables[table]; ok && prev >= 0 && count >= 0 {
+				trend.Growth[table] = count - prev
+			}
+		}
+	}
+	sendResponse(trend, w)
+}
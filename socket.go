@@ -0,0 +1,163 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+//With -listen unix:///run/docker/plugins/ipdk.sock the plugin serves
+//docker and the admin API on a unix socket, which docker discovers
+//without an ipdk.json spec file. The socket is given the owner, group and
+//mode of -socket-owner, -socket-group and -socket-mode, e.g. root:docker
+//0660, and the credentials of every connection are checked: only root,
+//which the docker daemon runs as, the user of the plugin, the owner of
+//the socket and the users of -socket-peers may connect.
+var (
+	socketOwner = flag.String("socket-owner", "", "owner of the unix socket of -listen, user name or ID (default the plugin user)")
+	socketGroup = flag.String("socket-group", "", "group of the unix socket of -listen, group name or ID (default the plugin group)")
+	socketMode  = flag.String("socket-mode", "0660", "permissions of the unix socket of -listen, in octal")
+	socketPeers = flag.String("socket-peers", "", "comma separated users, names or IDs, allowed to connect to the unix socket of -listen besides root, the plugin user and the socket owner")
+)
+
+const unixScheme = "unix://"
+
+//lookupUID returns the ID of a user given by name or ID
+func lookupUID(v string) (int, error) {
+	u, err := user.Lookup(v)
+	if err != nil {
+		if u, err = user.LookupId(v); err != nil {
+			return 0, fmt.Errorf("unknown user %q", v)
+		}
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+//lookupGID returns the ID of a group given by name or ID
+func lookupGID(v string) (int, error) {
+	g, err := user.LookupGroup(v)
+	if err != nil {
+		if g, err = user.LookupGroupId(v); err != nil {
+			return 0, fmt.Errorf("unknown group %q", v)
+		}
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+//peerListener only accepts the connections of the allowed users
+type peerListener struct {
+	*net.UnixListener
+	allowed map[int]bool
+}
+
+//peerUID returns the user of the process at the other end of a
+//connection
+func peerUID(conn *net.UnixConn) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return 0, err
+	}
+	if credErr != nil {
+		return 0, credErr
+	}
+	return int(cred.Uid), nil
+}
+
+func (l *peerListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			return nil, err
+		}
+		uid, err := peerUID(conn)
+		if err == nil && l.allowed[uid] {
+			return conn, nil
+		}
+		slog.Warn("Refused connection on the plugin socket", "uid", uid, "err", err)
+		conn.Close()
+	}
+}
+
+//listen returns the listener of -listen, a TCP address or a unix socket
+func listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixScheme) {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, unixScheme)
+
+	uid, gid := os.Getuid(), os.Getgid()
+	var err error
+	if *socketOwner != "" {
+		if uid, err = lookupUID(*socketOwner); err != nil {
+			return nil, err
+		}
+	}
+	if *socketGroup != "" {
+		if gid, err = lookupGID(*socketGroup); err != nil {
+			return nil, err
+		}
+	}
+	mode, err := strconv.ParseUint(*socketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return nil, fmt.Errorf("invalid -socket-mode %q", *socketMode)
+	}
+	allowed := map[int]bool{0: true, os.Getuid(): true, uid: true}
+	for _, peer := range splitOption(*socketPeers) {
+		id, err := lookupUID(peer)
+		if err != nil {
+			return nil, err
+		}
+		allowed[id] = true
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	//A socket left over by a previous run would fail the bind
+	os.Remove(path)
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chown(path, uid, gid); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	slog.Info("Listening on unix socket", "path", path, "uid", uid, "gid", gid, "mode", *socketMode)
+	return &peerListener{UnixListener: l, allowed: allowed}, nil
+}
@@ -0,0 +1,164 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//Endpoints created with --driver-opt com.ipdk.port_type=vf are given an
+//SR-IOV virtual function of the -sriov-pf physical function, or a
+//function of an IPU, instead of a vhost-user port. The plugin binds a
+//free VF to its kernel driver, programs the port of its representor into
+//the pipeline in place of a vhost-user port, and hands its netdev to
+//docker, which moves it into the container. VF n is represented by
+//pipeline port -vf-port-base + n, which must not overlap with the
+//interface IDs of vhost-user ports.
+var sriovPF = flag.String("sriov-pf", "", "physical function whose virtual functions back vf endpoints")
+var vfPortBase = flag.Int("vf-port-base", 1024, "pipeline port of the representor of virtual function 0")
+var vfDriver = flag.String("vf-driver", "iavf", "kernel driver virtual functions are bound to")
+
+const (
+	optPortType = "com.ipdk.port_type"
+
+	portTypeVhost = "vhost"
+	portTypeVF    = "vf"
+)
+
+var pciAddressRe = regexp.MustCompile(`^[0-9a-f]{4}:[0-9a-f]{2}:[0-9a-f]{2}\.[0-7]$`)
+
+//parsePortType parses the port type of an endpoint, "" is a vhost-user
+//port
+func parsePortType(v string) (string, error) {
+	switch v {
+	case "", portTypeVhost:
+		return "", nil
+	case portTypeTAP:
+		return v, nil
+	case portTypeVF:
+		if *sriovPF == "" {
+			return "", fmt.Errorf("%s=%s needs the plugin to be started with -sriov-pf", optPortType, v)
+		}
+		return v, nil
+	}
+	return "", fmt.Errorf("invalid %s %q, expected %s, %s or %s", optPortType, v, portTypeVhost, portTypeTAP, portTypeVF)
+}
+
+//virtualFunction is a VF of the -sriov-pf physical function, Netdev
+//being "" while it is not bound to a kernel driver
+type virtualFunction struct {
+	Index  int
+	PCI    string
+	Netdev string
+}
+
+//listVFs returns the virtual functions of the physical function, by
+//index
+func listVFs() ([]virtualFunction, error) {
+	dir := filepath.Join("/sys/class/net", *sriovPF, "device")
+	links, err := filepath.Glob(filepath.Join(dir, "virtfn*"))
+	if err != nil || len(links) == 0 {
+		return nil, fmt.Errorf("no virtual functions found for %v", *sriovPF)
+	}
+
+	var vfs []virtualFunction
+	for _, link := range links {
+		index, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(link), "virtfn"))
+		if err != nil {
+			continue
+		}
+		vf, err := readVF(link, index)
+		if err != nil {
+			return nil, err
+		}
+		vfs = append(vfs, vf)
+	}
+	sort.Slice(vfs, func(i, j int) bool { return vfs[i].Index < vfs[j].Index })
+	return vfs, nil
+}
+
+//readVF reads the PCI address and netdev of a virtual function from its
+//virtfn link
+func readVF(link string, index int) (virtualFunction, error) {
+	target, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		return virtualFunction{}, err
+	}
+	vf := virtualFunction{Index: index, PCI: filepath.Base(target)}
+	if netdevs, err := ioutil.ReadDir(filepath.Join(target, "net")); err == nil && len(netdevs) != 0 {
+		vf.Netdev = netdevs[0].Name()
+	}
+	return vf, nil
+}
+
+//allocVF returns a virtual function no endpoint uses, bound to its
+//kernel driver. epMap must be locked by the caller.
+func allocVF() (*virtualFunction, error) {
+	vfs, err := listVFs()
+	if err != nil {
+		return nil, err
+	}
+
+	used := make(map[string]bool)
+	for _, ep := range allEndpoints() {
+		if ep.VF != "" {
+			used[ep.VF] = true
+		}
+	}
+
+	for _, vf := range vfs {
+		if used[vf.PCI] {
+			continue
+		}
+		if vf.Netdev == "" {
+			if err := host.BindVF(vf.PCI); err != nil {
+				return nil, fmt.Errorf("unable to bind virtual function %v: %v", vf.PCI, err)
+			}
+			link := filepath.Join("/sys/class/net", *sriovPF, "device", fmt.Sprintf("virtfn%d", vf.Index))
+			if vf, err = readVF(link, vf.Index); err != nil {
+				return nil, err
+			}
+			if vf.Netdev == "" {
+				return nil, fmt.Errorf("virtual function %v has no netdev once bound to %v", vf.PCI, *vfDriver)
+			}
+		}
+		return &vf, nil
+	}
+	return nil, fmt.Errorf("all %d virtual functions of %v are in use", len(vfs), *sriovPF)
+}
+
+//vfPort returns the pipeline port of the representor of a virtual
+//function
+func vfPort(vf *virtualFunction) int {
+	return *vfPortBase + vf.Index
+}
+
+//endpointLink returns the interface docker moves into the container of
+//an endpoint
+func endpointLink(ep *epVal) string {
+	if ep.Netdev != "" {
+		return ep.Netdev
+	}
+	return dummyLink(ep)
+}
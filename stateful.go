@@ -0,0 +1,131 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+)
+
+//Networks created with -o com.ipdk.stateful=true only accept traffic
+//from outside the network that belongs to a connection one of their
+//endpoints opened, or that targets a published port. The pipeline tracks
+//connections itself, e.g. with PNA add-on-miss tables, and exposes the
+//state of the connection of a packet as meta.ct_state, 1 for
+//established. The entries of the ternary ingress.conntrack table, by
+//decreasing priority, allow established connections, traffic from the
+//segment of the network and published ports, and drop the rest of the
+//traffic towards the subnet.
+const (
+	optStateful = "com.ipdk.stateful"
+
+	ctTable       = "ingress.conntrack"
+	ctAllowAction = "ingress.allow"
+	ctDropAction  = "ingress.drop"
+
+	ctEstablished = 1
+
+	ctEstablishedPriority = 100
+	ctPublishedPriority   = 75
+	ctSegmentPriority     = 50
+	ctDropPriority        = 1
+)
+
+//parseStateful parses the stateful option of a network
+func parseStateful(v string) (bool, error) {
+	if v == "" {
+		return false, nil
+	}
+	stateful, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q", optStateful, v)
+	}
+	return stateful, nil
+}
+
+//ctEntry is an entry of the conntrack table
+type ctEntry struct {
+	match  string
+	action string
+}
+
+//statefulEntries returns the entries of a stateful network
+func statefulEntries(nw *nwVal) []ctEntry {
+	subnet := nw.Subnet.String()
+	return []ctEntry{
+		{fmt.Sprintf("meta.ct_state=%d,hdr.ipv4.dst_addr=%s,priority=%d", ctEstablished, subnet, ctEstablishedPriority), ctAllowAction},
+		{fmt.Sprintf("meta.segment_id=%d,hdr.ipv4.dst_addr=%s,priority=%d", nw.Segment, subnet, ctSegmentPriority), ctAllowAction},
+		{fmt.Sprintf("hdr.ipv4.dst_addr=%s,priority=%d", subnet, ctDropPriority), ctDropAction},
+	}
+}
+
+//programStateful installs the conntrack entries of a stateful network
+func programStateful(networkID string, nw *nwVal) error {
+	if !nw.Stateful || nw.Subnet.IP == nil {
+		return nil
+	}
+
+	entries := statefulEntries(nw)
+	for i, e := range entries {
+		if err := addEntry(networkOwner(networkID), nw.Bridge, ctTable, e.match, e.action); err != nil {
+			for _, e := range entries[:i] {
+				removeConntrackEntry(nw.Bridge, e.match)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+//unprogramStateful removes the entries installed by programStateful
+func unprogramStateful(nw *nwVal) {
+	if nw == nil || !nw.Stateful || nw.Subnet.IP == nil {
+		return
+	}
+
+	for _, e := range statefulEntries(nw) {
+		removeConntrackEntry(nw.Bridge, e.match)
+	}
+}
+
+func removeConntrackEntry(bridge string, m string) {
+	if err := deleteEntry(bridge, ctTable, m); err != nil {
+		slog.Error("Unable to remove conntrack entry", "match", m, "err", err)
+	}
+}
+
+func ctPublishedMatch(ip string, p publishedPort) string {
+	return fmt.Sprintf("hdr.ipv4.dst_addr=%s/32,hdr.ipv4.protocol=%d,meta.l4_dst_port=%d,priority=%d",
+		ip, p.Proto, p.Port, ctPublishedPriority)
+}
+
+//allowPublishedPort lets new connections reach a port published by an
+//endpoint of a stateful network
+func allowPublishedPort(owner string, nw *nwVal, ip string, p publishedPort) error {
+	if !nw.Stateful {
+		return nil
+	}
+	return addEntry(owner, nw.Bridge, ctTable, ctPublishedMatch(ip, p), ctAllowAction)
+}
+
+func revokePublishedPort(nw *nwVal, ip string, p publishedPort) {
+	if !nw.Stateful {
+		return
+	}
+	removeConntrackEntry(nw.Bridge, ctPublishedMatch(ip, p))
+}
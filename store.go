@@ -0,0 +1,475 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+//The plugin state lives in a kvStore, a set of tables holding JSON
+//records. The default store is the local bolt db; passing
+//-store etcd://host:2379 or -store consul://host:8500 keeps the state in
+//a cluster key-value store instead, under keys of the form
+//<prefix>/<table>/<key>.
+//
+//The etcd and Consul stores talk to the HTTP APIs of the servers (the
+//etcd v3 JSON gateway and the Consul KV API) so no client library is
+//needed. Both apply a batch of writes in a single transaction.
+var (
+	storeURL    = flag.String("store", "", "state store: bolt (default), etcd://host:port or consul://host:port (default $IPDK_STORE)")
+	storePrefix = flag.String("store-prefix", "ipdk-docker-plugin", "key prefix of the state in an etcd or Consul store")
+)
+
+type kvStore interface {
+	//Init creates the tables that do not exist yet
+	Init(tables []string) error
+	//Get returns the value of key, or nil if it does not exist
+	Get(table string, key string) ([]byte, error)
+	//Create stores value under key unless the key exists, and reports
+	//whether it did
+	Create(table string, key string, value []byte) (bool, error)
+	//List returns all the records of a table
+	List(table string) (map[string][]byte, error)
+	//Batch applies all ops atomically
+	Batch(ops []dbOp) error
+	Close() error
+}
+
+var store kvStore
+
+//openStore opens the store selected by -store
+func openStore(spec string) (kvStore, error) {
+	if spec == "" || spec == "bolt" {
+		return openBoltStore(dbFile)
+	}
+	return openClusterStore(spec, *storePrefix)
+}
+
+//openClusterStore opens an etcd or Consul store keeping its tables under
+//prefix
+func openClusterStore(spec string, prefix string) (kvStore, error) {
+	u, err := url.Parse(spec)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid store %q", spec)
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	switch u.Scheme {
+	case "etcd":
+		return &etcdStore{endpoint: "http://" + u.Host, prefix: prefix, client: client}, nil
+	case "consul":
+		return &consulStore{endpoint: "http://" + u.Host, prefix: prefix, client: client}, nil
+	}
+	return nil, fmt.Errorf("unsupported store %q", u.Scheme)
+}
+
+//boltStore keeps the tables as buckets of the local bolt db
+type boltStore struct {
+	sync.RWMutex //Held for writing while the db file is replaced
+	db           *bolt.DB
+}
+
+func openBoltStore(path string) (kvStore, error) {
+	options := bolt.Options{
+		Timeout: 3 * time.Second,
+	}
+
+	if err := checkDbDir(path); err != nil {
+		return nil, err
+	}
+
+	var err error
+	db, err = bolt.Open(path, 0600, &options)
+	if err != nil {
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Init(tables []string) error {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, table := range tables {
+			_, err := tx.CreateBucketIfNotExists([]byte(table))
+			if err != nil {
+				return fmt.Errorf("Bucket creation error: %v %v", table, err)
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Get(table string, key string) ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	var value []byte
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(table))
+		if bucket == nil {
+			return fmt.Errorf("Bucket %v not found", table)
+		}
+
+		//The value is only valid for the life of the transaction
+		if v := bucket.Get([]byte(key)); v != nil {
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (s *boltStore) Create(table string, key string, value []byte) (bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	created := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(table))
+		if bucket == nil {
+			return fmt.Errorf("Bucket %v not found", table)
+		}
+		if bucket.Get([]byte(key)) != nil {
+			return nil
+		}
+		created = true
+		return bucket.Put([]byte(key), value)
+	})
+	return created, err
+}
+
+func (s *boltStore) List(table string) (map[string][]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	records := make(map[string][]byte)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(table))
+		if bucket == nil {
+			return fmt.Errorf("Bucket %v not found", table)
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			records[string(k)] = append([]byte{}, v...)
+			return nil
+		})
+	})
+	return records, err
+}
+
+func (s *boltStore) Batch(ops []dbOp) error {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, op := range ops {
+			bucket := tx.Bucket([]byte(op.table))
+			if bucket == nil {
+				return fmt.Errorf("Bucket %v not found", op.table)
+			}
+
+			if op.value == nil {
+				if err := bucket.Delete([]byte(op.key)); err != nil {
+					return fmt.Errorf("Key Delete error: %v %v ", op.key, err)
+				}
+				continue
+			}
+			if err := bucket.Put([]byte(op.key), op.value); err != nil {
+				return fmt.Errorf("Key Store error: %v %v %v", op.table, op.key, err)
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.db.Close()
+}
+
+//storeRequest sends a request with a JSON body and decodes the JSON
+//response into out, unless out is nil
+func storeRequest(client *http.Client, method string, u string, in interface{}, out interface{}) (int, error) {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return 0, err
+		}
+	}
+
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return resp.StatusCode, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, fmt.Errorf("%v %v: %v %s", method, u, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return resp.StatusCode, fmt.Errorf("Decode Error: %v %v", u, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+//etcdStore keeps the tables in etcd, through the v3 JSON gateway
+type etcdStore struct {
+	endpoint string
+	prefix   string
+	client   *http.Client
+}
+
+type etcdKeyValue struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value,omitempty"`
+}
+
+type etcdRange struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+}
+
+type etcdRangeResponse struct {
+	Kvs []etcdKeyValue `json:"kvs"`
+}
+
+type etcdRequestOp struct {
+	RequestPut         *etcdKeyValue `json:"request_put,omitempty"`
+	RequestDeleteRange *etcdRange    `json:"request_delete_range,omitempty"`
+}
+
+//etcdCompare compares the creation revision of a key, 0 if it does not
+//exist
+type etcdCompare struct {
+	Key            []byte `json:"key"`
+	Target         string `json:"target"`
+	Result         string `json:"result"`
+	CreateRevision string `json:"create_revision"`
+}
+
+type etcdTxn struct {
+	Compare []etcdCompare   `json:"compare,omitempty"`
+	Success []etcdRequestOp `json:"success"`
+}
+
+type etcdTxnResponse struct {
+	Succeeded bool `json:"succeeded"`
+}
+
+func (s *etcdStore) key(table string, key string) string {
+	return s.prefix + "/" + table + "/" + key
+}
+
+//Tables are key prefixes, there is nothing to create
+func (s *etcdStore) Init(tables []string) error {
+	return nil
+}
+
+func (s *etcdStore) Get(table string, key string) ([]byte, error) {
+	resp := etcdRangeResponse{}
+	_, err := storeRequest(s.client, "POST", s.endpoint+"/v3/kv/range",
+		etcdRange{Key: []byte(s.key(table, key))}, &resp)
+	if err != nil || len(resp.Kvs) == 0 {
+		return nil, err
+	}
+	return resp.Kvs[0].Value, nil
+}
+
+func (s *etcdStore) Create(table string, key string, value []byte) (bool, error) {
+	k := []byte(s.key(table, key))
+	txn := etcdTxn{
+		Compare: []etcdCompare{{Key: k, Target: "CREATE", Result: "EQUAL", CreateRevision: "0"}},
+		Success: []etcdRequestOp{{RequestPut: &etcdKeyValue{Key: k, Value: value}}},
+	}
+	resp := etcdTxnResponse{}
+	if _, err := storeRequest(s.client, "POST", s.endpoint+"/v3/kv/txn", txn, &resp); err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+func (s *etcdStore) List(table string) (map[string][]byte, error) {
+	prefix := s.key(table, "")
+	//The range end of a prefix is the prefix with its last byte incremented
+	end := []byte(prefix)
+	end[len(end)-1]++
+
+	resp := etcdRangeResponse{}
+	_, err := storeRequest(s.client, "POST", s.endpoint+"/v3/kv/range",
+		etcdRange{Key: []byte(prefix), RangeEnd: end}, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make(map[string][]byte)
+	for _, kv := range resp.Kvs {
+		records[strings.TrimPrefix(string(kv.Key), prefix)] = kv.Value
+	}
+	return records, nil
+}
+
+func (s *etcdStore) Batch(ops []dbOp) error {
+	txn := etcdTxn{}
+	for _, op := range ops {
+		k := []byte(s.key(op.table, op.key))
+		if op.value == nil {
+			txn.Success = append(txn.Success, etcdRequestOp{RequestDeleteRange: &etcdRange{Key: k}})
+			continue
+		}
+		txn.Success = append(txn.Success, etcdRequestOp{RequestPut: &etcdKeyValue{Key: k, Value: op.value}})
+	}
+
+	resp := etcdTxnResponse{}
+	if _, err := storeRequest(s.client, "POST", s.endpoint+"/v3/kv/txn", txn, &resp); err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return fmt.Errorf("etcd transaction failed")
+	}
+	return nil
+}
+
+func (s *etcdStore) Close() error {
+	return nil
+}
+
+//consulStore keeps the tables in the Consul KV store
+type consulStore struct {
+	endpoint string
+	prefix   string
+	client   *http.Client
+}
+
+type consulKVPair struct {
+	Key   string
+	Value []byte
+}
+
+type consulTxnKV struct {
+	Verb  string
+	Key   string
+	Value string `json:",omitempty"`
+}
+
+type consulTxnOp struct {
+	KV consulTxnKV
+}
+
+func (s *consulStore) key(table string, key string) string {
+	return s.prefix + "/" + table + "/" + key
+}
+
+func (s *consulStore) url(key string, query string) string {
+	u := url.URL{Path: "/v1/kv/" + key, RawQuery: query}
+	return s.endpoint + u.String()
+}
+
+//Tables are key prefixes, there is nothing to create
+func (s *consulStore) Init(tables []string) error {
+	return nil
+}
+
+func (s *consulStore) Get(table string, key string) ([]byte, error) {
+	var pairs []consulKVPair
+	_, err := storeRequest(s.client, "GET", s.url(s.key(table, key), ""), nil, &pairs)
+	if err != nil || len(pairs) == 0 {
+		return nil, err
+	}
+	return pairs[0].Value, nil
+}
+
+//Create uses a check-and-set with index 0, which only succeeds if the key
+//does not exist
+func (s *consulStore) Create(table string, key string, value []byte) (bool, error) {
+	txn := []consulTxnOp{{KV: consulTxnKV{Verb: "cas", Key: s.key(table, key),
+		Value: base64.StdEncoding.EncodeToString(value)}}}
+	status, err := storeRequest(s.client, "PUT", s.endpoint+"/v1/txn", txn, nil)
+	if status == http.StatusConflict {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *consulStore) List(table string) (map[string][]byte, error) {
+	prefix := s.key(table, "")
+
+	var pairs []consulKVPair
+	if _, err := storeRequest(s.client, "GET", s.url(prefix, "recurse"), nil, &pairs); err != nil {
+		return nil, err
+	}
+
+	records := make(map[string][]byte)
+	for _, p := range pairs {
+		records[strings.TrimPrefix(p.Key, prefix)] = p.Value
+	}
+	return records, nil
+}
+
+func (s *consulStore) Batch(ops []dbOp) error {
+	var txn []consulTxnOp
+	for _, op := range ops {
+		k := s.key(op.table, op.key)
+		if op.value == nil {
+			txn = append(txn, consulTxnOp{KV: consulTxnKV{Verb: "delete", Key: k}})
+			continue
+		}
+		txn = append(txn, consulTxnOp{KV: consulTxnKV{Verb: "set", Key: k,
+			Value: base64.StdEncoding.EncodeToString(op.value)}})
+	}
+
+	//A rolled back transaction is reported with 409 Conflict
+	_, err := storeRequest(s.client, "PUT", s.endpoint+"/v1/txn", txn, nil)
+	return err
+}
+
+func (s *consulStore) Close() error {
+	return nil
+}
@@ -0,0 +1,185 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+//With -scope global the plugin is a swarm scoped driver: docker creates
+//the networks of the plugin on every node of the swarm running a task
+//attached to them. The state is then kept in an etcd or Consul store
+//shared by the nodes. The tables coordinating the nodes live under the
+//-store-prefix of the store: segments, claiming a segment, and with it a
+//bridge ID, for every network, so that a network has the same segment on
+//all nodes, and poolMap, the pools of the IPAM driver, so that the nodes
+//don't hand out overlapping subnets. The other tables describe the ports
+//and entries of a node and live under <prefix>/nodes/<-node-name>.
+var (
+	driverScope = flag.String("scope", scopeLocal, "scope of the driver, local or global for swarm networks spanning several nodes")
+	nodeName    = flag.String("node-name", "", "name of the node in a global scope store (default the hostname)")
+)
+
+const (
+	scopeLocal  = "local"
+	scopeGlobal = "global"
+
+	//Highest segment claimed for a global network
+	maxSegment = 65535
+)
+
+var sharedTables = map[string]bool{"segments": true, "poolMap": true}
+
+//globalStore keeps the tables shared by the nodes of a swarm and those of
+//the node in two stores
+type globalStore struct {
+	shared kvStore
+	local  kvStore
+}
+
+//openGlobalStore opens the store of a global scope driver
+func openGlobalStore(spec string) (kvStore, error) {
+	if spec == "" || spec == "bolt" {
+		return nil, fmt.Errorf("-scope %s needs an etcd or Consul store", scopeGlobal)
+	}
+
+	node := *nodeName
+	if node == "" {
+		var err error
+		if node, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+
+	shared, err := openClusterStore(spec, *storePrefix)
+	if err != nil {
+		return nil, err
+	}
+	local, err := openClusterStore(spec, *storePrefix+"/nodes/"+node)
+	if err != nil {
+		return nil, err
+	}
+	return &globalStore{shared: shared, local: local}, nil
+}
+
+func (s *globalStore) table(table string) kvStore {
+	if sharedTables[table] {
+		return s.shared
+	}
+	return s.local
+}
+
+func (s *globalStore) Init(tables []string) error {
+	if err := s.shared.Init(tables); err != nil {
+		return err
+	}
+	return s.local.Init(tables)
+}
+
+func (s *globalStore) Get(table string, key string) ([]byte, error) {
+	return s.table(table).Get(table, key)
+}
+
+func (s *globalStore) Create(table string, key string, value []byte) (bool, error) {
+	return s.table(table).Create(table, key, value)
+}
+
+func (s *globalStore) List(table string) (map[string][]byte, error) {
+	return s.table(table).List(table)
+}
+
+//Batch applies the writes of the shared tables first. The two halves of
+//a batch are not applied atomically.
+func (s *globalStore) Batch(ops []dbOp) error {
+	var shared, local []dbOp
+	for _, op := range ops {
+		if sharedTables[op.table] {
+			shared = append(shared, op)
+		} else {
+			local = append(local, op)
+		}
+	}
+	if len(shared) > 0 {
+		if err := s.shared.Batch(shared); err != nil {
+			return err
+		}
+	}
+	if len(local) > 0 {
+		return s.local.Batch(local)
+	}
+	return nil
+}
+
+func (s *globalStore) Close() error {
+	if err := s.shared.Close(); err != nil {
+		return err
+	}
+	return s.local.Close()
+}
+
+//claimSegment returns the segment of a network, claiming the lowest free
+//one if no node did yet
+func claimSegment(networkID string) (int, error) {
+	records, err := store.List("segments")
+	if err != nil {
+		return 0, err
+	}
+
+	used := make(map[int]bool)
+	for k, v := range records {
+		segment, err := strconv.Atoi(k)
+		if err != nil {
+			continue
+		}
+		var id string
+		if err := json.Unmarshal(v, &id); err == nil && id == networkID {
+			return segment, nil
+		}
+		used[segment] = true
+	}
+
+	for segment := 1; segment <= maxSegment; segment++ {
+		if used[segment] {
+			continue
+		}
+		created, err := dbCreate("segments", strconv.Itoa(segment), networkID)
+		if err != nil {
+			return 0, err
+		}
+		if created {
+			return segment, nil
+		}
+		//Another node claimed it meanwhile, it may have been for this
+		//network
+		if v, err := store.Get("segments", strconv.Itoa(segment)); err == nil {
+			var id string
+			if json.Unmarshal(v, &id) == nil && id == networkID {
+				return segment, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("all %d segments are in use", maxSegment)
+}
+
+//releaseSegment returns the op releasing the segment of a network
+func releaseSegment(segment int) dbOp {
+	return dbDel("segments", strconv.Itoa(segment))
+}
@@ -0,0 +1,62 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+//Vhost-user ports can only be consumed by VM based runtimes such as Kata
+//Containers. Endpoints created with --driver-opt com.ipdk.port_type=tap
+//get a TAP port of the pipeline instead, a kernel netdev docker moves
+//into the container, so plain runc containers have connectivity too.
+const (
+	portTypeTAP = "tap"
+
+	tapPipeline = "pipe"
+	tapMempool  = "MEMPOOL0"
+	tapMTU      = 1500
+)
+
+//tapName returns the netdev name of the TAP port of an interface ID
+func tapName(intf int) string {
+	return fmt.Sprintf("ipdktap%d", intf)
+}
+
+//createTapPort creates the TAP port of an interface ID, with the default
+//MTU if mtu is 0:
+//docker exec -it ipdk gnmi-cli set "device:virtual-device,name:ipdktap1,pipeline-name:pipe,mempool-name:MEMPOOL0,mtu:1500,port-type:TAP"
+func createTapPort(intf int, mtu int) error {
+	if mtu == 0 {
+		mtu = tapMTU
+	}
+	ifc, err := ipdkExec("gnmi-cli", "set", fmt.Sprintf("device:virtual-device,name:%s,pipeline-name:%s,mempool-name:%s,mtu:%d,port-type:TAP",
+		tapName(intf), tapPipeline, tapMempool, mtu))
+	if err != nil {
+		return err
+	}
+
+	slog.Debug("Result of gnmi-cli", "output", ifc)
+	return nil
+}
+
+//deleteTapPort deletes the TAP port of an interface ID
+func deleteTapPort(intf int) error {
+	_, err := ipdkExec("gnmi-cli", "delete", fmt.Sprintf("device:virtual-device,name:%s", tapName(intf)))
+	return err
+}
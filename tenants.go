@@ -0,0 +1,206 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+//Hosts shared by several teams label each network with the tenant it
+//belongs to:
+//
+//  docker network create -d ipdk -o com.ipdk.tenant=blue blue0
+//  docker run --network name=blue0,driver-opt=com.ipdk.tenant=blue ...
+//
+//An endpoint only joins a network if it names the tenant of the network,
+//and networks without a tenant only take endpoints naming none. Every
+//tenant is given a token with -tenant-tokens, sent to the admin API as
+//Authorization: Bearer <token>. Requests carrying the token of a tenant
+//only see the networks of the tenant and their endpoints, and may only
+//read them, everything else being refused. Once tenant tokens are set,
+//requests without a token are refused, see authRequired: operators need
+//an admin token or client certificate of their own, see auth.go.
+var tenantTokens = flag.String("tenant-tokens", "", "comma separated <tenant>=<token> pairs scoping the admin API to the networks of a tenant")
+
+const optTenant = "com.ipdk.tenant"
+
+var tenantPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+//tenantOptions are the options given both for networks and their
+//endpoints, which must agree rather than being inherited
+var tenantOptions = map[string]bool{
+	optTenant: true,
+}
+
+//parseTenant parses the tenant option of a network or endpoint, ""
+//meaning none
+func parseTenant(v string) (string, error) {
+	if v != "" && !tenantPattern.MatchString(v) {
+		return "", fmt.Errorf("invalid %s %q, expected up to 63 lower case letters, digits, - and _", optTenant, v)
+	}
+	return v, nil
+}
+
+//checkEndpointTenant verifies that an endpoint names the tenant of its
+//network, the tenant of an endpoint being only given in its own options
+func checkEndpointTenant(options map[string]interface{}, nw *nwVal) error {
+	v, _ := options[optTenant].(string)
+	tenant, err := parseTenant(v)
+	if err != nil {
+		return err
+	}
+	if tenant != nw.Tenant {
+		if nw.Tenant == "" {
+			return fmt.Errorf("endpoint of tenant %s can't join a network without a tenant", tenant)
+		}
+		return fmt.Errorf("only endpoints of tenant %s can join the network, set %s", nw.Tenant, optTenant)
+	}
+	return nil
+}
+
+//parseTenantTokens parses -tenant-tokens into tenants by token
+func parseTenantTokens(v string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	for _, item := range splitOption(v) {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || kv[1] == "" || !tenantPattern.MatchString(kv[0]) {
+			return nil, fmt.Errorf("invalid tenant token %q, expected <tenant>=<token>", strings.SplitN(item, "=", 2)[0])
+		}
+		if _, ok := tokens[kv[1]]; ok {
+			return nil, fmt.Errorf("token of tenant %s is given twice", kv[0])
+		}
+		tokens[kv[1]] = kv[0]
+	}
+	return tokens, nil
+}
+
+//bearerToken returns the token of the Authorization header of a request
+func bearerToken(r *http.Request) string {
+	return strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+}
+
+type tenantKey struct{}
+
+//requestTenant returns the tenant an admin request is scoped to, ""
+//for none
+func requestTenant(r *http.Request) string {
+	tenant, _ := r.Context().Value(tenantKey{}).(string)
+	return tenant
+}
+
+//networkTenant returns the tenant of a network and whether it exists
+func networkTenant(id string) (string, bool) {
+	nwMap.Lock()
+	defer nwMap.Unlock()
+
+	nw, ok := nwMap.m[id]
+	if !ok {
+		return "", false
+	}
+	return nw.Tenant, true
+}
+
+//endpointTenant returns the tenant of the network of an endpoint and
+//whether the endpoint exists
+func endpointTenant(id string) (string, bool) {
+	epMap.Lock()
+	ep, ok := epMap.m[id]
+	networkID := ""
+	if ok {
+		networkID = ep.NetworkID
+	}
+	epMap.Unlock()
+	if !ok {
+		return "", false
+	}
+	tenant, _ := networkTenant(networkID)
+	return tenant, true
+}
+
+//Kinds of admin routes, by what they show to tenants, see authorized
+const (
+	tenantHost     = ""          //The state of the host, refused to tenants
+	tenantList     = "list"      //Listings, filtered by tenant
+	tenantNetwork  = "networks"  //Routes of the network {id}
+	tenantEndpoint = "endpoints" //Routes of the endpoint {id}
+)
+
+//scopeToTenant checks that the network or endpoint of a route belongs to
+//a tenant, and scopes the request to the tenant. Networks and endpoints
+//of other tenants are reported not found, as if they didn't exist.
+func scopeToTenant(w http.ResponseWriter, r *http.Request, kind string, tenant string) (*http.Request, bool) {
+	id := mux.Vars(r)["id"]
+	switch kind {
+	case tenantNetwork:
+		if t, ok := networkTenant(id); !ok || t != tenant {
+			adminError(w, http.StatusNotFound, "network %s not found", id)
+			return nil, false
+		}
+	case tenantEndpoint:
+		if t, ok := endpointTenant(id); !ok || t != tenant {
+			adminError(w, http.StatusNotFound, "endpoint %s not found", id)
+			return nil, false
+		}
+	}
+	return r.WithContext(context.WithValue(r.Context(), tenantKey{}, tenant)), true
+}
+
+//tenantNetworks returns the IDs of the networks of a tenant, nil for all
+//of them if tenant is ""
+func tenantNetworks(tenant string) map[string]bool {
+	if tenant == "" {
+		return nil
+	}
+
+	nwMap.Lock()
+	defer nwMap.Unlock()
+
+	ids := make(map[string]bool)
+	for id, nw := range nwMap.m {
+		if nw.Tenant == tenant {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+//tenantEndpoints returns the IDs of the endpoints of the networks of a
+//tenant, nil for all of them if tenant is ""
+func tenantEndpoints(tenant string) map[string]bool {
+	networks := tenantNetworks(tenant)
+	if networks == nil {
+		return nil
+	}
+
+	epMap.Lock()
+	defer epMap.Unlock()
+
+	ids := make(map[string]bool)
+	for id, ep := range epMap.m {
+		if networks[ep.NetworkID] {
+			ids[id] = true
+		}
+	}
+	return ids
+}
@@ -0,0 +1,97 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+//Every command run on the host or in the ipdk container is killed once it
+//runs for longer than its timeout, so that a wedged docker exec or an
+//unresponsive infrap4d fails the request instead of hanging it, along with
+//the network operations of docker, forever. Compiling and loading the P4
+//program takes much longer than anything else and has its own timeout.
+var (
+	execTimeout    = flag.Duration("exec-timeout", 30*time.Second, "how long a command may run on the host or in the ipdk container before it is killed, 0 to not time out")
+	compileTimeout = flag.Duration("compile-timeout", 10*time.Minute, "how long compiling or loading the P4 program may take before it is killed, 0 to not time out")
+)
+
+//execKillGrace is how long a command timed out in the ipdk container is
+//given to exit after SIGTERM, and docker exec to return after that
+const execKillGrace = 2 * time.Second
+
+//compileCommands are the names of the commands bounded by
+//-compile-timeout, see commandName
+var compileCommands = map[string]bool{
+	"p4c --arch":         true,
+	"bash -c":            true,
+	"ovs-p4ctl set-pipe": true,
+}
+
+//commandTimeout returns the timeout of a command, 0 for none
+func commandTimeout(name string) time.Duration {
+	if compileCommands[name] {
+		return durationSetting(compileTimeout)
+	}
+	return durationSetting(execTimeout)
+}
+
+//timeoutError is the error of a command killed after its timeout
+type timeoutError struct {
+	timeout time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("command timed out after %v", e.timeout)
+}
+
+//runCommand runs a command and returns its output, killing it once its
+//timeout expires. Killing docker exec leaves the command running in the
+//container, so commands run in the ipdk container are also run under
+//timeout there, which stops them first.
+func runCommand(cmd string, args []string) ([]byte, error) {
+	d := commandTimeout(commandName(cmd, args))
+	if d <= 0 {
+		return exec.Command(cmd, args...).Output()
+	}
+
+	wait := d
+	if cmd == "docker" && len(args) > 2 && args[0] == "exec" {
+		bounded := append([]string{}, args[:2]...)
+		bounded = append(bounded, "timeout", "-k", fmt.Sprintf("%g", execKillGrace.Seconds()), fmt.Sprintf("%g", d.Seconds()))
+		args = append(bounded, args[2:]...)
+		wait += 2 * execKillGrace
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	c := exec.CommandContext(ctx, cmd, args...)
+	//Children of the command holding its output open don't delay the
+	//return past the kill
+	c.WaitDelay = execKillGrace
+
+	start := time.Now()
+	output, err := c.Output()
+	if err != nil && (ctx.Err() != nil || time.Since(start) >= d) {
+		return output, &timeoutError{timeout: d}
+	}
+	return output, err
+}
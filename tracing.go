@@ -0,0 +1,319 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Driver requests are traced as OpenTelemetry spans when an OTLP endpoint
+//is set, -otlp-endpoint or $OTEL_EXPORTER_OTLP_ENDPOINT. Every command a
+//request runs, gnmi-cli, ovs-p4ctl or ip, and every call to the
+//privileged helper, is a child span of the request, so that a slow
+//docker run can be attributed to the step taking the time. Spans are
+//exported in batches to <endpoint>/v1/traces with the JSON encoding of
+//OTLP/HTTP, which needs no client library.
+//
+//The dataplane functions don't carry a context, so the span of a request
+//is tracked per goroutine: handlers run their commands on the goroutine
+//serving the request.
+var (
+	otlpEndpoint = flag.String("otlp-endpoint", "", "OTLP/HTTP collector spans are exported to, e.g. http://127.0.0.1:4318 (default $OTEL_EXPORTER_OTLP_ENDPOINT)")
+	serviceName  = flag.String("service-name", "ipdk-docker-network-plugin", "service name of the exported spans")
+)
+
+const (
+	spanBatchSize     = 512
+	spanFlushInterval = 5 * time.Second
+
+	//OTLP span kinds and status codes
+	spanKindServer = 2
+	spanKindClient = 3
+	statusError    = 2
+)
+
+type span struct {
+	TraceID  string
+	SpanID   string
+	ParentID string
+	Name     string
+	Kind     int
+	Start    time.Time
+	End      time.Time
+	Attrs    map[string]string
+	Err      string
+}
+
+//tracer holds the active request span of every goroutine serving one,
+//and the ended spans waiting to be exported
+var tracer = struct {
+	sync.Mutex
+	enabled bool
+	url     string
+	active  map[int64]*span
+	queue   chan *span
+}{active: make(map[int64]*span)}
+
+//initTracing starts the exporter if an OTLP endpoint is set
+func initTracing() {
+	endpoint := *otlpEndpoint
+	if endpoint == "" {
+		return
+	}
+
+	tracer.enabled = true
+	tracer.url = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	tracer.queue = make(chan *span, 4*spanBatchSize)
+	go exportLoop()
+	slog.Info("Tracing driver requests", "endpoint", tracer.url)
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+//goroutineID returns the ID of the calling goroutine, parsed from the
+//header of its stack trace, "goroutine <id> [running]:"
+func goroutineID() int64 {
+	var buf [64]byte
+	n := runtime.Stack(buf[:], false)
+	fields := strings.Fields(string(buf[:n]))
+	if len(fields) < 2 {
+		return 0
+	}
+	id, _ := strconv.ParseInt(fields[1], 10, 64)
+	return id
+}
+
+//startCommandSpan starts a child span of the request served by the
+//calling goroutine, nil if there is none
+func startCommandSpan(name string, attrs map[string]string) *span {
+	if !tracer.enabled {
+		return nil
+	}
+
+	tracer.Lock()
+	parent := tracer.active[goroutineID()]
+	tracer.Unlock()
+	if parent == nil {
+		return nil
+	}
+	return &span{
+		TraceID:  parent.TraceID,
+		SpanID:   randomID(8),
+		ParentID: parent.SpanID,
+		Name:     name,
+		Kind:     spanKindClient,
+		Start:    time.Now(),
+		Attrs:    attrs,
+	}
+}
+
+//end ends a span and queues it for export, spans are dropped if the
+//collector can't keep up
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	if err != nil {
+		s.Err = err.Error()
+	}
+	select {
+	case tracer.queue <- s:
+	default:
+	}
+}
+
+//traced wraps a driver handler in a span named after the request,
+//continuing the trace of a W3C traceparent header if there is one, and
+//records it in the operation history
+func traced(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		//The IDs of the request become attributes of the span, and are
+		//kept in the operation history
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		ids := struct{ NetworkID, EndpointID string }{}
+		json.Unmarshal(body, &ids)
+
+		var s *span
+		id := goroutineID()
+		if tracer.enabled {
+			s = &span{TraceID: randomID(16), SpanID: randomID(8), Name: name, Kind: spanKindServer, Start: start, Attrs: map[string]string{}}
+			if parts := strings.Split(r.Header.Get("traceparent"), "-"); len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+				s.TraceID, s.ParentID = parts[1], parts[2]
+			}
+			if ids.NetworkID != "" {
+				s.Attrs["ipdk.network_id"] = ids.NetworkID
+			}
+			if ids.EndpointID != "" {
+				s.Attrs["ipdk.endpoint_id"] = ids.EndpointID
+			}
+
+			tracer.Lock()
+			tracer.active[id] = s
+			tracer.Unlock()
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		h(rec, r)
+
+		//IPAM responses carry their error in Error
+		resp := struct{ Err, Error string }{}
+		json.Unmarshal(rec.body.Bytes(), &resp)
+		var err error
+		if msg := resp.Err + resp.Error; msg != "" {
+			err = fmt.Errorf("%s", msg)
+		}
+		recordOperation(name, ids.NetworkID, ids.EndpointID, start, err)
+
+		if s != nil {
+			tracer.Lock()
+			delete(tracer.active, id)
+			tracer.Unlock()
+			s.end(err)
+		}
+	}
+}
+
+//responseRecorder keeps a copy of the response of a driver handler, to
+//tell failed requests apart
+type responseRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+//otlpValue and otlpAttribute follow the OTLP JSON encoding, in which IDs
+//are hex strings and timestamps decimal strings
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+func otlpAttributes(attrs map[string]string) []otlpAttribute {
+	list := []otlpAttribute{}
+	for k, v := range attrs {
+		list = append(list, otlpAttribute{Key: k, Value: otlpValue{StringValue: v}})
+	}
+	return list
+}
+
+func (s *span) otlp() map[string]interface{} {
+	v := map[string]interface{}{
+		"traceId":           s.TraceID,
+		"spanId":            s.SpanID,
+		"name":              s.Name,
+		"kind":              s.Kind,
+		"startTimeUnixNano": strconv.FormatInt(s.Start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.End.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.Attrs),
+	}
+	if s.ParentID != "" {
+		v["parentSpanId"] = s.ParentID
+	}
+	if s.Err != "" {
+		v["status"] = map[string]interface{}{"code": statusError, "message": s.Err}
+	}
+	return v
+}
+
+//exportSpans posts a batch of spans to the collector
+func exportSpans(spans []*span) error {
+	var list []map[string]interface{}
+	for _, s := range spans {
+		list = append(list, s.otlp())
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]string{"service.name": *serviceName}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "ipdk-docker-network-plugin"},
+				"spans": list,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Post(tracer.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+func exportLoop() {
+	var batch []*span
+	ticker := time.NewTicker(spanFlushInterval)
+	defer ticker.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := exportSpans(batch); err != nil {
+			slog.Warn("Unable to export spans", "spans", len(batch), "err", err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s := <-tracer.queue:
+			batch = append(batch, s)
+			if len(batch) >= spanBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
@@ -0,0 +1,150 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+//A network can be attached to the physical fabric through a port of its
+//own:
+//
+//  docker network create -d ipdk -o com.ipdk.uplink=0000:18:00.0 ...
+//
+//The PCI device is bound into the pipeline as a physical port, with an
+//interface ID of its own. Traffic received from it is classified into
+//the segment of the network, it is a member of the replication group of
+//the network, and the traffic of the network no endpoint entry matches
+//leaves through it, from the lowest priority ingress.uplink entry.
+const (
+	optUplink = "com.ipdk.uplink"
+
+	uplinkTable  = "ingress.uplink"
+	uplinkAction = "ingress.send"
+)
+
+//parseUplink parses the uplink option of a network, "" means none
+func parseUplink(v string) (string, error) {
+	if v == "" {
+		return "", nil
+	}
+	if !pciAddressRe.MatchString(v) {
+		return "", fmt.Errorf("invalid %s %q, expected a PCI address such as 0000:18:00.0", optUplink, v)
+	}
+	return v, nil
+}
+
+//uplinkNetwork returns the ID of the network using a PCI device as its
+//uplink, or "". nwMap must be locked by the caller.
+func uplinkNetwork(pci string) string {
+	for id, nw := range nwMap.m {
+		if nw.Uplink == pci {
+			return id
+		}
+	}
+	return ""
+}
+
+//physicalPortName returns the gNMI device name of the physical port of
+//an interface ID
+func physicalPortName(intf int) string {
+	return fmt.Sprintf("PORT%d", intf)
+}
+
+//createPhysicalPort binds a PCI device into the pipeline:
+//docker exec -it ipdk gnmi-cli set "device:physical-device,name:PORT3,pipeline-name:pipe,mempool-name:MEMPOOL0,mtu:1500,pci-bdf:0000:18:00.0,port-type:LINK"
+func createPhysicalPort(intf int, pci string, mtu int, rss *rssConfig) error {
+	if mtu == 0 {
+		mtu = tapMTU
+	}
+	ifc, err := ipdkExec("gnmi-cli", "set", fmt.Sprintf("device:physical-device,name:%s,pipeline-name:%s,mempool-name:%s,mtu:%d,pci-bdf:%s,port-type:LINK",
+		physicalPortName(intf), tapPipeline, tapMempool, mtu, pci)+rss.config())
+	if err != nil {
+		return err
+	}
+
+	slog.Debug("Result of gnmi-cli", "output", ifc)
+	return nil
+}
+
+func deletePhysicalPort(intf int) error {
+	_, err := ipdkExec("gnmi-cli", "delete", fmt.Sprintf("device:physical-device,name:%s", physicalPortName(intf)))
+	return err
+}
+
+func uplinkMatch(segment int) string {
+	return fmt.Sprintf("meta.segment_id=%d", segment)
+}
+
+func removeUplinkEntry(bridge string, table string, m string) {
+	if err := deleteEntry(bridge, table, m); err != nil {
+		slog.Error("Unable to remove uplink entry", "match", m, "err", err)
+	}
+}
+
+//programUplink creates the uplink port of a network and connects it to
+//the segment of the network. The network must not be in nwMap, its
+//flood group changes.
+func programUplink(networkID string, nw *nwVal) error {
+	if nw.Uplink == "" {
+		return nil
+	}
+
+	if err := createPhysicalPort(nw.UplinkPort, nw.Uplink, nw.MTU, nw.RSS); err != nil {
+		return err
+	}
+
+	owner := networkOwner(networkID)
+	err := addEntry(owner, nw.Bridge, segmentTable, segmentMatch(nw.UplinkPort),
+		fmt.Sprintf("%s(%d)", segmentAction, nw.Segment))
+	if err == nil {
+		err = addEntry(owner, nw.Bridge, uplinkTable, uplinkMatch(nw.Segment),
+			fmt.Sprintf("%s(%d)", uplinkAction, nw.UplinkPort))
+		if err != nil {
+			removeUplinkEntry(nw.Bridge, segmentTable, segmentMatch(nw.UplinkPort))
+		}
+	}
+	if err == nil {
+		if err = joinFloodGroup(networkID, nw, nw.UplinkPort); err != nil {
+			removeUplinkEntry(nw.Bridge, uplinkTable, uplinkMatch(nw.Segment))
+			removeUplinkEntry(nw.Bridge, segmentTable, segmentMatch(nw.UplinkPort))
+		}
+	}
+	if err != nil {
+		if err := deletePhysicalPort(nw.UplinkPort); err != nil {
+			slog.Error("Unable to delete uplink port", "uplink", nw.Uplink, "err", err)
+		}
+		return err
+	}
+	return nil
+}
+
+//unprogramUplink removes what programUplink installed. The network must
+//not be in nwMap.
+func unprogramUplink(networkID string, nw *nwVal) {
+	if nw == nil || nw.Uplink == "" {
+		return
+	}
+
+	leaveFloodGroup(networkID, nw, nw.UplinkPort)
+	removeUplinkEntry(nw.Bridge, uplinkTable, uplinkMatch(nw.Segment))
+	removeUplinkEntry(nw.Bridge, segmentTable, segmentMatch(nw.UplinkPort))
+	if err := deletePhysicalPort(nw.UplinkPort); err != nil {
+		slog.Error("Unable to delete uplink port", "uplink", nw.Uplink, "err", err)
+	}
+}
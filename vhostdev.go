@@ -0,0 +1,117 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"regexp"
+
+	"github.com/gorilla/mux"
+)
+
+//Kata based pods request vhost-user interfaces as intel.com/ipdk-vhost
+//devices of the ipdk-device-plugin, cmd/ipdk-device-plugin. Allocating a
+//device reserves its socket directory, <-vhost-dir>/devices/<device>,
+//which the device plugin mounts into the pod. The endpoint of the pod is
+//then given its vhost-user socket in that directory through the
+//com.ipdk.vhost_device option, which Multus sets from the deviceID of the
+//CNI configuration.
+const optVhostDevice = "com.ipdk.vhost_device"
+
+var vhostDeviceName = regexp.MustCompile(`^vhost-[0-9]{1,4}$`)
+
+//vhostDevice is a device of the device plugin, Endpoint being the ID of
+//the endpoint using it, if any
+type vhostDevice struct {
+	ID        string
+	SocketDir string
+	Endpoint  string `json:",omitempty"`
+}
+
+//parseVhostDevice parses the device option of an endpoint, "" means no
+//device
+func parseVhostDevice(v string) (string, error) {
+	if v != "" && !vhostDeviceName.MatchString(v) {
+		return "", fmt.Errorf("invalid %s %q, expected vhost-<n>", optVhostDevice, v)
+	}
+	return v, nil
+}
+
+//vhostDeviceDir returns the socket directory of a device
+func vhostDeviceDir(id string) string {
+	return filepath.Join(*vhostDir, "devices", id)
+}
+
+//socketDirEndpoint returns the ID of the endpoint using a socket
+//directory, or "". epMap must be locked by the caller.
+func socketDirEndpoint(dir string) string {
+	for id, ep := range allEndpoints() {
+		if ep.PortType == "" && endpointSocketDir(ep) == dir {
+			return id
+		}
+	}
+	return ""
+}
+
+//adminVhostDevice decodes the device of a request
+func adminVhostDevice(w http.ResponseWriter, r *http.Request) *vhostDevice {
+	id := mux.Vars(r)["id"]
+	if _, err := parseVhostDevice(id); err != nil || id == "" {
+		adminError(w, http.StatusBadRequest, "invalid device %q", id)
+		return nil
+	}
+	return &vhostDevice{ID: id, SocketDir: vhostDeviceDir(id)}
+}
+
+func adminGetVhostDevice(w http.ResponseWriter, r *http.Request) {
+	d := adminVhostDevice(w, r)
+	if d == nil {
+		return
+	}
+
+	epMap.Lock()
+	defer epMap.Unlock()
+
+	d.Endpoint = socketDirEndpoint(d.SocketDir)
+	sendResponse(d, w)
+}
+
+//adminAllocateVhostDevice creates the socket directory of a device
+//allocated to a pod
+func adminAllocateVhostDevice(w http.ResponseWriter, r *http.Request) {
+	d := adminVhostDevice(w, r)
+	if d == nil {
+		return
+	}
+
+	epMap.Lock()
+	defer epMap.Unlock()
+
+	if id := socketDirEndpoint(d.SocketDir); id != "" {
+		adminError(w, http.StatusConflict, "device %v is used by endpoint %v", d.ID, id)
+		return
+	}
+	if err := makeSocketDir(d.SocketDir); err != nil {
+		adminError(w, http.StatusInternalServerError, "unable to create %v: %v", d.SocketDir, err)
+		return
+	}
+	slog.Info("Allocated vhost device", "device", d.ID)
+	sendResponse(d, w)
+}
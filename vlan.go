@@ -0,0 +1,110 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+)
+
+//Networks created with -o com.ipdk.vlan=<id> get their own VLAN instead
+//of sharing the flat ipv4_host table of br0. Traffic received from the
+//port of an endpoint is classified into, and tagged with, the VLAN of its
+//network, and is only forwarded to endpoints of the same VLAN, which
+//receive it untagged.
+const (
+	optVLAN = "com.ipdk.vlan"
+
+	vlanPortTable  = "ingress.port_vlan"
+	vlanPortAction = "ingress.push_vlan"
+	vlanHostTable  = "ingress.vlan_ipv4_host"
+	vlanHostAction = "ingress.pop_vlan_send"
+	vlanMinID      = 1
+	vlanMaxID      = 4094
+)
+
+//parseVLAN parses the VLAN option of a network, 0 means no VLAN
+func parseVLAN(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+
+	vlan, err := strconv.Atoi(v)
+	if err != nil || vlan < vlanMinID || vlan > vlanMaxID {
+		return 0, fmt.Errorf("invalid %s %q, expected %d to %d", optVLAN, v, vlanMinID, vlanMaxID)
+	}
+	return vlan, nil
+}
+
+//vlanNetwork returns the ID of the network using a VLAN, or "".
+//nwMap must be locked by the caller.
+func vlanNetwork(vlan int) string {
+	for id, nw := range nwMap.m {
+		if nw.VLAN == vlan {
+			return id
+		}
+	}
+	return ""
+}
+
+func vlanPortMatch(intf int) string {
+	return fmt.Sprintf("istd.ingress_port=%d", intf)
+}
+
+func vlanHostMatch(vlan int, ip string) string {
+	return fmt.Sprintf("meta.vlan_id=%d,%s", vlan, hostEntryMatch(ip))
+}
+
+//addVLANEndpoint classifies the traffic of the port intf into the VLAN
+//and forwards traffic for ip within the VLAN to it
+func addVLANEndpoint(owner string, bridge string, vlan int, ip string, intf int) error {
+	if err := addEntry(owner, bridge, vlanPortTable, vlanPortMatch(intf), fmt.Sprintf("%s(%d)", vlanPortAction, vlan)); err != nil {
+		return err
+	}
+
+	if err := addEntry(owner, bridge, vlanHostTable, vlanHostMatch(vlan, ip), fmt.Sprintf("%s(%d)", vlanHostAction, intf)); err != nil {
+		if err := deleteEntry(bridge, vlanPortTable, vlanPortMatch(intf)); err != nil {
+			slog.Error("Unable to remove VLAN entry", "port", intf, "err", err)
+		}
+		return err
+	}
+	return nil
+}
+
+//deleteVLANEndpoint removes the entries installed by addVLANEndpoint
+func deleteVLANEndpoint(bridge string, vlan int, ip string, intf int) {
+	if err := deleteEntry(bridge, vlanHostTable, vlanHostMatch(vlan, ip)); err != nil {
+		slog.Error("Unable to remove VLAN entry", "ip", ip, "err", err)
+	}
+	if err := deleteEntry(bridge, vlanPortTable, vlanPortMatch(intf)); err != nil {
+		slog.Error("Unable to remove VLAN entry", "port", intf, "err", err)
+	}
+}
+
+//addEndpointForwarding installs the forwarding entries of an endpoint,
+//scoped to the VLAN of its network if it has one, or keyed on its MAC
+//address on L2 networks
+func addEndpointForwarding(endpointID string, nw *nwVal, ip string, mac string, intf int) error {
+	if nw.Forwarding == forwardingL2 {
+		return addL2Endpoint(endpointOwner(endpointID), nw.Bridge, mac, intf)
+	}
+	if nw.VLAN != 0 {
+		return addVLANEndpoint(endpointOwner(endpointID), nw.Bridge, nw.VLAN, ip, intf)
+	}
+	return addHostEntry(endpointOwner(endpointID), nw.Bridge, ip, intf)
+}
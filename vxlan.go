@@ -0,0 +1,301 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+//Overlay networks span several IPDK hosts over VXLAN:
+//
+//  docker network create -d ipdk --subnet 10.10.0.0/24 \
+//      -o com.ipdk.vxlan_vni=5000 -o com.ipdk.vxlan_remote=192.168.1.12 ov0
+//
+//The same network is created on every host, with its own range of
+//addresses (--ip-range) and the other hosts as remote VTEPs. VXLAN
+//packets for the VNI received on the local VTEP are decapsulated and
+//forwarded as usual. Traffic for addresses of the subnet that are not
+//local is encapsulated towards the remote VTEP of the network when there
+//is a single one; with several remote VTEPs, the VTEP of each remote
+//address is declared as a peer through the admin API.
+var vtepIP = flag.String("vtep-ip", "", "address of the local VXLAN tunnel endpoint (default $IPDK_VTEP_IP)")
+
+const (
+	optVXLANVNI    = "com.ipdk.vxlan_vni"
+	optVXLANRemote = "com.ipdk.vxlan_remote"
+
+	vxlanDecapTable  = "ingress.vxlan_decap"
+	vxlanDecapAction = "ingress.vxlan_decap"
+	vxlanEncapTable  = "ingress.vxlan_encap"
+	vxlanEncapAction = "ingress.vxlan_encap"
+
+	vxlanPeerPriority   = 100
+	vxlanSubnetPriority = 1
+	vxlanMaxVNI         = 1<<24 - 1
+)
+
+//vxlanPeer is a remote address of an overlay network and the VTEP it is
+//reachable through
+type vxlanPeer struct {
+	IP   string
+	VTEP string
+}
+
+//parseVNI parses the VNI option of a network, 0 means no overlay
+func parseVNI(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+
+	vni, err := strconv.Atoi(v)
+	if err != nil || vni < 1 || vni > vxlanMaxVNI {
+		return 0, fmt.Errorf("invalid %s %q, expected 1 to %d", optVXLANVNI, v, vxlanMaxVNI)
+	}
+	return vni, nil
+}
+
+//parseVTEPs parses a comma separated list of VTEP addresses
+func parseVTEPs(v string) ([]string, error) {
+	var vteps []string
+	for _, item := range splitOption(v) {
+		ip := net.ParseIP(item)
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("invalid VTEP address %q", item)
+		}
+		vteps = append(vteps, ip.String())
+	}
+	return vteps, nil
+}
+
+//localVTEP returns the address of the local VTEP
+func localVTEP() (string, error) {
+	v := *vtepIP
+	if v == "" {
+		v = discoveredSelf()
+	}
+	if v == "" {
+		return "", fmt.Errorf("overlay networks need the local VTEP address, set -vtep-ip or IPDK_VTEP_IP")
+	}
+	if ip := net.ParseIP(v); ip == nil || ip.To4() == nil {
+		return "", fmt.Errorf("invalid local VTEP address %q", v)
+	}
+	return v, nil
+}
+
+//vxlanNetwork returns the ID of the network using a VNI, or "".
+//nwMap must be locked by the caller.
+func vxlanNetwork(vni int) string {
+	for id, nw := range nwMap.m {
+		if nw.VNI == vni {
+			return id
+		}
+	}
+	return ""
+}
+
+func vxlanDecapMatch(local string, vni int) string {
+	return fmt.Sprintf("hdr.outer_ipv4.dst_addr=%s,hdr.vxlan.vni=%d", local, vni)
+}
+
+func vxlanEncapMatch(dst string, priority int) string {
+	return fmt.Sprintf("hdr.ipv4.dst_addr=%s,priority=%d", dst, priority)
+}
+
+func vxlanEncap(owner string, bridge string, local string, vni int, dst string, priority int, vtep string) error {
+	return addEntry(owner, bridge, vxlanEncapTable, vxlanEncapMatch(dst, priority),
+		fmt.Sprintf("%s(%d,%s,%s)", vxlanEncapAction, vni, local, vtep))
+}
+
+func removeVXLANEntry(bridge string, table string, m string) {
+	if err := deleteEntry(bridge, table, m); err != nil {
+		slog.Error("Unable to remove VXLAN entry", "match", m, "err", err)
+	}
+}
+
+//programVXLAN installs the decap entry of an overlay network, the
+//subnet wide encap entry towards its remote VTEP and the entries of its
+//peers
+func programVXLAN(networkID string, nw *nwVal) error {
+	if nw.VNI == 0 {
+		return nil
+	}
+
+	local, err := localVTEP()
+	if err != nil {
+		return err
+	}
+	owner := networkOwner(networkID)
+
+	if err := addEntry(owner, nw.Bridge, vxlanDecapTable, vxlanDecapMatch(local, nw.VNI), vxlanDecapAction); err != nil {
+		return err
+	}
+
+	if len(nw.VTEPs) == 1 {
+		if err := vxlanEncap(owner, nw.Bridge, local, nw.VNI, nw.Subnet.String(), vxlanSubnetPriority, nw.VTEPs[0]); err != nil {
+			removeVXLANEntry(nw.Bridge, vxlanDecapTable, vxlanDecapMatch(local, nw.VNI))
+			return err
+		}
+	}
+
+	for i, p := range nw.Peers {
+		if err := vxlanEncap(owner, nw.Bridge, local, nw.VNI, p.IP+"/32", vxlanPeerPriority, p.VTEP); err != nil {
+			unprogramVXLAN(&nwVal{Bridge: nw.Bridge, VNI: nw.VNI, VTEPs: nw.VTEPs, Subnet: nw.Subnet, Peers: nw.Peers[:i]})
+			return err
+		}
+	}
+	return nil
+}
+
+//unprogramVXLAN removes the entries installed by programVXLAN
+func unprogramVXLAN(nw *nwVal) {
+	if nw == nil || nw.VNI == 0 {
+		return
+	}
+
+	local, err := localVTEP()
+	if err != nil {
+		slog.Error("Unable to remove VXLAN entries", "err", err)
+		return
+	}
+
+	for _, p := range nw.Peers {
+		removeVXLANEntry(nw.Bridge, vxlanEncapTable, vxlanEncapMatch(p.IP+"/32", vxlanPeerPriority))
+	}
+	if len(nw.VTEPs) == 1 {
+		removeVXLANEntry(nw.Bridge, vxlanEncapTable, vxlanEncapMatch(nw.Subnet.String(), vxlanSubnetPriority))
+	}
+	removeVXLANEntry(nw.Bridge, vxlanDecapTable, vxlanDecapMatch(local, nw.VNI))
+}
+
+//adminOverlayNetwork returns the overlay network of a peer request.
+//nwMap must be locked by the caller.
+func adminOverlayNetwork(w http.ResponseWriter, id string) *nwVal {
+	nw, ok := nwMap.m[id]
+	if !ok {
+		adminError(w, http.StatusNotFound, "network %s not found", id)
+		return nil
+	}
+	if nw.VNI == 0 {
+		adminError(w, http.StatusConflict, "network %s is not an overlay network", id)
+		return nil
+	}
+	return nw
+}
+
+func adminListPeers(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	nwMap.Lock()
+	defer nwMap.Unlock()
+
+	if nw := adminOverlayNetwork(w, id); nw != nil {
+		sendResponse(nw.Peers, w)
+	}
+}
+
+func adminAddPeer(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	body, err := getBody(r)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	p := vxlanPeer{}
+	if err := json.Unmarshal(body, &p); err != nil {
+		adminError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	ip := net.ParseIP(p.IP)
+	vteps, err := parseVTEPs(p.VTEP)
+	if ip == nil || err != nil || len(vteps) != 1 {
+		adminError(w, http.StatusBadRequest, "invalid peer %v through %v", p.IP, p.VTEP)
+		return
+	}
+	p = vxlanPeer{IP: ip.String(), VTEP: vteps[0]}
+
+	nwMap.Lock()
+	defer nwMap.Unlock()
+
+	nw := adminOverlayNetwork(w, id)
+	if nw == nil {
+		return
+	}
+	if !nw.Subnet.Contains(ip) {
+		adminError(w, http.StatusBadRequest, "peer %v is not part of %v", ip, nw.Subnet.String())
+		return
+	}
+	for _, v := range nw.Peers {
+		if v.IP == p.IP {
+			adminError(w, http.StatusConflict, "peer %v already exists", p.IP)
+			return
+		}
+	}
+
+	local, err := localVTEP()
+	if err == nil {
+		err = vxlanEncap(networkOwner(id), nw.Bridge, local, nw.VNI, p.IP+"/32", vxlanPeerPriority, p.VTEP)
+	}
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, "unable to add peer %v: %v", p.IP, err)
+		return
+	}
+	nw.Peers = append(nw.Peers, p)
+	if err := dbUpdate(putNetwork(id, nw)); err != nil {
+		slog.Error("Unable to update db", "err", err)
+	}
+	sendResponse(nw.Peers, w)
+}
+
+func adminRemovePeer(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	nwMap.Lock()
+	defer nwMap.Unlock()
+
+	nw := adminOverlayNetwork(w, id)
+	if nw == nil {
+		return
+	}
+
+	var kept []vxlanPeer
+	for _, p := range nw.Peers {
+		if p.IP != vars["ip"] {
+			kept = append(kept, p)
+		}
+	}
+	if len(kept) == len(nw.Peers) {
+		adminError(w, http.StatusNotFound, "peer %v not found on network %s", vars["ip"], id)
+		return
+	}
+
+	removeVXLANEntry(nw.Bridge, vxlanEncapTable, vxlanEncapMatch(vars["ip"]+"/32", vxlanPeerPriority))
+	nw.Peers = kept
+	if err := dbUpdate(putNetwork(id, nw)); err != nil {
+		slog.Error("Unable to update db", "err", err)
+	}
+	sendResponse(nw.Peers, w)
+}
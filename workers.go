@@ -0,0 +1,89 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+)
+
+//Endpoints are provisioned by a pool of workers: a CreateEndpoint request
+//waits for a free worker once its options are checked, then runs the
+//commands setting up the endpoint along with the creations on the other
+//workers, whatever their network. The pool bounds the number of
+//concurrent commands run against the IPDK container.
+var endpointWorkers = flag.Int("endpoint-workers", 8, "number of endpoints provisioned concurrently")
+
+var workers = struct {
+	sync.Mutex
+	once    sync.Once
+	slots   chan struct{}
+	waiting int
+}{}
+
+//workerState is the size of the pool, and the number of endpoint
+//creations provisioning and waiting for a worker
+type workerState struct {
+	Size    int
+	Busy    int
+	Waiting int
+}
+
+func checkEndpointWorkers() error {
+	if *endpointWorkers < 1 {
+		return fmt.Errorf("-endpoint-workers must be at least 1")
+	}
+	return nil
+}
+
+func workerSlots() chan struct{} {
+	workers.once.Do(func() {
+		n := *endpointWorkers
+		if n < 1 {
+			n = 1
+		}
+		workers.slots = make(chan struct{}, n)
+	})
+	return workers.slots
+}
+
+//endpointWorker waits for a free worker and returns the function
+//releasing it
+func endpointWorker() func() {
+	slots := workerSlots()
+
+	workers.Lock()
+	workers.waiting++
+	workers.Unlock()
+
+	slots <- struct{}{}
+
+	workers.Lock()
+	workers.waiting--
+	workers.Unlock()
+
+	return func() { <-slots }
+}
+
+func endpointWorkerState() workerState {
+	slots := workerSlots()
+
+	workers.Lock()
+	defer workers.Unlock()
+	return workerState{Size: cap(slots), Busy: len(slots), Waiting: workers.waiting}
+}